@@ -0,0 +1,125 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ConsumerGroupSpec defines the desired state of ConsumerGroup
+type ConsumerGroupSpec struct {
+	// Cluster 消费组所在的DledgerBroker名称，其他命名空间使用 namespace/name
+	Cluster string `json:"cluster"`
+	// GroupName 消费组名称，为空时使用metadata.name
+	GroupName string `json:"groupName,omitempty"`
+	// ConsumeEnable 是否允许消费，关闭后broker拒绝该消费组的拉取请求，默认true
+	// +kubebuilder:default=true
+	ConsumeEnable *bool `json:"consumeEnable,omitempty"`
+	// ConsumeBroadcastEnable 是否允许广播消费
+	ConsumeBroadcastEnable bool `json:"consumeBroadcastEnable,omitempty"`
+	// RetryQueueNums 重试topic的队列数
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1
+	RetryQueueNums int `json:"retryQueueNums,omitempty"`
+	// RetryMaxTimes 最大重试次数，超过后消息进入死信队列%DLQ%<group>，默认16
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=16
+	RetryMaxTimes *int `json:"retryMaxTimes,omitempty"`
+	// BrokerId 从哪个brokerId消费，默认0即master
+	// +kubebuilder:validation:Minimum=0
+	BrokerId int64 `json:"brokerId,omitempty"`
+	// WhichBrokerWhenConsumeSlowly 消费落后较多时从哪个brokerId消费，默认1即slave
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=1
+	WhichBrokerWhenConsumeSlowly *int64 `json:"whichBrokerWhenConsumeSlowly,omitempty"`
+	// DeletePolicy 删除ConsumerGroup时对broker上消费组配置的处理方式，默认Retain
+	DeletePolicy DeletePolicy `json:"deletePolicy,omitempty"`
+}
+
+// ConsumerGroupStatus defines the observed state of ConsumerGroup
+type ConsumerGroupStatus struct {
+	// ObservedGeneration 最近一次完成调谐时实例的generation
+	ObservedGeneration int64                      `json:"observedGeneration,omitempty"`
+	Phase              Phase                      `json:"phase,omitempty"`        // 实例状态概要
+	GroupName          string                     `json:"groupName,omitempty"`    // 实际创建的消费组名称
+	BrokerGroups       []ConsumerGroupBrokerState `json:"brokerGroups,omitempty"` // 各broker组上消费组配置的状态
+	OnlineClients      int                        `json:"onlineClients"`          // 在线的消费者客户端数
+	ConsumeType        string                     `json:"consumeType,omitempty"`  // 在线客户端的消费方式，如CONSUME_PASSIVELY
+	MessageModel       string                     `json:"messageModel,omitempty"` // 在线客户端的消费模式，CLUSTERING或BROADCASTING
+	Lag                int64                      `json:"lag"`                    // 所有订阅topic未消费的消息数
+	TopicLags          []TopicLag                 `json:"topicLags,omitempty"`    // 各订阅topic未消费的消息数
+	LastSyncTime       *metav1.Time               `json:"lastSyncTime,omitempty"` // 最近一次刷新消费进度的时间
+	Conditions         []metav1.Condition         `json:"conditions,omitempty"`   // 实例状态，包括Ready、Progressing、Degraded
+}
+
+// ConsumerGroupBrokerState 一个broker组上消费组配置的状态
+type ConsumerGroupBrokerState struct {
+	BrokerName string    `json:"brokerName"`
+	State      SyncState `json:"state"`
+	Message    string    `json:"message,omitempty"`
+}
+
+// TopicLag 一个topic未消费的消息数
+type TopicLag struct {
+	Topic string `json:"topic"`
+	Lag   int64  `json:"lag"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.cluster`
+// +kubebuilder:printcolumn:name="Group",type=string,JSONPath=`.status.groupName`
+// +kubebuilder:printcolumn:name="Clients",type=integer,JSONPath=`.status.onlineClients`
+// +kubebuilder:printcolumn:name="Lag",type=integer,JSONPath=`.status.lag`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ConsumerGroup is the Schema for the consumergroups API
+type ConsumerGroup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ConsumerGroupSpec   `json:"spec,omitempty"`
+	Status ConsumerGroupStatus `json:"status,omitempty"`
+}
+
+// GroupName 返回消费组名称，Spec.GroupName为空时使用metadata.name
+func (g *ConsumerGroup) GroupName() string {
+	if g.Spec.GroupName != "" {
+		return g.Spec.GroupName
+	}
+	return g.Name
+}
+
+// ClusterRef 解析Spec.Cluster，未指定命名空间时使用实例所在命名空间
+func (g *ConsumerGroup) ClusterRef() types.NamespacedName {
+	return namespacedRef(g.Namespace, g.Spec.Cluster)
+}
+
+// +kubebuilder:object:root=true
+
+// ConsumerGroupList contains a list of ConsumerGroup
+type ConsumerGroupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ConsumerGroup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ConsumerGroup{}, &ConsumerGroupList{})
+}
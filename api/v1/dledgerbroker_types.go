@@ -17,8 +17,14 @@ limitations under the License.
 package v1
 
 import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -35,27 +41,113 @@ type DledgerBrokerSpec struct {
 	PodSpec            *PodSpec                     `json:"podSpec,omitempty"`            // broker pod配置
 	Env                []corev1.EnvVar              `json:"env,omitempty"`                // 环境变量设置
 	Config             map[string]string            `json:"config,omitempty"`             // broker 配置文件
-	Nameserver         string                       `json:"nameserver,omitempty"`         // 需要连接的nameserver实例名称
+	Nameserver         string                       `json:"nameserver,omitempty"`         // 需要连接的nameserver实例名称，其他命名空间使用 namespace/name
 	Acl                *Acl                         `json:"acl,omitempty"`                // broker acl配置
+	UpdateStrategy     BrokerUpdateStrategy         `json:"updateStrategy,omitempty"`     // broker pod的更新策略，默认LeaderAware
+	ExternalAccess     *ExternalAccess              `json:"externalAccess,omitempty"`     // 集群外访问设置，为每个broker pod创建service
+	// AllowedNamespaces 允许其中的Topic、ConsumerGroup和RocketMQUser引用该集群的其他命名空间，*表示所有命名空间，
+	// 默认只允许集群所在命名空间的资源引用
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+}
+
+// ExternalAccess 集群外访问设置
+type ExternalAccess struct {
+	// Type 对外暴露的service类型。NodePort时broker监听operator分配的nodePort并以所在节点的ip注册到nameserver，
+	// LoadBalancer时broker以负载均衡的地址注册到nameserver。ClusterIP只能与Hostname一起使用，
+	// 由集群外的ingress或sni代理按域名转发到各broker pod的service
+	// +kubebuilder:validation:Enum=NodePort;LoadBalancer;ClusterIP
+	Type corev1.ServiceType `json:"type"`
+	// Annotations 添加到对外service的注解，如云厂商负载均衡的配置
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Hostname broker注册到nameserver的域名模板(go template)，设置后broker以渲染出的域名代替ip注册。
+	// 可用字段为.Cluster、.Namespace、.Group(broker组序号)、.BrokerName、.Index(组内pod序号)和.Pod，
+	// 如 {{.Cluster}}-{{.Group}}-{{.Index}}.mq.example.com。只用于broker
+	Hostname string `json:"hostname,omitempty"`
+	// ExternalDNS 为对外service添加external-dns的hostname注解，需要设置Hostname
+	ExternalDNS bool `json:"externalDNS,omitempty"`
+}
+
+// hostnameData 为Hostname模板的渲染参数
+type hostnameData struct {
+	Cluster    string
+	Namespace  string
+	Group      int
+	BrokerName string
+	Index      int
+	Pod        string
+}
+
+// RenderHostname 渲染第group个broker组第index个pod注册的域名，brokerName为broker组名称
+func (a *ExternalAccess) RenderHostname(cluster, namespace, brokerName string, group, index int) (string, error) {
+	tmpl, err := template.New("hostname").Option("missingkey=error").Parse(a.Hostname)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	err = tmpl.Execute(buf, hostnameData{
+		Cluster:    cluster,
+		Namespace:  namespace,
+		Group:      group,
+		BrokerName: brokerName,
+		Index:      index,
+		Pod:        fmt.Sprintf("%s-%d", brokerName, index),
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
 }
 
+// BrokerUpdateStrategy broker pod的更新策略
+// +kubebuilder:validation:Enum=LeaderAware;RollingUpdate
+type BrokerUpdateStrategy string
+
+const (
+	// UpdateStrategyLeaderAware 由operator逐个重启pod，先重启follower并等待其追上leader，转移leadership后再重启原leader
+	UpdateStrategyLeaderAware BrokerUpdateStrategy = "LeaderAware"
+	// UpdateStrategyRollingUpdate 使用statefulset的滚动更新，按序号从大到小重启pod
+	UpdateStrategyRollingUpdate BrokerUpdateStrategy = "RollingUpdate"
+)
+
 // Dledger模式设置
 type Dledger struct {
 	BrokerGroupNumber    int   `json:"brokerGroupNumber,omitempty"`
 	BrokerNumberPerGroup []int `json:"brokerNumberPerGroup,omitempty"` // broker每个group node数量
+	AllowSingleNode      bool  `json:"allowSingleNode,omitempty"`      // 允许单节点的group，仅用于测试环境
+	// ExtendTopicsOnScaleOut 扩容broker组后，将已有topic的队列扩展到新的broker组
+	ExtendTopicsOnScaleOut bool `json:"extendTopicsOnScaleOut,omitempty"`
 }
 
 // 存储设置
 type DledgerStorage struct {
 	StorageClass string `json:"storageClass,omitempty"`
-	Size         string `json:"size,omitempty"`
+	Size         string `json:"size,omitempty"`    // commitlog、consumequeue等存储的容量
+	LogSize      string `json:"logSize,omitempty"` // 日志存储的容量，为空时日志不单独使用持久卷
+	// RetentionPolicy 删除实例或缩容移除broker组时持久卷的处理方式，默认Retain
+	RetentionPolicy RetentionPolicy `json:"retentionPolicy,omitempty"`
+	// SnapshotClass 为RetentionPolicy为Snapshot时使用的VolumeSnapshotClass，为空时使用集群默认值
+	SnapshotClass string `json:"snapshotClass,omitempty"`
 }
 
+// RetentionPolicy 持久卷保留策略
+// +kubebuilder:validation:Enum=Retain;Delete;Snapshot
+type RetentionPolicy string
+
+const (
+	// RetentionPolicyRetain 保留持久卷，需要手动清理
+	RetentionPolicyRetain RetentionPolicy = "Retain"
+	// RetentionPolicyDelete 删除持久卷
+	RetentionPolicyDelete RetentionPolicy = "Delete"
+	// RetentionPolicySnapshot 为持久卷创建VolumeSnapshot，快照就绪后删除持久卷
+	RetentionPolicySnapshot RetentionPolicy = "Snapshot"
+)
+
 // export设置
 type ExportSetting struct {
-	Open         bool                         `json:"open"`
-	Resource     *corev1.ResourceRequirements `json:"resource,omitempty"`
-	ImageSetting `json:",inline"`
+	Open           bool                         `json:"open"`
+	Resource       *corev1.ResourceRequirements `json:"resource,omitempty"`
+	ImageSetting   `json:",inline"`
+	ServiceMonitor bool `json:"serviceMonitor,omitempty"` // 创建prometheus-operator的ServiceMonitor
 }
 
 // image设置
@@ -82,27 +174,99 @@ type Acl struct {
 }
 
 type Account struct {
-	AccessKey          string   `json:"accessKey"`
-	SecretKey          string   `json:"secretKey"`
-	WhiteRemoteAddress string   `json:"whiteRemoteAddress,omitempty"`
-	Admin              bool     `json:"admin,omitempty"`
-	DefaultTopicPerm   string   `json:"defaultTopicPerm"`
-	DefaultGroupPerm   string   `json:"defaultGroupPerm"`
-	TopicPerms         []string `json:"topicPerms"`
-	GroupPerms         []string `json:"groupPerms"`
+	AccessKey          string                    `json:"accessKey,omitempty"`
+	AccessKeyRef       *corev1.SecretKeySelector `json:"accessKeyRef,omitempty"` // 从secret中读取accessKey，与accessKey二选一
+	SecretKey          string                    `json:"secretKey,omitempty"`    // 明文secretKey，建议使用secretKeyRef
+	SecretKeyRef       *corev1.SecretKeySelector `json:"secretKeyRef,omitempty"` // 从secret中读取secretKey，与secretKey二选一
+	WhiteRemoteAddress string                    `json:"whiteRemoteAddress,omitempty"`
+	Admin              bool                      `json:"admin,omitempty"`
+	DefaultTopicPerm   string                    `json:"defaultTopicPerm"`
+	DefaultGroupPerm   string                    `json:"defaultGroupPerm"`
+	TopicPerms         []string                  `json:"topicPerms"`
+	GroupPerms         []string                  `json:"groupPerms"`
 }
 
 // DledgerBrokerStatus defines the observed state of DledgerBroker
 type DledgerBrokerStatus struct {
-	BrokerConfigmap string              `json:"brokerConfigmap,omitempty"` // 当前实例挂载的broker配置
-	NameserverAddr  []string            `json:"nameserverAddr,omitempty"`  // 当前实例上报的nameserver地址
-	InternalAccess  string              `json:"InternalAccess,omitempty"`  // 内部访问地址
-	ExternalAccess  string              `json:"ExternalAccess,omitempty"`  // 外部访问地址
-	BrokerInfo      map[string][]string `json:"BrokerInfo,omitempty"`      // broker配置信息
+	BrokerConfigmap string   `json:"brokerConfigmap,omitempty"` // 当前实例挂载的broker配置
+	NameserverAddr  []string `json:"nameserverAddr,omitempty"`  // 当前实例上报的nameserver地址
+	InternalAccess  string   `json:"InternalAccess,omitempty"`  // 内部访问地址，各broker pod的地址以;分隔
+	ExternalAccess  string   `json:"ExternalAccess,omitempty"`  // 外部访问地址，各broker pod注册的地址以;分隔
+	// Deprecated: 使用BrokerMembers，保留以兼容已发布的schema，值为各broker组成员注册到nameserver的地址
+	BrokerInfo    map[string][]string       `json:"BrokerInfo,omitempty"`
+	BrokerMembers map[string][]BrokerMember `json:"brokerMembers,omitempty"` // 各broker组成员的实际状态，key为brokerName
+	Conditions    []metav1.Condition        `json:"conditions,omitempty"`    // 实例状态
+	VolumeResize  []VolumeResizeStatus      `json:"volumeResize,omitempty"`  // 正在扩容的持久卷
+	// ObservedGeneration 最近一次完成调谐时实例的generation
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+	Phase              Phase  `json:"phase,omitempty"`       // 实例状态概要
+	ReadyGroups        string `json:"readyGroups,omitempty"` // 就绪的broker组数，格式为 就绪数/总数
+	ReadyNodes         string `json:"readyNodes,omitempty"`  // 就绪的broker节点数，格式为 就绪数/总数
+}
+
+// BrokerMember broker组中一个节点从nameserver和dledger获取的实际状态
+type BrokerMember struct {
+	Pod        string      `json:"pod"`                // pod名称
+	Address    string      `json:"address,omitempty"`  // broker注册到nameserver的地址
+	Role       DledgerRole `json:"role,omitempty"`     // dledger角色，节点无法访问时为空
+	Term       int64       `json:"term,omitempty"`     // dledger当前的term
+	Registered bool        `json:"registered"`         // 是否已注册到nameserver
+	BrokerId   *int        `json:"brokerId,omitempty"` // 注册到nameserver的brokerId，0为master
 }
 
+// DledgerRole dledger节点的角色
+type DledgerRole string
+
+const (
+	DledgerRoleLeader    DledgerRole = "Leader"
+	DledgerRoleFollower  DledgerRole = "Follower"
+	DledgerRoleCandidate DledgerRole = "Candidate"
+)
+
+// 持久卷扩容进度
+type VolumeResizeStatus struct {
+	Name      string `json:"name"`               // pvc名称
+	Requested string `json:"requested"`          // 申请的容量
+	Capacity  string `json:"capacity,omitempty"` // 当前实际容量
+	Phase     string `json:"phase"`              // Resizing 或 FileSystemResizePending
+}
+
+// Phase 实例状态概要，由Ready、Progressing、Degraded状态推导
+type Phase string
+
+const (
+	PhasePending     Phase = "Pending"
+	PhaseRunning     Phase = "Running"
+	PhaseUpdating    Phase = "Updating"
+	PhaseDegraded    Phase = "Degraded"
+	PhaseTerminating Phase = "Terminating"
+)
+
+const (
+	// ConditionReady 表示所有节点就绪且可以提供服务
+	ConditionReady = "Ready"
+	// ConditionProgressing 表示实例正在创建、更新或扩缩容
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded 表示有节点长时间不可用或broker组失去quorum
+	ConditionDegraded = "Degraded"
+	// ConditionNameserverResolved 表示Spec.Nameserver引用的nameserver是否已找到并可用
+	ConditionNameserverResolved = "NameserverResolved"
+	// ConditionStorageReady 表示broker的持久卷是否与Spec.Storage一致
+	ConditionStorageReady = "StorageReady"
+	// ConditionScaling 表示broker组是否正在扩缩容
+	ConditionScaling = "Scaling"
+	// ConditionRollingUpdate 表示是否有broker pod正在按先follower后leader的顺序重启
+	ConditionRollingUpdate = "RollingUpdate"
+)
+
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Groups",type=string,JSONPath=`.status.readyGroups`,description="Ready broker groups"
+// +kubebuilder:printcolumn:name="Nodes",type=string,JSONPath=`.status.readyNodes`,description="Ready broker nodes"
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Internal",type=string,JSONPath=`.status.InternalAccess`,priority=1
+// +kubebuilder:printcolumn:name="External",type=string,JSONPath=`.status.ExternalAccess`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // DledgerBroker is the Schema for the dledgerbrokers API
 type DledgerBroker struct {
@@ -113,6 +277,33 @@ type DledgerBroker struct {
 	Status DledgerBrokerStatus `json:"status,omitempty"`
 }
 
+// NameserverRef 解析Spec.Nameserver，未指定命名空间时使用实例所在命名空间
+func (r *DledgerBroker) NameserverRef() types.NamespacedName {
+	return namespacedRef(r.Namespace, r.Spec.Nameserver)
+}
+
+// AllowsNamespace 返回namespace中的Topic、ConsumerGroup和RocketMQUser能否引用该集群
+func (r *DledgerBroker) AllowsNamespace(namespace string) bool {
+	if namespace == r.Namespace {
+		return true
+	}
+	for _, allowed := range r.Spec.AllowedNamespaces {
+		if allowed == "*" || allowed == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// namespacedRef 解析 name 或 namespace/name 格式的引用，未指定命名空间时使用namespace
+func namespacedRef(namespace, ref string) types.NamespacedName {
+	name := types.NamespacedName{Namespace: namespace, Name: ref}
+	if kv := strings.SplitN(ref, "/", 2); len(kv) == 2 {
+		name.Namespace, name.Name = kv[0], kv[1]
+	}
+	return name
+}
+
 // +kubebuilder:object:root=true
 
 // DledgerBrokerList contains a list of DledgerBroker
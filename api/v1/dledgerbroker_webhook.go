@@ -17,14 +17,24 @@ limitations under the License.
 package v1
 
 import (
+	"context"
+	"fmt"
+	"strings"
+
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"rocketmq-operator-v2/pkg/configs"
 	"rocketmq-operator-v2/pkg/logi"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 	"strconv"
 )
 
@@ -32,6 +42,15 @@ import (
 var dledgerbrokerlog = logi.GetSugaredLogger().With(zap.String("Webhook", "Dledgerbroker"))
 
 func (r *DledgerBroker) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookClient = mgr.GetClient()
+	// 先注册带warning的校验webhook，builder发现路径已注册后会跳过默认的校验webhook
+	mgr.GetWebhookServer().Register(dledgerBrokerValidatePath, &webhook.Admission{
+		Handler: &warningHandler{
+			Handler:  admission.ValidatingWebhookFor(r).Handler,
+			warnings: func(obj runtime.Object) []string { return obj.(*DledgerBroker).warnings() },
+			newObj:   func() runtime.Object { return &DledgerBroker{} },
+		},
+	})
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
 		Complete()
@@ -46,23 +65,13 @@ var _ webhook.Defaulter = &DledgerBroker{}
 // Default implements webhook.Defaulter so a webhook will be registered for the type
 func (r *DledgerBroker) Default() {
 	dledgerbrokerlog.Info("default", "name", r.Name)
-	brokerGroups := r.Spec.Dledger.BrokerGroupNumber
-	preGroup := r.Spec.BrokerNumberPerGroup
 	cfg := configs.GetGlobalConfig()
 	specEnv := r.Spec.Env
 	defer func() {
 		r.Spec.Env = specEnv
 	}()
-	if brokerGroups <= 0 {
-		brokerGroups = 2
-	}
-	if len(preGroup) == 0 {
-		preGroup = make([]int, 0, brokerGroups)
-		for k := range preGroup {
-			preGroup[k] = 3
-		}
-		r.Spec.BrokerNumberPerGroup = preGroup
-	}
+	r.defaultDledger()
+
 	if r.Spec.Image == "" {
 		r.Spec.Image = cfg.IMAGE_ROCKETMQ
 	}
@@ -72,7 +81,7 @@ func (r *DledgerBroker) Default() {
 		*r.Spec.Resource = defaultBrokerResource()
 	}
 
-	if r.Spec.Export.Open {
+	if r.Spec.Export != nil && r.Spec.Export.Open {
 		if r.Spec.Export.Image == "" {
 			r.Spec.Export.Image = cfg.IMAGE_EXPORTER
 		}
@@ -82,25 +91,65 @@ func (r *DledgerBroker) Default() {
 		}
 	}
 
+	if r.Spec.Storage == nil {
+		r.Spec.Storage = new(DledgerStorage)
+	}
 	if r.Spec.Storage.StorageClass == "" {
 		r.Spec.Storage.StorageClass = cfg.STORAGE_CLASS_NAME
 	}
 
 	if r.Spec.Storage.Size == "" {
-		r.Spec.Storage.Size = "2Gi"
+		r.Spec.Storage.Size = defaultStorageSize
+	}
+	if r.Spec.Storage.RetentionPolicy == "" {
+		r.Spec.Storage.RetentionPolicy = RetentionPolicyRetain
+	}
+	if r.Spec.UpdateStrategy == "" {
+		r.Spec.UpdateStrategy = UpdateStrategyLeaderAware
 	}
 	func() {
-		m := r.Spec.Resource.Requests.Memory().Size()
+		m := r.Spec.Resource.Requests.Memory().Value() / (1024 * 1024)
 		if m <= 0 {
 			return
 		}
-		specEnv = configs.SetEnvIfUnset(specEnv, configs.JVM_XMX, strconv.FormatInt(int64(m), 10)+"m")
-		specEnv = configs.SetEnvIfUnset(specEnv, configs.JVM_XMS, strconv.FormatInt(int64(m)/4, 10)+"m")
+		specEnv = configs.SetEnvIfUnset(specEnv, configs.JVM_XMX, strconv.FormatInt(m, 10)+"m")
+		specEnv = configs.SetEnvIfUnset(specEnv, configs.JVM_XMS, strconv.FormatInt(m/4, 10)+"m")
 	}()
 
 	specEnv = configs.MergeEnv(specEnv, cfg.InstanceEnv)
 }
 
+const (
+	defaultBrokerGroupNumber    = 2
+	defaultBrokerNumberPerGroup = 3
+	defaultStorageSize          = "2Gi"
+)
+
+// defaultDledger 补全broker组数量以及每组节点数，BrokerNumberPerGroup按组数量补齐或截断
+func (r *DledgerBroker) defaultDledger() {
+	perGroup := r.Spec.BrokerNumberPerGroup
+	if r.Spec.BrokerGroupNumber <= 0 {
+		r.Spec.BrokerGroupNumber = len(perGroup)
+		if r.Spec.BrokerGroupNumber == 0 {
+			r.Spec.BrokerGroupNumber = defaultBrokerGroupNumber
+		}
+	}
+
+	groups := r.Spec.BrokerGroupNumber
+	if len(perGroup) > groups {
+		perGroup = perGroup[:groups]
+	}
+	for len(perGroup) < groups {
+		perGroup = append(perGroup, defaultBrokerNumberPerGroup)
+	}
+	for k := range perGroup {
+		if perGroup[k] <= 0 {
+			perGroup[k] = defaultBrokerNumberPerGroup
+		}
+	}
+	r.Spec.BrokerNumberPerGroup = perGroup
+}
+
 func defaultBrokerResource() v1.ResourceRequirements {
 	return v1.ResourceRequirements{
 		Requests: v1.ResourceList{
@@ -127,8 +176,12 @@ func defaultExportResource() v1.ResourceRequirements {
 	}
 }
 
-// TODO(user): change verbs to "verbs=create;update;delete" if you want to enable deletion validation.
-// +kubebuilder:webhook:verbs=create;update,path=/validate-rocketmq-daocloud-io-v1-dledgerbroker,mutating=false,failurePolicy=fail,groups=rocketmq.daocloud.io,resources=dledgerbrokers,versions=v1,name=vdledgerbroker.kb.io
+// +kubebuilder:webhook:verbs=create;update;delete,path=/validate-rocketmq-daocloud-io-v1-dledgerbroker,mutating=false,failurePolicy=fail,groups=rocketmq.daocloud.io,resources=dledgerbrokers,versions=v1,name=vdledgerbroker.kb.io
+
+const dledgerBrokerValidatePath = "/validate-rocketmq-daocloud-io-v1-dledgerbroker"
+
+// AnnotationDeletionProtection 设置为"true"时拒绝删除实例
+const AnnotationDeletionProtection = "rocketmq.daocloud.io/deletion-protection"
 
 var _ webhook.Validator = &DledgerBroker{}
 
@@ -136,22 +189,366 @@ var _ webhook.Validator = &DledgerBroker{}
 func (r *DledgerBroker) ValidateCreate() error {
 	dledgerbrokerlog.Info("validate create", "name", r.Name)
 
-	// TODO(user): fill in your validation logic upon object creation.
-	return nil
+	return r.toInvalidError(r.validateSpec())
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (r *DledgerBroker) ValidateUpdate(old runtime.Object) error {
 	dledgerbrokerlog.Info("validate update", "name", r.Name)
 
-	// TODO(user): fill in your validation logic upon object update.
-	return nil
+	// 删除过程中只会移除finalizer，不再校验spec
+	if !r.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	allErrs := r.validateSpec()
+	if oldBroker, ok := old.(*DledgerBroker); ok {
+		allErrs = append(allErrs, r.validateStorageUpdate(oldBroker)...)
+		allErrs = append(allErrs, r.validateDledgerUpdate(oldBroker)...)
+	}
+	return r.toInvalidError(allErrs)
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
 func (r *DledgerBroker) ValidateDelete() error {
 	dledgerbrokerlog.Info("validate delete", "name", r.Name)
 
-	// TODO(user): fill in your validation logic upon object deletion.
+	if r.Annotations[AnnotationDeletionProtection] == "true" {
+		return apierrors.NewForbidden(GroupVersion.WithResource("dledgerbrokers").GroupResource(), r.Name,
+			fmt.Errorf("deletion protection is enabled, remove annotation %s first", AnnotationDeletionProtection))
+	}
+	return nil
+}
+
+// warnings 返回不影响准入但需要提示用户的问题
+func (r *DledgerBroker) warnings() []string {
+	var warnings []string
+	if r.Spec.Acl == nil {
+		return warnings
+	}
+	for i, account := range r.Spec.Acl.Accounts {
+		if account.SecretKey != "" {
+			warnings = append(warnings, fmt.Sprintf(
+				"spec.acl.accounts[%d].secretKey is stored in plain text and readable by anyone who can read dledgerbrokers, use secretKeyRef instead", i))
+		}
+	}
+	return warnings
+}
+
+func (r *DledgerBroker) toInvalidError(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("DledgerBroker").GroupKind(), r.Name, allErrs)
+}
+
+func (r *DledgerBroker) validateSpec() field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+	allErrs = append(allErrs, r.validateDledger(specPath)...)
+	allErrs = append(allErrs, r.validateStorage(specPath.Child("storage"))...)
+	allErrs = append(allErrs, r.validateConfig(specPath.Child("config"))...)
+	allErrs = append(allErrs, validateAcl(r.Spec.Acl, specPath.Child("acl"))...)
+	allErrs = append(allErrs, validateExternalAccess(r.Spec.ExternalAccess, specPath.Child("externalAccess"), true)...)
+	switch r.Spec.UpdateStrategy {
+	case "", UpdateStrategyLeaderAware, UpdateStrategyRollingUpdate:
+	default:
+		allErrs = append(allErrs, field.NotSupported(specPath.Child("updateStrategy"), r.Spec.UpdateStrategy,
+			[]string{string(UpdateStrategyLeaderAware), string(UpdateStrategyRollingUpdate)}))
+	}
+	return allErrs
+}
+
+func (r *DledgerBroker) validateDledger(specPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	groups := r.Spec.BrokerGroupNumber
+	perGroup := r.Spec.BrokerNumberPerGroup
+	if groups <= 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("brokerGroupNumber"), groups, "must be greater than 0"))
+	}
+	if len(perGroup) != groups {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("brokerNumberPerGroup"), perGroup,
+			fmt.Sprintf("must have exactly %d entries to match brokerGroupNumber", groups)))
+	}
+	for i, n := range perGroup {
+		p := specPath.Child("brokerNumberPerGroup").Index(i)
+		switch {
+		case n == 1 && r.Spec.AllowSingleNode:
+		case n < 3:
+			allErrs = append(allErrs, field.Invalid(p, n, "must be at least 3 so that a dledger quorum survives a node failure, or set allowSingleNode for a single node group"))
+		case n%2 == 0:
+			allErrs = append(allErrs, field.Invalid(p, n, "must be odd, an even number of nodes does not improve dledger fault tolerance"))
+		}
+	}
+	return allErrs
+}
+
+// validateDledgerUpdate 已有broker组的成员由operator每次增减一个节点并滚动重启，
+// 少于3个节点的组在调整过程中会失去quorum，不允许调整
+func (r *DledgerBroker) validateDledgerUpdate(old *DledgerBroker) field.ErrorList {
+	var allErrs field.ErrorList
+	for i, n := range r.Spec.BrokerNumberPerGroup {
+		if i >= len(old.Spec.BrokerNumberPerGroup) || i >= old.Spec.BrokerGroupNumber {
+			break
+		}
+		oldN := old.Spec.BrokerNumberPerGroup[i]
+		if n != oldN && (n < 3 || oldN < 3) {
+			allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "brokerNumberPerGroup").Index(i),
+				fmt.Sprintf("can not resize dledger group from %d to %d members, groups with less than 3 members lose quorum while resizing", oldN, n)))
+		}
+	}
+	return allErrs
+}
+
+func (r *DledgerBroker) validateStorage(storagePath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if r.Spec.Storage == nil {
+		return allErrs
+	}
+	allErrs = append(allErrs, validateStorageSize(r.Spec.Storage.Size, storagePath.Child("size"))...)
+	allErrs = append(allErrs, validateStorageSize(r.Spec.Storage.LogSize, storagePath.Child("logSize"))...)
+	switch r.Spec.Storage.RetentionPolicy {
+	case "", RetentionPolicyRetain, RetentionPolicyDelete:
+		if r.Spec.Storage.SnapshotClass != "" {
+			allErrs = append(allErrs, field.Invalid(storagePath.Child("snapshotClass"), r.Spec.Storage.SnapshotClass,
+				"snapshotClass is only used when retentionPolicy is Snapshot"))
+		}
+	case RetentionPolicySnapshot:
+	default:
+		allErrs = append(allErrs, field.NotSupported(storagePath.Child("retentionPolicy"), r.Spec.Storage.RetentionPolicy,
+			[]string{string(RetentionPolicyRetain), string(RetentionPolicyDelete), string(RetentionPolicySnapshot)}))
+	}
+	return allErrs
+}
+
+// validateStorageSize 校验非空的容量可以解析且大于0
+func validateStorageSize(size string, sizePath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if size == "" {
+		return allErrs
+	}
+	q, err := resource.ParseQuantity(size)
+	if err != nil {
+		allErrs = append(allErrs, field.Invalid(sizePath, size, err.Error()))
+	} else if q.Sign() <= 0 {
+		allErrs = append(allErrs, field.Invalid(sizePath, size, "must be greater than 0"))
+	}
+	return allErrs
+}
+
+func (r *DledgerBroker) validateStorageUpdate(old *DledgerBroker) field.ErrorList {
+	var allErrs field.ErrorList
+	if old.Spec.Storage == nil {
+		return allErrs
+	}
+	storagePath := field.NewPath("spec", "storage")
+	newStorage := r.Spec.Storage
+	if newStorage == nil {
+		newStorage = &DledgerStorage{}
+	}
+	if old.Spec.Storage.StorageClass != "" && newStorage.StorageClass != old.Spec.Storage.StorageClass {
+		allErrs = append(allErrs, field.Forbidden(storagePath.Child("storageClass"), "storageClass is immutable"))
+	}
+	allErrs = append(allErrs, validateStorageSizeUpdate(old.Spec.Storage.Size, newStorage.Size,
+		newStorage.StorageClass, storagePath.Child("size"))...)
+	allErrs = append(allErrs, validateStorageSizeUpdate(old.Spec.Storage.LogSize, newStorage.LogSize,
+		newStorage.StorageClass, storagePath.Child("logSize"))...)
+	return allErrs
+}
+
+// validateStorageSizeUpdate 容量不允许缩小，扩容时要求StorageClass开启allowVolumeExpansion
+func validateStorageSizeUpdate(oldSize, newSize, storageClass string, sizePath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if oldSize == "" {
+		return allErrs
+	}
+	oldQuantity, err := resource.ParseQuantity(oldSize)
+	if err != nil {
+		return allErrs
+	}
+	if newSize == "" {
+		allErrs = append(allErrs, field.Required(sizePath, "size can not be removed once set"))
+		return allErrs
+	}
+	newQuantity, err := resource.ParseQuantity(newSize)
+	if err != nil {
+		return allErrs
+	}
+	switch newQuantity.Cmp(oldQuantity) {
+	case -1:
+		allErrs = append(allErrs, field.Forbidden(sizePath, fmt.Sprintf("can not shrink storage from %s to %s", oldSize, newSize)))
+	case 1:
+		if err := checkVolumeExpansion(storageClass); err != nil {
+			allErrs = append(allErrs, field.Forbidden(sizePath, err.Error()))
+		}
+	}
+	return allErrs
+}
+
+// checkVolumeExpansion 检查StorageClass是否允许扩容，未设置client时跳过
+func checkVolumeExpansion(storageClass string) error {
+	if webhookClient == nil {
+		return nil
+	}
+	if storageClass == "" {
+		return fmt.Errorf("can not expand storage without an explicit storageClass")
+	}
+	sc := &storagev1.StorageClass{}
+	if err := webhookClient.Get(context.Background(), types.NamespacedName{Name: storageClass}, sc); err != nil {
+		return fmt.Errorf("can not expand storage, get storageClass %s: %v", storageClass, err)
+	}
+	if sc.AllowVolumeExpansion == nil || !*sc.AllowVolumeExpansion {
+		return fmt.Errorf("storageClass %s does not allow volume expansion", storageClass)
+	}
 	return nil
 }
+
+func (r *DledgerBroker) validateConfig(configPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	managed := configs.ManagedBrokerConfigKeys[:len(configs.ManagedBrokerConfigKeys):len(configs.ManagedBrokerConfigKeys)]
+	if r.Spec.Nameserver != "" {
+		managed = append(managed, configs.NamesrvAddr)
+	}
+	if r.Spec.Acl != nil {
+		managed = append(managed, configs.AclEnable)
+	}
+	if r.Spec.ExternalAccess != nil {
+		managed = append(managed, configs.BrokerIP1, configs.ListenPort)
+	}
+	for _, k := range managed {
+		if _, ok := r.Spec.Config[k]; ok {
+			allErrs = append(allErrs, field.Forbidden(configPath.Key(k), "managed by the operator and can not be overridden"))
+		}
+	}
+	return allErrs
+}
+
+// validateExternalAccess 校验外部访问设置，hostname表示是否支持以域名注册(只用于broker)
+func validateExternalAccess(access *ExternalAccess, accessPath *field.Path, hostname bool) field.ErrorList {
+	var allErrs field.ErrorList
+	if access == nil {
+		return allErrs
+	}
+	supportedTypes := []string{string(v1.ServiceTypeNodePort), string(v1.ServiceTypeLoadBalancer)}
+	if hostname && access.Hostname != "" {
+		supportedTypes = append(supportedTypes, string(v1.ServiceTypeClusterIP))
+	}
+	supported := false
+	for _, t := range supportedTypes {
+		supported = supported || string(access.Type) == t
+	}
+	if !supported {
+		allErrs = append(allErrs, field.NotSupported(accessPath.Child("type"), access.Type, supportedTypes))
+	}
+	if !hostname {
+		if access.Hostname != "" {
+			allErrs = append(allErrs, field.Forbidden(accessPath.Child("hostname"), "only supported for brokers"))
+		}
+		if access.ExternalDNS {
+			allErrs = append(allErrs, field.Forbidden(accessPath.Child("externalDNS"), "only supported for brokers"))
+		}
+		return allErrs
+	}
+	if access.Hostname == "" {
+		if access.ExternalDNS {
+			allErrs = append(allErrs, field.Required(accessPath.Child("hostname"), "required when externalDNS is enabled"))
+		}
+		return allErrs
+	}
+	// 使用示例参数渲染，校验模板可用、结果为合法域名且各pod的域名不同
+	rendered := make(map[string]bool)
+	for _, p := range [][2]int{{0, 0}, {0, 1}, {1, 0}} {
+		name, err := access.RenderHostname("cluster", "namespace", fmt.Sprintf("cluster-broker-%d", p[0]), p[0], p[1])
+		if err != nil {
+			return append(allErrs, field.Invalid(accessPath.Child("hostname"), access.Hostname, err.Error()))
+		}
+		if msgs := validation.IsDNS1123Subdomain(name); len(msgs) > 0 {
+			return append(allErrs, field.Invalid(accessPath.Child("hostname"), access.Hostname,
+				fmt.Sprintf("rendered %q: %s", name, strings.Join(msgs, ", "))))
+		}
+		rendered[name] = true
+	}
+	if len(rendered) < 3 {
+		allErrs = append(allErrs, field.Invalid(accessPath.Child("hostname"), access.Hostname,
+			"must render a distinct hostname for each broker pod, e.g. using .Group and .Index or .Pod"))
+	}
+	return allErrs
+}
+
+// aclPerms 为rocketmq plain acl支持的权限
+var aclPerms = map[string]bool{
+	"DENY":    true,
+	"PUB":     true,
+	"SUB":     true,
+	"PUB|SUB": true,
+}
+
+func validateAcl(acl *Acl, aclPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if acl == nil {
+		return allErrs
+	}
+	accessKeys := make(map[string]bool, len(acl.Accounts))
+	for i, account := range acl.Accounts {
+		p := aclPath.Child("accounts").Index(i)
+		allErrs = append(allErrs, validateAccountKey(account.AccessKey, account.AccessKeyRef, p.Child("accessKey"), p.Child("accessKeyRef"), true)...)
+		if account.AccessKeyRef == nil {
+			if accessKeys[account.AccessKey] {
+				allErrs = append(allErrs, field.Duplicate(p.Child("accessKey"), account.AccessKey))
+			}
+			accessKeys[account.AccessKey] = true
+		}
+		allErrs = append(allErrs, validateAccountKey(account.SecretKey, account.SecretKeyRef, p.Child("secretKey"), p.Child("secretKeyRef"), false)...)
+		if account.DefaultTopicPerm != "" && !aclPerms[account.DefaultTopicPerm] {
+			allErrs = append(allErrs, field.NotSupported(p.Child("defaultTopicPerm"), account.DefaultTopicPerm, aclPermList()))
+		}
+		if account.DefaultGroupPerm != "" && !aclPerms[account.DefaultGroupPerm] {
+			allErrs = append(allErrs, field.NotSupported(p.Child("defaultGroupPerm"), account.DefaultGroupPerm, aclPermList()))
+		}
+		allErrs = append(allErrs, validateResourcePerms(account.TopicPerms, p.Child("topicPerms"))...)
+		allErrs = append(allErrs, validateResourcePerms(account.GroupPerms, p.Child("groupPerms"))...)
+	}
+	return allErrs
+}
+
+// validateAccountKey 校验明文key和secret引用二选一，明文key至少6个字符
+func validateAccountKey(key string, ref *v1.SecretKeySelector, keyPath, refPath *field.Path, showValue bool) field.ErrorList {
+	var allErrs field.ErrorList
+	value := key
+	if !showValue {
+		value = ""
+	}
+	switch {
+	case key != "" && ref != nil:
+		allErrs = append(allErrs, field.Forbidden(refPath, fmt.Sprintf("may not be set together with %s", keyPath.String())))
+	case ref != nil:
+		if ref.Name == "" {
+			allErrs = append(allErrs, field.Required(refPath.Child("name"), ""))
+		}
+		if ref.Key == "" {
+			allErrs = append(allErrs, field.Required(refPath.Child("key"), ""))
+		}
+	case len(key) < 6:
+		allErrs = append(allErrs, field.Invalid(keyPath, value, "must be at least 6 characters"))
+	}
+	return allErrs
+}
+
+// validateResourcePerms 校验 resource=PERM 格式的权限配置
+func validateResourcePerms(perms []string, permsPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for i, perm := range perms {
+		kv := strings.SplitN(perm, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			allErrs = append(allErrs, field.Invalid(permsPath.Index(i), perm, "must be in the form <resource>=<PERM>"))
+			continue
+		}
+		if !aclPerms[kv[1]] {
+			allErrs = append(allErrs, field.NotSupported(permsPath.Index(i), kv[1], aclPermList()))
+		}
+	}
+	return allErrs
+}
+
+func aclPermList() []string {
+	return []string{"DENY", "PUB", "SUB", "PUB|SUB"}
+}
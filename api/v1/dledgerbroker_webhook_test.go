@@ -0,0 +1,668 @@
+package v1
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"rocketmq-operator-v2/pkg/configs"
+)
+
+func TestDledgerBrokerDefaultDledger(t *testing.T) {
+	tests := []struct {
+		name         string
+		groups       int
+		perGroup     []int
+		wantGroups   int
+		wantPerGroup []int
+	}{
+		{
+			name:         "empty spec",
+			wantGroups:   2,
+			wantPerGroup: []int{3, 3},
+		},
+		{
+			name:         "groups only",
+			groups:       4,
+			wantGroups:   4,
+			wantPerGroup: []int{3, 3, 3, 3},
+		},
+		{
+			name:         "groups derived from per group sizes",
+			perGroup:     []int{5, 3, 1},
+			wantGroups:   3,
+			wantPerGroup: []int{5, 3, 1},
+		},
+		{
+			name:         "pad per group sizes",
+			groups:       3,
+			perGroup:     []int{5},
+			wantGroups:   3,
+			wantPerGroup: []int{5, 3, 3},
+		},
+		{
+			name:         "truncate per group sizes",
+			groups:       1,
+			perGroup:     []int{5, 3},
+			wantGroups:   1,
+			wantPerGroup: []int{5},
+		},
+		{
+			name:         "non positive sizes",
+			groups:       2,
+			perGroup:     []int{0, -1},
+			wantGroups:   2,
+			wantPerGroup: []int{3, 3},
+		},
+		{
+			name:         "negative groups",
+			groups:       -1,
+			wantGroups:   2,
+			wantPerGroup: []int{3, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DledgerBroker{}
+			r.Spec.BrokerGroupNumber = tt.groups
+			r.Spec.BrokerNumberPerGroup = tt.perGroup
+			r.Default()
+			if r.Spec.BrokerGroupNumber != tt.wantGroups {
+				t.Errorf("BrokerGroupNumber = %d, want %d", r.Spec.BrokerGroupNumber, tt.wantGroups)
+			}
+			if !reflect.DeepEqual(r.Spec.BrokerNumberPerGroup, tt.wantPerGroup) {
+				t.Errorf("BrokerNumberPerGroup = %v, want %v", r.Spec.BrokerNumberPerGroup, tt.wantPerGroup)
+			}
+		})
+	}
+}
+
+func TestDledgerBrokerDefaultStorage(t *testing.T) {
+	cfg := configs.GetGlobalConfig()
+	tests := []struct {
+		name    string
+		storage *DledgerStorage
+		want    *DledgerStorage
+	}{
+		{
+			name: "nil storage",
+			want: &DledgerStorage{StorageClass: cfg.STORAGE_CLASS_NAME, Size: "2Gi", RetentionPolicy: RetentionPolicyRetain},
+		},
+		{
+			name:    "empty storage",
+			storage: &DledgerStorage{},
+			want:    &DledgerStorage{StorageClass: cfg.STORAGE_CLASS_NAME, Size: "2Gi", RetentionPolicy: RetentionPolicyRetain},
+		},
+		{
+			name:    "keep user storage",
+			storage: &DledgerStorage{StorageClass: "fast", Size: "10Gi", RetentionPolicy: RetentionPolicyDelete},
+			want:    &DledgerStorage{StorageClass: "fast", Size: "10Gi", RetentionPolicy: RetentionPolicyDelete},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DledgerBroker{}
+			r.Spec.Storage = tt.storage
+			r.Default()
+			if !reflect.DeepEqual(r.Spec.Storage, tt.want) {
+				t.Errorf("Storage = %+v, want %+v", r.Spec.Storage, tt.want)
+			}
+		})
+	}
+}
+
+func TestDledgerBrokerDefaultExport(t *testing.T) {
+	cfg := configs.GetGlobalConfig()
+	defaultResource := defaultExportResource()
+	tests := []struct {
+		name   string
+		export *ExportSetting
+		want   *ExportSetting
+	}{
+		{
+			name: "nil export",
+		},
+		{
+			name:   "closed export",
+			export: &ExportSetting{},
+			want:   &ExportSetting{},
+		},
+		{
+			name:   "open export",
+			export: &ExportSetting{Open: true},
+			want: &ExportSetting{
+				Open:         true,
+				Resource:     &defaultResource,
+				ImageSetting: ImageSetting{Image: cfg.IMAGE_EXPORTER},
+			},
+		},
+		{
+			name:   "keep user image",
+			export: &ExportSetting{Open: true, ImageSetting: ImageSetting{Image: "exporter:1"}},
+			want: &ExportSetting{
+				Open:         true,
+				Resource:     &defaultResource,
+				ImageSetting: ImageSetting{Image: "exporter:1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DledgerBroker{}
+			r.Spec.Export = tt.export
+			r.Default()
+			if !reflect.DeepEqual(r.Spec.Export, tt.want) {
+				t.Errorf("Export = %+v, want %+v", r.Spec.Export, tt.want)
+			}
+		})
+	}
+}
+
+func TestDledgerBrokerDefaultImageAndResource(t *testing.T) {
+	cfg := configs.GetGlobalConfig()
+	custom := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("4Gi")},
+	}
+	tests := []struct {
+		name         string
+		image        string
+		resource     *corev1.ResourceRequirements
+		wantImage    string
+		wantResource corev1.ResourceRequirements
+	}{
+		{
+			name:         "defaults",
+			wantImage:    cfg.IMAGE_ROCKETMQ,
+			wantResource: defaultBrokerResource(),
+		},
+		{
+			name:         "empty resource",
+			resource:     &corev1.ResourceRequirements{},
+			wantImage:    cfg.IMAGE_ROCKETMQ,
+			wantResource: defaultBrokerResource(),
+		},
+		{
+			name:         "keep user settings",
+			image:        "rocketmq:4.9",
+			resource:     custom.DeepCopy(),
+			wantImage:    "rocketmq:4.9",
+			wantResource: custom,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DledgerBroker{}
+			r.Spec.Image = tt.image
+			r.Spec.Resource = tt.resource
+			r.Default()
+			if r.Spec.Image != tt.wantImage {
+				t.Errorf("Image = %s, want %s", r.Spec.Image, tt.wantImage)
+			}
+			if !reflect.DeepEqual(*r.Spec.Resource, tt.wantResource) {
+				t.Errorf("Resource = %+v, want %+v", *r.Spec.Resource, tt.wantResource)
+			}
+		})
+	}
+}
+
+func TestDledgerBrokerDefaultEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		memory  string
+		env     []corev1.EnvVar
+		wantXmx string
+		wantXms string
+	}{
+		{
+			name:    "derived from default memory request",
+			wantXmx: "1024m",
+			wantXms: "256m",
+		},
+		{
+			name:    "derived from memory request",
+			memory:  "4Gi",
+			wantXmx: "4096m",
+			wantXms: "1024m",
+		},
+		{
+			name:   "keep user heap",
+			memory: "4Gi",
+			env: []corev1.EnvVar{
+				{Name: configs.JVM_XMX, Value: "2g"},
+				{Name: configs.JVM_XMS, Value: "1g"},
+			},
+			wantXmx: "2g",
+			wantXms: "1g",
+		},
+		{
+			name:    "empty user heap uses placeholder",
+			memory:  "4Gi",
+			env:     []corev1.EnvVar{{Name: configs.JVM_XMX}},
+			wantXmx: configs.Empty,
+			wantXms: "1024m",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DledgerBroker{}
+			if tt.memory != "" {
+				r.Spec.Resource = &corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse(tt.memory)},
+				}
+			}
+			r.Spec.Env = tt.env
+			r.Default()
+			if v, _ := configs.LookupEnv(r.Spec.Env, configs.JVM_XMX); v != tt.wantXmx {
+				t.Errorf("Xmx = %s, want %s", v, tt.wantXmx)
+			}
+			if v, _ := configs.LookupEnv(r.Spec.Env, configs.JVM_XMS); v != tt.wantXms {
+				t.Errorf("Xms = %s, want %s", v, tt.wantXms)
+			}
+		})
+	}
+}
+
+func TestDledgerBrokerDefaultIdempotent(t *testing.T) {
+	r := &DledgerBroker{}
+	r.Spec.Export = &ExportSetting{Open: true}
+	r.Default()
+	first := r.DeepCopy()
+	r.Default()
+	if !reflect.DeepEqual(first.Spec, r.Spec) {
+		t.Errorf("second Default changed spec:\n%+v\n%+v", first.Spec, r.Spec)
+	}
+}
+
+func TestDledgerBrokerValidateDledgerUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		old     []int
+		new     []int
+		wantErr bool
+	}{
+		{name: "grow group", old: []int{3, 3}, new: []int{5, 3}},
+		{name: "shrink group", old: []int{5, 3}, new: []int{3, 3}},
+		{name: "add group", old: []int{3}, new: []int{3, 1}},
+		{name: "shrink below quorum", old: []int{3, 3}, new: []int{1, 3}, wantErr: true},
+		{name: "grow single node group", old: []int{1}, new: []int{3}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := &DledgerBroker{}
+			old.Spec.BrokerGroupNumber = len(tt.old)
+			old.Spec.BrokerNumberPerGroup = tt.old
+			r := &DledgerBroker{}
+			r.Spec.BrokerGroupNumber = len(tt.new)
+			r.Spec.BrokerNumberPerGroup = tt.new
+			if errs := r.validateDledgerUpdate(old); (len(errs) > 0) != tt.wantErr {
+				t.Errorf("validateDledgerUpdate() = %v, wantErr %v", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDledgerBrokerValidateExternalAccess(t *testing.T) {
+	tests := []struct {
+		name    string
+		access  *ExternalAccess
+		config  map[string]string
+		wantErr bool
+	}{
+		{name: "disabled", config: map[string]string{configs.BrokerIP1: "10.0.0.1"}},
+		{name: "node port", access: &ExternalAccess{Type: corev1.ServiceTypeNodePort}},
+		{name: "load balancer", access: &ExternalAccess{Type: corev1.ServiceTypeLoadBalancer}},
+		{name: "cluster ip", access: &ExternalAccess{Type: corev1.ServiceTypeClusterIP}, wantErr: true},
+		{name: "empty type", access: &ExternalAccess{}, wantErr: true},
+		{
+			name:   "hostname with cluster ip",
+			access: &ExternalAccess{Type: corev1.ServiceTypeClusterIP, Hostname: "{{.Cluster}}-{{.Group}}-{{.Index}}.mq.example.com", ExternalDNS: true},
+		},
+		{name: "hostname by pod", access: &ExternalAccess{Type: corev1.ServiceTypeLoadBalancer, Hostname: "{{.Pod}}.{{.Namespace}}.example.com"}},
+		{
+			name:    "hostname not distinct",
+			access:  &ExternalAccess{Type: corev1.ServiceTypeClusterIP, Hostname: "{{.Cluster}}.mq.example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "hostname invalid template",
+			access:  &ExternalAccess{Type: corev1.ServiceTypeClusterIP, Hostname: "{{.Broker}}-{{.Index}}.example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "hostname invalid dns name",
+			access:  &ExternalAccess{Type: corev1.ServiceTypeClusterIP, Hostname: "{{.Pod}}_mq.example.com"},
+			wantErr: true,
+		},
+		{name: "external dns without hostname", access: &ExternalAccess{Type: corev1.ServiceTypeNodePort, ExternalDNS: true}, wantErr: true},
+		{
+			name:    "brokerIP1 managed",
+			access:  &ExternalAccess{Type: corev1.ServiceTypeNodePort},
+			config:  map[string]string{configs.BrokerIP1: "10.0.0.1"},
+			wantErr: true,
+		},
+		{
+			name:    "listenPort managed",
+			access:  &ExternalAccess{Type: corev1.ServiceTypeLoadBalancer},
+			config:  map[string]string{configs.ListenPort: "10911"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DledgerBroker{}
+			r.Spec.ExternalAccess = tt.access
+			r.Spec.Config = tt.config
+			errs := append(validateExternalAccess(tt.access, field.NewPath("spec", "externalAccess"), true),
+				r.validateConfig(field.NewPath("spec", "config"))...)
+			if (len(errs) > 0) != tt.wantErr {
+				t.Errorf("validate external access = %v, wantErr %v", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDledgerBrokerValidateDledger(t *testing.T) {
+	tests := []struct {
+		name        string
+		groups      int
+		perGroup    []int
+		singleNode  bool
+		wantErrPath []string
+	}{
+		{name: "odd groups", groups: 2, perGroup: []int{3, 5}},
+		{name: "single node opt in", groups: 2, perGroup: []int{1, 3}, singleNode: true},
+		{
+			name:        "single node without opt in",
+			groups:      1,
+			perGroup:    []int{1},
+			wantErrPath: []string{"spec.brokerNumberPerGroup[0]"},
+		},
+		{
+			name:        "two nodes even with opt in",
+			groups:      1,
+			perGroup:    []int{2},
+			singleNode:  true,
+			wantErrPath: []string{"spec.brokerNumberPerGroup[0]"},
+		},
+		{
+			name:        "even group",
+			groups:      2,
+			perGroup:    []int{3, 4},
+			wantErrPath: []string{"spec.brokerNumberPerGroup[1]"},
+		},
+		{
+			name:        "count mismatch",
+			groups:      3,
+			perGroup:    []int{3, 3},
+			wantErrPath: []string{"spec.brokerNumberPerGroup"},
+		},
+		{
+			name:        "no groups",
+			groups:      0,
+			wantErrPath: []string{"spec.brokerGroupNumber"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DledgerBroker{}
+			r.Spec.BrokerGroupNumber = tt.groups
+			r.Spec.BrokerNumberPerGroup = tt.perGroup
+			r.Spec.AllowSingleNode = tt.singleNode
+			assertErrorPaths(t, r.validateDledger(field.NewPath("spec")), tt.wantErrPath)
+		})
+	}
+}
+
+func TestDledgerBrokerValidateStorage(t *testing.T) {
+	tests := []struct {
+		name        string
+		storage     *DledgerStorage
+		wantErrPath []string
+	}{
+		{name: "nil"},
+		{name: "valid", storage: &DledgerStorage{Size: "10Gi", LogSize: "1Gi", RetentionPolicy: RetentionPolicyDelete}},
+		{name: "snapshot", storage: &DledgerStorage{RetentionPolicy: RetentionPolicySnapshot, SnapshotClass: "csi"}},
+		{name: "invalid size", storage: &DledgerStorage{Size: "ten"}, wantErrPath: []string{"spec.storage.size"}},
+		{name: "zero log size", storage: &DledgerStorage{LogSize: "0"}, wantErrPath: []string{"spec.storage.logSize"}},
+		{
+			name:        "snapshot class without snapshot",
+			storage:     &DledgerStorage{SnapshotClass: "csi"},
+			wantErrPath: []string{"spec.storage.snapshotClass"},
+		},
+		{
+			name:        "unknown retention policy",
+			storage:     &DledgerStorage{RetentionPolicy: "Archive"},
+			wantErrPath: []string{"spec.storage.retentionPolicy"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DledgerBroker{}
+			r.Spec.Storage = tt.storage
+			assertErrorPaths(t, r.validateStorage(field.NewPath("spec", "storage")), tt.wantErrPath)
+		})
+	}
+}
+
+func TestDledgerBrokerValidateStorageUpdate(t *testing.T) {
+	tests := []struct {
+		name        string
+		old         *DledgerStorage
+		new         *DledgerStorage
+		wantErrPath []string
+	}{
+		{name: "no storage before", new: &DledgerStorage{Size: "10Gi", StorageClass: "fast"}},
+		{name: "unchanged", old: &DledgerStorage{Size: "10Gi", StorageClass: "fast"}, new: &DledgerStorage{Size: "10Gi", StorageClass: "fast"}},
+		{name: "same size in other unit", old: &DledgerStorage{Size: "1Gi"}, new: &DledgerStorage{Size: "1024Mi"}},
+		{name: "grow", old: &DledgerStorage{Size: "10Gi", StorageClass: "fast"}, new: &DledgerStorage{Size: "20Gi", StorageClass: "fast"}},
+		{name: "set storage class", old: &DledgerStorage{Size: "10Gi"}, new: &DledgerStorage{Size: "10Gi", StorageClass: "fast"}},
+		{
+			name:        "shrink",
+			old:         &DledgerStorage{Size: "10Gi", LogSize: "2Gi"},
+			new:         &DledgerStorage{Size: "5Gi", LogSize: "2Gi"},
+			wantErrPath: []string{"spec.storage.size"},
+		},
+		{
+			name:        "shrink log",
+			old:         &DledgerStorage{Size: "10Gi", LogSize: "2Gi"},
+			new:         &DledgerStorage{Size: "10Gi", LogSize: "1Gi"},
+			wantErrPath: []string{"spec.storage.logSize"},
+		},
+		{
+			name:        "remove size",
+			old:         &DledgerStorage{Size: "10Gi"},
+			new:         nil,
+			wantErrPath: []string{"spec.storage.size"},
+		},
+		{
+			name:        "change storage class",
+			old:         &DledgerStorage{Size: "10Gi", StorageClass: "fast"},
+			new:         &DledgerStorage{Size: "10Gi", StorageClass: "slow"},
+			wantErrPath: []string{"spec.storage.storageClass"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := &DledgerBroker{}
+			old.Spec.Storage = tt.old
+			r := &DledgerBroker{}
+			r.Spec.Storage = tt.new
+			assertErrorPaths(t, r.validateStorageUpdate(old), tt.wantErrPath)
+		})
+	}
+}
+
+func TestDledgerBrokerValidateConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		nameserver  string
+		acl         *Acl
+		config      map[string]string
+		wantErrPath []string
+	}{
+		{name: "free keys", config: map[string]string{"flushDiskType": "SYNC_FLUSH", configs.NamesrvAddr: "ns:9876", configs.AclEnable: "true"}},
+		{
+			name:        "dledger keys managed",
+			config:      map[string]string{configs.DLegerPeers: "n0-x:40911", configs.BrokerName: "b"},
+			wantErrPath: []string{"spec.config[brokerName]", "spec.config[dLegerPeers]"},
+		},
+		{
+			name:        "namesrvAddr managed with nameserver reference",
+			nameserver:  "ns",
+			config:      map[string]string{configs.NamesrvAddr: "ns:9876"},
+			wantErrPath: []string{"spec.config[namesrvAddr]"},
+		},
+		{
+			name:        "aclEnable managed with acl",
+			acl:         &Acl{},
+			config:      map[string]string{configs.AclEnable: "false"},
+			wantErrPath: []string{"spec.config[aclEnable]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DledgerBroker{}
+			r.Spec.Nameserver = tt.nameserver
+			r.Spec.Acl = tt.acl
+			r.Spec.Config = tt.config
+			assertErrorPaths(t, r.validateConfig(field.NewPath("spec", "config")), tt.wantErrPath)
+		})
+	}
+}
+
+func TestValidateAcl(t *testing.T) {
+	ref := &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "acl"}, Key: "secretKey"}
+	tests := []struct {
+		name        string
+		accounts    []Account
+		wantErrPath []string
+	}{
+		{
+			name: "valid",
+			accounts: []Account{
+				{AccessKey: "rocketmq2", SecretKey: "12345678", Admin: true},
+				{AccessKey: "app-user", SecretKeyRef: ref, DefaultTopicPerm: "DENY", TopicPerms: []string{"orders=PUB|SUB"}, GroupPerms: []string{"g=SUB"}},
+			},
+		},
+		{
+			name:        "short access key",
+			accounts:    []Account{{AccessKey: "abc", SecretKey: "12345678"}},
+			wantErrPath: []string{"spec.acl.accounts[0].accessKey"},
+		},
+		{
+			name:        "duplicate access key",
+			accounts:    []Account{{AccessKey: "rocketmq2", SecretKey: "12345678"}, {AccessKey: "rocketmq2", SecretKey: "87654321"}},
+			wantErrPath: []string{"spec.acl.accounts[1].accessKey"},
+		},
+		{
+			name:        "secret key and ref",
+			accounts:    []Account{{AccessKey: "rocketmq2", SecretKey: "12345678", SecretKeyRef: ref}},
+			wantErrPath: []string{"spec.acl.accounts[0].secretKeyRef"},
+		},
+		{
+			name: "incomplete ref",
+			accounts: []Account{{AccessKey: "rocketmq2",
+				SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "acl"}}}},
+			wantErrPath: []string{"spec.acl.accounts[0].secretKeyRef.key"},
+		},
+		{
+			name:        "unknown default perm",
+			accounts:    []Account{{AccessKey: "rocketmq2", SecretKey: "12345678", DefaultTopicPerm: "ALL", DefaultGroupPerm: "SUB"}},
+			wantErrPath: []string{"spec.acl.accounts[0].defaultTopicPerm"},
+		},
+		{
+			name: "malformed resource perms",
+			accounts: []Account{{AccessKey: "rocketmq2", SecretKey: "12345678",
+				TopicPerms: []string{"orders", "=PUB", "orders=WRITE"}, GroupPerms: []string{"g=SUB|PUB"}}},
+			wantErrPath: []string{
+				"spec.acl.accounts[0].topicPerms[0]",
+				"spec.acl.accounts[0].topicPerms[1]",
+				"spec.acl.accounts[0].topicPerms[2]",
+				"spec.acl.accounts[0].groupPerms[0]",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := &Acl{Accounts: tt.accounts}
+			assertErrorPaths(t, validateAcl(acl, field.NewPath("spec", "acl")), tt.wantErrPath)
+		})
+	}
+}
+
+func TestDledgerBrokerWarnings(t *testing.T) {
+	r := &DledgerBroker{}
+	if w := r.warnings(); len(w) != 0 {
+		t.Errorf("warnings() without acl = %v", w)
+	}
+	r.Spec.Acl = &Acl{Accounts: []Account{
+		{AccessKey: "rocketmq2", SecretKeyRef: &corev1.SecretKeySelector{Key: "k"}},
+		{AccessKey: "rocketmq3", SecretKey: "12345678"},
+	}}
+	w := r.warnings()
+	if len(w) != 1 || !strings.Contains(w[0], "spec.acl.accounts[1].secretKey") {
+		t.Errorf("warnings() = %v, want one warning for accounts[1]", w)
+	}
+}
+
+func TestDledgerBrokerValidateDelete(t *testing.T) {
+	r := &DledgerBroker{}
+	if err := r.ValidateDelete(); err != nil {
+		t.Errorf("ValidateDelete() = %v", err)
+	}
+	r.Annotations = map[string]string{AnnotationDeletionProtection: "true"}
+	if err := r.ValidateDelete(); err == nil {
+		t.Error("ValidateDelete() with deletion protection = nil, want error")
+	}
+}
+
+// assertErrorPaths 校验错误按顺序出现在wantPaths指定的字段上
+func assertErrorPaths(t *testing.T, errs field.ErrorList, wantPaths []string) {
+	t.Helper()
+	got := make([]string, 0, len(errs))
+	for _, err := range errs {
+		got = append(got, err.Field)
+	}
+	if len(wantPaths) == 0 {
+		wantPaths = []string{}
+	}
+	if !reflect.DeepEqual(got, wantPaths) {
+		t.Errorf("errors on %v, want %v: %v", got, wantPaths, errs)
+	}
+}
+
+func TestCheckVolumeExpansion(t *testing.T) {
+	allow, deny := true, false
+	s := runtime.NewScheme()
+	_ = storagev1.AddToScheme(s)
+	c := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "expandable"}, AllowVolumeExpansion: &allow},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "fixed"}, AllowVolumeExpansion: &deny},
+	).Build()
+	defer func(old client.Client) { webhookClient = old }(webhookClient)
+	webhookClient = c
+
+	tests := []struct {
+		storageClass string
+		wantErr      bool
+	}{
+		{storageClass: "expandable"},
+		{storageClass: "fixed", wantErr: true},
+		{storageClass: "missing", wantErr: true},
+		{storageClass: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := checkVolumeExpansion(tt.storageClass); (err != nil) != tt.wantErr {
+			t.Errorf("checkVolumeExpansion(%q) = %v, wantErr %v", tt.storageClass, err, tt.wantErr)
+		}
+	}
+}
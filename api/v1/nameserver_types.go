@@ -33,15 +33,26 @@ type NameserverSpec struct {
 	Env                []corev1.EnvVar             `json:"env,omitempty"`
 	PodSpec            PodSpec                     `json:"podSpec,omitempty"`
 	Export             ExportSetting               `json:"export,omitempty"`
+	ExternalAccess     *ExternalAccess             `json:"externalAccess,omitempty"` // 集群外访问设置，修改nameserver service的类型
 }
 
 // NameserverStatus defines the observed state of Nameserver
 type NameserverStatus struct {
-	ConnectAddr string `json:"externalAddr,omitempty"`
+	ConnectAddr        string             `json:"externalAddr,omitempty"`
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"` // 最近一次完成调谐时实例的generation
+	Phase              Phase              `json:"phase,omitempty"`              // 实例状态概要
+	ReadyReplicas      int32              `json:"readyReplicas,omitempty"`      // 就绪的nameserver数量
+	ExternalAccess     string             `json:"externalAccess,omitempty"`     // 集群外访问的namesrvAddr
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`         // 实例状态，包括Ready、Progressing、Degraded
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Replicas",type=integer,JSONPath=`.spec.nameserverNumber`
+// +kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyReplicas`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Address",type=string,JSONPath=`.status.externalAddr`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Nameserver is the Schema for the nameservers API
 type Nameserver struct {
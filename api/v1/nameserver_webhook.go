@@ -17,36 +17,101 @@ limitations under the License.
 package v1
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"rocketmq-operator-v2/pkg/configs"
+	"rocketmq-operator-v2/pkg/logi"
 	ctrl "sigs.k8s.io/controller-runtime"
-	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 )
 
 // log is for logging in this package.
-var nameserverlog = logf.Log.WithName("nameserver-resource")
+var nameserverlog = logi.GetSugaredLogger().With(zap.String("Webhook", "Nameserver"))
+
+// webhookClient 供需要查询集群状态的校验使用，在SetupWebhookWithManager中设置
+var webhookClient client.Client
 
 func (r *Nameserver) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookClient = mgr.GetClient()
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
 		Complete()
 }
 
-// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
-
 // +kubebuilder:webhook:path=/mutate-rocketmq-daocloud-io-v1-nameserver,mutating=true,failurePolicy=fail,groups=rocketmq.daocloud.io,resources=nameservers,verbs=create;update,versions=v1,name=mnameserver.kb.io
 
 var _ webhook.Defaulter = &Nameserver{}
 
+const defaultNameserverNumber = 2
+
 // Default implements webhook.Defaulter so a webhook will be registered for the type
 func (r *Nameserver) Default() {
 	nameserverlog.Info("default", "name", r.Name)
+	cfg := configs.GetGlobalConfig()
+	specEnv := r.Spec.Env
+	defer func() {
+		r.Spec.Env = specEnv
+	}()
+
+	if r.Spec.NameserverNumber == 0 {
+		r.Spec.NameserverNumber = defaultNameserverNumber
+	}
+
+	if r.Spec.Image.Image == "" {
+		r.Spec.Image.Image = cfg.IMAGE_ROCKETMQ
+	}
+
+	if r.Spec.Resource.Size() == 0 {
+		r.Spec.Resource = defaultNameserverResource()
+	}
+
+	if r.Spec.Export.Open {
+		if r.Spec.Export.Image == "" {
+			r.Spec.Export.Image = cfg.IMAGE_EXPORTER
+		}
+		if r.Spec.Export.Resource == nil || r.Spec.Export.Resource.Size() == 0 {
+			r.Spec.Export.Resource = new(v1.ResourceRequirements)
+			*r.Spec.Export.Resource = defaultExportResource()
+		}
+	}
+
+	func() {
+		m := r.Spec.Resource.Requests.Memory().Value() / (1024 * 1024)
+		if m <= 0 {
+			return
+		}
+		specEnv = configs.SetEnvIfUnset(specEnv, configs.NS_JVM_XMX, strconv.FormatInt(m, 10)+"m")
+		specEnv = configs.SetEnvIfUnset(specEnv, configs.NS_JVM_XMS, strconv.FormatInt(m/4, 10)+"m")
+	}()
+
+	specEnv = configs.MergeEnv(specEnv, cfg.InstanceEnv)
+}
 
-	// TODO(user): fill in your defaulting logic.
+func defaultNameserverResource() v1.ResourceRequirements {
+	return v1.ResourceRequirements{
+		Requests: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("250m"),
+			v1.ResourceMemory: resource.MustParse("512Mi"),
+		},
+		Limits: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("500m"),
+			v1.ResourceMemory: resource.MustParse("1Gi"),
+		},
+	}
 }
 
-// TODO(user): change verbs to "verbs=create;update;delete" if you want to enable deletion validation.
-// +kubebuilder:webhook:verbs=create;update,path=/validate-rocketmq-daocloud-io-v1-nameserver,mutating=false,failurePolicy=fail,groups=rocketmq.daocloud.io,resources=nameservers,versions=v1,name=vnameserver.kb.io
+// +kubebuilder:webhook:verbs=create;update;delete,path=/validate-rocketmq-daocloud-io-v1-nameserver,mutating=false,failurePolicy=fail,groups=rocketmq.daocloud.io,resources=nameservers,versions=v1,name=vnameserver.kb.io
 
 var _ webhook.Validator = &Nameserver{}
 
@@ -54,22 +119,83 @@ var _ webhook.Validator = &Nameserver{}
 func (r *Nameserver) ValidateCreate() error {
 	nameserverlog.Info("validate create", "name", r.Name)
 
-	// TODO(user): fill in your validation logic upon object creation.
-	return nil
+	return r.toInvalidError(r.validateSpec())
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (r *Nameserver) ValidateUpdate(old runtime.Object) error {
 	nameserverlog.Info("validate update", "name", r.Name)
 
-	// TODO(user): fill in your validation logic upon object update.
-	return nil
+	if !r.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	return r.toInvalidError(r.validateSpec())
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
 func (r *Nameserver) ValidateDelete() error {
 	nameserverlog.Info("validate delete", "name", r.Name)
 
-	// TODO(user): fill in your validation logic upon object deletion.
+	if webhookClient == nil {
+		return nil
+	}
+	brokers := &DledgerBrokerList{}
+	if err := webhookClient.List(context.Background(), brokers); err != nil {
+		return apierrors.NewInternalError(err)
+	}
+	self := types.NamespacedName{Namespace: r.Namespace, Name: r.Name}
+	var refs []string
+	for k := range brokers.Items {
+		broker := &brokers.Items[k]
+		if broker.Spec.Nameserver != "" && broker.NameserverRef() == self {
+			refs = append(refs, broker.Namespace+"/"+broker.Name)
+		}
+	}
+	if len(refs) > 0 {
+		return apierrors.NewForbidden(GroupVersion.WithResource("nameservers").GroupResource(), r.Name,
+			fmt.Errorf("still referenced by dledgerbrokers: %s", strings.Join(refs, ", ")))
+	}
 	return nil
 }
+
+func (r *Nameserver) toInvalidError(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("Nameserver").GroupKind(), r.Name, allErrs)
+}
+
+func (r *Nameserver) validateSpec() field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+	if r.Spec.NameserverNumber <= 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("nameserverNumber"), r.Spec.NameserverNumber, "must be greater than 0"))
+	}
+	allErrs = append(allErrs, validateResourceRequirements(&r.Spec.Resource, specPath.Child("resource"))...)
+	allErrs = append(allErrs, validateExternalAccess(r.Spec.ExternalAccess, specPath.Child("externalAccess"), false)...)
+	if r.Spec.Export.Open && r.Spec.Export.Resource != nil {
+		allErrs = append(allErrs, validateResourceRequirements(r.Spec.Export.Resource, specPath.Child("export", "resource"))...)
+	}
+	return allErrs
+}
+
+// validateResourceRequirements 校验资源不能为负且request不能大于limit
+func validateResourceRequirements(req *v1.ResourceRequirements, resourcePath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for name, q := range req.Limits {
+		if q.Sign() < 0 {
+			allErrs = append(allErrs, field.Invalid(resourcePath.Child("limits").Key(string(name)), q.String(), "must not be negative"))
+		}
+	}
+	for name, q := range req.Requests {
+		p := resourcePath.Child("requests").Key(string(name))
+		if q.Sign() < 0 {
+			allErrs = append(allErrs, field.Invalid(p, q.String(), "must not be negative"))
+			continue
+		}
+		if limit, ok := req.Limits[name]; ok && q.Cmp(limit) > 0 {
+			allErrs = append(allErrs, field.Invalid(p, q.String(), fmt.Sprintf("must be less than or equal to %s limit", name)))
+		}
+	}
+	return allErrs
+}
@@ -0,0 +1,214 @@
+package v1
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"rocketmq-operator-v2/pkg/configs"
+)
+
+func TestNameserverDefault(t *testing.T) {
+	cfg := configs.GetGlobalConfig()
+	custom := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi")},
+	}
+	tests := []struct {
+		name         string
+		spec         NameserverSpec
+		wantNumber   int
+		wantImage    string
+		wantResource corev1.ResourceRequirements
+		wantXmx      string
+		wantXms      string
+	}{
+		{
+			name:         "empty spec",
+			wantNumber:   defaultNameserverNumber,
+			wantImage:    cfg.IMAGE_ROCKETMQ,
+			wantResource: defaultNameserverResource(),
+			wantXmx:      "512m",
+			wantXms:      "128m",
+		},
+		{
+			name: "keep user settings",
+			spec: NameserverSpec{
+				NameserverNumber: 3,
+				Image:            ImageSetting{Image: "rocketmq:4.9"},
+				Resource:         *custom.DeepCopy(),
+			},
+			wantNumber:   3,
+			wantImage:    "rocketmq:4.9",
+			wantResource: custom,
+			wantXmx:      "2048m",
+			wantXms:      "512m",
+		},
+		{
+			name: "keep user jvm env",
+			spec: NameserverSpec{
+				Env: []corev1.EnvVar{{Name: configs.NS_JVM_XMX, Value: "1g"}, {Name: configs.NS_JVM_XMS, Value: ""}},
+			},
+			wantNumber:   defaultNameserverNumber,
+			wantImage:    cfg.IMAGE_ROCKETMQ,
+			wantResource: defaultNameserverResource(),
+			wantXmx:      "1g",
+			wantXms:      configs.Empty,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Nameserver{Spec: tt.spec}
+			r.Default()
+			if r.Spec.NameserverNumber != tt.wantNumber {
+				t.Errorf("NameserverNumber = %d, want %d", r.Spec.NameserverNumber, tt.wantNumber)
+			}
+			if r.Spec.Image.Image != tt.wantImage {
+				t.Errorf("Image = %s, want %s", r.Spec.Image.Image, tt.wantImage)
+			}
+			if !reflect.DeepEqual(r.Spec.Resource, tt.wantResource) {
+				t.Errorf("Resource = %+v, want %+v", r.Spec.Resource, tt.wantResource)
+			}
+			if v, _ := configs.LookupEnv(r.Spec.Env, configs.NS_JVM_XMX); v != tt.wantXmx {
+				t.Errorf("%s = %s, want %s", configs.NS_JVM_XMX, v, tt.wantXmx)
+			}
+			if v, _ := configs.LookupEnv(r.Spec.Env, configs.NS_JVM_XMS); v != tt.wantXms {
+				t.Errorf("%s = %s, want %s", configs.NS_JVM_XMS, v, tt.wantXms)
+			}
+		})
+	}
+}
+
+func TestNameserverDefaultExport(t *testing.T) {
+	cfg := configs.GetGlobalConfig()
+	r := &Nameserver{}
+	r.Default()
+	if r.Spec.Export.Image != "" || r.Spec.Export.Resource != nil {
+		t.Errorf("closed export defaulted: %+v", r.Spec.Export)
+	}
+
+	r = &Nameserver{Spec: NameserverSpec{Export: ExportSetting{Open: true}}}
+	r.Default()
+	want := defaultExportResource()
+	if r.Spec.Export.Image != cfg.IMAGE_EXPORTER || r.Spec.Export.Resource == nil || !reflect.DeepEqual(*r.Spec.Export.Resource, want) {
+		t.Errorf("Export = %+v, want image %s and default resource", r.Spec.Export, cfg.IMAGE_EXPORTER)
+	}
+}
+
+func TestNameserverDefaultIdempotent(t *testing.T) {
+	r := &Nameserver{Spec: NameserverSpec{Export: ExportSetting{Open: true}}}
+	r.Default()
+	first := r.DeepCopy()
+	r.Default()
+	if !reflect.DeepEqual(first.Spec, r.Spec) {
+		t.Errorf("second Default changed spec:\n%+v\n%+v", first.Spec, r.Spec)
+	}
+}
+
+func TestNameserverValidateSpec(t *testing.T) {
+	negative := resource.MustParse("-1")
+	tests := []struct {
+		name        string
+		spec        NameserverSpec
+		wantErrPath []string
+	}{
+		{
+			name: "valid",
+			spec: NameserverSpec{NameserverNumber: 2, Resource: defaultNameserverResource(),
+				ExternalAccess: &ExternalAccess{Type: corev1.ServiceTypeLoadBalancer}},
+		},
+		{
+			name:        "no replicas",
+			spec:        NameserverSpec{},
+			wantErrPath: []string{"spec.nameserverNumber"},
+		},
+		{
+			name: "request greater than limit",
+			spec: NameserverSpec{NameserverNumber: 1, Resource: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi")},
+				Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+			}},
+			wantErrPath: []string{"spec.resource.requests[memory]"},
+		},
+		{
+			name: "negative limit",
+			spec: NameserverSpec{NameserverNumber: 1, Resource: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{corev1.ResourceCPU: negative},
+			}},
+			wantErrPath: []string{"spec.resource.limits[cpu]"},
+		},
+		{
+			name: "invalid export resource",
+			spec: NameserverSpec{NameserverNumber: 1, Export: ExportSetting{Open: true, Resource: &corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: negative},
+			}}},
+			wantErrPath: []string{"spec.export.resource.requests[cpu]"},
+		},
+		{
+			name: "hostname not supported",
+			spec: NameserverSpec{NameserverNumber: 1, ExternalAccess: &ExternalAccess{
+				Type: corev1.ServiceTypeNodePort, Hostname: "{{.Pod}}.example.com", ExternalDNS: true,
+			}},
+			wantErrPath: []string{"spec.externalAccess.hostname", "spec.externalAccess.externalDNS"},
+		},
+		{
+			name:        "cluster ip not supported",
+			spec:        NameserverSpec{NameserverNumber: 1, ExternalAccess: &ExternalAccess{Type: corev1.ServiceTypeClusterIP}},
+			wantErrPath: []string{"spec.externalAccess.type"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Nameserver{Spec: tt.spec}
+			assertErrorPaths(t, r.validateSpec(), tt.wantErrPath)
+		})
+	}
+}
+
+func TestNameserverValidateUpdateDuringDeletion(t *testing.T) {
+	now := metav1.Now()
+	r := &Nameserver{ObjectMeta: metav1.ObjectMeta{DeletionTimestamp: &now}}
+	if err := r.ValidateUpdate(&Nameserver{}); err != nil {
+		t.Errorf("ValidateUpdate() during deletion = %v", err)
+	}
+	r.DeletionTimestamp = nil
+	if err := r.ValidateUpdate(&Nameserver{}); err == nil {
+		t.Error("ValidateUpdate() with invalid spec = nil, want error")
+	}
+}
+
+func TestNameserverValidateDelete(t *testing.T) {
+	s := runtime.NewScheme()
+	_ = AddToScheme(s)
+	broker := func(namespace, name, nameserver string) *DledgerBroker {
+		return &DledgerBroker{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Spec:       DledgerBrokerSpec{Nameserver: nameserver},
+		}
+	}
+	tests := []struct {
+		name    string
+		brokers []client.Object
+		wantErr bool
+	}{
+		{name: "not referenced", brokers: []client.Object{broker("mq", "b0", ""), broker("mq", "b1", "other")}},
+		{name: "referenced in same namespace", brokers: []client.Object{broker("mq", "b0", "ns")}, wantErr: true},
+		{name: "referenced from other namespace", brokers: []client.Object{broker("app", "b0", "mq/ns")}, wantErr: true},
+		{name: "same name in other namespace", brokers: []client.Object{broker("app", "b0", "ns")}},
+	}
+	defer func(old client.Client) { webhookClient = old }(webhookClient)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhookClient = fake.NewClientBuilder().WithScheme(s).WithObjects(tt.brokers...).Build()
+			r := &Nameserver{ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "ns"}}
+			if err := r.ValidateDelete(); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateDelete() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
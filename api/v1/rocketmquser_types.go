@@ -0,0 +1,108 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// RocketMQUserSpec defines the desired state of RocketMQUser
+type RocketMQUserSpec struct {
+	// Cluster 账号所属的DledgerBroker名称，其他命名空间使用 namespace/name，集群需开启Spec.Acl
+	Cluster string `json:"cluster"`
+	// AccessKey 账号的accessKey，为空时使用 namespace-name，在集群内需唯一
+	AccessKey string `json:"accessKey,omitempty"`
+	// SecretName 存放accessKey和secretKey的secret名称，为空时使用 name-credentials。
+	// secret中没有secretKey时由operator生成随机值，删除secret中的secretKey即可轮转
+	SecretName string `json:"secretName,omitempty"`
+	// WhiteRemoteAddress 允许访问的客户端地址
+	WhiteRemoteAddress string `json:"whiteRemoteAddress,omitempty"`
+	// DefaultTopicPerm 未在TopicPerms中声明的topic的权限，默认DENY
+	// +kubebuilder:validation:Enum=DENY;PUB;SUB;PUB|SUB
+	// +kubebuilder:default=DENY
+	DefaultTopicPerm string `json:"defaultTopicPerm,omitempty"`
+	// DefaultGroupPerm 未在GroupPerms中声明的消费组的权限，默认DENY
+	// +kubebuilder:validation:Enum=DENY;PUB;SUB;PUB|SUB
+	// +kubebuilder:default=DENY
+	DefaultGroupPerm string `json:"defaultGroupPerm,omitempty"`
+	// TopicPerms topic权限，格式为 topic=PERM
+	TopicPerms []string `json:"topicPerms,omitempty"`
+	// GroupPerms 消费组权限，格式为 group=PERM
+	GroupPerms []string `json:"groupPerms,omitempty"`
+}
+
+// RocketMQUserStatus defines the observed state of RocketMQUser
+type RocketMQUserStatus struct {
+	// ObservedGeneration 最近一次完成调谐时实例的generation
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Phase              Phase              `json:"phase,omitempty"`      // 实例状态概要
+	AccessKey          string             `json:"accessKey,omitempty"`  // 写入plain_acl.yml的accessKey
+	SecretName         string             `json:"secretName,omitempty"` // 存放凭证的secret名称
+	Conditions         []metav1.Condition `json:"conditions,omitempty"` // 实例状态，包括Ready、Progressing、Degraded
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.cluster`
+// +kubebuilder:printcolumn:name="AccessKey",type=string,JSONPath=`.status.accessKey`
+// +kubebuilder:printcolumn:name="Secret",type=string,JSONPath=`.status.secretName`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// RocketMQUser is the Schema for the rocketmqusers API
+type RocketMQUser struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RocketMQUserSpec   `json:"spec,omitempty"`
+	Status RocketMQUserStatus `json:"status,omitempty"`
+}
+
+// AccessKey 返回账号的accessKey，Spec.AccessKey为空时使用 namespace-name
+func (u *RocketMQUser) AccessKey() string {
+	if u.Spec.AccessKey != "" {
+		return u.Spec.AccessKey
+	}
+	return u.Namespace + "-" + u.Name
+}
+
+// SecretName 返回存放凭证的secret名称，Spec.SecretName为空时使用 name-credentials
+func (u *RocketMQUser) SecretName() string {
+	if u.Spec.SecretName != "" {
+		return u.Spec.SecretName
+	}
+	return u.Name + "-credentials"
+}
+
+// ClusterRef 解析Spec.Cluster，未指定命名空间时使用实例所在命名空间
+func (u *RocketMQUser) ClusterRef() types.NamespacedName {
+	return namespacedRef(u.Namespace, u.Spec.Cluster)
+}
+
+// +kubebuilder:object:root=true
+
+// RocketMQUserList contains a list of RocketMQUser
+type RocketMQUserList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []RocketMQUser `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&RocketMQUser{}, &RocketMQUserList{})
+}
@@ -0,0 +1,114 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"rocketmq-operator-v2/pkg/logi"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var rocketmquserlog = logi.GetSugaredLogger().With(zap.String("Webhook", "RocketMQUser"))
+
+func (r *RocketMQUser) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookClient = mgr.GetClient()
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-rocketmq-daocloud-io-v1-rocketmquser,mutating=false,failurePolicy=fail,groups=rocketmq.daocloud.io,resources=rocketmqusers,versions=v1,name=vrocketmquser.kb.io
+
+var _ webhook.Validator = &RocketMQUser{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *RocketMQUser) ValidateCreate() error {
+	rocketmquserlog.Info("validate create", "name", r.Name)
+
+	return r.toInvalidError(append(r.validateSpec(), r.validateCluster()...))
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *RocketMQUser) ValidateUpdate(old runtime.Object) error {
+	rocketmquserlog.Info("validate update", "name", r.Name)
+
+	if !r.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	return r.toInvalidError(append(r.validateSpec(), r.validateCluster()...))
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *RocketMQUser) ValidateDelete() error {
+	return nil
+}
+
+func (r *RocketMQUser) toInvalidError(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("RocketMQUser").GroupKind(), r.Name, allErrs)
+}
+
+// validateSpec 校验账号能被broker加载，broker要求accessKey长度大于6
+func (r *RocketMQUser) validateSpec() field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+	if r.Spec.Cluster == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("cluster"), ""))
+	}
+	if len(r.AccessKey()) <= 6 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("accessKey"), r.AccessKey(), "must be longer than 6 characters"))
+	}
+	if r.Spec.DefaultTopicPerm != "" && !aclPerms[r.Spec.DefaultTopicPerm] {
+		allErrs = append(allErrs, field.NotSupported(specPath.Child("defaultTopicPerm"), r.Spec.DefaultTopicPerm, aclPermList()))
+	}
+	if r.Spec.DefaultGroupPerm != "" && !aclPerms[r.Spec.DefaultGroupPerm] {
+		allErrs = append(allErrs, field.NotSupported(specPath.Child("defaultGroupPerm"), r.Spec.DefaultGroupPerm, aclPermList()))
+	}
+	allErrs = append(allErrs, validateResourcePerms(r.Spec.TopicPerms, specPath.Child("topicPerms"))...)
+	allErrs = append(allErrs, validateResourcePerms(r.Spec.GroupPerms, specPath.Child("groupPerms"))...)
+	return allErrs
+}
+
+// validateCluster 拒绝引用不允许本命名空间的集群，集群不存在或未设置client时跳过，由控制器在集群创建后检查
+func (r *RocketMQUser) validateCluster() field.ErrorList {
+	if webhookClient == nil || r.Spec.Cluster == "" {
+		return nil
+	}
+	clusterPath := field.NewPath("spec").Child("cluster")
+	cluster := &DledgerBroker{}
+	if err := webhookClient.Get(context.Background(), r.ClusterRef(), cluster); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return field.ErrorList{field.InternalError(clusterPath, err)}
+	}
+	if !cluster.AllowsNamespace(r.Namespace) {
+		return field.ErrorList{field.Forbidden(clusterPath,
+			fmt.Sprintf("namespace %s is not in allowedNamespaces of cluster %s/%s", r.Namespace, cluster.Namespace, cluster.Name))}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package v1
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRocketMQUserValidateSpec(t *testing.T) {
+	tests := []struct {
+		name      string
+		meta      metav1.ObjectMeta
+		spec      RocketMQUserSpec
+		wantField []string
+	}{
+		{
+			name: "valid",
+			meta: metav1.ObjectMeta{Namespace: "app", Name: "orders"},
+			spec: RocketMQUserSpec{
+				Cluster:          "mq/broker",
+				DefaultTopicPerm: "DENY",
+				TopicPerms:       []string{"orders=PUB|SUB"},
+				GroupPerms:       []string{"orders-consumer=SUB"},
+			},
+		},
+		{
+			name:      "missing cluster",
+			meta:      metav1.ObjectMeta{Namespace: "app", Name: "orders"},
+			wantField: []string{"spec.cluster"},
+		},
+		{
+			name:      "defaulted access key too short",
+			meta:      metav1.ObjectMeta{Namespace: "a", Name: "b"},
+			spec:      RocketMQUserSpec{Cluster: "broker"},
+			wantField: []string{"spec.accessKey"},
+		},
+		{
+			name: "invalid perms",
+			meta: metav1.ObjectMeta{Namespace: "app", Name: "orders"},
+			spec: RocketMQUserSpec{
+				Cluster:          "broker",
+				AccessKey:        "orders-key",
+				DefaultGroupPerm: "ALL",
+				TopicPerms:       []string{"orders"},
+				GroupPerms:       []string{"g=WRITE"},
+			},
+			wantField: []string{"spec.defaultGroupPerm", "spec.topicPerms[0]", "spec.groupPerms[0]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &RocketMQUser{ObjectMeta: tt.meta, Spec: tt.spec}
+			errs := u.validateSpec()
+			if len(errs) != len(tt.wantField) {
+				t.Fatalf("validateSpec() = %v, want errors on %v", errs, tt.wantField)
+			}
+			for i, err := range errs {
+				if err.Field != tt.wantField[i] {
+					t.Errorf("error %d field = %s, want %s", i, err.Field, tt.wantField[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRocketMQUserValidateCluster(t *testing.T) {
+	s := runtime.NewScheme()
+	_ = AddToScheme(s)
+	broker := &DledgerBroker{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "broker"},
+		Spec:       DledgerBrokerSpec{AllowedNamespaces: []string{"app"}},
+	}
+	open := &DledgerBroker{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "open"},
+		Spec:       DledgerBrokerSpec{AllowedNamespaces: []string{"*"}},
+	}
+	tests := []struct {
+		name      string
+		namespace string
+		cluster   string
+		wantErr   bool
+	}{
+		{name: "same namespace", namespace: "mq", cluster: "broker"},
+		{name: "allowed namespace", namespace: "app", cluster: "mq/broker"},
+		{name: "namespace not allowed", namespace: "other", cluster: "mq/broker", wantErr: true},
+		{name: "all namespaces allowed", namespace: "other", cluster: "mq/open"},
+		{name: "cluster not found", namespace: "other", cluster: "mq/missing"},
+	}
+	defer func(old client.Client) { webhookClient = old }(webhookClient)
+	webhookClient = fake.NewClientBuilder().WithScheme(s).WithObjects(broker, open).Build()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &RocketMQUser{
+				ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Name: "orders"},
+				Spec:       RocketMQUserSpec{Cluster: tt.cluster, AccessKey: "orders-key"},
+			}
+			errs := u.validateCluster()
+			if (len(errs) > 0) != tt.wantErr {
+				t.Fatalf("validateCluster() = %v, wantErr %v", errs, tt.wantErr)
+			}
+			if err := u.ValidateCreate(); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateCreate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
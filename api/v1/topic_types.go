@@ -0,0 +1,149 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TopicSpec defines the desired state of Topic
+type TopicSpec struct {
+	// Cluster topic所在的DledgerBroker名称，其他命名空间使用 namespace/name
+	Cluster string `json:"cluster"`
+	// TopicName topic名称，为空时使用metadata.name
+	TopicName string `json:"topicName,omitempty"`
+	// ReadQueueNums 每个broker组的读队列数
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=8
+	ReadQueueNums int `json:"readQueueNums,omitempty"`
+	// WriteQueueNums 每个broker组的写队列数
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=8
+	WriteQueueNums int `json:"writeQueueNums,omitempty"`
+	// Perm topic权限，2为只写、4为只读、6为读写
+	// +kubebuilder:validation:Enum=2;4;6
+	// +kubebuilder:default=6
+	Perm int `json:"perm,omitempty"`
+	// MessageType 消息类型，写入topic的message.type属性，只有5.x的broker支持
+	MessageType TopicMessageType `json:"messageType,omitempty"`
+	// Order 是否为顺序topic，开启后在nameserver中记录各broker组的分区配置
+	Order bool `json:"order,omitempty"`
+	// BrokerGroups 放置topic的broker组序号，为空时放置到所有broker组
+	BrokerGroups []int `json:"brokerGroups,omitempty"`
+	// DeletePolicy 删除Topic或从BrokerGroups中移除broker组时对topic的处理方式，默认Retain
+	DeletePolicy DeletePolicy `json:"deletePolicy,omitempty"`
+}
+
+// TopicMessageType topic的消息类型，对应rocketmq 5.x的TopicMessageType
+// +kubebuilder:validation:Enum=NORMAL;FIFO;DELAY;TRANSACTION
+type TopicMessageType string
+
+const (
+	TopicMessageTypeNormal      TopicMessageType = "NORMAL"
+	TopicMessageTypeFIFO        TopicMessageType = "FIFO"
+	TopicMessageTypeDelay       TopicMessageType = "DELAY"
+	TopicMessageTypeTransaction TopicMessageType = "TRANSACTION"
+)
+
+// DeletePolicy 删除CR时对broker和nameserver上资源的处理方式，供Topic等资源共用
+// +kubebuilder:validation:Enum=Retain;Delete
+type DeletePolicy string
+
+const (
+	// DeletePolicyRetain 保留broker和nameserver上的资源
+	DeletePolicyRetain DeletePolicy = "Retain"
+	// DeletePolicyDelete 从broker和nameserver上删除资源
+	DeletePolicyDelete DeletePolicy = "Delete"
+)
+
+// TopicStatus defines the observed state of Topic
+type TopicStatus struct {
+	// ObservedGeneration 最近一次完成调谐时实例的generation
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Phase              Phase              `json:"phase,omitempty"`        // 实例状态概要
+	TopicName          string             `json:"topicName,omitempty"`    // 实际创建的topic名称
+	BrokerGroups       []TopicGroupStatus `json:"brokerGroups,omitempty"` // 各broker组上topic的状态
+	OrderConf          string             `json:"orderConf,omitempty"`    // 写入nameserver的顺序topic分区配置
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`   // 实例状态，包括Ready、Progressing、Degraded
+}
+
+// TopicGroupStatus 一个broker组上topic的状态
+type TopicGroupStatus struct {
+	BrokerName     string    `json:"brokerName"`
+	State          SyncState `json:"state"`
+	ReadQueueNums  int       `json:"readQueueNums,omitempty"`  // broker上实际的读队列数
+	WriteQueueNums int       `json:"writeQueueNums,omitempty"` // broker上实际的写队列数
+	Perm           int       `json:"perm,omitempty"`           // broker上实际的权限
+	Message        string    `json:"message,omitempty"`
+}
+
+// SyncState broker组上配置的同步状态，供Topic等资源共用
+type SyncState string
+
+const (
+	// SyncStateSynced broker上的配置与Spec一致
+	SyncStateSynced SyncState = "Synced"
+	// SyncStatePending broker组没有可用的master，等待其注册到nameserver
+	SyncStatePending SyncState = "Pending"
+	// SyncStateFailed 创建或更新配置失败
+	SyncStateFailed SyncState = "Failed"
+)
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.cluster`
+// +kubebuilder:printcolumn:name="Topic",type=string,JSONPath=`.status.topicName`
+// +kubebuilder:printcolumn:name="Read",type=integer,JSONPath=`.spec.readQueueNums`,priority=1
+// +kubebuilder:printcolumn:name="Write",type=integer,JSONPath=`.spec.writeQueueNums`,priority=1
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// Topic is the Schema for the topics API
+type Topic struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TopicSpec   `json:"spec,omitempty"`
+	Status TopicStatus `json:"status,omitempty"`
+}
+
+// TopicName 返回topic名称，Spec.TopicName为空时使用metadata.name
+func (t *Topic) TopicName() string {
+	if t.Spec.TopicName != "" {
+		return t.Spec.TopicName
+	}
+	return t.Name
+}
+
+// ClusterRef 解析Spec.Cluster，未指定命名空间时使用实例所在命名空间
+func (t *Topic) ClusterRef() types.NamespacedName {
+	return namespacedRef(t.Namespace, t.Spec.Cluster)
+}
+
+// +kubebuilder:object:root=true
+
+// TopicList contains a list of Topic
+type TopicList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Topic `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Topic{}, &TopicList{})
+}
@@ -0,0 +1,39 @@
+package v1
+
+import (
+	"context"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// warningHandler 包装controller-runtime默认的校验handler，在允许的create/update请求上附加warning
+type warningHandler struct {
+	admission.Handler
+	warnings func(obj runtime.Object) []string
+	newObj   func() runtime.Object
+	decoder  *admission.Decoder
+}
+
+var _ admission.DecoderInjector = &warningHandler{}
+
+// InjectDecoder injects the decoder into the handler and the wrapped handler.
+func (h *warningHandler) InjectDecoder(d *admission.Decoder) error {
+	h.decoder = d
+	_, err := admission.InjectDecoderInto(d, h.Handler)
+	return err
+}
+
+// Handle handles admission requests.
+func (h *warningHandler) Handle(ctx context.Context, req admission.Request) admission.Response {
+	resp := h.Handler.Handle(ctx, req)
+	if !resp.Allowed || (req.Operation != admissionv1.Create && req.Operation != admissionv1.Update) {
+		return resp
+	}
+	obj := h.newObj()
+	if err := h.decoder.DecodeRaw(req.Object, obj); err != nil {
+		return resp
+	}
+	return resp.WithWarnings(h.warnings(obj)...)
+}
@@ -1,4 +1,4 @@
-// +build !ignore_autogenerated
+//go:build !ignore_autogenerated
 
 /*
 
@@ -21,16 +21,260 @@ limitations under the License.
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Account) DeepCopyInto(out *Account) {
+	*out = *in
+	if in.AccessKeyRef != nil {
+		in, out := &in.AccessKeyRef, &out.AccessKeyRef
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecretKeyRef != nil {
+		in, out := &in.SecretKeyRef, &out.SecretKeyRef
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TopicPerms != nil {
+		in, out := &in.TopicPerms, &out.TopicPerms
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.GroupPerms != nil {
+		in, out := &in.GroupPerms, &out.GroupPerms
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Account.
+func (in *Account) DeepCopy() *Account {
+	if in == nil {
+		return nil
+	}
+	out := new(Account)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Acl) DeepCopyInto(out *Acl) {
+	*out = *in
+	if in.GlobalWhiteRemoteAddresses != nil {
+		in, out := &in.GlobalWhiteRemoteAddresses, &out.GlobalWhiteRemoteAddresses
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Accounts != nil {
+		in, out := &in.Accounts, &out.Accounts
+		*out = make([]Account, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Acl.
+func (in *Acl) DeepCopy() *Acl {
+	if in == nil {
+		return nil
+	}
+	out := new(Acl)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BrokerMember) DeepCopyInto(out *BrokerMember) {
+	*out = *in
+	if in.BrokerId != nil {
+		in, out := &in.BrokerId, &out.BrokerId
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BrokerMember.
+func (in *BrokerMember) DeepCopy() *BrokerMember {
+	if in == nil {
+		return nil
+	}
+	out := new(BrokerMember)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConsumerGroup) DeepCopyInto(out *ConsumerGroup) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConsumerGroup.
+func (in *ConsumerGroup) DeepCopy() *ConsumerGroup {
+	if in == nil {
+		return nil
+	}
+	out := new(ConsumerGroup)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ConsumerGroup) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConsumerGroupBrokerState) DeepCopyInto(out *ConsumerGroupBrokerState) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConsumerGroupBrokerState.
+func (in *ConsumerGroupBrokerState) DeepCopy() *ConsumerGroupBrokerState {
+	if in == nil {
+		return nil
+	}
+	out := new(ConsumerGroupBrokerState)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConsumerGroupList) DeepCopyInto(out *ConsumerGroupList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ConsumerGroup, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConsumerGroupList.
+func (in *ConsumerGroupList) DeepCopy() *ConsumerGroupList {
+	if in == nil {
+		return nil
+	}
+	out := new(ConsumerGroupList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ConsumerGroupList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConsumerGroupSpec) DeepCopyInto(out *ConsumerGroupSpec) {
+	*out = *in
+	if in.ConsumeEnable != nil {
+		in, out := &in.ConsumeEnable, &out.ConsumeEnable
+		*out = new(bool)
+		**out = **in
+	}
+	if in.RetryMaxTimes != nil {
+		in, out := &in.RetryMaxTimes, &out.RetryMaxTimes
+		*out = new(int)
+		**out = **in
+	}
+	if in.WhichBrokerWhenConsumeSlowly != nil {
+		in, out := &in.WhichBrokerWhenConsumeSlowly, &out.WhichBrokerWhenConsumeSlowly
+		*out = new(int64)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConsumerGroupSpec.
+func (in *ConsumerGroupSpec) DeepCopy() *ConsumerGroupSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ConsumerGroupSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConsumerGroupStatus) DeepCopyInto(out *ConsumerGroupStatus) {
+	*out = *in
+	if in.BrokerGroups != nil {
+		in, out := &in.BrokerGroups, &out.BrokerGroups
+		*out = make([]ConsumerGroupBrokerState, len(*in))
+		copy(*out, *in)
+	}
+	if in.TopicLags != nil {
+		in, out := &in.TopicLags, &out.TopicLags
+		*out = make([]TopicLag, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastSyncTime != nil {
+		in, out := &in.LastSyncTime, &out.LastSyncTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConsumerGroupStatus.
+func (in *ConsumerGroupStatus) DeepCopy() *ConsumerGroupStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ConsumerGroupStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Dledger) DeepCopyInto(out *Dledger) {
+	*out = *in
+	if in.BrokerNumberPerGroup != nil {
+		in, out := &in.BrokerNumberPerGroup, &out.BrokerNumberPerGroup
+		*out = make([]int, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Dledger.
+func (in *Dledger) DeepCopy() *Dledger {
+	if in == nil {
+		return nil
+	}
+	out := new(Dledger)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DledgerBroker) DeepCopyInto(out *DledgerBroker) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DledgerBroker.
@@ -86,6 +330,57 @@ func (in *DledgerBrokerList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DledgerBrokerSpec) DeepCopyInto(out *DledgerBrokerSpec) {
 	*out = *in
+	in.Dledger.DeepCopyInto(&out.Dledger)
+	if in.Resource != nil {
+		in, out := &in.Resource, &out.Resource
+		*out = new(corev1.ResourceRequirements)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Storage != nil {
+		in, out := &in.Storage, &out.Storage
+		*out = new(DledgerStorage)
+		**out = **in
+	}
+	if in.Export != nil {
+		in, out := &in.Export, &out.Export
+		*out = new(ExportSetting)
+		(*in).DeepCopyInto(*out)
+	}
+	in.ImageSetting.DeepCopyInto(&out.ImageSetting)
+	if in.PodSpec != nil {
+		in, out := &in.PodSpec, &out.PodSpec
+		*out = new(PodSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Env != nil {
+		in, out := &in.Env, &out.Env
+		*out = make([]corev1.EnvVar, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Config != nil {
+		in, out := &in.Config, &out.Config
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Acl != nil {
+		in, out := &in.Acl, &out.Acl
+		*out = new(Acl)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ExternalAccess != nil {
+		in, out := &in.ExternalAccess, &out.ExternalAccess
+		*out = new(ExternalAccess)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AllowedNamespaces != nil {
+		in, out := &in.AllowedNamespaces, &out.AllowedNamespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DledgerBrokerSpec.
@@ -101,6 +396,57 @@ func (in *DledgerBrokerSpec) DeepCopy() *DledgerBrokerSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DledgerBrokerStatus) DeepCopyInto(out *DledgerBrokerStatus) {
 	*out = *in
+	if in.NameserverAddr != nil {
+		in, out := &in.NameserverAddr, &out.NameserverAddr
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.BrokerInfo != nil {
+		in, out := &in.BrokerInfo, &out.BrokerInfo
+		*out = make(map[string][]string, len(*in))
+		for key, val := range *in {
+			var outVal []string
+			if val == nil {
+				(*out)[key] = nil
+			} else {
+				inVal := (*in)[key]
+				in, out := &inVal, &outVal
+				*out = make([]string, len(*in))
+				copy(*out, *in)
+			}
+			(*out)[key] = outVal
+		}
+	}
+	if in.BrokerMembers != nil {
+		in, out := &in.BrokerMembers, &out.BrokerMembers
+		*out = make(map[string][]BrokerMember, len(*in))
+		for key, val := range *in {
+			var outVal []BrokerMember
+			if val == nil {
+				(*out)[key] = nil
+			} else {
+				inVal := (*in)[key]
+				in, out := &inVal, &outVal
+				*out = make([]BrokerMember, len(*in))
+				for i := range *in {
+					(*in)[i].DeepCopyInto(&(*out)[i])
+				}
+			}
+			(*out)[key] = outVal
+		}
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.VolumeResize != nil {
+		in, out := &in.VolumeResize, &out.VolumeResize
+		*out = make([]VolumeResizeStatus, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DledgerBrokerStatus.
@@ -113,13 +459,91 @@ func (in *DledgerBrokerStatus) DeepCopy() *DledgerBrokerStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DledgerStorage) DeepCopyInto(out *DledgerStorage) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DledgerStorage.
+func (in *DledgerStorage) DeepCopy() *DledgerStorage {
+	if in == nil {
+		return nil
+	}
+	out := new(DledgerStorage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExportSetting) DeepCopyInto(out *ExportSetting) {
+	*out = *in
+	if in.Resource != nil {
+		in, out := &in.Resource, &out.Resource
+		*out = new(corev1.ResourceRequirements)
+		(*in).DeepCopyInto(*out)
+	}
+	in.ImageSetting.DeepCopyInto(&out.ImageSetting)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExportSetting.
+func (in *ExportSetting) DeepCopy() *ExportSetting {
+	if in == nil {
+		return nil
+	}
+	out := new(ExportSetting)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalAccess) DeepCopyInto(out *ExternalAccess) {
+	*out = *in
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalAccess.
+func (in *ExternalAccess) DeepCopy() *ExternalAccess {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalAccess)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageSetting) DeepCopyInto(out *ImageSetting) {
+	*out = *in
+	if in.ImagePullSecret != nil {
+		in, out := &in.ImagePullSecret, &out.ImagePullSecret
+		*out = make([]corev1.LocalObjectReference, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageSetting.
+func (in *ImageSetting) DeepCopy() *ImageSetting {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageSetting)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Nameserver) DeepCopyInto(out *Nameserver) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Nameserver.
@@ -175,6 +599,22 @@ func (in *NameserverList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NameserverSpec) DeepCopyInto(out *NameserverSpec) {
 	*out = *in
+	in.Resource.DeepCopyInto(&out.Resource)
+	in.Image.DeepCopyInto(&out.Image)
+	if in.Env != nil {
+		in, out := &in.Env, &out.Env
+		*out = make([]corev1.EnvVar, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	in.PodSpec.DeepCopyInto(&out.PodSpec)
+	in.Export.DeepCopyInto(&out.Export)
+	if in.ExternalAccess != nil {
+		in, out := &in.ExternalAccess, &out.ExternalAccess
+		*out = new(ExternalAccess)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NameserverSpec.
@@ -190,6 +630,13 @@ func (in *NameserverSpec) DeepCopy() *NameserverSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NameserverStatus) DeepCopyInto(out *NameserverStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NameserverStatus.
@@ -201,3 +648,306 @@ func (in *NameserverStatus) DeepCopy() *NameserverStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodSpec) DeepCopyInto(out *PodSpec) {
+	*out = *in
+	if in.HostAliases != nil {
+		in, out := &in.HostAliases, &out.HostAliases
+		*out = make([]corev1.HostAlias, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.SecurityContext != nil {
+		in, out := &in.SecurityContext, &out.SecurityContext
+		*out = new(corev1.PodSecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Affinity != nil {
+		in, out := &in.Affinity, &out.Affinity
+		*out = new(corev1.Affinity)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Tolerations != nil {
+		in, out := &in.Tolerations, &out.Tolerations
+		*out = make([]corev1.Toleration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodSpec.
+func (in *PodSpec) DeepCopy() *PodSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PodSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RocketMQUser) DeepCopyInto(out *RocketMQUser) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RocketMQUser.
+func (in *RocketMQUser) DeepCopy() *RocketMQUser {
+	if in == nil {
+		return nil
+	}
+	out := new(RocketMQUser)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *RocketMQUser) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RocketMQUserList) DeepCopyInto(out *RocketMQUserList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]RocketMQUser, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RocketMQUserList.
+func (in *RocketMQUserList) DeepCopy() *RocketMQUserList {
+	if in == nil {
+		return nil
+	}
+	out := new(RocketMQUserList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *RocketMQUserList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RocketMQUserSpec) DeepCopyInto(out *RocketMQUserSpec) {
+	*out = *in
+	if in.TopicPerms != nil {
+		in, out := &in.TopicPerms, &out.TopicPerms
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.GroupPerms != nil {
+		in, out := &in.GroupPerms, &out.GroupPerms
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RocketMQUserSpec.
+func (in *RocketMQUserSpec) DeepCopy() *RocketMQUserSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(RocketMQUserSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RocketMQUserStatus) DeepCopyInto(out *RocketMQUserStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RocketMQUserStatus.
+func (in *RocketMQUserStatus) DeepCopy() *RocketMQUserStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RocketMQUserStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Topic) DeepCopyInto(out *Topic) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Topic.
+func (in *Topic) DeepCopy() *Topic {
+	if in == nil {
+		return nil
+	}
+	out := new(Topic)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *Topic) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TopicGroupStatus) DeepCopyInto(out *TopicGroupStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TopicGroupStatus.
+func (in *TopicGroupStatus) DeepCopy() *TopicGroupStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(TopicGroupStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TopicLag) DeepCopyInto(out *TopicLag) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TopicLag.
+func (in *TopicLag) DeepCopy() *TopicLag {
+	if in == nil {
+		return nil
+	}
+	out := new(TopicLag)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TopicList) DeepCopyInto(out *TopicList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]Topic, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TopicList.
+func (in *TopicList) DeepCopy() *TopicList {
+	if in == nil {
+		return nil
+	}
+	out := new(TopicList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *TopicList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TopicSpec) DeepCopyInto(out *TopicSpec) {
+	*out = *in
+	if in.BrokerGroups != nil {
+		in, out := &in.BrokerGroups, &out.BrokerGroups
+		*out = make([]int, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TopicSpec.
+func (in *TopicSpec) DeepCopy() *TopicSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(TopicSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TopicStatus) DeepCopyInto(out *TopicStatus) {
+	*out = *in
+	if in.BrokerGroups != nil {
+		in, out := &in.BrokerGroups, &out.BrokerGroups
+		*out = make([]TopicGroupStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TopicStatus.
+func (in *TopicStatus) DeepCopy() *TopicStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(TopicStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VolumeResizeStatus) DeepCopyInto(out *VolumeResizeStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VolumeResizeStatus.
+func (in *VolumeResizeStatus) DeepCopy() *VolumeResizeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VolumeResizeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,377 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/admin"
+)
+
+var consumerGroupFinalizerName = "consumergroup.finalizers.rocketmq.daocloud.io"
+
+// ConsumerGroupReconciler reconciles a ConsumerGroup object
+type ConsumerGroupReconciler struct {
+	client.Client
+	Log    *zap.SugaredLogger
+	Scheme *runtime.Scheme
+	Admin  admin.Admin
+	// SyncInterval 刷新消费进度和在线客户端的间隔，同时修复broker上配置的偏差，为0时不定期刷新
+	SyncInterval time.Duration
+}
+
+// +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=consumergroups,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=consumergroups/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=dledgerbrokers,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+
+func (r *ConsumerGroupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	reqLog := log.With(
+		zap.String("Request.Namespace", req.Namespace),
+		zap.String("Request.Name", req.Name),
+	)
+	reqLog.Info("Reconcile ConsumerGroup")
+	r.Log = reqLog
+	instance := &rocketmqv1.ConsumerGroup{}
+	if err := r.Client.Get(ctx, req.NamespacedName, instance); err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	if !instance.ObjectMeta.DeletionTimestamp.IsZero() {
+		if containsString(instance.GetFinalizers(), consumerGroupFinalizerName) {
+			if instance.Status.Phase != rocketmqv1.PhaseTerminating {
+				instance.Status.Phase = rocketmqv1.PhaseTerminating
+				if err := r.Status().Update(ctx, instance); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+			if instance.Spec.DeletePolicy == rocketmqv1.DeletePolicyDelete {
+				if err := r.deleteSubscriptionGroup(ctx, instance); err != nil {
+					r.Log.Warnw("delete subscription group failed", "group", instance.Status.GroupName, "error", err)
+					return ctrl.Result{}, err
+				}
+			}
+			controllerutil.RemoveFinalizer(instance, consumerGroupFinalizerName)
+			if err := r.Update(ctx, instance); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+	if !containsString(instance.GetFinalizers(), consumerGroupFinalizerName) {
+		controllerutil.AddFinalizer(instance, consumerGroupFinalizerName)
+		if err := r.Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	oldStatus := instance.Status.DeepCopy()
+	cluster := &rocketmqv1.DledgerBroker{}
+	if err := r.Get(ctx, instance.ClusterRef(), cluster); err != nil {
+		if !errors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		// DledgerBroker创建后会通过watch重新触发
+		return ctrl.Result{}, r.setConsumerGroupHealth(ctx, instance, oldStatus,
+			[]string{fmt.Sprintf("cluster %s not found", instance.ClusterRef())}, nil)
+	}
+	if msg := clusterNotAllowed(cluster, instance.Namespace); msg != "" {
+		// 集群修改allowedNamespaces后会通过watch重新触发
+		return ctrl.Result{}, r.setConsumerGroupHealth(ctx, instance, oldStatus, []string{msg}, []string{msg})
+	}
+	ctx, err := clusterAdminContext(ctx, r.Client, cluster)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	namesrvAddr := brokerNamesrvAddr(cluster)
+	if namesrvAddr == "" {
+		return ctrl.Result{}, r.setConsumerGroupHealth(ctx, instance, oldStatus,
+			[]string{fmt.Sprintf("waiting for namesrvAddr of cluster %s", instance.ClusterRef())}, nil)
+	}
+	info, err := clusterInfo(ctx, r.Admin, namesrvAddr)
+	if err != nil {
+		r.Log.Warnw("get cluster info from nameserver failed", "namesrvAddr", namesrvAddr, "error", err)
+		return ctrl.Result{RequeueAfter: topicRetryInterval}, r.setConsumerGroupHealth(ctx, instance, oldStatus,
+			[]string{fmt.Sprintf("get cluster info from nameserver: %v", err)}, nil)
+	}
+
+	if renamed := instance.Status.GroupName != "" && instance.Status.GroupName != instance.GroupName(); renamed &&
+		instance.Spec.DeletePolicy == rocketmqv1.DeletePolicyDelete {
+		for i := 0; i < cluster.Spec.BrokerGroupNumber; i++ {
+			if err := r.deleteSubscriptionGroupInBroker(ctx, cluster, i, info, instance.Status.GroupName); err != nil {
+				r.Log.Warnw("delete renamed subscription group failed", "group", instance.Status.GroupName,
+					"brokerName", brokerGroupName(cluster, i), "error", err)
+			}
+		}
+	}
+
+	var notReady, degraded []string
+	masters := make([]string, 0, cluster.Spec.BrokerGroupNumber)
+	states := make([]rocketmqv1.ConsumerGroupBrokerState, 0, cluster.Spec.BrokerGroupNumber)
+	for i := 0; i < cluster.Spec.BrokerGroupNumber; i++ {
+		state, addr := r.syncSubscriptionGroup(ctx, instance, cluster, i, info)
+		states = append(states, state)
+		if addr != "" {
+			masters = append(masters, addr)
+		}
+		if state.State != rocketmqv1.SyncStateSynced {
+			notReady = append(notReady, fmt.Sprintf("%s: %s", state.BrokerName, state.Message))
+		}
+		if state.State == rocketmqv1.SyncStateFailed {
+			degraded = append(degraded, fmt.Sprintf("%s: %s", state.BrokerName, state.Message))
+		}
+	}
+	instance.Status.GroupName = instance.GroupName()
+	instance.Status.BrokerGroups = states
+	r.syncConsumeStatus(ctx, instance, masters)
+
+	if err := r.setConsumerGroupHealth(ctx, instance, oldStatus, notReady, degraded); err != nil {
+		return ctrl.Result{}, err
+	}
+	if len(notReady) > 0 || len(degraded) > 0 {
+		return ctrl.Result{RequeueAfter: topicRetryInterval}, nil
+	}
+	return ctrl.Result{RequeueAfter: r.SyncInterval}, nil
+}
+
+// setConsumerGroupHealth 设置状态并在变化时更新
+func (r *ConsumerGroupReconciler) setConsumerGroupHealth(ctx context.Context, instance *rocketmqv1.ConsumerGroup, oldStatus *rocketmqv1.ConsumerGroupStatus, notReady, degraded []string) error {
+	instance.Status.Phase = setHealthConditions(&instance.Status.Conditions, instance.Generation, instance.Status.Phase,
+		notReady, nil, reasonSyncFailed, degraded)
+	instance.Status.ObservedGeneration = instance.Generation
+	if equality.Semantic.DeepEqual(oldStatus, &instance.Status) {
+		return nil
+	}
+	return r.Status().Update(ctx, instance)
+}
+
+// subscriptionGroupConfig 将Spec应用到broker上已有的消费组配置，保留Spec未管理的字段
+func subscriptionGroupConfig(instance *rocketmqv1.ConsumerGroup, config admin.SubscriptionGroupConfig) admin.SubscriptionGroupConfig {
+	config.GroupName = instance.GroupName()
+	config.ConsumeEnable = instance.Spec.ConsumeEnable == nil || *instance.Spec.ConsumeEnable
+	config.ConsumeBroadcastEnable = instance.Spec.ConsumeBroadcastEnable
+	config.RetryQueueNums = instance.Spec.RetryQueueNums
+	if config.RetryQueueNums <= 0 {
+		config.RetryQueueNums = 1
+	}
+	config.RetryMaxTimes = 16
+	if instance.Spec.RetryMaxTimes != nil {
+		config.RetryMaxTimes = *instance.Spec.RetryMaxTimes
+	}
+	config.BrokerId = instance.Spec.BrokerId
+	config.WhichBrokerWhenConsumeSlowly = 1
+	if instance.Spec.WhichBrokerWhenConsumeSlowly != nil {
+		config.WhichBrokerWhenConsumeSlowly = *instance.Spec.WhichBrokerWhenConsumeSlowly
+	}
+	return config
+}
+
+// syncSubscriptionGroup 在第i个broker组的master上创建或更新消费组配置，返回该组的状态和master地址
+func (r *ConsumerGroupReconciler) syncSubscriptionGroup(ctx context.Context, instance *rocketmqv1.ConsumerGroup, cluster *rocketmqv1.DledgerBroker, i int, info *admin.ClusterInfo) (rocketmqv1.ConsumerGroupBrokerState, string) {
+	state := rocketmqv1.ConsumerGroupBrokerState{BrokerName: brokerGroupName(cluster, i)}
+	addr, err := masterBrokerAddr(ctx, r.Client, cluster, i, info)
+	if err != nil {
+		state.State, state.Message = rocketmqv1.SyncStateFailed, err.Error()
+		return state, ""
+	}
+	if addr == "" {
+		state.State, state.Message = rocketmqv1.SyncStatePending, "no master registered in nameserver"
+		return state, ""
+	}
+
+	group := instance.GroupName()
+	callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+	defer cancel()
+	configs, err := r.Admin.GetAllSubscriptionGroupConfig(callCtx, addr)
+	if err != nil {
+		state.State, state.Message = rocketmqv1.SyncStateFailed, fmt.Sprintf("get subscription group config: %v", err)
+		return state, addr
+	}
+	current, ok := configs[group]
+	if !ok {
+		current = admin.NewSubscriptionGroupConfig(group)
+	}
+	want := subscriptionGroupConfig(instance, current)
+	if !ok || want != current {
+		if err := r.Admin.CreateOrUpdateSubscriptionGroup(callCtx, addr, want); err != nil {
+			state.State, state.Message = rocketmqv1.SyncStateFailed, fmt.Sprintf("create or update subscription group: %v", err)
+			return state, addr
+		}
+		r.Log.Infow("create or update subscription group", "group", group, "brokerName", state.BrokerName, "created", !ok,
+			"consumeEnable", want.ConsumeEnable, "consumeBroadcastEnable", want.ConsumeBroadcastEnable,
+			"retryQueueNums", want.RetryQueueNums, "retryMaxTimes", want.RetryMaxTimes)
+	}
+	state.State = rocketmqv1.SyncStateSynced
+	return state, addr
+}
+
+// syncConsumeStatus 汇总各broker组master上的消费进度，并从master获取在线客户端。
+// 查询失败时保留上次的结果，消费组还没有消费进度时积压为0
+func (r *ConsumerGroupReconciler) syncConsumeStatus(ctx context.Context, instance *rocketmqv1.ConsumerGroup, masters []string) {
+	if len(masters) == 0 {
+		return
+	}
+	group := instance.GroupName()
+	lags := make(map[string]int64)
+	for _, addr := range masters {
+		callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+		stats, err := r.Admin.GetConsumeStats(callCtx, addr, group, "")
+		cancel()
+		if err != nil {
+			if admin.IsSubscriptionGroupNotExist(err) || admin.IsTopicNotExist(err) {
+				continue
+			}
+			r.Log.Warnw("get consume stats failed", "group", group, "broker", addr, "error", err)
+			return
+		}
+		for mq, offset := range stats.OffsetTable {
+			lags[mq.Topic] += offset.BrokerOffset - offset.ConsumerOffset
+		}
+	}
+	var total int64
+	topicLags := make([]rocketmqv1.TopicLag, 0, len(lags))
+	for topic, lag := range lags {
+		total += lag
+		topicLags = append(topicLags, rocketmqv1.TopicLag{Topic: topic, Lag: lag})
+	}
+	sort.Slice(topicLags, func(a, b int) bool { return topicLags[a].Topic < topicLags[b].Topic })
+	instance.Status.Lag = total
+	instance.Status.TopicLags = topicLags
+
+	// 客户端向所有master发送心跳，任一master上的连接即为全部在线客户端
+	for _, addr := range masters {
+		callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+		connection, err := r.Admin.GetConsumerConnectionList(callCtx, addr, group)
+		cancel()
+		if admin.IsConsumerNotOnline(err) {
+			connection, err = &admin.ConsumerConnection{}, nil
+		}
+		if err != nil {
+			r.Log.Warnw("get consumer connections failed", "group", group, "broker", addr, "error", err)
+			continue
+		}
+		instance.Status.OnlineClients = len(connection.ConnectionSet)
+		instance.Status.ConsumeType = connection.ConsumeType
+		instance.Status.MessageModel = connection.MessageModel
+		break
+	}
+	now := metav1.Now()
+	instance.Status.LastSyncTime = &now
+}
+
+// deleteSubscriptionGroup 从所有broker组删除消费组配置，集群已删除时无需处理，broker组没有master时跳过该组
+func (r *ConsumerGroupReconciler) deleteSubscriptionGroup(ctx context.Context, instance *rocketmqv1.ConsumerGroup) error {
+	if instance.Status.GroupName == "" {
+		return nil
+	}
+	cluster := &rocketmqv1.DledgerBroker{}
+	if err := r.Get(ctx, instance.ClusterRef(), cluster); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if msg := clusterNotAllowed(cluster, instance.Namespace); msg != "" {
+		r.Log.Warnw("skip deleting subscription group on cluster not allowed", "group", instance.Status.GroupName, "reason", msg)
+		return nil
+	}
+	ctx, err := clusterAdminContext(ctx, r.Client, cluster)
+	if err != nil {
+		return err
+	}
+	info, err := clusterInfo(ctx, r.Admin, brokerNamesrvAddr(cluster))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < cluster.Spec.BrokerGroupNumber; i++ {
+		if err := r.deleteSubscriptionGroupInBroker(ctx, cluster, i, info, instance.Status.GroupName); err != nil {
+			return err
+		}
+	}
+	r.Log.Infow("delete subscription group", "group", instance.Status.GroupName)
+	return nil
+}
+
+// deleteSubscriptionGroupInBroker 从第i个broker组的master删除消费组配置，没有master时跳过
+func (r *ConsumerGroupReconciler) deleteSubscriptionGroupInBroker(ctx context.Context, cluster *rocketmqv1.DledgerBroker, i int, info *admin.ClusterInfo, group string) error {
+	addr, err := masterBrokerAddr(ctx, r.Client, cluster, i, info)
+	if err != nil {
+		return err
+	}
+	if addr == "" {
+		r.Log.Warnw("skip deleting subscription group on broker group without master", "group", group, "brokerName", brokerGroupName(cluster, i))
+		return nil
+	}
+	callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+	defer cancel()
+	return r.Admin.DeleteSubscriptionGroup(callCtx, addr, group)
+}
+
+// consumerGroupsForCluster 返回引用了该DledgerBroker的所有ConsumerGroup
+func (r *ConsumerGroupReconciler) consumerGroupsForCluster(obj client.Object) []reconcile.Request {
+	groups := &rocketmqv1.ConsumerGroupList{}
+	if err := r.List(context.Background(), groups); err != nil {
+		log.Errorw("list consumergroups failed", "error", err)
+		return nil
+	}
+	cluster := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	var requests []reconcile.Request
+	for k := range groups.Items {
+		group := &groups.Items[k]
+		if group.ClusterRef() != cluster {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Namespace: group.Namespace,
+			Name:      group.Name,
+		}})
+	}
+	return requests
+}
+
+func (r *ConsumerGroupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		// 状态中的消费进度每次刷新都会变化，只在spec变化时触发调谐，进度由SyncInterval定期刷新
+		For(&rocketmqv1.ConsumerGroup{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&source.Kind{Type: &rocketmqv1.DledgerBroker{}}, handler.EnqueueRequestsFromMapFunc(r.consumerGroupsForCluster),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
@@ -0,0 +1,263 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	errors2 "github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/admin"
+	"rocketmq-operator-v2/pkg/logi"
+)
+
+func testConsumerGroup(namespace, name string, spec rocketmqv1.ConsumerGroupSpec) *rocketmqv1.ConsumerGroup {
+	return &rocketmqv1.ConsumerGroup{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Finalizers: []string{consumerGroupFinalizerName}},
+		Spec:       spec,
+	}
+}
+
+func TestSubscriptionGroupConfig(t *testing.T) {
+	disabled, zeroRetry, master := false, 0, int64(0)
+	tests := []struct {
+		name    string
+		spec    rocketmqv1.ConsumerGroupSpec
+		current admin.SubscriptionGroupConfig
+		want    admin.SubscriptionGroupConfig
+	}{
+		{
+			name:    "defaults match the broker",
+			current: admin.NewSubscriptionGroupConfig("billing"),
+			want:    admin.NewSubscriptionGroupConfig("billing"),
+		},
+		{
+			name: "spec values",
+			spec: rocketmqv1.ConsumerGroupSpec{
+				ConsumeEnable:                &disabled,
+				ConsumeBroadcastEnable:       true,
+				RetryQueueNums:               2,
+				RetryMaxTimes:                &zeroRetry,
+				BrokerId:                     1,
+				WhichBrokerWhenConsumeSlowly: &master,
+			},
+			current: admin.NewSubscriptionGroupConfig("billing"),
+			want: admin.SubscriptionGroupConfig{
+				GroupName:                      "billing",
+				ConsumeFromMinEnable:           true,
+				ConsumeBroadcastEnable:         true,
+				RetryQueueNums:                 2,
+				BrokerId:                       1,
+				NotifyConsumerIdsChangedEnable: true,
+			},
+		},
+		{
+			name: "unmanaged fields are kept",
+			current: admin.SubscriptionGroupConfig{
+				GroupName:     "billing",
+				RetryMaxTimes: 3,
+			},
+			want: admin.SubscriptionGroupConfig{
+				GroupName:                    "billing",
+				ConsumeEnable:                true,
+				RetryQueueNums:               1,
+				RetryMaxTimes:                16,
+				WhichBrokerWhenConsumeSlowly: 1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.spec.GroupName = "billing"
+			if got := subscriptionGroupConfig(testConsumerGroup("mq", "g", tt.spec), tt.current); got != tt.want {
+				t.Errorf("subscriptionGroupConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncConsumeStatus(t *testing.T) {
+	offsets := func(entries ...interface{}) *admin.ConsumeStats {
+		stats := &admin.ConsumeStats{OffsetTable: make(map[admin.MessageQueue]admin.OffsetWrapper)}
+		for k := 0; k < len(entries); k += 3 {
+			mq := entries[k].(admin.MessageQueue)
+			stats.OffsetTable[mq] = admin.OffsetWrapper{BrokerOffset: int64(entries[k+1].(int)), ConsumerOffset: int64(entries[k+2].(int))}
+		}
+		return stats
+	}
+	queue := func(topic, brokerName string, id int) admin.MessageQueue {
+		return admin.MessageQueue{Topic: topic, BrokerName: brokerName, QueueId: id}
+	}
+	online := &admin.ConsumerConnection{
+		ConnectionSet: []admin.Connection{{ClientId: "a"}, {ClientId: "b"}},
+		ConsumeType:   "CONSUME_PASSIVELY",
+		MessageModel:  "CLUSTERING",
+	}
+	previous := rocketmqv1.ConsumerGroupStatus{Lag: 42, TopicLags: []rocketmqv1.TopicLag{{Topic: "orders", Lag: 42}}, OnlineClients: 1}
+	tests := []struct {
+		name     string
+		masters  []string
+		admin    *fakeAdmin
+		want     rocketmqv1.ConsumerGroupStatus
+		wantSync bool
+	}{
+		{
+			name:    "lag aggregated by topic across broker groups",
+			masters: []string{"b0", "b1"},
+			admin: &fakeAdmin{
+				consumeStats: map[string]*admin.ConsumeStats{
+					"b0": offsets(queue("orders", "demo-broker-0", 0), 10, 4, queue("orders", "demo-broker-0", 1), 5, 5,
+						queue("%RETRY%billing", "demo-broker-0", 0), 2, 1),
+					"b1": offsets(queue("orders", "demo-broker-1", 0), 7, 0),
+				},
+				connections: map[string]*admin.ConsumerConnection{"b0": online},
+			},
+			want: rocketmqv1.ConsumerGroupStatus{
+				Lag:           14,
+				TopicLags:     []rocketmqv1.TopicLag{{Topic: "%RETRY%billing", Lag: 1}, {Topic: "orders", Lag: 13}},
+				OnlineClients: 2,
+				ConsumeType:   "CONSUME_PASSIVELY",
+				MessageModel:  "CLUSTERING",
+			},
+			wantSync: true,
+		},
+		{
+			name:    "group without offsets on a broker group",
+			masters: []string{"b0", "b1"},
+			admin: &fakeAdmin{consumeStats: map[string]*admin.ConsumeStats{
+				"b1": offsets(queue("orders", "demo-broker-1", 0), 7, 2),
+			}},
+			want:     rocketmqv1.ConsumerGroupStatus{Lag: 5, TopicLags: []rocketmqv1.TopicLag{{Topic: "orders", Lag: 5}}},
+			wantSync: true,
+		},
+		{
+			name:    "connections from the next reachable master",
+			masters: []string{"b0", "b1"},
+			admin: &fakeAdmin{
+				consumeStats: map[string]*admin.ConsumeStats{"b1": offsets()},
+				connections:  map[string]*admin.ConsumerConnection{"b0": nil, "b1": online},
+			},
+			want: rocketmqv1.ConsumerGroupStatus{
+				TopicLags:     []rocketmqv1.TopicLag{},
+				OnlineClients: 2,
+				ConsumeType:   "CONSUME_PASSIVELY",
+				MessageModel:  "CLUSTERING",
+			},
+			wantSync: true,
+		},
+		{
+			name:    "previous status kept when a broker is unreachable",
+			masters: []string{"b0", "b1"},
+			admin: &fakeAdmin{
+				consumeStats: map[string]*admin.ConsumeStats{"b0": offsets(queue("orders", "demo-broker-0", 0), 10, 0)},
+				consumeErrs:  map[string]error{"b1": errors2.New("broker b1 unreachable")},
+			},
+			want: previous,
+		},
+		{
+			name:  "no master",
+			admin: &fakeAdmin{},
+			want:  previous,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group := testConsumerGroup("mq", "billing", rocketmqv1.ConsumerGroupSpec{Cluster: "demo"})
+			group.Status = *previous.DeepCopy()
+			r := &ConsumerGroupReconciler{Admin: tt.admin, Log: logi.GetSugaredLogger()}
+			r.syncConsumeStatus(context.Background(), group, tt.masters)
+			if (group.Status.LastSyncTime != nil) != tt.wantSync {
+				t.Errorf("lastSyncTime = %v, want synced %v", group.Status.LastSyncTime, tt.wantSync)
+			}
+			group.Status.LastSyncTime = nil
+			if !reflect.DeepEqual(group.Status, tt.want) {
+				t.Errorf("status = %+v, want %+v", group.Status, tt.want)
+			}
+		})
+	}
+}
+
+func TestConsumerGroupReconcileRename(t *testing.T) {
+	cluster, pods, info := testTopicCluster(2)
+	addr0, addr1 := testMasterAddr(cluster, 0), testMasterAddr(cluster, 1)
+	tests := []struct {
+		name   string
+		policy rocketmqv1.DeletePolicy
+		want   []string
+	}{
+		{name: "delete old group", policy: rocketmqv1.DeletePolicyDelete, want: []string{"payments"}},
+		{name: "retain old group", policy: rocketmqv1.DeletePolicyRetain, want: []string{"billing", "payments"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group := testConsumerGroup("mq", "g", rocketmqv1.ConsumerGroupSpec{Cluster: "demo", GroupName: "payments", DeletePolicy: tt.policy})
+			group.Status.GroupName = "billing"
+			c := newFakeClient(cluster, &pods[0], &pods[1], group)
+			a := &fakeAdmin{cluster: info, groupConfigs: map[string]map[string]admin.SubscriptionGroupConfig{
+				addr0: {"billing": admin.NewSubscriptionGroupConfig("billing")},
+				addr1: {"billing": admin.NewSubscriptionGroupConfig("billing")},
+			}}
+			r := &ConsumerGroupReconciler{Client: c, Admin: a, Scheme: testScheme()}
+			ref := types.NamespacedName{Namespace: "mq", Name: "g"}
+			if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: ref}); err != nil {
+				t.Fatal(err)
+			}
+			for _, addr := range []string{addr0, addr1} {
+				var got []string
+				for name := range a.groupConfigs[addr] {
+					got = append(got, name)
+				}
+				sort.Strings(got)
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("groups on %s = %v, want %v", addr, got, tt.want)
+				}
+			}
+			if err := c.Get(context.Background(), ref, group); err != nil {
+				t.Fatal(err)
+			}
+			if group.Status.GroupName != "payments" || group.Status.Phase != rocketmqv1.PhaseRunning {
+				t.Errorf("status = %+v, want payments synced", group.Status)
+			}
+		})
+	}
+}
+
+func TestConsumerGroupNamespaceNotAllowed(t *testing.T) {
+	cluster, pods, info := testTopicCluster(1)
+	addr := testMasterAddr(cluster, 0)
+	for _, allowed := range [][]string{nil, {"apps"}} {
+		cluster := cluster.DeepCopy()
+		cluster.Spec.AllowedNamespaces = allowed
+		group := testConsumerGroup("apps", "billing", rocketmqv1.ConsumerGroupSpec{Cluster: "mq/demo"})
+		c := newFakeClient(cluster, &pods[0], group)
+		a := &fakeAdmin{cluster: info, groupConfigs: map[string]map[string]admin.SubscriptionGroupConfig{addr: {}}}
+		r := &ConsumerGroupReconciler{Client: c, Admin: a, Scheme: testScheme()}
+		ref := types.NamespacedName{Namespace: "apps", Name: "billing"}
+		if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: ref}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Get(context.Background(), ref, group); err != nil {
+			t.Fatal(err)
+		}
+		_, created := a.groupConfigs[addr]["billing"]
+		degraded := meta.IsStatusConditionTrue(group.Status.Conditions, rocketmqv1.ConditionDegraded)
+		if created == (allowed == nil) || degraded != (allowed == nil) {
+			t.Errorf("allowedNamespaces %v: created = %v, degraded = %v", allowed, created, degraded)
+		}
+
+		a.groupConfigs[addr]["billing"] = admin.NewSubscriptionGroupConfig("billing")
+		group.Status.GroupName = "billing"
+		if err := r.deleteSubscriptionGroup(context.Background(), group); err != nil {
+			t.Fatal(err)
+		}
+		if _, kept := a.groupConfigs[addr]["billing"]; kept != (allowed == nil) {
+			t.Errorf("allowedNamespaces %v: group kept after delete = %v", allowed, kept)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	errors2 "github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/yaml"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/configs"
+	"rocketmq-operator-v2/pkg/controller/common"
+	"rocketmq-operator-v2/pkg/remoting"
+)
+
+const (
+	brokerAclVolume = "broker-acl"
+	// brokerAclDir 为相对于ROCKETMQ_HOME的acl目录，以目录方式挂载secret，
+	// 这样secret更新后文件会被kubelet原地替换，由broker热加载而无需重启
+	brokerAclDir = "/acl"
+
+	// labelUser 标记RocketMQUser生成的凭证secret，值为RocketMQUser名称
+	labelUser = "rocketmq.daocloud.io/user"
+
+	// 凭证secret中accessKey和secretKey的key，用于RocketMQUser和集群admin账号的secret
+	credentialAccessKey = "accessKey"
+	credentialSecretKey = "secretKey"
+)
+
+// plainAcl 对应rocketmq的plain_acl.yml
+type plainAcl struct {
+	GlobalWhiteRemoteAddresses []string       `json:"globalWhiteRemoteAddresses,omitempty"`
+	Accounts                   []plainAccount `json:"accounts,omitempty"`
+}
+
+type plainAccount struct {
+	AccessKey          string   `json:"accessKey"`
+	SecretKey          string   `json:"secretKey"`
+	WhiteRemoteAddress string   `json:"whiteRemoteAddress,omitempty"`
+	Admin              bool     `json:"admin,omitempty"`
+	DefaultTopicPerm   string   `json:"defaultTopicPerm,omitempty"`
+	DefaultGroupPerm   string   `json:"defaultGroupPerm,omitempty"`
+	TopicPerms         []string `json:"topicPerms,omitempty"`
+	GroupPerms         []string `json:"groupPerms,omitempty"`
+}
+
+// brokerAclSecretName 返回存放plain_acl.yml的secret名称
+func brokerAclSecretName(instance *rocketmqv1.DledgerBroker) string {
+	return instance.Name + "-broker-acl"
+}
+
+// brokerAdminSecretName 返回存放集群admin账号凭证的secret名称，供exporter和operator访问broker使用
+func brokerAdminSecretName(instance *rocketmqv1.DledgerBroker) string {
+	return instance.Name + "-broker-admin"
+}
+
+// brokerAclJavaOpt 返回让broker读取挂载的plain_acl.yml的jvm参数
+func brokerAclJavaOpt() string {
+	return "-Drocketmq.acl.plain.file=" + brokerAclDir + "/" + configs.PlainAclKey
+}
+
+// defaultPlainAcl 读取operator命名空间下ACL_CONFIG_MAP中的默认acl配置，configmap不存在时返回空配置
+func defaultPlainAcl(ctx context.Context, c client.Reader) (*plainAcl, error) {
+	cm := &corev1.ConfigMap{}
+	key := types.NamespacedName{
+		Namespace: common.GetOperatorNamespace(),
+		Name:      configs.GetGlobalConfig().ACL_CONFIG_MAP,
+	}
+	acl := &plainAcl{}
+	if err := c.Get(ctx, key, cm); err != nil {
+		if errors.IsNotFound(err) {
+			log.Debugw("default plain acl not found", "configmap", key)
+			return acl, nil
+		}
+		return nil, err
+	}
+	if err := yaml.Unmarshal([]byte(cm.Data[configs.PlainAclKey]), acl); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// renderPlainAcl 合并默认acl和accounts，accounts中的账号按accessKey覆盖默认账号
+func renderPlainAcl(acl *rocketmqv1.Acl, accounts []plainAccount, defaults *plainAcl) ([]byte, error) {
+	r := plainAcl{}
+	seen := make(map[string]bool)
+	for _, addrs := range [][]string{defaults.GlobalWhiteRemoteAddresses, acl.GlobalWhiteRemoteAddresses} {
+		for _, addr := range addrs {
+			if !seen[addr] {
+				seen[addr] = true
+				r.GlobalWhiteRemoteAddresses = append(r.GlobalWhiteRemoteAddresses, addr)
+			}
+		}
+	}
+
+	overrides := make(map[string]bool, len(accounts))
+	for _, account := range accounts {
+		overrides[account.AccessKey] = true
+	}
+	for _, account := range defaults.Accounts {
+		if !overrides[account.AccessKey] {
+			r.Accounts = append(r.Accounts, account)
+		}
+	}
+	r.Accounts = append(r.Accounts, accounts...)
+	return yaml.Marshal(r)
+}
+
+// resolveAccounts 解析Spec.Acl中的账号，accessKeyRef/secretKeyRef从实例所在命名空间的secret中读取
+func resolveAccounts(ctx context.Context, c client.Reader, instance *rocketmqv1.DledgerBroker) ([]plainAccount, error) {
+	accounts := make([]plainAccount, 0, len(instance.Spec.Acl.Accounts))
+	for _, account := range instance.Spec.Acl.Accounts {
+		accessKey, err := resolveSecretKey(ctx, c, instance.Namespace, account.AccessKey, account.AccessKeyRef)
+		if err != nil {
+			return nil, err
+		}
+		secretKey, err := resolveSecretKey(ctx, c, instance.Namespace, account.SecretKey, account.SecretKeyRef)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, plainAccount{
+			AccessKey:          accessKey,
+			SecretKey:          secretKey,
+			WhiteRemoteAddress: account.WhiteRemoteAddress,
+			Admin:              account.Admin,
+			DefaultTopicPerm:   account.DefaultTopicPerm,
+			DefaultGroupPerm:   account.DefaultGroupPerm,
+			TopicPerms:         account.TopicPerms,
+			GroupPerms:         account.GroupPerms,
+		})
+	}
+	return accounts, nil
+}
+
+// resolveSecretKey 未设置ref时返回明文value，否则读取secret中的对应key
+func resolveSecretKey(ctx context.Context, c client.Reader, namespace, value string, ref *corev1.SecretKeySelector) (string, error) {
+	if ref == nil {
+		return value, nil
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, secret); err != nil {
+		return "", errors2.Wrapf(err, "get acl secret %s/%s", namespace, ref.Name)
+	}
+	v, ok := secret.Data[ref.Key]
+	if !ok {
+		return "", errors2.Errorf("acl secret %s/%s has no key %s", namespace, ref.Name, ref.Key)
+	}
+	return string(v), nil
+}
+
+// adminAccount 返回集群的admin账号，优先使用Spec.Acl中的账号，其次为默认acl中未被覆盖的账号，没有时返回nil
+func adminAccount(defaults, accounts []plainAccount) *plainAccount {
+	overrides := make(map[string]bool, len(accounts))
+	for k := range accounts {
+		if accounts[k].Admin {
+			return &accounts[k]
+		}
+		overrides[accounts[k].AccessKey] = true
+	}
+	for k := range defaults {
+		if defaults[k].Admin && !overrides[defaults[k].AccessKey] {
+			return &defaults[k]
+		}
+	}
+	return nil
+}
+
+// reservedAccessKeys 返回默认账号和Spec.Acl中的账号占用的accessKey，RocketMQUser不能覆盖这些账号
+func reservedAccessKeys(defaults, accounts []plainAccount) map[string]bool {
+	reserved := make(map[string]bool, len(defaults)+len(accounts))
+	for _, list := range [][]plainAccount{defaults, accounts} {
+		for _, account := range list {
+			reserved[account.AccessKey] = true
+		}
+	}
+	return reserved
+}
+
+// clusterUsers 返回引用该集群的RocketMQUser，按创建时间排序。所在命名空间不在集群allowedNamespaces中的RocketMQUser被忽略，
+// 避免其他命名空间的用户为集群添加账号
+func clusterUsers(ctx context.Context, c client.Reader, instance *rocketmqv1.DledgerBroker) ([]rocketmqv1.RocketMQUser, error) {
+	list := &rocketmqv1.RocketMQUserList{}
+	if err := c.List(ctx, list); err != nil {
+		return nil, err
+	}
+	cluster := types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name}
+	var users []rocketmqv1.RocketMQUser
+	for k := range list.Items {
+		if list.Items[k].ClusterRef() == cluster && list.Items[k].DeletionTimestamp.IsZero() &&
+			instance.AllowsNamespace(list.Items[k].Namespace) {
+			users = append(users, list.Items[k])
+		}
+	}
+	sort.SliceStable(users, func(a, b int) bool {
+		ta, tb := users[a].CreationTimestamp, users[b].CreationTimestamp
+		if !ta.Equal(&tb) {
+			return ta.Before(&tb)
+		}
+		if users[a].Namespace != users[b].Namespace {
+			return users[a].Namespace < users[b].Namespace
+		}
+		return users[a].Name < users[b].Name
+	})
+	return users, nil
+}
+
+// userAccounts 解析引用该集群的RocketMQUser的账号，reserved为已被占用的accessKey。
+// accessKey冲突时先创建的RocketMQUser生效，返回被忽略的RocketMQUser及原因；凭证secret尚未生成的账号跳过
+func userAccounts(ctx context.Context, c client.Reader, instance *rocketmqv1.DledgerBroker, reserved map[string]bool) ([]plainAccount, map[types.NamespacedName]string, error) {
+	users, err := clusterUsers(ctx, c, instance)
+	if err != nil {
+		return nil, nil, err
+	}
+	var accounts []plainAccount
+	conflicts := make(map[types.NamespacedName]string)
+	owners := make(map[string]types.NamespacedName, len(users))
+	for k := range users {
+		user := &users[k]
+		ref := types.NamespacedName{Namespace: user.Namespace, Name: user.Name}
+		accessKey := user.AccessKey()
+		if reserved[accessKey] {
+			conflicts[ref] = fmt.Sprintf("accessKey %s is already used by an account of cluster %s/%s", accessKey, instance.Namespace, instance.Name)
+			continue
+		}
+		if owner, ok := owners[accessKey]; ok {
+			conflicts[ref] = fmt.Sprintf("accessKey %s is already used by RocketMQUser %s", accessKey, owner)
+			continue
+		}
+		owners[accessKey] = ref
+
+		secret := &corev1.Secret{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: user.Namespace, Name: user.SecretName()}, secret); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+		secretKey := string(secret.Data[credentialSecretKey])
+		if secretKey == "" || string(secret.Data[credentialAccessKey]) != accessKey {
+			continue
+		}
+		accounts = append(accounts, plainAccount{
+			AccessKey:          accessKey,
+			SecretKey:          secretKey,
+			WhiteRemoteAddress: user.Spec.WhiteRemoteAddress,
+			DefaultTopicPerm:   user.Spec.DefaultTopicPerm,
+			DefaultGroupPerm:   user.Spec.DefaultGroupPerm,
+			TopicPerms:         user.Spec.TopicPerms,
+			GroupPerms:         user.Spec.GroupPerms,
+		})
+	}
+	return accounts, conflicts, nil
+}
+
+// brokersForUser 返回RocketMQUser引用的DledgerBroker，账号变化时重新渲染plain_acl.yml
+func (r *DledgerBrokerReconciler) brokersForUser(obj client.Object) []reconcile.Request {
+	user, ok := obj.(*rocketmqv1.RocketMQUser)
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: user.ClusterRef()}}
+}
+
+// brokersForSecret 返回acl账号引用了该secret的所有DledgerBroker，secret轮转时重新渲染plain_acl.yml。
+// RocketMQUser生成的secret映射到其引用的DledgerBroker
+func (r *DledgerBrokerReconciler) brokersForSecret(obj client.Object) []reconcile.Request {
+	var requests []reconcile.Request
+	if name := obj.GetLabels()[labelUser]; name != "" {
+		user := &rocketmqv1.RocketMQUser{}
+		if err := r.Get(context.Background(), types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}, user); err == nil {
+			requests = append(requests, reconcile.Request{NamespacedName: user.ClusterRef()})
+		} else if !errors.IsNotFound(err) {
+			log.Errorw("get rocketmquser failed", "error", err)
+		}
+	}
+	brokers := &rocketmqv1.DledgerBrokerList{}
+	if err := r.List(context.Background(), brokers, client.InNamespace(obj.GetNamespace())); err != nil {
+		log.Errorw("list dledgerbrokers failed", "error", err)
+		return requests
+	}
+	for k := range brokers.Items {
+		broker := &brokers.Items[k]
+		if broker.Spec.Acl == nil || !aclReferencesSecret(broker.Spec.Acl, obj.GetName()) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Namespace: broker.Namespace,
+			Name:      broker.Name,
+		}})
+	}
+	return requests
+}
+
+func aclReferencesSecret(acl *rocketmqv1.Acl, name string) bool {
+	for _, account := range acl.Accounts {
+		if (account.AccessKeyRef != nil && account.AccessKeyRef.Name == name) ||
+			(account.SecretKeyRef != nil && account.SecretKeyRef.Name == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileAcl 渲染plain_acl.yml到secret，并将admin账号写入admin secret，未配置Spec.Acl时删除这两个secret。
+// 返回集群的admin账号及admin secret的resourceVersion，没有admin账号时返回nil和空
+func (r *DledgerBrokerReconciler) reconcileAcl(ctx context.Context, instance *rocketmqv1.DledgerBroker) (*plainAccount, string, error) {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:      brokerAclSecretName(instance),
+		Namespace: instance.Namespace,
+	}}
+	if instance.Spec.Acl == nil {
+		if err := r.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+			return nil, "", err
+		}
+		_, err := r.reconcileAdminSecret(ctx, instance, nil)
+		return nil, "", err
+	}
+
+	defaults, err := defaultPlainAcl(ctx, r.Client)
+	if err != nil {
+		return nil, "", err
+	}
+	accounts, err := resolveAccounts(ctx, r.Client, instance)
+	if err != nil {
+		return nil, "", err
+	}
+	admin := adminAccount(defaults.Accounts, accounts)
+	// RocketMQUser的账号追加在最后，冲突的账号由RocketMQUser控制器记录在其状态中
+	users, _, err := userAccounts(ctx, r.Client, instance, reservedAccessKeys(defaults.Accounts, accounts))
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := renderPlainAcl(instance.Spec.Acl, append(accounts, users...), defaults)
+	if err != nil {
+		return nil, "", err
+	}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, secret, func() error {
+		secret.Labels = mergeLabels(secret.Labels, brokerClusterLabels(instance))
+		secret.Data = map[string][]byte{configs.PlainAclKey: data}
+		return controllerutil.SetControllerReference(instance, secret, r.Scheme)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if op != controllerutil.OperationResultNone {
+		r.Log.Infow("reconciled broker plain acl", "secret", secret.Name, "operation", op)
+	}
+	version, err := r.reconcileAdminSecret(ctx, instance, admin)
+	if err != nil {
+		return nil, "", err
+	}
+	return admin, version, nil
+}
+
+// reconcileAdminSecret 将admin账号写入operator维护的secret，exporter通过secretKeyRef引用，避免明文key出现在deployment中。
+// 返回secret的resourceVersion，凭证变化时随之变化；admin为nil时删除secret
+func (r *DledgerBrokerReconciler) reconcileAdminSecret(ctx context.Context, instance *rocketmqv1.DledgerBroker, admin *plainAccount) (string, error) {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:      brokerAdminSecretName(instance),
+		Namespace: instance.Namespace,
+	}}
+	if admin == nil {
+		if err := r.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+			return "", err
+		}
+		return "", nil
+	}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, secret, func() error {
+		secret.Labels = mergeLabels(secret.Labels, brokerClusterLabels(instance))
+		secret.Data = map[string][]byte{
+			credentialAccessKey: []byte(admin.AccessKey),
+			credentialSecretKey: []byte(admin.SecretKey),
+		}
+		return controllerutil.SetControllerReference(instance, secret, r.Scheme)
+	})
+	if err != nil {
+		return "", err
+	}
+	if op != controllerutil.OperationResultNone {
+		r.Log.Infow("reconciled broker admin secret", "secret", secret.Name, "operation", op)
+	}
+	return secret.ResourceVersion, nil
+}
+
+// withAdminCredentials 返回携带管理员账号的ctx，admin客户端会用该账号对请求签名，account为空时原样返回
+func withAdminCredentials(ctx context.Context, account *plainAccount) context.Context {
+	if account == nil {
+		return ctx
+	}
+	return remoting.WithCredentials(ctx, remoting.SessionCredentials{AccessKey: account.AccessKey, SecretKey: account.SecretKey})
+}
+
+// clusterAdminContext 集群开启acl时从管理员secret读取账号，返回对发往该集群的请求签名的ctx。
+// 集群没有管理员账号时原样返回，broker会拒绝请求，错误记录在调用方的状态中
+func clusterAdminContext(ctx context.Context, c client.Reader, cluster *rocketmqv1.DledgerBroker) (context.Context, error) {
+	if cluster.Spec.Acl == nil {
+		return ctx, nil
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: cluster.Namespace, Name: brokerAdminSecretName(cluster)}, secret); err != nil {
+		if errors.IsNotFound(err) {
+			return ctx, nil
+		}
+		return ctx, err
+	}
+	return withAdminCredentials(ctx, &plainAccount{
+		AccessKey: string(secret.Data[credentialAccessKey]),
+		SecretKey: string(secret.Data[credentialSecretKey]),
+	}), nil
+}
@@ -0,0 +1,312 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/configs"
+	"rocketmq-operator-v2/pkg/remoting"
+)
+
+func TestRenderPlainAcl(t *testing.T) {
+	defaults := &plainAcl{
+		GlobalWhiteRemoteAddresses: []string{"10.10.*.*"},
+		Accounts: []plainAccount{
+			{AccessKey: "RocketMQ", SecretKey: "12345678", DefaultTopicPerm: "DENY"},
+			{AccessKey: "rocketmq2", SecretKey: "12345678", Admin: true},
+		},
+	}
+	tests := []struct {
+		name     string
+		acl      *rocketmqv1.Acl
+		accounts []plainAccount
+		defaults *plainAcl
+		want     string
+	}{
+		{
+			name:     "empty",
+			acl:      &rocketmqv1.Acl{},
+			defaults: &plainAcl{},
+			want:     "{}\n",
+		},
+		{
+			name: "defaults merged with spec",
+			acl:  &rocketmqv1.Acl{GlobalWhiteRemoteAddresses: []string{"192.168.0.*", "10.10.*.*"}},
+			accounts: []plainAccount{{
+				AccessKey:          "orders",
+				SecretKey:          "s1",
+				WhiteRemoteAddress: "192.168.0.*",
+				DefaultGroupPerm:   "SUB",
+				TopicPerms:         []string{"orders=PUB|SUB"},
+				GroupPerms:         []string{"billing=SUB"},
+			}},
+			defaults: defaults,
+			want: `accounts:
+- accessKey: RocketMQ
+  defaultTopicPerm: DENY
+  secretKey: "12345678"
+- accessKey: rocketmq2
+  admin: true
+  secretKey: "12345678"
+- accessKey: orders
+  defaultGroupPerm: SUB
+  groupPerms:
+  - billing=SUB
+  secretKey: s1
+  topicPerms:
+  - orders=PUB|SUB
+  whiteRemoteAddress: 192.168.0.*
+globalWhiteRemoteAddresses:
+- 10.10.*.*
+- 192.168.0.*
+`,
+		},
+		{
+			name:     "spec account overrides default with the same accessKey",
+			acl:      &rocketmqv1.Acl{},
+			accounts: []plainAccount{{AccessKey: "rocketmq2", SecretKey: "rotated"}},
+			defaults: defaults,
+			want: `accounts:
+- accessKey: RocketMQ
+  defaultTopicPerm: DENY
+  secretKey: "12345678"
+- accessKey: rocketmq2
+  secretKey: rotated
+globalWhiteRemoteAddresses:
+- 10.10.*.*
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderPlainAcl(tt.acl, tt.accounts, tt.defaults)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("renderPlainAcl() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveAccounts(t *testing.T) {
+	ref := func(name, key string) *corev1.SecretKeySelector {
+		return &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: name}, Key: key}
+	}
+	credentials := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "orders-credentials"},
+		Data:       map[string][]byte{"ak": []byte("orders"), "sk": []byte("from-secret")},
+	}
+	elsewhere := credentials.DeepCopy()
+	elsewhere.Namespace = "apps"
+	elsewhere.Data["accessKey"] = []byte("apps")
+	tests := []struct {
+		name     string
+		accounts []rocketmqv1.Account
+		want     []plainAccount
+		wantErr  string
+	}{
+		{
+			name:     "plaintext keys",
+			accounts: []rocketmqv1.Account{{AccessKey: "orders", SecretKey: "plain", Admin: true, TopicPerms: []string{"orders=PUB"}}},
+			want:     []plainAccount{{AccessKey: "orders", SecretKey: "plain", Admin: true, TopicPerms: []string{"orders=PUB"}}},
+		},
+		{
+			name: "keys from secret",
+			accounts: []rocketmqv1.Account{
+				{AccessKeyRef: ref("orders-credentials", "ak"), SecretKeyRef: ref("orders-credentials", "sk"), DefaultTopicPerm: "SUB"},
+				{AccessKey: "billing", SecretKeyRef: ref("orders-credentials", "sk")},
+			},
+			want: []plainAccount{
+				{AccessKey: "orders", SecretKey: "from-secret", DefaultTopicPerm: "SUB"},
+				{AccessKey: "billing", SecretKey: "from-secret"},
+			},
+		},
+		{
+			name:     "ref takes precedence over plaintext",
+			accounts: []rocketmqv1.Account{{AccessKey: "orders", SecretKey: "plain", SecretKeyRef: ref("orders-credentials", "sk")}},
+			want:     []plainAccount{{AccessKey: "orders", SecretKey: "from-secret"}},
+		},
+		{
+			name:     "secret not found",
+			accounts: []rocketmqv1.Account{{AccessKey: "orders", SecretKeyRef: ref("missing", "sk")}},
+			wantErr:  `get acl secret mq/missing: secrets "missing" not found`,
+		},
+		{
+			name:     "key not found",
+			accounts: []rocketmqv1.Account{{AccessKeyRef: ref("orders-credentials", "accessKey"), SecretKey: "plain"}},
+			wantErr:  "acl secret mq/orders-credentials has no key accessKey",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &rocketmqv1.DledgerBroker{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "demo"},
+				Spec:       rocketmqv1.DledgerBrokerSpec{Acl: &rocketmqv1.Acl{Accounts: tt.accounts}},
+			}
+			// 只读取实例所在命名空间的secret
+			got, err := resolveAccounts(context.Background(), newFakeClient(credentials, elsewhere), instance)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("resolveAccounts() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveAccounts() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminAccount(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults []plainAccount
+		accounts []plainAccount
+		want     string
+	}{
+		{name: "none", defaults: []plainAccount{{AccessKey: "d"}}, accounts: []plainAccount{{AccessKey: "a"}}},
+		{
+			name:     "spec admin first",
+			defaults: []plainAccount{{AccessKey: "default-admin", Admin: true}},
+			accounts: []plainAccount{{AccessKey: "user"}, {AccessKey: "spec-admin", Admin: true}},
+			want:     "spec-admin",
+		},
+		{
+			name:     "default admin",
+			defaults: []plainAccount{{AccessKey: "default-user"}, {AccessKey: "default-admin", Admin: true}},
+			accounts: []plainAccount{{AccessKey: "user"}},
+			want:     "default-admin",
+		},
+		{
+			name:     "default admin overridden by non admin",
+			defaults: []plainAccount{{AccessKey: "rocketmq2", Admin: true}},
+			accounts: []plainAccount{{AccessKey: "rocketmq2"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := adminAccount(tt.defaults, tt.accounts)
+			if (got == nil) != (tt.want == "") || (got != nil && got.AccessKey != tt.want) {
+				t.Errorf("adminAccount() = %+v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileAclAdminSecret(t *testing.T) {
+	instance := &rocketmqv1.DledgerBroker{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "demo", UID: "uid"},
+		Spec: rocketmqv1.DledgerBrokerSpec{Acl: &rocketmqv1.Acl{Accounts: []rocketmqv1.Account{
+			{AccessKey: "rocketmq2", SecretKey: "plain-secret", Admin: true},
+		}}},
+	}
+	c := newFakeClient(instance)
+	r := &DledgerBrokerReconciler{Client: c, Log: log, Scheme: testScheme()}
+	ctx := context.Background()
+
+	admin, version, err := r.reconcileAcl(ctx, instance)
+	if err != nil {
+		t.Fatalf("reconcileAcl() error = %v", err)
+	}
+	if admin == nil || admin.AccessKey != "rocketmq2" || version == "" {
+		t.Fatalf("reconcileAcl() admin = %+v, version = %q, want rocketmq2", admin, version)
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "mq", Name: brokerAdminSecretName(instance)}, secret); err != nil {
+		t.Fatalf("get admin secret: %v", err)
+	}
+	if string(secret.Data[credentialAccessKey]) != "rocketmq2" || string(secret.Data[credentialSecretKey]) != "plain-secret" {
+		t.Errorf("admin secret data = %v", secret.Data)
+	}
+
+	e := brokerExporter(instance, "ns:9876", version)
+	for _, env := range e.Env {
+		if env.Value != "" || env.ValueFrom == nil || env.ValueFrom.SecretKeyRef == nil ||
+			env.ValueFrom.SecretKeyRef.Name != brokerAdminSecretName(instance) {
+			t.Errorf("exporter env %s = %+v, want secretKeyRef to %s", env.Name, env, brokerAdminSecretName(instance))
+		}
+	}
+	if len(e.Env) != 2 || e.CredentialVersion != secret.ResourceVersion {
+		t.Errorf("exporter env = %+v, credential version = %q, want %q", e.Env, e.CredentialVersion, secret.ResourceVersion)
+	}
+	if _, ok := configs.LookupEnv(e.Env, configs.ACCESS_KEY); !ok {
+		t.Errorf("exporter env has no %s", configs.ACCESS_KEY)
+	}
+
+	// 凭证不变时resourceVersion不变，轮转secretKey后exporter pod随之重建
+	if _, again, err := r.reconcileAcl(ctx, instance); err != nil || again != version {
+		t.Errorf("reconcileAcl() again = %q, %v, want unchanged %q", again, err, version)
+	}
+	instance.Spec.Acl.Accounts[0].SecretKey = "rotated-secret"
+	_, rotated, err := r.reconcileAcl(ctx, instance)
+	if err != nil || rotated == version {
+		t.Errorf("reconcileAcl() after rotation = %q, %v, want a version other than %q", rotated, err, version)
+	}
+
+	// 关闭acl后删除admin secret，exporter不再注入凭证
+	instance.Spec.Acl = nil
+	if admin, version, err = r.reconcileAcl(ctx, instance); err != nil || admin != nil || version != "" {
+		t.Fatalf("reconcileAcl() without acl = %+v, %q, %v", admin, version, err)
+	}
+	err = c.Get(ctx, types.NamespacedName{Namespace: "mq", Name: brokerAdminSecretName(instance)}, secret)
+	if !errors.IsNotFound(err) {
+		t.Errorf("admin secret after disabling acl: %v", err)
+	}
+	if e := brokerExporter(instance, "ns:9876", ""); len(e.Env) != 0 || e.CredentialVersion != "" {
+		t.Errorf("exporter without admin = %+v", e)
+	}
+}
+
+func TestClusterAdminContext(t *testing.T) {
+	cluster := &rocketmqv1.DledgerBroker{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "demo"},
+		Spec:       rocketmqv1.DledgerBrokerSpec{Acl: &rocketmqv1.Acl{}},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: brokerAdminSecretName(cluster)},
+		Data:       map[string][]byte{credentialAccessKey: []byte("rocketmq2"), credentialSecretKey: []byte("12345678")},
+	}
+	noAcl := cluster.DeepCopy()
+	noAcl.Spec.Acl = nil
+	tests := []struct {
+		name    string
+		cluster *rocketmqv1.DledgerBroker
+		objs    []client.Object
+		want    *remoting.SessionCredentials
+	}{
+		{
+			name:    "acl enabled",
+			cluster: cluster,
+			objs:    []client.Object{secret},
+			want:    &remoting.SessionCredentials{AccessKey: "rocketmq2", SecretKey: "12345678"},
+		},
+		{name: "acl disabled", cluster: noAcl, objs: []client.Object{secret}},
+		{name: "no admin account", cluster: cluster},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := clusterAdminContext(context.Background(), newFakeClient(tt.objs...), tt.cluster)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := remoting.CredentialsFrom(ctx)
+			if ok != (tt.want != nil) || (ok && got != *tt.want) {
+				t.Errorf("credentials = %+v, %v, want %+v", got, ok, tt.want)
+			}
+		})
+	}
+}
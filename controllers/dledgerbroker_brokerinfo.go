@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	errors2 "github.com/pkg/errors"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/admin"
+	"rocketmq-operator-v2/pkg/configs"
+)
+
+// brokerInfoTimeout 查询单个nameserver或dledger节点的超时时间，避免不可达的节点阻塞调谐
+const brokerInfoTimeout = 3 * time.Second
+
+// syncBrokerInfo 从nameserver和各节点的dledger查询broker组的实际拓扑，记录到Status.BrokerMembers，
+// 同时将已注册的地址记录到已废弃的Status.BrokerInfo。未配置Admin时不更新，nameserver不可达时保留上次的结果
+func (r *DledgerBrokerReconciler) syncBrokerInfo(ctx context.Context, instance *rocketmqv1.DledgerBroker, namesrvAddr string) error {
+	if r.Admin == nil {
+		return nil
+	}
+	if namesrvAddr == "" {
+		namesrvAddr = instance.Spec.Config[configs.NamesrvAddr]
+	}
+	cluster, err := clusterInfo(ctx, r.Admin, namesrvAddr)
+	if err != nil {
+		r.Log.Warnw("get cluster info from nameserver failed", "namesrvAddr", namesrvAddr, "error", err)
+		return nil
+	}
+
+	info := make(map[string][]rocketmqv1.BrokerMember, instance.Spec.BrokerGroupNumber)
+	addrs := make(map[string][]string, instance.Spec.BrokerGroupNumber)
+	for i := 0; i < instance.Spec.BrokerGroupNumber; i++ {
+		pods, err := r.groupPods(ctx, instance, i)
+		if err != nil {
+			return err
+		}
+		group := brokerGroupName(instance, i)
+		// brokerAddrs的key为brokerId，转换为地址到brokerId的映射
+		registered := make(map[string]int)
+		for id, addr := range cluster.BrokerAddrTable[group].BrokerAddrs {
+			if n, err := strconv.Atoi(id); err == nil {
+				registered[addr] = n
+			}
+		}
+		members := make([]rocketmqv1.BrokerMember, 0, len(pods))
+		for k := range pods {
+			_, advertised, err := brokerEndpoint(ctx, r.Client, instance, &pods[k])
+			if err != nil {
+				return err
+			}
+			member := rocketmqv1.BrokerMember{Pod: pods[k].Name, Address: advertised}
+			if id, ok := registered[member.Address]; ok && member.Address != "" {
+				id := id
+				member.Registered = true
+				member.BrokerId = &id
+				addrs[group] = append(addrs[group], member.Address)
+			}
+			if isPodReady(&pods[k]) {
+				member.Role, member.Term = r.dledgerRole(ctx, instance, i, podOrdinal(&pods[k]))
+			}
+			members = append(members, member)
+		}
+		info[group] = members
+	}
+	instance.Status.BrokerMembers = info
+	instance.Status.BrokerInfo = addrs
+	return nil
+}
+
+// clusterInfo 依次尝试namesrvAddr中的nameserver，返回第一个成功的结果
+func clusterInfo(ctx context.Context, a admin.Admin, namesrvAddr string) (*admin.ClusterInfo, error) {
+	var lastErr error
+	for _, addr := range strings.Split(namesrvAddr, ";") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+		cluster, err := a.GetClusterInfo(callCtx, addr)
+		cancel()
+		if err == nil {
+			return cluster, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors2.New("namesrvAddr is empty")
+	}
+	return nil, lastErr
+}
+
+// dledgerRole 查询第i个broker组第k个节点的dledger角色和term，查询失败时返回空角色
+func (r *DledgerBrokerReconciler) dledgerRole(ctx context.Context, instance *rocketmqv1.DledgerBroker, i, k int) (rocketmqv1.DledgerRole, int64) {
+	callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+	defer cancel()
+	selfId := dledgerSelfId(k)
+	metadata, err := r.Admin.GetDledgerMetadata(callCtx, dledgerAddr(instance, i, k), brokerGroupName(instance, i), selfId)
+	if err != nil {
+		r.Log.Debugw("get dledger metadata failed", "group", brokerGroupName(instance, i), "selfId", selfId, "error", err)
+		return "", 0
+	}
+	switch metadata.LeaderId {
+	case "":
+		return rocketmqv1.DledgerRoleCandidate, metadata.Term
+	case selfId:
+		return rocketmqv1.DledgerRoleLeader, metadata.Term
+	default:
+		return rocketmqv1.DledgerRoleFollower, metadata.Term
+	}
+}
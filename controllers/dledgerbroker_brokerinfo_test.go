@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/admin"
+	"rocketmq-operator-v2/pkg/logi"
+)
+
+func TestSyncBrokerInfo(t *testing.T) {
+	instance := testBrokerInstance()
+	instance.Spec.BrokerGroupNumber = 1
+	pods := []client.Object{}
+	for k := 0; k < 3; k++ {
+		pod := testBrokerPod(instance, 0, k, k < 2)
+		pods = append(pods, &pod)
+	}
+	addr := func(k int) string { return fmt.Sprintf("10.0.0.%d:%d", k, brokerPortMain) }
+	registered := &admin.ClusterInfo{BrokerAddrTable: map[string]admin.BrokerData{
+		"demo-broker-0": {BrokerName: "demo-broker-0", BrokerAddrs: map[string]string{"0": addr(0), "1": addr(1)}},
+	}}
+	metadata := func(leader string) map[string]*admin.DledgerMetadata {
+		m := make(map[string]*admin.DledgerMetadata)
+		for k := 0; k < 3; k++ {
+			m[dledgerAddr(instance, 0, k)] = &admin.DledgerMetadata{LeaderId: leader, Term: 2}
+		}
+		return m
+	}
+	id := func(n int) *int { return &n }
+	previous := rocketmqv1.DledgerBrokerStatus{
+		BrokerInfo:    map[string][]string{"demo-broker-0": {addr(0)}},
+		BrokerMembers: map[string][]rocketmqv1.BrokerMember{"demo-broker-0": {{Pod: "demo-broker-0-0"}}},
+	}
+	tests := []struct {
+		name  string
+		admin admin.Admin
+		want  rocketmqv1.DledgerBrokerStatus
+	}{
+		{
+			name:  "roles from dledger",
+			admin: &fakeAdmin{cluster: registered, metadata: metadata("n0")},
+			want: rocketmqv1.DledgerBrokerStatus{
+				BrokerInfo: map[string][]string{"demo-broker-0": {addr(0), addr(1)}},
+				BrokerMembers: map[string][]rocketmqv1.BrokerMember{"demo-broker-0": {
+					{Pod: "demo-broker-0-0", Address: addr(0), Role: rocketmqv1.DledgerRoleLeader, Term: 2, Registered: true, BrokerId: id(0)},
+					{Pod: "demo-broker-0-1", Address: addr(1), Role: rocketmqv1.DledgerRoleFollower, Term: 2, Registered: true, BrokerId: id(1)},
+					// 未就绪的节点不查询dledger
+					{Pod: "demo-broker-0-2", Address: addr(2)},
+				}},
+			},
+		},
+		{
+			name:  "election in progress",
+			admin: &fakeAdmin{cluster: &admin.ClusterInfo{}, metadata: metadata("")},
+			want: rocketmqv1.DledgerBrokerStatus{
+				BrokerInfo: map[string][]string{},
+				BrokerMembers: map[string][]rocketmqv1.BrokerMember{"demo-broker-0": {
+					{Pod: "demo-broker-0-0", Address: addr(0), Role: rocketmqv1.DledgerRoleCandidate, Term: 2},
+					{Pod: "demo-broker-0-1", Address: addr(1), Role: rocketmqv1.DledgerRoleCandidate, Term: 2},
+					{Pod: "demo-broker-0-2", Address: addr(2)},
+				}},
+			},
+		},
+		{
+			name:  "dledger unreachable",
+			admin: &fakeAdmin{cluster: registered},
+			want: rocketmqv1.DledgerBrokerStatus{
+				BrokerInfo: map[string][]string{"demo-broker-0": {addr(0), addr(1)}},
+				BrokerMembers: map[string][]rocketmqv1.BrokerMember{"demo-broker-0": {
+					{Pod: "demo-broker-0-0", Address: addr(0), Registered: true, BrokerId: id(0)},
+					{Pod: "demo-broker-0-1", Address: addr(1), Registered: true, BrokerId: id(1)},
+					{Pod: "demo-broker-0-2", Address: addr(2)},
+				}},
+			},
+		},
+		{name: "nameserver unreachable keeps previous status", admin: &fakeAdmin{}, want: previous},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := instance.DeepCopy()
+			instance.Status = *previous.DeepCopy()
+			r := &DledgerBrokerReconciler{Client: newFakeClient(pods...), Admin: tt.admin, Log: logi.GetSugaredLogger()}
+			if err := r.syncBrokerInfo(context.Background(), instance, "ns:9876"); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(instance.Status, tt.want) {
+				t.Errorf("status = %+v, want %+v", instance.Status, tt.want)
+			}
+		})
+	}
+}
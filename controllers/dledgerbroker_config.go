@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/configs"
+	"rocketmq-operator-v2/pkg/controller/common"
+)
+
+const (
+	brokerConfigVolume    = "broker-config"
+	brokerConfigMountPath = "/home/rocketmq/conf"
+
+	annotationConfigHash = "rocketmq.daocloud.io/config-hash"
+)
+
+// brokerConfigMapName 返回第i个broker组的配置configmap名称
+func brokerConfigMapName(instance *rocketmqv1.DledgerBroker, i int) string {
+	return brokerGroupName(instance, i) + "-config"
+}
+
+// brokerConfigFileName 返回组内第k个节点的配置文件名
+func brokerConfigFileName(k int) string {
+	return fmt.Sprintf("broker-%d.conf", k)
+}
+
+// brokerPodFQDN 返回broker pod通过headless service解析的稳定dns名称
+func brokerPodFQDN(instance *rocketmqv1.DledgerBroker, i, k int) string {
+	return fmt.Sprintf("%s-%d.%s.%s.svc.%s", brokerGroupName(instance, i), k,
+		brokerHeadlessServiceName(instance), instance.Namespace, configs.GetGlobalConfig().CLUSTER_DOMAIN)
+}
+
+func dledgerSelfId(k int) string {
+	return fmt.Sprintf("n%d", k)
+}
+
+// dledgerPeers 计算第i个broker组的dLegerPeers，格式为 n0-host:port;n1-host:port
+func dledgerPeers(instance *rocketmqv1.DledgerBroker, i, members int) string {
+	peers := make([]string, 0, members)
+	for k := 0; k < members; k++ {
+		peers = append(peers, fmt.Sprintf("%s-%s:%d", dledgerSelfId(k), brokerPodFQDN(instance, i, k), brokerPortDledger))
+	}
+	return strings.Join(peers, ";")
+}
+
+// defaultBrokerConfig 读取operator命名空间下BROKER_CONFIG_MAP中的默认broker配置，configmap不存在时返回空配置
+func (r *DledgerBrokerReconciler) defaultBrokerConfig(ctx context.Context) (map[string]string, error) {
+	cm := &corev1.ConfigMap{}
+	key := types.NamespacedName{
+		Namespace: common.GetOperatorNamespace(),
+		Name:      configs.GetGlobalConfig().BROKER_CONFIG_MAP,
+	}
+	if err := r.Get(ctx, key, cm); err != nil {
+		if errors.IsNotFound(err) {
+			r.Log.Debugw("default broker config not found", "configmap", key)
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+	return configs.ParseProperties(cm.Data[configs.BrokerConfigKey]), nil
+}
+
+// renderBrokerConfig 渲染第i个broker组中members个节点的broker.conf，默认配置 < Spec.Config < operator维护的配置。
+// 调整组成员时members为当前步骤的成员数，而非Spec中的目标值。
+// namesrvAddr为空时保留Spec.Config中用户配置的namesrvAddr
+func renderBrokerConfig(instance *rocketmqv1.DledgerBroker, i, members int, defaults map[string]string, namesrvAddr string) map[string]string {
+	base := make(map[string]string, len(defaults)+len(instance.Spec.Config)+5)
+	for k, v := range defaults {
+		base[k] = v
+	}
+	for k, v := range instance.Spec.Config {
+		base[k] = v
+	}
+	base[configs.BrokerClusterName] = instance.Name
+	base[configs.BrokerName] = brokerGroupName(instance, i)
+	base[configs.EnableDLegerCommitLog] = "true"
+	base[configs.DLegerGroup] = brokerGroupName(instance, i)
+	base[configs.DLegerPeers] = dledgerPeers(instance, i, members)
+	base[configs.StorePathRootDir] = brokerStorePath
+	base[configs.StorePathCommitLog] = brokerStorePath + "/commitlog"
+	if namesrvAddr != "" {
+		base[configs.NamesrvAddr] = namesrvAddr
+	}
+	if instance.Spec.Acl != nil {
+		base[configs.AclEnable] = "true"
+	}
+
+	data := make(map[string]string, members)
+	for k := 0; k < members; k++ {
+		base[configs.DLegerSelfId] = dledgerSelfId(k)
+		data[brokerConfigFileName(k)] = configs.FormatProperties(base)
+	}
+	return data
+}
+
+// mutateBrokerConfigMap 渲染第i个broker组的配置configmap
+func mutateBrokerConfigMap(instance *rocketmqv1.DledgerBroker, i int, data map[string]string, cm *corev1.ConfigMap) {
+	cm.Labels = mergeLabels(cm.Labels, brokerGroupLabels(instance, i))
+	cm.Data = data
+}
+
+// configHash 计算配置内容的摘要，写入pod模板注解以便配置变化时滚动pod
+func configHash(data map[string]string) string {
+	h := sha256.New()
+	h.Write([]byte(configs.FormatProperties(data)))
+	return fmt.Sprintf("%x", h.Sum(nil))[:16]
+}
+
+// brokerStartCommand 使用指定的配置文件启动broker，conf中可引用HOSTNAME按pod序号选择配置文件
+func brokerStartCommand(conf string) []string {
+	return []string{"sh", "-c", "exec sh mqbroker -c " + conf}
+}
@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/configs"
+)
+
+func TestDledgerPeers(t *testing.T) {
+	instance := &rocketmqv1.DledgerBroker{ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "demo"}}
+	tests := []struct {
+		name    string
+		group   int
+		members int
+		want    string
+	}{
+		{
+			name:    "single node",
+			group:   0,
+			members: 1,
+			want:    "n0-demo-broker-0-0.demo-broker-hs.mq.svc.cluster.local:40911",
+		},
+		{
+			name:    "three nodes in second group",
+			group:   1,
+			members: 3,
+			want: "n0-demo-broker-1-0.demo-broker-hs.mq.svc.cluster.local:40911;" +
+				"n1-demo-broker-1-1.demo-broker-hs.mq.svc.cluster.local:40911;" +
+				"n2-demo-broker-1-2.demo-broker-hs.mq.svc.cluster.local:40911",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dledgerPeers(instance, tt.group, tt.members); got != tt.want {
+				t.Errorf("dledgerPeers() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderBrokerConfig(t *testing.T) {
+	peers := "n0-demo-broker-1-0.demo-broker-hs.mq.svc.cluster.local:40911;" +
+		"n1-demo-broker-1-1.demo-broker-hs.mq.svc.cluster.local:40911"
+	managed := map[string]string{
+		configs.BrokerClusterName:     "demo",
+		configs.BrokerName:            "demo-broker-1",
+		configs.EnableDLegerCommitLog: "true",
+		configs.DLegerGroup:           "demo-broker-1",
+		configs.DLegerPeers:           peers,
+		configs.StorePathRootDir:      brokerStorePath,
+		configs.StorePathCommitLog:    brokerStorePath + "/commitlog",
+	}
+	with := func(extra map[string]string) map[string]string {
+		m := make(map[string]string, len(managed)+len(extra))
+		for k, v := range managed {
+			m[k] = v
+		}
+		for k, v := range extra {
+			m[k] = v
+		}
+		return m
+	}
+
+	tests := []struct {
+		name        string
+		config      map[string]string
+		acl         *rocketmqv1.Acl
+		defaults    map[string]string
+		namesrvAddr string
+		want        map[string]string
+	}{
+		{
+			name: "managed keys only",
+			want: managed,
+		},
+		{
+			name:     "spec config overrides defaults",
+			defaults: map[string]string{"flushDiskType": "ASYNC_FLUSH", "deleteWhen": "04"},
+			config:   map[string]string{"flushDiskType": "SYNC_FLUSH"},
+			want:     with(map[string]string{"flushDiskType": "SYNC_FLUSH", "deleteWhen": "04"}),
+		},
+		{
+			name:     "managed keys override spec config and defaults",
+			defaults: map[string]string{configs.BrokerName: "default", configs.StorePathRootDir: "/tmp"},
+			config:   map[string]string{configs.BrokerClusterName: "other", configs.DLegerPeers: "n0-x:1"},
+			want:     managed,
+		},
+		{
+			name:   "spec namesrvAddr kept without resolved nameserver",
+			config: map[string]string{configs.NamesrvAddr: "10.0.0.1:9876"},
+			want:   with(map[string]string{configs.NamesrvAddr: "10.0.0.1:9876"}),
+		},
+		{
+			name:        "resolved namesrvAddr overrides spec config",
+			config:      map[string]string{configs.NamesrvAddr: "10.0.0.1:9876"},
+			namesrvAddr: "ns-0:9876;ns-1:9876",
+			want:        with(map[string]string{configs.NamesrvAddr: "ns-0:9876;ns-1:9876"}),
+		},
+		{
+			name:   "acl enables aclEnable",
+			acl:    &rocketmqv1.Acl{},
+			config: map[string]string{configs.AclEnable: "false"},
+			want:   with(map[string]string{configs.AclEnable: "true"}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &rocketmqv1.DledgerBroker{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "demo"},
+				Spec:       rocketmqv1.DledgerBrokerSpec{Config: tt.config, Acl: tt.acl},
+			}
+			data := renderBrokerConfig(instance, 1, 2, tt.defaults, tt.namesrvAddr)
+			if len(data) != 2 {
+				t.Fatalf("renderBrokerConfig() rendered %d files, want 2", len(data))
+			}
+			for k, selfId := range []string{"n0", "n1"} {
+				got := configs.ParseProperties(data[brokerConfigFileName(k)])
+				want := with(tt.want)
+				want[configs.DLegerSelfId] = selfId
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %v, want %v", brokerConfigFileName(k), got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderBrokerConfigDoesNotMutateInputs(t *testing.T) {
+	defaults := map[string]string{"deleteWhen": "04"}
+	instance := &rocketmqv1.DledgerBroker{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "demo"},
+		Spec:       rocketmqv1.DledgerBrokerSpec{Config: map[string]string{"flushDiskType": "SYNC_FLUSH"}},
+	}
+	renderBrokerConfig(instance, 0, 3, defaults, "ns:9876")
+	if !reflect.DeepEqual(defaults, map[string]string{"deleteWhen": "04"}) {
+		t.Errorf("defaults mutated: %v", defaults)
+	}
+	if !reflect.DeepEqual(instance.Spec.Config, map[string]string{"flushDiskType": "SYNC_FLUSH"}) {
+		t.Errorf("spec config mutated: %v", instance.Spec.Config)
+	}
+}
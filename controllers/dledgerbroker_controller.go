@@ -18,30 +18,63 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
 	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"rocketmq-operator-v2/pkg/logi"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/admin"
 )
 
 var log = logi.GetSugaredLogger()
 var dledgerBrokerFinalizerName = "dledgerbroker.finalizers.rocketmq.daocloud.io"
 
+const volumeResizeRequeueInterval = 30 * time.Second
+
 // DledgerBrokerReconciler reconciles a DledgerBroker object
 type DledgerBrokerReconciler struct {
 	client.Client
 	Log    *zap.SugaredLogger
 	Scheme *runtime.Scheme
+	// Admin 通过remoting协议查询和管理nameserver、broker及dledger，为空时不更新Status.BrokerMembers，
+	// 调整组成员、重启pod以及扩缩容都会一直等待
+	Admin admin.Admin
+	// StatusSyncInterval 定期刷新Status.BrokerMembers的间隔，为0时不定期刷新
+	StatusSyncInterval time.Duration
 }
 
 // +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=dledgerbrokers,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=dledgerbrokers/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=nameservers,verbs=get;list;watch
+// +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=rocketmqusers,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch;update;patch;delete
+// +kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create
 
 func (r *DledgerBrokerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	reqLog := log.With(
@@ -68,6 +101,19 @@ func (r *DledgerBrokerReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		}
 	} else {
 		if containsString(instance.GetFinalizers(), dledgerBrokerFinalizerName) {
+			if instance.Status.Phase != rocketmqv1.PhaseTerminating {
+				instance.Status.Phase = rocketmqv1.PhaseTerminating
+				if err := r.Status().Update(ctx, instance); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+			released, err := r.finalizeVolumes(ctx, instance)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if !released {
+				return ctrl.Result{RequeueAfter: retentionRequeueInterval}, nil
+			}
 			controllerutil.RemoveFinalizer(instance, dledgerBrokerFinalizerName)
 			if err := r.Update(ctx, instance); err != nil {
 				return ctrl.Result{}, err
@@ -75,9 +121,298 @@ func (r *DledgerBrokerReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		}
 		return ctrl.Result{}, nil
 	}
-	//
 
-	return ctrl.Result{}, nil
+	if len(instance.Spec.BrokerNumberPerGroup) < instance.Spec.BrokerGroupNumber {
+		r.Log.Errorw("brokerNumberPerGroup does not cover every broker group",
+			"brokerGroupNumber", instance.Spec.BrokerGroupNumber,
+			"brokerNumberPerGroup", instance.Spec.BrokerNumberPerGroup)
+		return ctrl.Result{}, nil
+	}
+
+	oldStatus := instance.Status.DeepCopy()
+	namesrvAddr, ready, err := r.resolveNameserver(ctx, instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !ready {
+		// nameserver创建或就绪后会通过watch重新触发
+		r.Log.Infow("waiting for nameserver", "nameserver", instance.NameserverRef())
+		instance.Status.Phase = setHealthConditions(&instance.Status.Conditions, instance.Generation, instance.Status.Phase,
+			[]string{fmt.Sprintf("waiting for nameserver %s", instance.NameserverRef())}, nil, reasonPodsUnavailable, nil)
+		return ctrl.Result{}, r.updateStatus(ctx, instance, oldStatus)
+	}
+
+	if err := r.reconcileHeadlessService(ctx, instance); err != nil {
+		return ctrl.Result{}, err
+	}
+	admin, adminVersion, err := r.reconcileAcl(ctx, instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	ctx = withAdminCredentials(ctx, admin)
+	defaults, err := r.defaultBrokerConfig(ctx)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	configMaps := make([]string, 0, instance.Spec.BrokerGroupNumber)
+	var drift, released, scalingOut, resizingMembers, rolling []string
+	membersReleased := true
+	var rollingReason string
+	memberCounts := make([]int, 0, instance.Spec.BrokerGroupNumber)
+	for i := 0; i < instance.Spec.BrokerGroupNumber; i++ {
+		members, msg, err := r.groupMembers(ctx, instance, i)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if msg != "" {
+			resizingMembers = append(resizingMembers, msg)
+		}
+		memberCounts = append(memberCounts, members)
+		data := renderBrokerConfig(instance, i, members, defaults, namesrvAddr)
+		if err := r.reconcileConfigMap(ctx, instance, i, data); err != nil {
+			return ctrl.Result{}, err
+		}
+		configMaps = append(configMaps, brokerConfigMapName(instance, i))
+		allowed, reused, err := r.pendingReleasedVolumes(ctx, instance, i, members)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if len(reused) > 0 {
+			released = append(released, releasedVolumesMessage(brokerGroupName(instance, i), reused))
+		}
+		if !allowed {
+			// 不创建会复用过时数据的broker组，等待用户处理保留的pvc
+			continue
+		}
+		recreate, err := r.expandVolumes(ctx, instance, i)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if recreate {
+			return ctrl.Result{Requeue: true}, nil
+		}
+		sts, err := r.reconcileStatefulSet(ctx, instance, i, members, configHash(data))
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		drift = append(drift, storageDrift(instance, sts)...)
+		msg, reason, err := r.rollBrokerGroup(ctx, instance, i, members, sts, namesrvAddr)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if msg != "" {
+			rolling = append(rolling, msg)
+		}
+		// leadership转移失败需要人工介入，优先于未经转移重启leader展示
+		if reason != "" && rollingReason != reasonLeadershipTransferFailed {
+			rollingReason = reason
+		}
+		msg, err = r.scaleOutBrokerGroup(ctx, instance, i, sts, namesrvAddr)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if msg != "" {
+			scalingOut = append(scalingOut, msg)
+		}
+		done, err := r.releaseRemovedMembers(ctx, instance, i, members)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		membersReleased = membersReleased && done
+	}
+	if len(drift) > 0 {
+		r.Log.Warnw("broker volumes drift from spec.storage", "drift", drift)
+	}
+	if len(released) > 0 {
+		r.Log.Warnw("refuse to reuse released broker volumes", "released", released)
+	}
+	setStorageCondition(instance, drift, released)
+	resizing, err := r.volumeResizeStatus(ctx, instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	instance.Status.VolumeResize = resizing
+	staleRemoved, scalingIn, err := r.removeStaleGroups(ctx, instance, namesrvAddr)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.reconcileExternalAccess(ctx, instance); err != nil {
+		return ctrl.Result{}, err
+	}
+	setScalingCondition(instance, scalingIn, scalingOut, resizingMembers)
+	setRollingCondition(instance, rolling, rollingReason)
+	if err := r.setAccessStatus(ctx, instance, memberCounts); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.syncBrokerInfo(ctx, instance, namesrvAddr); err != nil {
+		return ctrl.Result{}, err
+	}
+	var progressing []string
+	for _, msgs := range [][]string{scalingIn, scalingOut, resizingMembers, rolling} {
+		progressing = append(progressing, msgs...)
+	}
+	for _, v := range resizing {
+		progressing = append(progressing, fmt.Sprintf("volume %s resizing to %s", v.Name, v.Requested))
+	}
+	healthRequeue, err := r.brokerHealth(ctx, instance, memberCounts, progressing)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := reconcileExporter(ctx, r.Client, r.Scheme, r.Log, instance, brokerExporter(instance, namesrvAddr, adminVersion)); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	instance.Status.BrokerConfigmap = strings.Join(configMaps, ",")
+	instance.Status.ObservedGeneration = instance.Generation
+	if err := r.updateStatus(ctx, instance, oldStatus); err != nil {
+		return ctrl.Result{}, err
+	}
+	if len(resizing) > 0 {
+		// pvc不归实例所有，扩容期间定期刷新进度
+		return ctrl.Result{RequeueAfter: volumeResizeRequeueInterval}, nil
+	}
+	if len(scalingIn) > 0 || len(scalingOut) > 0 || len(resizingMembers) > 0 || len(rolling) > 0 {
+		// 等待broker写入停止、消费完毕、注册到nameserver或leader选举，这些状态变化不会触发调谐
+		return ctrl.Result{RequeueAfter: scalingRequeueInterval}, nil
+	}
+	if !staleRemoved || !membersReleased {
+		return ctrl.Result{RequeueAfter: retentionRequeueInterval}, nil
+	}
+	// leader切换、broker注册等变化不会触发调谐，定期刷新BrokerMembers；
+	// pod长时间未就绪也不会触发调谐，在其达到降级阈值时重新检查
+	requeue := r.StatusSyncInterval
+	if healthRequeue > 0 && (requeue == 0 || healthRequeue < requeue) {
+		requeue = healthRequeue
+	}
+	return ctrl.Result{RequeueAfter: requeue}, nil
+}
+
+// updateStatus 仅在状态发生变化时更新status子资源
+func (r *DledgerBrokerReconciler) updateStatus(ctx context.Context, instance *rocketmqv1.DledgerBroker, oldStatus *rocketmqv1.DledgerBrokerStatus) error {
+	if equality.Semantic.DeepEqual(oldStatus, &instance.Status) {
+		return nil
+	}
+	return r.Status().Update(ctx, instance)
+}
+
+func (r *DledgerBrokerReconciler) reconcileConfigMap(ctx context.Context, instance *rocketmqv1.DledgerBroker, i int, data map[string]string) error {
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Name:      brokerConfigMapName(instance, i),
+		Namespace: instance.Namespace,
+	}}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, cm, func() error {
+		mutateBrokerConfigMap(instance, i, data, cm)
+		return controllerutil.SetControllerReference(instance, cm, r.Scheme)
+	})
+	if err != nil {
+		return err
+	}
+	if op != controllerutil.OperationResultNone {
+		r.Log.Infow("reconciled broker configmap", "configmap", cm.Name, "operation", op)
+	}
+	return nil
+}
+
+func (r *DledgerBrokerReconciler) reconcileHeadlessService(ctx context.Context, instance *rocketmqv1.DledgerBroker) error {
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name:      brokerHeadlessServiceName(instance),
+		Namespace: instance.Namespace,
+	}}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, svc, func() error {
+		mutateBrokerHeadlessService(instance, svc)
+		return controllerutil.SetControllerReference(instance, svc, r.Scheme)
+	})
+	if err != nil {
+		return err
+	}
+	if op != controllerutil.OperationResultNone {
+		r.Log.Infow("reconciled broker headless service", "service", svc.Name, "operation", op)
+	}
+	return nil
+}
+
+func (r *DledgerBrokerReconciler) reconcileStatefulSet(ctx context.Context, instance *rocketmqv1.DledgerBroker, i, members int, hash string) (*appsv1.StatefulSet, error) {
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+		Name:      brokerGroupName(instance, i),
+		Namespace: instance.Namespace,
+	}}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, sts, func() error {
+		mutateBrokerStatefulSet(instance, i, members, hash, sts)
+		return controllerutil.SetControllerReference(instance, sts, r.Scheme)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if op != controllerutil.OperationResultNone {
+		r.Log.Infow("reconciled broker statefulset", "statefulset", sts.Name, "operation", op)
+	}
+	return sts, nil
+}
+
+// removeStaleGroups 缩容时先将超出BrokerGroupNumber的broker组设置为只读并等待消息消费完毕，
+// 再删除其statefulset和配置，broker停止后按RetentionPolicy处理其pvc。
+// 返回false表示缩容尚未完成，等待消费时同时返回描述进度的消息
+func (r *DledgerBrokerReconciler) removeStaleGroups(ctx context.Context, instance *rocketmqv1.DledgerBroker, namesrvAddr string) (bool, []string, error) {
+	stale := func(group int) bool { return group >= instance.Spec.BrokerGroupNumber }
+	stsList := &appsv1.StatefulSetList{}
+	if err := r.List(ctx, stsList, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(brokerClusterLabels(instance))); err != nil {
+		return false, nil, err
+	}
+	var draining []string
+	for k := range stsList.Items {
+		sts := &stsList.Items[k]
+		group, err := strconv.Atoi(sts.Labels[labelBrokerGroup])
+		if err != nil || !stale(group) || !metav1.IsControlledBy(sts, instance) || !sts.DeletionTimestamp.IsZero() {
+			continue
+		}
+		drained, msg, err := r.drainBrokerGroup(ctx, instance, group, sts, namesrvAddr)
+		if err != nil {
+			return false, nil, err
+		}
+		if !drained {
+			draining = append(draining, msg)
+		}
+	}
+	if len(draining) > 0 {
+		return false, draining, nil
+	}
+
+	cms := &corev1.ConfigMapList{}
+	if err := r.List(ctx, cms, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(brokerClusterLabels(instance))); err != nil {
+		return false, nil, err
+	}
+	for k := range cms.Items {
+		cm := &cms.Items[k]
+		group, err := strconv.Atoi(cm.Labels[labelBrokerGroup])
+		if err != nil || !stale(group) || !metav1.IsControlledBy(cm, instance) {
+			continue
+		}
+		r.Log.Infow("delete stale broker configmap", "configmap", cm.Name)
+		if err := r.Delete(ctx, cm); err != nil && !errors.IsNotFound(err) {
+			return false, nil, err
+		}
+	}
+	stopped, err := r.stopBrokerGroups(ctx, instance, stale)
+	if err != nil || !stopped {
+		return false, nil, err
+	}
+	released, err := r.releaseVolumes(ctx, instance, func(group, _ int) bool { return stale(group) })
+	return released, nil, err
+}
+
+// finalizeVolumes 删除实例时按RetentionPolicy处理所有broker组的pvc，Retain时直接返回
+func (r *DledgerBrokerReconciler) finalizeVolumes(ctx context.Context, instance *rocketmqv1.DledgerBroker) (bool, error) {
+	if retentionPolicy(instance) == rocketmqv1.RetentionPolicyRetain {
+		return true, nil
+	}
+	// 先停止broker，保证快照数据一致且pvc能够被删除
+	stopped, err := r.stopBrokerGroups(ctx, instance, func(int) bool { return true })
+	if err != nil || !stopped {
+		return false, err
+	}
+	return r.releaseVolumes(ctx, instance, func(int, int) bool { return true })
 }
 
 func containsString(slice []string, s string) bool {
@@ -92,5 +427,14 @@ func containsString(slice []string, s string) bool {
 func (r *DledgerBrokerReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&rocketmqv1.DledgerBroker{}).
+		Owns(&appsv1.StatefulSet{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&corev1.Service{}).
+		Owns(&corev1.ConfigMap{}).
+		Owns(&corev1.Secret{}).
+		Watches(&source.Kind{Type: &rocketmqv1.Nameserver{}}, handler.EnqueueRequestsFromMapFunc(r.brokersForNameserver)).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.brokersForSecret)).
+		Watches(&source.Kind{Type: &rocketmqv1.RocketMQUser{}}, handler.EnqueueRequestsFromMapFunc(r.brokersForUser),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
 		Complete(r)
 }
@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"rocketmq-operator-v2/pkg/logi"
+)
+
+func TestRemoveStaleGroups(t *testing.T) {
+	instance := testBrokerInstance()
+	instance.UID = "uid"
+	instance.Spec.BrokerGroupNumber = 3
+	instance.Spec.BrokerNumberPerGroup = []int{1, 1, 1}
+	configMap := func(i int) *corev1.ConfigMap {
+		cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Namespace: instance.Namespace,
+			Name:      brokerConfigMapName(instance, i),
+			Labels:    brokerGroupLabels(instance, i),
+		}}
+		if err := controllerutil.SetControllerReference(instance, cm, testScheme()); err != nil {
+			t.Fatal(err)
+		}
+		return cm
+	}
+	kept, stale := testBrokerStatefulSet(t, instance, 0), testBrokerStatefulSet(t, instance, 1)
+	stale.Annotations = map[string]string{annotationDrained: "true"}
+	// 同名集群标签但不属于该实例的statefulset不会被删除
+	foreign := testBrokerStatefulSet(t, instance, 2)
+	foreign.OwnerReferences = nil
+	instance.Spec.BrokerGroupNumber = 1
+	objs := []client.Object{kept, stale, foreign, configMap(0), configMap(1)}
+	c := newFakeClient(objs...)
+	r := &DledgerBrokerReconciler{Client: c, Log: logi.GetSugaredLogger()}
+	ctx := context.Background()
+
+	// 先删除statefulset，pod退出后才完成缩容
+	pod := testBrokerPod(instance, 1, 0, true)
+	if err := c.Create(ctx, &pod); err != nil {
+		t.Fatal(err)
+	}
+	removed, draining, err := r.removeStaleGroups(ctx, instance, "ns:9876")
+	if err != nil || removed || len(draining) > 0 {
+		t.Fatalf("removeStaleGroups() = %v, %v, %v, want waiting for pods to exit", removed, draining, err)
+	}
+	if err := c.Delete(ctx, &pod); err != nil {
+		t.Fatal(err)
+	}
+	if removed, draining, err = r.removeStaleGroups(ctx, instance, "ns:9876"); err != nil || !removed || len(draining) > 0 {
+		t.Fatalf("removeStaleGroups() = %v, %v, %v, want removed", removed, draining, err)
+	}
+
+	for _, obj := range objs {
+		err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj.DeepCopyObject().(client.Object))
+		if deleted := errors.IsNotFound(err); deleted != (obj == stale || obj.GetName() == brokerConfigMapName(instance, 1)) {
+			t.Errorf("%T %s deleted = %v, error %v", obj, obj.GetName(), deleted, err)
+		}
+	}
+	remaining := &appsv1.StatefulSetList{}
+	if err := c.List(ctx, remaining); err != nil || len(remaining.Items) != 2 {
+		t.Errorf("statefulsets = %d, %v, want 2", len(remaining.Items), err)
+	}
+}
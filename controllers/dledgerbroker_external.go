@@ -0,0 +1,482 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	errors2 "github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/configs"
+)
+
+const (
+	// labelExternal 标记为broker pod创建的对外service
+	labelExternal = "rocketmq.daocloud.io/external"
+	// annotationExternalAccess 记录pod模板使用的外部访问方式和域名模板，变化时滚动pod使broker重新注册
+	annotationExternalAccess = "rocketmq.daocloud.io/external-access"
+
+	brokerAdvertiseContainerName = "advertise"
+
+	brokerExternalVolume        = "broker-external"
+	brokerExternalMountPath     = "/home/rocketmq/external"
+	brokerRuntimeConfigVolume   = "broker-runtime-config"
+	brokerRuntimeConfigPath     = "/home/rocketmq/runtime-conf"
+	brokerRuntimeConfigFile     = brokerRuntimeConfigPath + "/broker.conf"
+	brokerExternalPortKeySuffix = ".port"
+	brokerExternalHostKeySuffix = ".host"
+
+	// statefulSetPodNameLabel statefulset为每个pod添加的pod名称标签
+	statefulSetPodNameLabel = "statefulset.kubernetes.io/pod-name"
+
+	// annotationExternalDNSHostname external-dns根据该注解为service创建dns记录
+	annotationExternalDNSHostname = "external-dns.alpha.kubernetes.io/hostname"
+)
+
+// brokerExternalConfigMapName 返回记录各broker pod对外端口和地址的configmap名称，由advertise初始化容器读取
+func brokerExternalConfigMapName(instance *rocketmqv1.DledgerBroker) string {
+	return fmt.Sprintf("%s-broker-external", instance.Name)
+}
+
+// brokerPodName 返回第i个broker组第k个节点的pod名称
+func brokerPodName(instance *rocketmqv1.DledgerBroker, i, k int) string {
+	return fmt.Sprintf("%s-%d", brokerGroupName(instance, i), k)
+}
+
+// brokerExternalServiceName 返回broker pod对外service的名称
+func brokerExternalServiceName(pod string) string {
+	return pod + "-external"
+}
+
+// brokerAdvertiseScript 为advertise初始化容器的脚本：复制本节点的配置文件，
+// 等待operator分配端口和地址后追加brokerIP1和listenPort。未写入地址时使用所在节点的ip
+func brokerAdvertiseScript(access *rocketmqv1.ExternalAccess) string {
+	lines := []string{
+		"set -e",
+		fmt.Sprintf("cp %s/broker-${HOSTNAME##*-}.conf %s", brokerConfigMountPath, brokerRuntimeConfigFile),
+		fmt.Sprintf("port_file=%s/${HOSTNAME}%s", brokerExternalMountPath, brokerExternalPortKeySuffix),
+		`until [ -s "$port_file" ]; do echo "waiting for external port of $HOSTNAME"; sleep 2; done`,
+		"host=$HOST_IP",
+	}
+	if advertiseHost(access) {
+		lines = append(lines,
+			fmt.Sprintf("host_file=%s/${HOSTNAME}%s", brokerExternalMountPath, brokerExternalHostKeySuffix),
+			`until [ -s "$host_file" ]; do echo "waiting for advertised address of $HOSTNAME"; sleep 2; done`,
+			`host=$(cat "$host_file")`,
+		)
+	}
+	lines = append(lines, fmt.Sprintf(`printf '\n%s=%%s\n%s=%%s\n' "$host" "$(cat "$port_file")" >> %s`,
+		configs.BrokerIP1, configs.ListenPort, brokerRuntimeConfigFile))
+	return strings.Join(lines, "\n")
+}
+
+// applyBrokerExternalAccess 开启外部访问时添加advertise初始化容器，broker使用其生成的配置文件启动，关闭时移除
+func applyBrokerExternalAccess(instance *rocketmqv1.DledgerBroker, template *corev1.PodTemplateSpec, container *corev1.Container) {
+	podSpec := &template.Spec
+	access := instance.Spec.ExternalAccess
+	if access == nil {
+		delete(template.Annotations, annotationExternalAccess)
+		container.Command = brokerStartCommand(brokerConfigMountPath + "/broker-${HOSTNAME##*-}.conf")
+		removeVolume(podSpec, brokerExternalVolume)
+		removeVolume(podSpec, brokerRuntimeConfigVolume)
+		removeVolumeMount(container, brokerRuntimeConfigVolume)
+		for k := range podSpec.InitContainers {
+			if podSpec.InitContainers[k].Name == brokerAdvertiseContainerName {
+				podSpec.InitContainers = append(podSpec.InitContainers[:k], podSpec.InitContainers[k+1:]...)
+				break
+			}
+		}
+		return
+	}
+
+	template.Annotations = mergeLabels(template.Annotations, map[string]string{
+		annotationExternalAccess: string(access.Type) + "/" + access.Hostname,
+	})
+	optional := true
+	setVolume(podSpec, corev1.Volume{
+		Name: brokerExternalVolume,
+		VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: brokerExternalConfigMapName(instance)},
+			// configmap由operator在statefulset之后创建，初始化容器会等待其中的端口
+			Optional: &optional,
+		}},
+	})
+	setVolume(podSpec, corev1.Volume{
+		Name:         brokerRuntimeConfigVolume,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+	container.Command = brokerStartCommand(brokerRuntimeConfigFile)
+	setVolumeMount(container, corev1.VolumeMount{Name: brokerRuntimeConfigVolume, MountPath: brokerRuntimeConfigPath})
+
+	var init *corev1.Container
+	for k := range podSpec.InitContainers {
+		if podSpec.InitContainers[k].Name == brokerAdvertiseContainerName {
+			init = &podSpec.InitContainers[k]
+		}
+	}
+	if init == nil {
+		podSpec.InitContainers = append(podSpec.InitContainers, corev1.Container{Name: brokerAdvertiseContainerName})
+		init = &podSpec.InitContainers[len(podSpec.InitContainers)-1]
+	}
+	init.Image = instance.Spec.Image
+	init.ImagePullPolicy = instance.Spec.ImagePullPolicy
+	init.Command = []string{"sh", "-c", brokerAdvertiseScript(access)}
+	init.Env = []corev1.EnvVar{{
+		Name:      "HOST_IP",
+		ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"}},
+	}}
+	setVolumeMount(init, corev1.VolumeMount{Name: brokerConfigVolume, MountPath: brokerConfigMountPath})
+	setVolumeMount(init, corev1.VolumeMount{Name: brokerExternalVolume, MountPath: brokerExternalMountPath})
+	setVolumeMount(init, corev1.VolumeMount{Name: brokerRuntimeConfigVolume, MountPath: brokerRuntimeConfigPath})
+}
+
+// brokerListensOnNodePort 返回broker是否直接监听分配的nodePort。rocketmq以brokerIP1:listenPort注册到nameserver，
+// 无法单独指定注册的端口，NodePort方式下broker只能监听nodePort才能让客户端通过所在节点访问
+func brokerListensOnNodePort(instance *rocketmqv1.DledgerBroker) bool {
+	return instance.Spec.ExternalAccess != nil && instance.Spec.ExternalAccess.Type == corev1.ServiceTypeNodePort
+}
+
+// advertiseHost 返回broker是否以operator写入的地址注册，否则使用所在节点的ip
+func advertiseHost(access *rocketmqv1.ExternalAccess) bool {
+	return access.Hostname != "" || access.Type == corev1.ServiceTypeLoadBalancer
+}
+
+// brokerHostname 返回第i个broker组第k个pod注册的域名，未设置域名模板时为空
+func brokerHostname(instance *rocketmqv1.DledgerBroker, i, k int) (string, error) {
+	access := instance.Spec.ExternalAccess
+	if access == nil || access.Hostname == "" {
+		return "", nil
+	}
+	hostname, err := access.RenderHostname(instance.Name, instance.Namespace, brokerGroupName(instance, i), i, k)
+	return hostname, errors2.Wrap(err, "render externalAccess.hostname")
+}
+
+// mutateBrokerExternalService 渲染broker pod的对外service，只暴露客户端使用的main和vip端口。
+// 使用Local流量策略保留客户端ip供acl白名单使用，NodePort方式下broker也只在所在节点上可达。
+// hostname非空且开启ExternalDNS时添加external-dns注解
+func mutateBrokerExternalService(instance *rocketmqv1.DledgerBroker, i int, pod, hostname string, nodePort int32, svc *corev1.Service) {
+	access := instance.Spec.ExternalAccess
+	labels := brokerGroupLabels(instance, i)
+	labels[labelExternal] = "true"
+	svc.Labels = mergeLabels(svc.Labels, labels)
+	svc.Annotations = mergeLabels(svc.Annotations, access.Annotations)
+	if access.ExternalDNS && hostname != "" {
+		svc.Annotations = mergeLabels(svc.Annotations, map[string]string{annotationExternalDNSHostname: hostname})
+	} else if _, ok := access.Annotations[annotationExternalDNSHostname]; !ok {
+		delete(svc.Annotations, annotationExternalDNSHostname)
+	}
+	svc.Spec.Type = access.Type
+	svc.Spec.ExternalTrafficPolicy = ""
+	if svc.Spec.Type != corev1.ServiceTypeClusterIP {
+		svc.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyTypeLocal
+	}
+	svc.Spec.Selector = map[string]string{statefulSetPodNameLabel: pod}
+	if svc.Spec.Type == corev1.ServiceTypeNodePort {
+		// broker直接监听nodePort，fastListenPort固定为listenPort-2
+		svc.Spec.Ports = []corev1.ServicePort{
+			{Name: "main", Port: nodePort, TargetPort: intstr.FromInt(int(nodePort)), NodePort: nodePort},
+			{Name: "vip", Port: nodePort - 2, TargetPort: intstr.FromInt(int(nodePort - 2)), NodePort: nodePort - 2},
+		}
+		return
+	}
+	ports := []corev1.ServicePort{
+		{Name: "main", Port: brokerPortMain, TargetPort: intstr.FromInt(brokerPortMain)},
+		{Name: "vip", Port: brokerPortVip, TargetPort: intstr.FromInt(brokerPortVip)},
+	}
+	// 保留apiserver为LoadBalancer分配的nodePort
+	for k := range ports {
+		for _, old := range svc.Spec.Ports {
+			if svc.Spec.Type == corev1.ServiceTypeLoadBalancer && old.Name == ports[k].Name && old.Port == ports[k].Port {
+				ports[k].NodePort = old.NodePort
+			}
+		}
+	}
+	svc.Spec.Ports = ports
+}
+
+// nodePortRange 解析MOCK_RANDOM_PORT配置的端口范围
+func nodePortRange() (int32, int32, error) {
+	return parseNodePortRange(configs.GetGlobalConfig().MOCK_RANDOM_PORT)
+}
+
+// parseNodePortRange 解析 start-end 格式的端口范围，范围内至少要能容纳一对相差2的端口
+func parseNodePortRange(s string) (int32, int32, error) {
+	kv := strings.SplitN(s, "-", 2)
+	if len(kv) != 2 {
+		return 0, 0, errors2.Errorf("invalid MOCK_RANDOM_PORT %q, expected start-end", s)
+	}
+	start, err1 := strconv.Atoi(strings.TrimSpace(kv[0]))
+	end, err2 := strconv.Atoi(strings.TrimSpace(kv[1]))
+	if err1 != nil || err2 != nil || start <= 0 || end-start < 2 {
+		return 0, 0, errors2.Errorf("invalid MOCK_RANDOM_PORT %q, expected start-end", s)
+	}
+	return int32(start), int32(end), nil
+}
+
+// allocateNodePort 为pod分配一个端口p，使p和p-2都未被使用。从pod名称的哈希位置开始查找，减少多个实例同时分配时的冲突
+func allocateNodePort(used map[int32]bool, start, end int32, pod string) (int32, error) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(pod))
+	size := end - start - 1
+	offset := int32(h.Sum32() % uint32(size))
+	for n := int32(0); n < size; n++ {
+		p := start + 2 + (offset+n)%size
+		if !used[p] && !used[p-2] {
+			return p, nil
+		}
+	}
+	return 0, errors2.Errorf("no free node port pair in range %d-%d", start, end)
+}
+
+// usedNodePorts 返回集群中已被service占用的nodePort
+func (r *DledgerBrokerReconciler) usedNodePorts(ctx context.Context) (map[int32]bool, error) {
+	services := &corev1.ServiceList{}
+	if err := r.List(ctx, services); err != nil {
+		return nil, err
+	}
+	used := make(map[int32]bool)
+	for k := range services.Items {
+		for _, p := range services.Items[k].Spec.Ports {
+			if p.NodePort != 0 {
+				used[p.NodePort] = true
+			}
+		}
+	}
+	return used, nil
+}
+
+// reconcileExternalAccess 为每个broker pod创建对外service，将分配的端口和负载均衡地址写入configmap供advertise初始化容器读取，
+// 同时删除不再需要的service，并在状态中记录内部和外部访问地址
+func (r *DledgerBrokerReconciler) reconcileExternalAccess(ctx context.Context, instance *rocketmqv1.DledgerBroker) error {
+	existing := &corev1.ServiceList{}
+	if err := r.List(ctx, existing, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(mergeLabels(brokerClusterLabels(instance), map[string]string{labelExternal: "true"}))); err != nil {
+		return err
+	}
+	// 为所有broker statefulset的pod(包括缩容中的broker组)保留service
+	stsList := &appsv1.StatefulSetList{}
+	if err := r.List(ctx, stsList, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(brokerClusterLabels(instance))); err != nil {
+		return err
+	}
+	// service名称到broker组序号和pod序号的映射
+	wanted := make(map[string][2]int)
+	if instance.Spec.ExternalAccess != nil {
+		for k := range stsList.Items {
+			sts := &stsList.Items[k]
+			group, err := strconv.Atoi(sts.Labels[labelBrokerGroup])
+			if err != nil || sts.Spec.Replicas == nil {
+				continue
+			}
+			for n := 0; n < int(*sts.Spec.Replicas); n++ {
+				wanted[brokerExternalServiceName(brokerPodName(instance, group, n))] = [2]int{group, n}
+			}
+		}
+	}
+	for k := range existing.Items {
+		svc := &existing.Items[k]
+		if _, ok := wanted[svc.Name]; ok {
+			continue
+		}
+		r.Log.Infow("delete broker external service", "service", svc.Name)
+		if err := r.Delete(ctx, svc); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	if instance.Spec.ExternalAccess == nil {
+		cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: brokerExternalConfigMapName(instance), Namespace: instance.Namespace}}
+		if err := r.Delete(ctx, cm); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	var used map[int32]bool
+	var start, end int32
+	data := make(map[string]string, 2*len(wanted))
+	for name, ordinal := range wanted {
+		group := ordinal[0]
+		pod := brokerPodName(instance, group, ordinal[1])
+		hostname, err := brokerHostname(instance, group, ordinal[1])
+		if err != nil {
+			return err
+		}
+		svc := &corev1.Service{}
+		err = r.Get(ctx, types.NamespacedName{Namespace: instance.Namespace, Name: name}, svc)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		nodePort := mainNodePort(svc)
+		if instance.Spec.ExternalAccess.Type == corev1.ServiceTypeNodePort && nodePort == 0 {
+			if used == nil {
+				if start, end, err = nodePortRange(); err != nil {
+					return err
+				}
+				if used, err = r.usedNodePorts(ctx); err != nil {
+					return err
+				}
+			}
+			if nodePort, err = allocateNodePort(used, start, end, pod); err != nil {
+				return err
+			}
+			used[nodePort], used[nodePort-2] = true, true
+		}
+
+		svc = &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: instance.Namespace}}
+		op, err := controllerutil.CreateOrUpdate(ctx, r.Client, svc, func() error {
+			mutateBrokerExternalService(instance, group, pod, hostname, nodePort, svc)
+			return controllerutil.SetControllerReference(instance, svc, r.Scheme)
+		})
+		if err != nil {
+			return err
+		}
+		if op != controllerutil.OperationResultNone {
+			r.Log.Infow("reconciled broker external service", "service", svc.Name, "operation", op)
+		}
+
+		data[pod+brokerExternalPortKeySuffix] = strconv.Itoa(brokerPortMain)
+		if instance.Spec.ExternalAccess.Type == corev1.ServiceTypeNodePort {
+			data[pod+brokerExternalPortKeySuffix] = strconv.Itoa(int(nodePort))
+		}
+		if hostname != "" {
+			data[pod+brokerExternalHostKeySuffix] = hostname
+		} else if host := loadBalancerHost(svc); host != "" {
+			data[pod+brokerExternalHostKeySuffix] = host
+		}
+	}
+
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: brokerExternalConfigMapName(instance), Namespace: instance.Namespace}}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, cm, func() error {
+		cm.Labels = mergeLabels(cm.Labels, brokerClusterLabels(instance))
+		cm.Data = data
+		return controllerutil.SetControllerReference(instance, cm, r.Scheme)
+	})
+	if err != nil {
+		return err
+	}
+	if op != controllerutil.OperationResultNone {
+		r.Log.Infow("reconciled broker external configmap", "configmap", cm.Name, "operation", op)
+	}
+	return nil
+}
+
+// mainNodePort 返回service中main端口的nodePort，未分配时返回0
+func mainNodePort(svc *corev1.Service) int32 {
+	for _, p := range svc.Spec.Ports {
+		if p.Name == "main" {
+			return p.NodePort
+		}
+	}
+	return 0
+}
+
+func loadBalancerHost(svc *corev1.Service) string {
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			return ingress.IP
+		}
+		if ingress.Hostname != "" {
+			return ingress.Hostname
+		}
+	}
+	return ""
+}
+
+// brokerEndpoint 返回broker pod的监听端口以及注册到nameserver的地址，地址未确定时为空。
+// NodePort方式下监听端口为分配的nodePort，尚未分配时为0
+func brokerEndpoint(ctx context.Context, c client.Reader, instance *rocketmqv1.DledgerBroker, pod *corev1.Pod) (int, string, error) {
+	access := instance.Spec.ExternalAccess
+	if access == nil {
+		if pod == nil || pod.Status.PodIP == "" {
+			return brokerPortMain, "", nil
+		}
+		return brokerPortMain, fmt.Sprintf("%s:%d", pod.Status.PodIP, brokerPortMain), nil
+	}
+	svc := &corev1.Service{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: instance.Namespace, Name: brokerExternalServiceName(pod.Name)}, svc); err != nil {
+		if errors.IsNotFound(err) && brokerListensOnNodePort(instance) {
+			return 0, "", nil
+		}
+		if errors.IsNotFound(err) {
+			return brokerPortMain, "", nil
+		}
+		return 0, "", err
+	}
+	port := brokerPortMain
+	if brokerListensOnNodePort(instance) {
+		if port = int(mainNodePort(svc)); port == 0 {
+			return port, "", nil
+		}
+	}
+	i, err := strconv.Atoi(pod.Labels[labelBrokerGroup])
+	if err == nil && access.Hostname != "" {
+		hostname, err := brokerHostname(instance, i, podOrdinal(pod))
+		if err != nil {
+			return 0, "", err
+		}
+		return port, fmt.Sprintf("%s:%d", hostname, port), nil
+	}
+	if access.Type == corev1.ServiceTypeNodePort {
+		if pod.Status.HostIP == "" {
+			return port, "", nil
+		}
+		return port, fmt.Sprintf("%s:%d", pod.Status.HostIP, port), nil
+	}
+	if host := loadBalancerHost(svc); host != "" {
+		return brokerPortMain, fmt.Sprintf("%s:%d", host, brokerPortMain), nil
+	}
+	return brokerPortMain, "", nil
+}
+
+// brokerAddr 返回第i个broker组中第k个节点通过headless service访问的地址
+func brokerAddr(ctx context.Context, c client.Reader, instance *rocketmqv1.DledgerBroker, i, k int) (string, error) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: brokerPodName(instance, i, k), Namespace: instance.Namespace}}
+	port, _, err := brokerEndpoint(ctx, c, instance, pod)
+	if err != nil {
+		return "", err
+	}
+	if port == 0 {
+		return "", errors2.Errorf("node port of broker pod %s is not allocated", pod.Name)
+	}
+	return fmt.Sprintf("%s:%d", brokerPodFQDN(instance, i, k), port), nil
+}
+
+// setAccessStatus 记录各broker pod的内部地址和注册的地址
+func (r *DledgerBrokerReconciler) setAccessStatus(ctx context.Context, instance *rocketmqv1.DledgerBroker, memberCounts []int) error {
+	var internal, external []string
+	for i, members := range memberCounts {
+		pods, err := r.groupPods(ctx, instance, i)
+		if err != nil {
+			return err
+		}
+		for k := range pods {
+			if podOrdinal(&pods[k]) >= members {
+				continue
+			}
+			port, advertised, err := brokerEndpoint(ctx, r.Client, instance, &pods[k])
+			if err != nil {
+				return err
+			}
+			if port != 0 {
+				internal = append(internal, fmt.Sprintf("%s:%d", brokerPodFQDN(instance, i, podOrdinal(&pods[k])), port))
+			}
+			if instance.Spec.ExternalAccess != nil && advertised != "" {
+				external = append(external, advertised)
+			}
+		}
+	}
+	instance.Status.InternalAccess = strings.Join(internal, ";")
+	instance.Status.ExternalAccess = strings.Join(external, ";")
+	return nil
+}
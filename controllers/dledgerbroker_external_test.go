@@ -0,0 +1,472 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/configs"
+)
+
+func TestParseNodePortRange(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantStart int32
+		wantEnd   int32
+		wantErr   bool
+	}{
+		{value: "30000-32767", wantStart: 30000, wantEnd: 32767},
+		{value: " 31000 - 31010 ", wantStart: 31000, wantEnd: 31010},
+		{value: "31000-31002", wantStart: 31000, wantEnd: 31002},
+		{value: "31000-31001", wantErr: true},
+		{value: "31010-31000", wantErr: true},
+		{value: "0-100", wantErr: true},
+		{value: "31000", wantErr: true},
+		{value: "a-b", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			start, end, err := parseNodePortRange(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNodePortRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if start != tt.wantStart || end != tt.wantEnd {
+				t.Errorf("parseNodePortRange() = %d-%d, want %d-%d", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+
+	if start, end, err := nodePortRange(); err != nil || start != 30000 || end != 32767 {
+		t.Errorf("default nodePortRange() = %d-%d, %v, want 30000-32767", start, end, err)
+	}
+}
+
+func TestAllocateNodePort(t *testing.T) {
+	ports := func(ps ...int32) map[int32]bool {
+		used := make(map[int32]bool)
+		for _, p := range ps {
+			used[p] = true
+		}
+		return used
+	}
+	tests := []struct {
+		name    string
+		used    map[int32]bool
+		start   int32
+		end     int32
+		want    int32
+		wantErr bool
+	}{
+		{
+			name:  "single pair in range",
+			used:  ports(),
+			start: 31000,
+			end:   31002,
+			want:  31002,
+		},
+		{
+			name:  "skip port used by another service",
+			used:  ports(31003),
+			start: 31000,
+			end:   31003,
+			want:  31002,
+		},
+		{
+			name:  "skip port whose vip port is used",
+			used:  ports(31001),
+			start: 31000,
+			end:   31003,
+			want:  31002,
+		},
+		{
+			name:    "range exhausted",
+			used:    ports(31000, 31001),
+			start:   31000,
+			end:     31003,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := allocateNodePort(tt.used, tt.start, tt.end, "demo-broker-0-0")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("allocateNodePort() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("allocateNodePort() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocateNodePortAvoidsCollisions(t *testing.T) {
+	used := make(map[int32]bool)
+	instance := testBrokerInstance()
+	// 依次为10个pod分配端口，每个端口及其vip端口都不能与之前分配的重复
+	start, end := int32(31000), int32(31029)
+	for i := 0; i < 5; i++ {
+		for k := 0; k < 2; k++ {
+			pod := brokerPodName(instance, i, k)
+			p, err := allocateNodePort(used, start, end, pod)
+			if err != nil {
+				t.Fatalf("allocateNodePort(%s) error = %v", pod, err)
+			}
+			if p-2 < start || p > end {
+				t.Fatalf("allocateNodePort(%s) = %d, out of range %d-%d", pod, p, start, end)
+			}
+			if used[p] || used[p-2] {
+				t.Fatalf("allocateNodePort(%s) = %d, collides with %v", pod, p, used)
+			}
+			used[p], used[p-2] = true, true
+		}
+	}
+	if p, err := allocateNodePort(map[int32]bool{}, start, end, "demo-broker-0-0"); err != nil {
+		t.Fatal(err)
+	} else if q, _ := allocateNodePort(map[int32]bool{}, start, end, "demo-broker-0-0"); p != q {
+		t.Errorf("allocateNodePort() = %d then %d, want the same port for the same pod", p, q)
+	}
+}
+
+// runAdvertiseScript 在临时目录中执行advertise脚本，返回生成的broker配置
+func runAdvertiseScript(t *testing.T, access *rocketmqv1.ExternalAccess, external map[string]string) map[string]string {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	dir, err := ioutil.TempDir("", "advertise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	paths := map[string]string{
+		brokerConfigMountPath:   filepath.Join(dir, "conf"),
+		brokerExternalMountPath: filepath.Join(dir, "external"),
+		brokerRuntimeConfigPath: filepath.Join(dir, "runtime-conf"),
+	}
+	script := brokerAdvertiseScript(access)
+	for from, to := range paths {
+		if err := os.MkdirAll(to, 0755); err != nil {
+			t.Fatal(err)
+		}
+		script = strings.ReplaceAll(script, from, to)
+	}
+	conf := "brokerName=demo-broker-0\ndLegerSelfId=n1"
+	if err := ioutil.WriteFile(filepath.Join(paths[brokerConfigMountPath], "broker-1.conf"), []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range external {
+		if err := ioutil.WriteFile(filepath.Join(paths[brokerExternalMountPath], name), []byte(value), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(sh, "-c", script)
+	cmd.Env = []string{"HOSTNAME=demo-broker-0-1", "HOST_IP=192.168.1.10"}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("advertise script failed: %v\n%s", err, out)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(paths[brokerRuntimeConfigPath], "broker.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configs.ParseProperties(string(data))
+}
+
+func TestBrokerAdvertiseScript(t *testing.T) {
+	tests := []struct {
+		name     string
+		access   *rocketmqv1.ExternalAccess
+		external map[string]string
+		want     map[string]string
+	}{
+		{
+			name:     "node port advertises host ip",
+			access:   &rocketmqv1.ExternalAccess{Type: corev1.ServiceTypeNodePort},
+			external: map[string]string{"demo-broker-0-1.port": "31002"},
+			want:     map[string]string{configs.BrokerIP1: "192.168.1.10", configs.ListenPort: "31002"},
+		},
+		{
+			name:   "hostname template",
+			access: &rocketmqv1.ExternalAccess{Type: corev1.ServiceTypeNodePort, Hostname: "{{.Pod}}.mq.example.com"},
+			external: map[string]string{
+				"demo-broker-0-1.port": "31004",
+				"demo-broker-0-1.host": "demo-broker-0-1.mq.example.com",
+			},
+			want: map[string]string{configs.BrokerIP1: "demo-broker-0-1.mq.example.com", configs.ListenPort: "31004"},
+		},
+		{
+			name:   "load balancer address",
+			access: &rocketmqv1.ExternalAccess{Type: corev1.ServiceTypeLoadBalancer},
+			external: map[string]string{
+				"demo-broker-0-1.port": "10911",
+				"demo-broker-0-1.host": "203.0.113.7",
+			},
+			want: map[string]string{configs.BrokerIP1: "203.0.113.7", configs.ListenPort: "10911"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := map[string]string{"brokerName": "demo-broker-0", "dLegerSelfId": "n1"}
+			for k, v := range tt.want {
+				want[k] = v
+			}
+			if got := runAdvertiseScript(t, tt.access, tt.external); !reflect.DeepEqual(got, want) {
+				t.Errorf("broker.conf = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestBrokerNodePortListenPort(t *testing.T) {
+	instance := testBrokerInstance()
+	instance.Spec.BrokerGroupNumber = 1
+	instance.Spec.ExternalAccess = &rocketmqv1.ExternalAccess{Type: corev1.ServiceTypeNodePort}
+	pod := testBrokerPod(instance, 0, 1, true)
+	pod.Status.HostIP = "192.168.1.10"
+	ctx := context.Background()
+
+	// broker监听各自的nodePort，不再声明固定的main和vip端口
+	headless := &corev1.Service{}
+	mutateBrokerHeadlessService(instance, headless)
+	var ports []string
+	for _, p := range headless.Spec.Ports {
+		ports = append(ports, fmt.Sprintf("%s=%d", p.Name, p.Port))
+	}
+	if want := []string{"ha=10912", "dledger=40911"}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("headless service ports = %v, want %v", ports, want)
+	}
+	sts := &appsv1.StatefulSet{}
+	mutateBrokerStatefulSet(instance, 0, 3, "hash", sts)
+	if got := sts.Spec.Template.Spec.Containers[0].Ports; !reflect.DeepEqual(got, brokerContainerPorts(instance)) || len(got) != 2 {
+		t.Errorf("container ports = %+v", got)
+	}
+
+	// 端口分配前operator不访问broker
+	c := newFakeClient(&pod)
+	if addr, err := brokerAddr(ctx, c, instance, 0, 1); err == nil {
+		t.Errorf("brokerAddr() before node port allocation = %q, want error", addr)
+	}
+	r := &DledgerBrokerReconciler{Client: c}
+	if err := r.setAccessStatus(ctx, instance, []int{2}); err != nil || instance.Status.InternalAccess != "" {
+		t.Errorf("internal access before node port allocation = %q, %v", instance.Status.InternalAccess, err)
+	}
+
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: brokerExternalServiceName(pod.Name)}}
+	mutateBrokerExternalService(instance, 0, pod.Name, "", 31002, svc)
+	for _, p := range svc.Spec.Ports {
+		if p.Port != p.NodePort || p.TargetPort.IntVal != p.NodePort {
+			t.Errorf("external service port %+v, want port and targetPort equal to nodePort", p)
+		}
+	}
+	c = newFakeClient(&pod, svc)
+	addr, err := brokerAddr(ctx, c, instance, 0, 1)
+	if want := brokerPodFQDN(instance, 0, 1) + ":31002"; err != nil || addr != want {
+		t.Errorf("brokerAddr() = %q, %v, want %q", addr, err, want)
+	}
+	port, advertised, err := brokerEndpoint(ctx, c, instance, &pod)
+	if err != nil || port != 31002 || advertised != "192.168.1.10:31002" {
+		t.Errorf("brokerEndpoint() = %d, %q, %v", port, advertised, err)
+	}
+
+	// 其他方式下broker监听固定端口
+	instance.Spec.ExternalAccess.Type = corev1.ServiceTypeLoadBalancer
+	if got := brokerContainerPorts(instance); len(got) != 4 || got[0].ContainerPort != brokerPortMain {
+		t.Errorf("container ports with LoadBalancer = %+v", got)
+	}
+	if addr, err := brokerAddr(ctx, newFakeClient(&pod), instance, 0, 1); err != nil || addr != brokerPodFQDN(instance, 0, 1)+":10911" {
+		t.Errorf("brokerAddr() with LoadBalancer = %q, %v", addr, err)
+	}
+}
+
+func TestBrokerHostname(t *testing.T) {
+	instance := testBrokerInstance()
+	instance.Spec.BrokerGroupNumber = 2
+	pod := testBrokerPod(instance, 1, 2, true)
+	pod.Status.HostIP = "192.168.1.10"
+	svc := func(nodePort int32, lb string) *corev1.Service {
+		s := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: brokerExternalServiceName(pod.Name)},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "main", NodePort: nodePort}}},
+		}
+		if lb != "" {
+			s.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: lb}}
+		}
+		return s
+	}
+	tests := []struct {
+		name           string
+		access         rocketmqv1.ExternalAccess
+		svc            *corev1.Service
+		wantHostname   string
+		wantAdvertised string
+	}{
+		{
+			name:           "template by group and index",
+			access:         rocketmqv1.ExternalAccess{Type: corev1.ServiceTypeClusterIP, Hostname: "{{.Cluster}}-{{.Group}}-{{.Index}}.{{.Namespace}}.example.com"},
+			svc:            svc(0, ""),
+			wantHostname:   "demo-1-2.mq.example.com",
+			wantAdvertised: "demo-1-2.mq.example.com:10911",
+		},
+		{
+			name:           "template by pod with node port",
+			access:         rocketmqv1.ExternalAccess{Type: corev1.ServiceTypeNodePort, Hostname: "{{.Pod}}.example.com"},
+			svc:            svc(31002, ""),
+			wantHostname:   "demo-broker-1-2.example.com",
+			wantAdvertised: "demo-broker-1-2.example.com:31002",
+		},
+		{
+			name:           "hostname takes precedence over load balancer address",
+			access:         rocketmqv1.ExternalAccess{Type: corev1.ServiceTypeLoadBalancer, Hostname: "{{.BrokerName}}-{{.Index}}.example.com"},
+			svc:            svc(0, "203.0.113.7"),
+			wantHostname:   "demo-broker-1-2.example.com",
+			wantAdvertised: "demo-broker-1-2.example.com:10911",
+		},
+		{
+			name:           "load balancer address without hostname",
+			access:         rocketmqv1.ExternalAccess{Type: corev1.ServiceTypeLoadBalancer},
+			svc:            svc(0, "203.0.113.7"),
+			wantAdvertised: "203.0.113.7:10911",
+		},
+		{
+			name:           "node ip without hostname",
+			access:         rocketmqv1.ExternalAccess{Type: corev1.ServiceTypeNodePort},
+			svc:            svc(31002, ""),
+			wantAdvertised: "192.168.1.10:31002",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := instance.DeepCopy()
+			instance.Spec.ExternalAccess = &tt.access
+			hostname, err := brokerHostname(instance, 1, 2)
+			if err != nil || hostname != tt.wantHostname {
+				t.Errorf("brokerHostname() = %q, %v, want %q", hostname, err, tt.wantHostname)
+			}
+			_, advertised, err := brokerEndpoint(context.Background(), newFakeClient(tt.svc), instance, &pod)
+			if err != nil || advertised != tt.wantAdvertised {
+				t.Errorf("brokerEndpoint() advertised = %q, %v, want %q", advertised, err, tt.wantAdvertised)
+			}
+		})
+	}
+
+	instance.Spec.ExternalAccess = &rocketmqv1.ExternalAccess{Type: corev1.ServiceTypeClusterIP, Hostname: "{{.Broker}}.example.com"}
+	if _, err := brokerHostname(instance, 1, 2); err == nil {
+		t.Error("brokerHostname() with an unknown template field, want error")
+	}
+}
+
+func TestMutateBrokerExternalServiceDNS(t *testing.T) {
+	instance := testBrokerInstance()
+	tests := []struct {
+		name        string
+		access      rocketmqv1.ExternalAccess
+		hostname    string
+		existing    map[string]string
+		want        string
+		wantPresent bool
+	}{
+		{
+			name:        "external-dns hostname",
+			access:      rocketmqv1.ExternalAccess{Type: corev1.ServiceTypeLoadBalancer, Hostname: "{{.Pod}}.example.com", ExternalDNS: true},
+			hostname:    "demo-broker-0-0.example.com",
+			want:        "demo-broker-0-0.example.com",
+			wantPresent: true,
+		},
+		{
+			name:     "external-dns disabled removes the annotation",
+			access:   rocketmqv1.ExternalAccess{Type: corev1.ServiceTypeLoadBalancer, Hostname: "{{.Pod}}.example.com"},
+			hostname: "demo-broker-0-0.example.com",
+			existing: map[string]string{annotationExternalDNSHostname: "demo-broker-0-0.example.com"},
+		},
+		{
+			name: "user annotation is kept",
+			access: rocketmqv1.ExternalAccess{
+				Type:        corev1.ServiceTypeLoadBalancer,
+				Annotations: map[string]string{annotationExternalDNSHostname: "mq.example.com"},
+			},
+			want:        "mq.example.com",
+			wantPresent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := instance.DeepCopy()
+			instance.Spec.ExternalAccess = &tt.access
+			svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: tt.existing}}
+			mutateBrokerExternalService(instance, 0, "demo-broker-0-0", tt.hostname, 0, svc)
+			got, ok := svc.Annotations[annotationExternalDNSHostname]
+			if ok != tt.wantPresent || got != tt.want {
+				t.Errorf("external-dns annotation = %q (present %v), want %q (present %v)", got, ok, tt.want, tt.wantPresent)
+			}
+			if svc.Spec.Selector[statefulSetPodNameLabel] != "demo-broker-0-0" ||
+				svc.Spec.ExternalTrafficPolicy != corev1.ServiceExternalTrafficPolicyTypeLocal {
+				t.Errorf("service spec = %+v", svc.Spec)
+			}
+		})
+	}
+}
+
+func TestReconcileExternalAccessHostname(t *testing.T) {
+	instance := testBrokerInstance()
+	instance.UID = "uid"
+	instance.Spec.BrokerGroupNumber = 1
+	instance.Spec.ExternalAccess = &rocketmqv1.ExternalAccess{
+		Type:        corev1.ServiceTypeLoadBalancer,
+		Hostname:    "{{.Cluster}}-{{.Group}}-{{.Index}}.example.com",
+		ExternalDNS: true,
+	}
+	replicas := int32(2)
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: brokerGroupName(instance, 0), Labels: brokerGroupLabels(instance, 0)},
+		Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+	}
+	c := newFakeClient(instance, sts)
+	r := &DledgerBrokerReconciler{Client: c, Scheme: testScheme(), Log: log}
+	ctx := context.Background()
+	if err := r.reconcileExternalAccess(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+
+	// advertise初始化容器从configmap读取渲染后的域名注册到nameserver
+	cm := &corev1.ConfigMap{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "mq", Name: brokerExternalConfigMapName(instance)}, cm); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"demo-broker-0-0.port": "10911",
+		"demo-broker-0-0.host": "demo-0-0.example.com",
+		"demo-broker-0-1.port": "10911",
+		"demo-broker-0-1.host": "demo-0-1.example.com",
+	}
+	if !reflect.DeepEqual(cm.Data, want) {
+		t.Errorf("external configmap = %v, want %v", cm.Data, want)
+	}
+	got := runAdvertiseScript(t, instance.Spec.ExternalAccess, map[string]string{
+		"demo-broker-0-1.port": cm.Data["demo-broker-0-1.port"],
+		"demo-broker-0-1.host": cm.Data["demo-broker-0-1.host"],
+	})
+	if got[configs.BrokerIP1] != "demo-0-1.example.com" || got[configs.ListenPort] != "10911" {
+		t.Errorf("advertised broker.conf = %v", got)
+	}
+	for k := 0; k < 2; k++ {
+		svc := &corev1.Service{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: "mq", Name: brokerExternalServiceName(brokerPodName(instance, 0, k))}, svc); err != nil {
+			t.Fatal(err)
+		}
+		if host := fmt.Sprintf("demo-0-%d.example.com", k); svc.Annotations[annotationExternalDNSHostname] != host {
+			t.Errorf("service %s annotations = %v, want external-dns hostname %s", svc.Name, svc.Annotations, host)
+		}
+	}
+}
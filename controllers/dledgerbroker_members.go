@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	errors2 "github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/admin"
+)
+
+const (
+	// annotationMembers 记录broker组当前生效的dledger成员数，调整成员时每次只增减一个节点
+	annotationMembers = "rocketmq.daocloud.io/members"
+
+	reasonResizingMembers = "ResizingMembers"
+)
+
+// dledgerQuorum 返回members个节点的dledger组完成选举需要的节点数
+func dledgerQuorum(members int) int {
+	return members/2 + 1
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	if !pod.DeletionTimestamp.IsZero() {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// podOrdinal 返回statefulset pod名称中的序号
+func podOrdinal(pod *corev1.Pod) int {
+	k, err := strconv.Atoi(pod.Name[strings.LastIndex(pod.Name, "-")+1:])
+	if err != nil {
+		return -1
+	}
+	return k
+}
+
+// groupPods 返回第i个broker组的pod，按序号排序
+func (r *DledgerBrokerReconciler) groupPods(ctx context.Context, instance *rocketmqv1.DledgerBroker, i int) ([]corev1.Pod, error) {
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(brokerGroupLabels(instance, i))); err != nil {
+		return nil, err
+	}
+	sort.Slice(pods.Items, func(a, b int) bool { return podOrdinal(&pods.Items[a]) < podOrdinal(&pods.Items[b]) })
+	return pods.Items, nil
+}
+
+// groupSettled 判断broker组的所有pod都已按statefulset最新的模板运行并就绪
+func groupSettled(sts *appsv1.StatefulSet, pods []corev1.Pod) bool {
+	if sts.Status.ObservedGeneration < sts.Generation || sts.Spec.Replicas == nil || len(pods) != int(*sts.Spec.Replicas) {
+		return false
+	}
+	for k := range pods {
+		if !isPodReady(&pods[k]) || pods[k].Labels[appsv1.ControllerRevisionHashLabelKey] != sts.Status.UpdateRevision {
+			return false
+		}
+	}
+	return true
+}
+
+// groupLeader 向第i个broker组就绪的节点查询dledger元数据，返回自认为leader且term最大的节点所在的pod名称，
+// 没有节点确认自己是leader时返回空。未配置Admin或所有节点都查询失败时返回错误，调用方需要等待而不是跳过检查
+func (r *DledgerBrokerReconciler) groupLeader(ctx context.Context, instance *rocketmqv1.DledgerBroker, i int, pods []corev1.Pod) (string, error) {
+	if r.Admin == nil {
+		return "", errors2.New("admin is not configured")
+	}
+	var leader string
+	var term int64 = -1
+	var lastErr error
+	answered := 0
+	for k := range pods {
+		if !isPodReady(&pods[k]) {
+			continue
+		}
+		ordinal := podOrdinal(&pods[k])
+		selfId := dledgerSelfId(ordinal)
+		callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+		metadata, err := r.Admin.GetDledgerMetadata(callCtx, dledgerAddr(instance, i, ordinal), brokerGroupName(instance, i), selfId)
+		cancel()
+		if err != nil {
+			lastErr = errors2.Wrapf(err, "pod %s", pods[k].Name)
+			continue
+		}
+		answered++
+		if metadata.LeaderId == selfId && metadata.Term > term {
+			leader, term = pods[k].Name, metadata.Term
+		}
+	}
+	if answered == 0 && lastErr != nil {
+		return "", lastErr
+	}
+	return leader, nil
+}
+
+// groupMembers 返回第i个broker组本次调谐使用的成员数。成员数与Spec不一致时，
+// 在组内所有节点重启完成且leader存在后，才向目标值增减一个节点，返回非空的消息表示调整仍在进行
+func (r *DledgerBrokerReconciler) groupMembers(ctx context.Context, instance *rocketmqv1.DledgerBroker, i int) (int, string, error) {
+	desired := instance.Spec.BrokerNumberPerGroup[i]
+	sts := &appsv1.StatefulSet{}
+	key := types.NamespacedName{Namespace: instance.Namespace, Name: brokerGroupName(instance, i)}
+	if err := r.Get(ctx, key, sts); err != nil {
+		if errors.IsNotFound(err) {
+			return desired, "", nil
+		}
+		return 0, "", err
+	}
+	current, err := strconv.Atoi(sts.Annotations[annotationMembers])
+	if err != nil && sts.Spec.Replicas != nil {
+		current = int(*sts.Spec.Replicas)
+	}
+	if current == desired {
+		if sts.Annotations[annotationMembers] != strconv.Itoa(current) {
+			return current, "", r.annotateStatefulSet(ctx, sts, map[string]string{annotationMembers: strconv.Itoa(current)})
+		}
+		return current, "", nil
+	}
+
+	pods, err := r.groupPods(ctx, instance, i)
+	if err != nil {
+		return 0, "", err
+	}
+	if !groupSettled(sts, pods) {
+		return current, fmt.Sprintf("%s: resizing members %d -> %d, waiting for members to restart", sts.Name, current, desired), nil
+	}
+	leader, err := r.groupLeader(ctx, instance, i, pods)
+	if err != nil {
+		r.Log.Warnw("get dledger leader failed", "statefulset", sts.Name, "error", err)
+		return current, fmt.Sprintf("%s: resizing members %d -> %d, get leader: %v", sts.Name, current, desired, err), nil
+	}
+	if leader == "" {
+		return current, fmt.Sprintf("%s: resizing members %d -> %d, waiting for leader election", sts.Name, current, desired), nil
+	}
+
+	next := current + 1
+	if desired < current {
+		next = current - 1
+	}
+	// 所有节点就绪时，增加一个节点后现有节点数仍满足新的quorum，减少一个节点后剩余节点即为新的成员
+	if current < dledgerQuorum(next) {
+		return current, fmt.Sprintf("%s: refuse to resize members %d -> %d, %d members can not form a quorum of %d",
+			sts.Name, current, next, current, dledgerQuorum(next)), nil
+	}
+	if next < current && leader == brokerPodName(instance, i, current-1) {
+		if msg, moved := r.moveLeadership(ctx, instance, i, sts, pods, current-1); !moved {
+			return current, fmt.Sprintf("%s: resizing members %d -> %d, %s", sts.Name, current, desired, msg), nil
+		}
+	}
+	if next > current {
+		released, err := r.releasedVolumes(ctx, instance, i, current, next)
+		if err != nil {
+			return 0, "", err
+		}
+		if len(released) > 0 {
+			return current, fmt.Sprintf("%s, refuse to resize members %d -> %d", releasedVolumesMessage(sts.Name, released), current, next), nil
+		}
+	}
+	r.Log.Infow("resize dledger group members", "statefulset", sts.Name, "from", current, "to", next, "desired", desired)
+	if err := r.annotateStatefulSet(ctx, sts, map[string]string{annotationMembers: strconv.Itoa(next)}); err != nil {
+		return 0, "", err
+	}
+	return next, fmt.Sprintf("%s: resizing members %d -> %d, step %d", sts.Name, current, desired, next), nil
+}
+
+// moveLeadership 缩容前将leadership从即将移除的第k个节点转移到序号更小的节点，避免移除leader触发非计划的选举。
+// 返回true表示可以移除该节点；broker版本不支持转移时只能移除leader，由dledger重新选举
+func (r *DledgerBrokerReconciler) moveLeadership(ctx context.Context, instance *rocketmqv1.DledgerBroker, i int, sts *appsv1.StatefulSet, pods []corev1.Pod, k int) (string, bool) {
+	version, err := r.brokerVersion(ctx, instance, i, k)
+	if err != nil {
+		r.Log.Warnw("get broker version failed", "statefulset", sts.Name, "error", err)
+		return fmt.Sprintf("get broker version of leader %s: %v", brokerPodName(instance, i, k), err), false
+	}
+	if !admin.LeadershipTransferSupported(version) {
+		r.Log.Infow("broker does not support leadership transfer, remove leader directly", "statefulset", sts.Name, "version", version)
+		return "", true
+	}
+	target := -1
+	for n := range pods {
+		if ordinal := podOrdinal(&pods[n]); ordinal < k && isPodReady(&pods[n]) {
+			target = ordinal
+			break
+		}
+	}
+	if target < 0 {
+		return fmt.Sprintf("waiting for a ready member to take over leadership from %s", brokerPodName(instance, i, k)), false
+	}
+	callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+	defer cancel()
+	if err := r.Admin.TransferLeadership(callCtx, dledgerAddr(instance, i, k), brokerGroupName(instance, i),
+		dledgerSelfId(k), dledgerSelfId(target)); err != nil {
+		r.Log.Warnw("transfer leadership before removing member failed", "statefulset", sts.Name, "error", err)
+		return fmt.Sprintf("transfer leadership from %s to %s: %v", brokerPodName(instance, i, k), brokerPodName(instance, i, target), err), false
+	}
+	r.Log.Infow("transfer leadership before removing member", "from", brokerPodName(instance, i, k), "to", brokerPodName(instance, i, target))
+	return fmt.Sprintf("transferring leadership from %s to %s before removing it", brokerPodName(instance, i, k), brokerPodName(instance, i, target)), false
+}
@@ -0,0 +1,265 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/admin"
+	"rocketmq-operator-v2/pkg/logi"
+)
+
+// testBrokerPod 返回第i个broker组第k个节点的pod，podIP为10.0.i.k
+func testBrokerPod(instance *rocketmqv1.DledgerBroker, i, k int, ready bool) corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: instance.Namespace, Name: brokerPodName(instance, i, k), Labels: brokerGroupLabels(instance, i)},
+		Status: corev1.PodStatus{
+			PodIP:      fmt.Sprintf("10.0.%d.%d", i, k),
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func testBrokerInstance() *rocketmqv1.DledgerBroker {
+	return &rocketmqv1.DledgerBroker{ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "demo"}}
+}
+
+func TestGroupLeader(t *testing.T) {
+	instance := testBrokerInstance()
+	pods := []corev1.Pod{testBrokerPod(instance, 0, 0, true), testBrokerPod(instance, 0, 1, true), testBrokerPod(instance, 0, 2, false)}
+	addr := func(k int) string { return dledgerAddr(instance, 0, k) }
+	tests := []struct {
+		name     string
+		metadata map[string]*admin.DledgerMetadata
+		want     string
+		wantErr  bool
+	}{
+		{
+			name: "leader confirmed by itself",
+			metadata: map[string]*admin.DledgerMetadata{
+				addr(0): {LeaderId: "n1", Term: 2},
+				addr(1): {LeaderId: "n1", Term: 2},
+			},
+			want: "demo-broker-0-1",
+		},
+		{
+			name: "stale leader with lower term is ignored",
+			metadata: map[string]*admin.DledgerMetadata{
+				addr(0): {LeaderId: "n0", Term: 1},
+				addr(1): {LeaderId: "n1", Term: 3},
+			},
+			want: "demo-broker-0-1",
+		},
+		{
+			name: "leader reported only by followers is unknown",
+			metadata: map[string]*admin.DledgerMetadata{
+				addr(0): {LeaderId: "n2", Term: 2},
+			},
+		},
+		{
+			name: "election in progress",
+			metadata: map[string]*admin.DledgerMetadata{
+				addr(0): {Term: 4},
+				addr(1): {Term: 4},
+			},
+		},
+		{
+			name:    "all nodes unreachable",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DledgerBrokerReconciler{Admin: &fakeAdmin{metadata: tt.metadata}}
+			got, err := r.groupLeader(context.Background(), instance, 0, pods)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("groupLeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("groupLeader() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	r := &DledgerBrokerReconciler{}
+	if _, err := r.groupLeader(context.Background(), instance, 0, pods); err == nil {
+		t.Error("groupLeader() without admin should fail instead of skipping the leader check")
+	}
+}
+
+func TestLaggingFollowers(t *testing.T) {
+	instance := testBrokerInstance()
+	pods := []corev1.Pod{testBrokerPod(instance, 0, 0, true), testBrokerPod(instance, 0, 1, true), testBrokerPod(instance, 0, 2, true)}
+	registered := func(ks ...int) *admin.ClusterInfo {
+		addrs := make(map[string]string)
+		for id, k := range ks {
+			addrs[strconv.Itoa(id)] = fmt.Sprintf("10.0.0.%d:%d", k, brokerPortMain)
+		}
+		return &admin.ClusterInfo{BrokerAddrTable: map[string]admin.BrokerData{
+			"demo-broker-0": {BrokerName: "demo-broker-0", BrokerAddrs: addrs},
+		}}
+	}
+	offsets := func(values ...int64) map[string]*admin.BrokerRuntimeInfo {
+		m := make(map[string]*admin.BrokerRuntimeInfo)
+		for k, v := range values {
+			m[fmt.Sprintf("%s:%d", brokerPodFQDN(instance, 0, k), brokerPortMain)] = &admin.BrokerRuntimeInfo{
+				CommitLogMaxOffset: v,
+				Table:              map[string]string{"commitLogMaxOffset": strconv.FormatInt(v, 10)},
+			}
+		}
+		return m
+	}
+	tests := []struct {
+		name    string
+		admin   *fakeAdmin
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "followers caught up",
+			admin: &fakeAdmin{cluster: registered(0, 1, 2), runtime: offsets(100, 100, 100+catchUpLagBytes)},
+		},
+		{
+			name:  "follower not registered",
+			admin: &fakeAdmin{cluster: registered(0, 1), runtime: offsets(100, 100, 100)},
+			want:  []string{"demo-broker-0-2"},
+		},
+		{
+			name:  "follower behind leader",
+			admin: &fakeAdmin{cluster: registered(0, 1, 2), runtime: offsets(100, catchUpLagBytes+101, 50)},
+			want:  []string{"demo-broker-0-0", "demo-broker-0-2"},
+		},
+		{
+			name:    "nameserver unreachable",
+			admin:   &fakeAdmin{runtime: offsets(100, 100, 100)},
+			wantErr: true,
+		},
+		{
+			name:    "broker runtime info unavailable",
+			admin:   &fakeAdmin{cluster: registered(0, 1, 2), runtime: offsets(100, 100)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DledgerBrokerReconciler{Client: newFakeClient(), Admin: tt.admin}
+			got, err := r.laggingFollowers(context.Background(), instance, 0, pods, "demo-broker-0-1", "ns:9876")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("laggingFollowers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("laggingFollowers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupMembers(t *testing.T) {
+	instance := testBrokerInstance()
+	instance.Spec.BrokerGroupNumber = 1
+	leader := func(k int) map[string]*admin.DledgerMetadata {
+		m := make(map[string]*admin.DledgerMetadata)
+		for n := 0; n < 3; n++ {
+			m[dledgerAddr(instance, 0, n)] = &admin.DledgerMetadata{LeaderId: dledgerSelfId(k), Term: 1}
+		}
+		return m
+	}
+	version := func(v string) map[string]*admin.BrokerRuntimeInfo {
+		return map[string]*admin.BrokerRuntimeInfo{fmt.Sprintf("%s:%d", brokerPodFQDN(instance, 0, 2), brokerPortMain): {Version: v}}
+	}
+	tests := []struct {
+		name          string
+		current       int
+		desired       int
+		admin         *fakeAdmin
+		released      []int
+		want          int
+		wantTransfers []string
+	}{
+		{name: "members match spec", current: 3, desired: 3, admin: &fakeAdmin{}, want: 3},
+		{name: "grow one member at a time", current: 2, desired: 4, admin: &fakeAdmin{metadata: leader(0)}, want: 3},
+		{
+			name:     "refuse to grow onto a released volume",
+			current:  2,
+			desired:  4,
+			admin:    &fakeAdmin{metadata: leader(0)},
+			released: []int{2},
+			want:     2,
+		},
+		{name: "shrink a follower", current: 3, desired: 1, admin: &fakeAdmin{metadata: leader(0)}, want: 2},
+		{
+			name:          "move leadership off the removed member first",
+			current:       3,
+			desired:       1,
+			admin:         &fakeAdmin{metadata: leader(2), runtime: version("V4_9_4")},
+			want:          3,
+			wantTransfers: []string{dledgerAddr(instance, 0, 2) + " n2->n0"},
+		},
+		{
+			name:    "remove the leader when transfer is unsupported",
+			current: 3,
+			desired: 1,
+			admin:   &fakeAdmin{metadata: leader(2), runtime: version("V4_6_1")},
+			want:    2,
+		},
+		{name: "wait for leader election", current: 3, desired: 1, admin: &fakeAdmin{metadata: leader(5)}, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := instance.DeepCopy()
+			instance.Spec.BrokerNumberPerGroup = []int{tt.desired}
+			replicas := int32(tt.current)
+			sts := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "demo-broker-0",
+					Annotations: map[string]string{annotationMembers: strconv.Itoa(tt.current)}},
+				Spec:   appsv1.StatefulSetSpec{Replicas: &replicas},
+				Status: appsv1.StatefulSetStatus{UpdateRevision: "new"},
+			}
+			objs := []client.Object{sts}
+			for k := 0; k < tt.current; k++ {
+				p := testBrokerPod(instance, 0, k, true)
+				p.Labels[appsv1.ControllerRevisionHashLabelKey] = "new"
+				objs = append(objs, &p)
+			}
+			for _, k := range tt.released {
+				pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "mq",
+					Name:        brokerStoreVolume + "-" + brokerPodName(instance, 0, k),
+					Labels:      brokerGroupLabels(instance, 0),
+					Annotations: map[string]string{annotationVolumeReleased: "true"},
+				}}
+				objs = append(objs, pvc)
+			}
+			c := newFakeClient(objs...)
+			r := &DledgerBrokerReconciler{Client: c, Admin: tt.admin, Log: logi.GetSugaredLogger()}
+			got, msg, err := r.groupMembers(context.Background(), instance, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || (msg == "") != (tt.current == tt.desired) {
+				t.Errorf("groupMembers() = %d, %q, want %d", got, msg, tt.want)
+			}
+			if !reflect.DeepEqual(tt.admin.transfers, tt.wantTransfers) {
+				t.Errorf("transfers = %v, want %v", tt.admin.transfers, tt.wantTransfers)
+			}
+			if err := c.Get(context.Background(), client.ObjectKeyFromObject(sts), sts); err != nil {
+				t.Fatal(err)
+			}
+			if sts.Annotations[annotationMembers] != strconv.Itoa(tt.want) {
+				t.Errorf("members annotation = %s, want %d", sts.Annotations[annotationMembers], tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/configs"
+)
+
+const (
+	reasonNameserverResolved     = "Resolved"
+	reasonNameserverNotSpecified = "NotSpecified"
+	reasonNameserverNotFound     = "NotFound"
+	reasonNameserverNotReady     = "NotReady"
+)
+
+// resolveNameserver 解析Spec.Nameserver引用的nameserver并返回其namesrvAddr，同时更新NameserverResolved状态。
+// 未指定nameserver时返回空地址且ready为true，由用户在Spec.Config中自行配置namesrvAddr。
+// nameserver未发布地址或没有就绪的pod时ready为false。
+func (r *DledgerBrokerReconciler) resolveNameserver(ctx context.Context, instance *rocketmqv1.DledgerBroker) (addr string, ready bool, err error) {
+	if instance.Spec.Nameserver == "" {
+		instance.Status.NameserverAddr = nil
+		meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+			Type:               rocketmqv1.ConditionNameserverResolved,
+			Status:             metav1.ConditionFalse,
+			Reason:             reasonNameserverNotSpecified,
+			Message:            "spec.nameserver is empty, namesrvAddr is taken from spec.config",
+			ObservedGeneration: instance.Generation,
+		})
+		return "", true, nil
+	}
+
+	ref := instance.NameserverRef()
+	ns := &rocketmqv1.Nameserver{}
+	if err := r.Get(ctx, ref, ns); err != nil {
+		if !errors.IsNotFound(err) {
+			return "", false, err
+		}
+		meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+			Type:               rocketmqv1.ConditionNameserverResolved,
+			Status:             metav1.ConditionFalse,
+			Reason:             reasonNameserverNotFound,
+			Message:            fmt.Sprintf("nameserver %s not found", ref),
+			ObservedGeneration: instance.Generation,
+		})
+		return "", false, nil
+	}
+	if ns.Status.ConnectAddr == "" {
+		meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+			Type:               rocketmqv1.ConditionNameserverResolved,
+			Status:             metav1.ConditionFalse,
+			Reason:             reasonNameserverNotReady,
+			Message:            fmt.Sprintf("nameserver %s has not published its address yet", ref),
+			ObservedGeneration: instance.Generation,
+		})
+		return "", false, nil
+	}
+
+	// ConnectAddr在statefulset创建后即按pod域名生成，需等待至少一个nameserver pod就绪，
+	// 避免broker在nameserver启动前按新地址渲染配置并滚动
+	if ns.Status.ReadyReplicas == 0 {
+		meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+			Type:               rocketmqv1.ConditionNameserverResolved,
+			Status:             metav1.ConditionFalse,
+			Reason:             reasonNameserverNotReady,
+			Message:            fmt.Sprintf("nameserver %s has no ready pods", ref),
+			ObservedGeneration: instance.Generation,
+		})
+		return "", false, nil
+	}
+
+	instance.Status.NameserverAddr = strings.Split(ns.Status.ConnectAddr, ";")
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               rocketmqv1.ConditionNameserverResolved,
+		Status:             metav1.ConditionTrue,
+		Reason:             reasonNameserverResolved,
+		Message:            fmt.Sprintf("using nameserver %s", ref),
+		ObservedGeneration: instance.Generation,
+	})
+	return ns.Status.ConnectAddr, true, nil
+}
+
+// brokerNamesrvAddr 返回DledgerBroker使用的namesrvAddr，未引用Nameserver时使用Spec.Config中用户配置的地址
+func brokerNamesrvAddr(instance *rocketmqv1.DledgerBroker) string {
+	if instance.Spec.Nameserver != "" {
+		return strings.Join(instance.Status.NameserverAddr, ";")
+	}
+	return instance.Spec.Config[configs.NamesrvAddr]
+}
+
+// brokersForNameserver 返回引用了该nameserver的所有DledgerBroker，nameserver变化时重新渲染broker配置
+func (r *DledgerBrokerReconciler) brokersForNameserver(obj client.Object) []reconcile.Request {
+	brokers := &rocketmqv1.DledgerBrokerList{}
+	if err := r.List(context.Background(), brokers); err != nil {
+		log.Errorw("list dledgerbrokers failed", "error", err)
+		return nil
+	}
+	nameserver := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	var requests []reconcile.Request
+	for k := range brokers.Items {
+		broker := &brokers.Items[k]
+		if broker.Spec.Nameserver == "" || broker.NameserverRef() != nameserver {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Namespace: broker.Namespace,
+			Name:      broker.Name,
+		}})
+	}
+	return requests
+}
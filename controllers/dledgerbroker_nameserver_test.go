@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+)
+
+func TestResolveNameserver(t *testing.T) {
+	tests := []struct {
+		name       string
+		nameserver *rocketmqv1.Nameserver
+		wantAddr   string
+		wantReady  bool
+		wantReason string
+	}{
+		{
+			name:       "not found",
+			wantReason: reasonNameserverNotFound,
+		},
+		{
+			name: "address not published",
+			nameserver: &rocketmqv1.Nameserver{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "ns"},
+			},
+			wantReason: reasonNameserverNotReady,
+		},
+		{
+			name: "address published but no pod ready",
+			nameserver: &rocketmqv1.Nameserver{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "ns"},
+				Status:     rocketmqv1.NameserverStatus{ConnectAddr: "ns-0:9876;ns-1:9876"},
+			},
+			wantReason: reasonNameserverNotReady,
+		},
+		{
+			name: "ready",
+			nameserver: &rocketmqv1.Nameserver{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "ns"},
+				Status:     rocketmqv1.NameserverStatus{ConnectAddr: "ns-0:9876;ns-1:9876", ReadyReplicas: 1},
+			},
+			wantAddr:   "ns-0:9876;ns-1:9876",
+			wantReady:  true,
+			wantReason: reasonNameserverResolved,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeClient()
+			if tt.nameserver != nil {
+				c = newFakeClient(tt.nameserver)
+			}
+			r := &DledgerBrokerReconciler{Client: c, Log: log}
+			instance := &rocketmqv1.DledgerBroker{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "demo"},
+				Spec:       rocketmqv1.DledgerBrokerSpec{Nameserver: "ns"},
+			}
+			addr, ready, err := r.resolveNameserver(context.Background(), instance)
+			if err != nil {
+				t.Fatalf("resolveNameserver() error = %v", err)
+			}
+			if addr != tt.wantAddr || ready != tt.wantReady {
+				t.Errorf("resolveNameserver() = %q, %v, want %q, %v", addr, ready, tt.wantAddr, tt.wantReady)
+			}
+			cond := meta.FindStatusCondition(instance.Status.Conditions, rocketmqv1.ConditionNameserverResolved)
+			if cond == nil || cond.Reason != tt.wantReason {
+				t.Errorf("NameserverResolved condition = %+v, want reason %s", cond, tt.wantReason)
+			}
+		})
+	}
+}
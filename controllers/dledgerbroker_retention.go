@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+)
+
+const (
+	retentionRequeueInterval = 10 * time.Second
+
+	// annotationVolumeReleased 标记缩容后按Retain策略保留的pvc，其中的dledger和commitlog数据已过时，
+	// 扩容时不会复用，需要删除pvc或去掉该注解后才能重新加入
+	annotationVolumeReleased = "rocketmq.daocloud.io/released"
+)
+
+// snapshotPhase 为pvc快照的处理进度
+type snapshotPhase int
+
+const (
+	snapshotPending snapshotPhase = iota
+	snapshotReady
+	// snapshotUnavailable 无法创建快照，pvc被保留
+	snapshotUnavailable
+)
+
+var volumeSnapshotGVK = schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshot"}
+
+// retentionPolicy 返回实例的持久卷保留策略，未设置时为Retain
+func retentionPolicy(instance *rocketmqv1.DledgerBroker) rocketmqv1.RetentionPolicy {
+	if instance.Spec.Storage == nil || instance.Spec.Storage.RetentionPolicy == "" {
+		return rocketmqv1.RetentionPolicyRetain
+	}
+	return instance.Spec.Storage.RetentionPolicy
+}
+
+// volumeSnapshotName 以pvc的uid区分同名pvc的多次快照，重复调谐时得到相同的名称
+func volumeSnapshotName(pvc *corev1.PersistentVolumeClaim) string {
+	uid := string(pvc.UID)
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+	return fmt.Sprintf("%s-%s", pvc.Name, uid)
+}
+
+// stopBrokerGroups 删除selected选中的broker组的statefulset，返回true表示这些组的pod均已退出
+func (r *DledgerBrokerReconciler) stopBrokerGroups(ctx context.Context, instance *rocketmqv1.DledgerBroker, selected func(group int) bool) (bool, error) {
+	stsList := &appsv1.StatefulSetList{}
+	if err := r.List(ctx, stsList, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(brokerClusterLabels(instance))); err != nil {
+		return false, err
+	}
+	stopped := true
+	for k := range stsList.Items {
+		sts := &stsList.Items[k]
+		group, err := strconv.Atoi(sts.Labels[labelBrokerGroup])
+		if err != nil || !selected(group) || !metav1.IsControlledBy(sts, instance) {
+			continue
+		}
+		stopped = false
+		if sts.DeletionTimestamp.IsZero() {
+			r.Log.Infow("delete broker statefulset", "statefulset", sts.Name)
+			if err := r.Delete(ctx, sts); err != nil && !errors.IsNotFound(err) {
+				return false, err
+			}
+		}
+	}
+	if !stopped {
+		return false, nil
+	}
+
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(brokerClusterLabels(instance))); err != nil {
+		return false, err
+	}
+	for k := range pods.Items {
+		group, err := strconv.Atoi(pods.Items[k].Labels[labelBrokerGroup])
+		if err == nil && selected(group) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// pvcOrdinal 返回statefulset创建的pvc(<volume>-<statefulset>-<k>)对应的pod序号
+func pvcOrdinal(pvc *corev1.PersistentVolumeClaim) int {
+	return podOrdinal(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: pvc.Name}})
+}
+
+// releaseVolumes 按RetentionPolicy处理selected选中的broker组和序号的pvc，调用前需保证使用这些pvc的broker已停止。
+// Retain策略下为pvc添加released注解，避免之后扩容时复用过时的数据。
+// 返回true表示处理完成，Snapshot策略下快照未就绪时返回false
+func (r *DledgerBrokerReconciler) releaseVolumes(ctx context.Context, instance *rocketmqv1.DledgerBroker, selected func(group, ordinal int) bool) (bool, error) {
+	policy := retentionPolicy(instance)
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, pvcs, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(brokerClusterLabels(instance))); err != nil {
+		return false, err
+	}
+	done := true
+	for k := range pvcs.Items {
+		pvc := &pvcs.Items[k]
+		group, err := strconv.Atoi(pvc.Labels[labelBrokerGroup])
+		if err != nil || !selected(group, pvcOrdinal(pvc)) || !pvc.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if policy == rocketmqv1.RetentionPolicyRetain {
+			if pvc.Annotations[annotationVolumeReleased] == "" {
+				r.Log.Infow("retain released broker volume", "pvc", pvc.Name)
+				patch := client.MergeFrom(pvc.DeepCopy())
+				metav1.SetMetaDataAnnotation(&pvc.ObjectMeta, annotationVolumeReleased, "true")
+				if err := r.Patch(ctx, pvc, patch); err != nil {
+					return false, err
+				}
+			}
+			continue
+		}
+		if policy == rocketmqv1.RetentionPolicySnapshot {
+			phase, err := r.snapshotVolume(ctx, instance, pvc)
+			if err != nil {
+				return false, err
+			}
+			if phase == snapshotPending {
+				done = false
+			}
+			if phase != snapshotReady {
+				continue
+			}
+		}
+		r.Log.Infow("delete broker volume", "pvc", pvc.Name, "retentionPolicy", policy)
+		if err := r.Delete(ctx, pvc); err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+	}
+	return done, nil
+}
+
+// snapshotVolume 为pvc创建VolumeSnapshot，快照就绪后才可以删除pvc。
+// 集群未安装快照CRD或快照失败时保留pvc，避免数据丢失
+func (r *DledgerBrokerReconciler) snapshotVolume(ctx context.Context, instance *rocketmqv1.DledgerBroker, pvc *corev1.PersistentVolumeClaim) (snapshotPhase, error) {
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+	key := types.NamespacedName{Namespace: pvc.Namespace, Name: volumeSnapshotName(pvc)}
+	err := r.Get(ctx, key, snapshot)
+	if err != nil && isNoMatchError(err) {
+		r.Log.Warnw("VolumeSnapshot CRD is not installed, retain broker volume", "pvc", pvc.Name)
+		return snapshotUnavailable, nil
+	}
+	if errors.IsNotFound(err) {
+		snapshot.SetName(key.Name)
+		snapshot.SetNamespace(key.Namespace)
+		// 快照不设置ownerReference，实例删除后仍然保留
+		snapshot.SetLabels(mergeLabels(nil, pvc.Labels))
+		spec := map[string]interface{}{
+			"source": map[string]interface{}{"persistentVolumeClaimName": pvc.Name},
+		}
+		if instance.Spec.Storage != nil && instance.Spec.Storage.SnapshotClass != "" {
+			spec["volumeSnapshotClassName"] = instance.Spec.Storage.SnapshotClass
+		}
+		if err := unstructured.SetNestedField(snapshot.Object, spec, "spec"); err != nil {
+			return snapshotPending, err
+		}
+		r.Log.Infow("create broker volume snapshot", "pvc", pvc.Name, "volumesnapshot", key.Name)
+		if err := r.Create(ctx, snapshot); err != nil && !errors.IsAlreadyExists(err) {
+			return snapshotPending, err
+		}
+		return snapshotPending, nil
+	}
+	if err != nil {
+		return snapshotPending, err
+	}
+	if msg, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); found && msg != "" {
+		r.Log.Warnw("broker volume snapshot failed, retain broker volume", "pvc", pvc.Name,
+			"volumesnapshot", key.Name, "error", msg)
+		return snapshotUnavailable, nil
+	}
+	if ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); ready {
+		return snapshotReady, nil
+	}
+	return snapshotPending, nil
+}
+
+// releaseRemovedMembers 按RetentionPolicy处理第i个broker组中序号不小于members的pvc，
+// 这些节点已在调整成员时移除，等待其pod退出后再处理。返回false表示尚未处理完成
+func (r *DledgerBrokerReconciler) releaseRemovedMembers(ctx context.Context, instance *rocketmqv1.DledgerBroker, i, members int) (bool, error) {
+	pods, err := r.groupPods(ctx, instance, i)
+	if err != nil {
+		return false, err
+	}
+	for k := range pods {
+		if podOrdinal(&pods[k]) >= members {
+			return false, nil
+		}
+	}
+	return r.releaseVolumes(ctx, instance, func(group, ordinal int) bool { return group == i && ordinal >= members })
+}
+
+// releasedVolumes 返回第i个broker组中序号在[from, to)之间、缩容时已释放的pvc，
+// 创建这些序号的pod会挂载过时的数据，调用方需要拒绝扩容
+func (r *DledgerBrokerReconciler) releasedVolumes(ctx context.Context, instance *rocketmqv1.DledgerBroker, i, from, to int) ([]string, error) {
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, pvcs, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(brokerGroupLabels(instance, i))); err != nil {
+		return nil, err
+	}
+	var released []string
+	for k := range pvcs.Items {
+		pvc := &pvcs.Items[k]
+		if ordinal := pvcOrdinal(pvc); ordinal >= from && ordinal < to && pvc.Annotations[annotationVolumeReleased] != "" {
+			released = append(released, pvc.Name)
+		}
+	}
+	sort.Strings(released)
+	return released, nil
+}
+
+// pendingReleasedVolumes 返回第i个broker组接下来要创建的节点会挂载的、已释放的pvc：
+// statefulset不存在时为新建的members个节点，否则为调整成员时将要增加的节点。返回false表示不能创建该组
+func (r *DledgerBrokerReconciler) pendingReleasedVolumes(ctx context.Context, instance *rocketmqv1.DledgerBroker, i, members int) (bool, []string, error) {
+	key := types.NamespacedName{Namespace: instance.Namespace, Name: brokerGroupName(instance, i)}
+	err := r.Get(ctx, key, &appsv1.StatefulSet{})
+	if err != nil && !errors.IsNotFound(err) {
+		return false, nil, err
+	}
+	exists := err == nil
+	from, to := 0, members
+	if exists {
+		from, to = members, instance.Spec.BrokerNumberPerGroup[i]
+	}
+	released, err := r.releasedVolumes(ctx, instance, i, from, to)
+	if err != nil {
+		return false, nil, err
+	}
+	return exists || len(released) == 0, released, nil
+}
+
+// releasedVolumesMessage 说明被拒绝复用的pvc以及恢复方式
+func releasedVolumesMessage(name string, released []string) string {
+	return fmt.Sprintf("%s: volumes %s were released on scale-in and hold stale data, delete them or remove annotation %s to reuse them",
+		name, strings.Join(released, ","), annotationVolumeReleased)
+}
@@ -0,0 +1,396 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/logi"
+)
+
+// noSnapshotClient 模拟未安装VolumeSnapshot CRD的集群
+type noSnapshotClient struct {
+	client.Client
+}
+
+func (c noSnapshotClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if u, ok := obj.(*unstructured.Unstructured); ok && u.GroupVersionKind() == volumeSnapshotGVK {
+		return &meta.NoKindMatchError{GroupKind: volumeSnapshotGVK.GroupKind(), SearchedVersions: []string{volumeSnapshotGVK.Version}}
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+// remainingPVCs 返回仍然存在的pvc名称，以及其中带有released注解的pvc名称
+func remainingPVCs(t *testing.T, c client.Client) ([]string, []string) {
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := c.List(context.Background(), pvcs); err != nil {
+		t.Fatal(err)
+	}
+	var names, released []string
+	for _, pvc := range pvcs.Items {
+		names = append(names, pvc.Name)
+		if pvc.Annotations[annotationVolumeReleased] != "" {
+			released = append(released, pvc.Name)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(released)
+	return names, released
+}
+
+// volumeSnapshots 返回为pvcs创建的VolumeSnapshot名称及其源pvc
+func volumeSnapshots(t *testing.T, c client.Client, pvcs []*corev1.PersistentVolumeClaim) map[string]string {
+	snapshots := make(map[string]string)
+	for _, pvc := range pvcs {
+		s := &unstructured.Unstructured{}
+		s.SetGroupVersionKind(volumeSnapshotGVK)
+		err := c.Get(context.Background(), types.NamespacedName{Namespace: pvc.Namespace, Name: volumeSnapshotName(pvc)}, s)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		source, _, _ := unstructured.NestedString(s.Object, "spec", "source", "persistentVolumeClaimName")
+		snapshots[s.GetName()] = source
+	}
+	return snapshots
+}
+
+// markSnapshots 设置为pvcs创建的VolumeSnapshot的status
+func markSnapshots(t *testing.T, c client.Client, pvcs []*corev1.PersistentVolumeClaim, status map[string]interface{}) {
+	for _, pvc := range pvcs {
+		s := &unstructured.Unstructured{}
+		s.SetGroupVersionKind(volumeSnapshotGVK)
+		err := c.Get(context.Background(), types.NamespacedName{Namespace: pvc.Namespace, Name: volumeSnapshotName(pvc)}, s)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := unstructured.SetNestedField(s.Object, runtime.DeepCopyJSONValue(status), "status"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Update(context.Background(), s); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFinalizeVolumes(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        rocketmqv1.RetentionPolicy
+		noSnapshotCRD bool
+		// snapshotStatus 为第二次调谐后设置的快照状态
+		snapshotStatus map[string]interface{}
+		wantStopped    bool
+		wantPVCs       []string
+		wantSnapshots  int
+	}{
+		{name: "retain", policy: rocketmqv1.RetentionPolicyRetain, wantPVCs: []string{"store-demo-broker-0-0", "store-demo-broker-1-0"}},
+		{name: "default is retain", wantPVCs: []string{"store-demo-broker-0-0", "store-demo-broker-1-0"}},
+		{name: "delete", policy: rocketmqv1.RetentionPolicyDelete, wantStopped: true},
+		{
+			name:           "snapshot ready",
+			policy:         rocketmqv1.RetentionPolicySnapshot,
+			snapshotStatus: map[string]interface{}{"readyToUse": true},
+			wantStopped:    true,
+			wantSnapshots:  2,
+		},
+		{
+			name:           "snapshot failed",
+			policy:         rocketmqv1.RetentionPolicySnapshot,
+			snapshotStatus: map[string]interface{}{"error": map[string]interface{}{"message": "no space"}},
+			wantStopped:    true,
+			wantPVCs:       []string{"store-demo-broker-0-0", "store-demo-broker-1-0"},
+			wantSnapshots:  2,
+		},
+		{
+			name:          "snapshot crd not installed",
+			policy:        rocketmqv1.RetentionPolicySnapshot,
+			noSnapshotCRD: true,
+			wantStopped:   true,
+			wantPVCs:      []string{"store-demo-broker-0-0", "store-demo-broker-1-0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := testStorageInstance("10Gi", "")
+			instance.Spec.BrokerGroupNumber = 2
+			instance.Spec.Storage.RetentionPolicy = tt.policy
+			pvcs := []*corev1.PersistentVolumeClaim{
+				testBrokerPVC(instance, brokerStoreVolume, 0, 0, "10Gi", "10Gi"),
+				testBrokerPVC(instance, brokerStoreVolume, 1, 0, "10Gi", "10Gi"),
+			}
+			var c client.Client = newFakeClient(
+				testBrokerStatefulSet(t, instance, 0),
+				testBrokerStatefulSet(t, instance, 1),
+				pvcs[0].DeepCopy(),
+				pvcs[1].DeepCopy(),
+			)
+			if tt.noSnapshotCRD {
+				c = noSnapshotClient{c}
+			}
+			r := &DledgerBrokerReconciler{Client: c, Log: logi.GetSugaredLogger()}
+			ctx := context.Background()
+
+			done, err := r.finalizeVolumes(ctx, instance)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.policy == "" || tt.policy == rocketmqv1.RetentionPolicyRetain {
+				if !done {
+					t.Error("finalizeVolumes() with Retain should finish at once")
+				}
+			} else {
+				// 先删除statefulset，等待broker退出后再处理pvc
+				if done {
+					t.Error("finalizeVolumes() should wait for brokers to stop")
+				}
+				if done, err = r.finalizeVolumes(ctx, instance); err != nil {
+					t.Fatal(err)
+				}
+				if tt.snapshotStatus != nil {
+					if done {
+						t.Error("finalizeVolumes() should wait for snapshots to be ready")
+					}
+					markSnapshots(t, c, pvcs, tt.snapshotStatus)
+					if done, err = r.finalizeVolumes(ctx, instance); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if !done {
+					t.Error("finalizeVolumes() should finish")
+				}
+			}
+
+			stsList := &appsv1.StatefulSetList{}
+			if err := c.List(ctx, stsList); err != nil {
+				t.Fatal(err)
+			}
+			if stopped := len(stsList.Items) == 0; stopped != tt.wantStopped {
+				t.Errorf("statefulsets deleted = %v, want %v", stopped, tt.wantStopped)
+			}
+			remaining, released := remainingPVCs(t, c)
+			if !reflect.DeepEqual(remaining, tt.wantPVCs) {
+				t.Errorf("pvcs = %v, want %v", remaining, tt.wantPVCs)
+			}
+			// 删除实例时保留的pvc用于恢复集群，不标记为released
+			if len(released) > 0 {
+				t.Errorf("released pvcs = %v, want none", released)
+			}
+			if !tt.noSnapshotCRD {
+				if snapshots := volumeSnapshots(t, c, pvcs); len(snapshots) != tt.wantSnapshots {
+					t.Errorf("snapshots = %v, want %d", snapshots, tt.wantSnapshots)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveStaleGroupsVolumes(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       rocketmqv1.RetentionPolicy
+		wantPVCs     []string
+		wantReleased []string
+	}{
+		{
+			name:         "retain marks volumes released",
+			policy:       rocketmqv1.RetentionPolicyRetain,
+			wantPVCs:     []string{"logs-demo-broker-1-0", "store-demo-broker-0-0", "store-demo-broker-1-0"},
+			wantReleased: []string{"logs-demo-broker-1-0", "store-demo-broker-1-0"},
+		},
+		{
+			name:     "delete",
+			policy:   rocketmqv1.RetentionPolicyDelete,
+			wantPVCs: []string{"store-demo-broker-0-0"},
+		},
+		{
+			name:     "snapshot",
+			policy:   rocketmqv1.RetentionPolicySnapshot,
+			wantPVCs: []string{"store-demo-broker-0-0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := testStorageInstance("10Gi", "1Gi")
+			instance.Spec.BrokerGroupNumber = 2
+			instance.Spec.BrokerNumberPerGroup = []int{1, 1}
+			stale := testBrokerStatefulSet(t, instance, 1)
+			stale.Annotations = map[string]string{annotationDrained: "true"}
+			instance.Spec.BrokerGroupNumber = 1
+			instance.Spec.Storage.RetentionPolicy = tt.policy
+			pvcs := []*corev1.PersistentVolumeClaim{
+				testBrokerPVC(instance, brokerStoreVolume, 0, 0, "10Gi", "10Gi"),
+				testBrokerPVC(instance, brokerStoreVolume, 1, 0, "10Gi", "10Gi"),
+				testBrokerPVC(instance, brokerLogsVolume, 1, 0, "1Gi", "1Gi"),
+			}
+			c := newFakeClient(testBrokerStatefulSet(t, instance, 0), stale, pvcs[0].DeepCopy(), pvcs[1].DeepCopy(), pvcs[2].DeepCopy())
+			r := &DledgerBrokerReconciler{Client: c, Log: logi.GetSugaredLogger()}
+			ctx := context.Background()
+			removed := false
+			for n := 0; n < 5 && !removed; n++ {
+				var err error
+				if removed, _, err = r.removeStaleGroups(ctx, instance, "ns:9876"); err != nil {
+					t.Fatal(err)
+				}
+				markSnapshots(t, c, pvcs, map[string]interface{}{"readyToUse": true})
+			}
+			if !removed {
+				t.Fatal("removeStaleGroups() did not finish")
+			}
+			if err := c.Get(ctx, client.ObjectKeyFromObject(stale), &appsv1.StatefulSet{}); !errors.IsNotFound(err) {
+				t.Errorf("stale statefulset: %v, want deleted", err)
+			}
+			remaining, released := remainingPVCs(t, c)
+			if !reflect.DeepEqual(remaining, tt.wantPVCs) || !reflect.DeepEqual(released, tt.wantReleased) {
+				t.Errorf("pvcs = %v released %v, want %v released %v", remaining, released, tt.wantPVCs, tt.wantReleased)
+			}
+			if tt.policy == rocketmqv1.RetentionPolicySnapshot {
+				want := map[string]string{"store-demo-broker-1-0-01234567": "store-demo-broker-1-0", "logs-demo-broker-1-0-01234567": "logs-demo-broker-1-0"}
+				if got := volumeSnapshots(t, c, pvcs); !reflect.DeepEqual(got, want) {
+					t.Errorf("snapshots = %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReleaseRemovedMembers(t *testing.T) {
+	instance := testStorageInstance("10Gi", "")
+	instance.Spec.BrokerNumberPerGroup = []int{3}
+	pvcs := func() []client.Object {
+		var objs []client.Object
+		for k := 0; k < 3; k++ {
+			objs = append(objs, testBrokerPVC(instance, brokerStoreVolume, 0, k, "10Gi", "10Gi"))
+		}
+		return objs
+	}
+	tests := []struct {
+		name         string
+		policy       rocketmqv1.RetentionPolicy
+		podsLeft     int
+		wantDone     bool
+		wantPVCs     []string
+		wantReleased []string
+	}{
+		{
+			name:     "wait for removed pod to exit",
+			podsLeft: 3,
+			wantPVCs: []string{"store-demo-broker-0-0", "store-demo-broker-0-1", "store-demo-broker-0-2"},
+		},
+		{
+			name:         "retain marks removed member volume released",
+			podsLeft:     2,
+			wantDone:     true,
+			wantPVCs:     []string{"store-demo-broker-0-0", "store-demo-broker-0-1", "store-demo-broker-0-2"},
+			wantReleased: []string{"store-demo-broker-0-2"},
+		},
+		{
+			name:     "delete removed member volume",
+			policy:   rocketmqv1.RetentionPolicyDelete,
+			podsLeft: 2,
+			wantDone: true,
+			wantPVCs: []string{"store-demo-broker-0-0", "store-demo-broker-0-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := instance.DeepCopy()
+			instance.Spec.Storage.RetentionPolicy = tt.policy
+			objs := pvcs()
+			for k := 0; k < tt.podsLeft; k++ {
+				pod := testBrokerPod(instance, 0, k, true)
+				objs = append(objs, &pod)
+			}
+			c := newFakeClient(objs...)
+			r := &DledgerBrokerReconciler{Client: c, Log: logi.GetSugaredLogger()}
+			done, err := r.releaseRemovedMembers(context.Background(), instance, 0, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if done != tt.wantDone {
+				t.Errorf("releaseRemovedMembers() = %v, want %v", done, tt.wantDone)
+			}
+			pvcs, released := remainingPVCs(t, c)
+			if !reflect.DeepEqual(pvcs, tt.wantPVCs) || !reflect.DeepEqual(released, tt.wantReleased) {
+				t.Errorf("pvcs = %v released %v, want %v released %v", pvcs, released, tt.wantPVCs, tt.wantReleased)
+			}
+		})
+	}
+}
+
+func TestPendingReleasedVolumes(t *testing.T) {
+	instance := testStorageInstance("10Gi", "")
+	instance.Spec.BrokerNumberPerGroup = []int{3}
+	released := func(k int) *corev1.PersistentVolumeClaim {
+		pvc := testBrokerPVC(instance, brokerStoreVolume, 0, k, "10Gi", "10Gi")
+		pvc.Annotations = map[string]string{annotationVolumeReleased: "true"}
+		return pvc
+	}
+	tests := []struct {
+		name        string
+		objs        []client.Object
+		members     int
+		wantAllowed bool
+		want        []string
+	}{
+		{name: "new group without volumes", members: 3, wantAllowed: true},
+		{
+			name:    "new group would reuse released volumes",
+			objs:    []client.Object{released(0), testBrokerPVC(instance, brokerStoreVolume, 0, 1, "10Gi", "10Gi")},
+			members: 3,
+			want:    []string{"store-demo-broker-0-0"},
+		},
+		{
+			name:        "existing group growing onto a released volume",
+			objs:        []client.Object{testBrokerStatefulSet(t, instance, 0), released(2)},
+			members:     2,
+			wantAllowed: true,
+			want:        []string{"store-demo-broker-0-2"},
+		},
+		{
+			name:        "existing group not growing",
+			objs:        []client.Object{testBrokerStatefulSet(t, instance, 0), released(2)},
+			members:     3,
+			wantAllowed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DledgerBrokerReconciler{Client: newFakeClient(tt.objs...)}
+			allowed, got, err := r.pendingReleasedVolumes(context.Background(), instance, 0, tt.members)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed != tt.wantAllowed || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pendingReleasedVolumes() = %v, %v, want %v, %v", allowed, got, tt.wantAllowed, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetStorageConditionReleased(t *testing.T) {
+	// 被拒绝复用的pvc优先于差异展示
+	instance := testStorageInstance("10Gi", "")
+	setStorageCondition(instance, []string{"drift"}, []string{"released"})
+	if c := meta.FindStatusCondition(instance.Status.Conditions, rocketmqv1.ConditionStorageReady); c == nil ||
+		c.Status != metav1.ConditionFalse || c.Reason != reasonVolumesReleased || c.Message != "released; drift" {
+		t.Errorf("StorageReady with released volumes = %+v", c)
+	}
+}
@@ -0,0 +1,326 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	errors2 "github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/admin"
+	"rocketmq-operator-v2/pkg/configs"
+)
+
+const (
+	// annotationReadOnly broker组已设置为只读，等待写入停止、消息消费完毕
+	annotationReadOnly = "rocketmq.daocloud.io/read-only"
+	// annotationDrained broker组已无写入且消费完毕可以删除，也可以手动设置为true跳过等待
+	annotationDrained = "rocketmq.daocloud.io/drained"
+	// annotationTopicsExtended 已将topic的队列扩展到该broker组
+	annotationTopicsExtended = "rocketmq.daocloud.io/topics-extended"
+
+	reasonScaleComplete = "ScaleComplete"
+	reasonScalingOut    = "ScalingOut"
+	reasonScalingIn     = "ScalingIn"
+
+	scalingRequeueInterval = 10 * time.Second
+)
+
+// readyBrokerPod 返回第i个broker组中一个就绪的pod，没有就绪的pod时返回空
+func (r *DledgerBrokerReconciler) readyBrokerPod(ctx context.Context, instance *rocketmqv1.DledgerBroker, i int) (string, error) {
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(brokerGroupLabels(instance, i))); err != nil {
+		return "", err
+	}
+	for k := range pods.Items {
+		if isPodReady(&pods.Items[k]) {
+			return pods.Items[k].Name, nil
+		}
+	}
+	return "", nil
+}
+
+// setBrokerPermission 在线修改第i个broker组所有节点的brokerPermission
+func (r *DledgerBrokerReconciler) setBrokerPermission(ctx context.Context, instance *rocketmqv1.DledgerBroker, i, members int, perm string) error {
+	for k := 0; k < members; k++ {
+		addr, err := brokerAddr(ctx, r.Client, instance, i, k)
+		if err != nil {
+			return err
+		}
+		callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+		err = r.Admin.UpdateBrokerConfig(callCtx, addr, map[string]string{configs.BrokerPermission: perm})
+		cancel()
+		if err != nil {
+			return errors2.Wrapf(err, "update %s", addr)
+		}
+	}
+	return nil
+}
+
+// groupMasterAddr 从nameserver查询第i个broker组master通过headless service访问的地址，未注册时返回空
+func (r *DledgerBrokerReconciler) groupMasterAddr(ctx context.Context, instance *rocketmqv1.DledgerBroker, i int, namesrvAddr string) (string, error) {
+	info, err := clusterInfo(ctx, r.Admin, namesrvAddr)
+	if err != nil {
+		return "", err
+	}
+	return masterBrokerAddr(ctx, r.Client, instance, i, info)
+}
+
+// annotateStatefulSet 设置或删除(value为空)statefulset的注解，用于记录扩缩容进度
+func (r *DledgerBrokerReconciler) annotateStatefulSet(ctx context.Context, sts *appsv1.StatefulSet, values map[string]string) error {
+	patch := client.MergeFrom(sts.DeepCopy())
+	if sts.Annotations == nil {
+		sts.Annotations = make(map[string]string, len(values))
+	}
+	for k, v := range values {
+		if v == "" {
+			delete(sts.Annotations, k)
+		} else {
+			sts.Annotations[k] = v
+		}
+	}
+	return r.Patch(ctx, sts, patch)
+}
+
+// scaleOutBrokerGroup 恢复曾经被缩容设置为只读的broker组，并按需将已有topic扩展到该组。
+// 返回非空的消息表示扩容仍在进行
+func (r *DledgerBrokerReconciler) scaleOutBrokerGroup(ctx context.Context, instance *rocketmqv1.DledgerBroker, i int, sts *appsv1.StatefulSet, namesrvAddr string) (string, error) {
+	readOnly := sts.Annotations[annotationReadOnly] == "true"
+	extend := instance.Spec.ExtendTopicsOnScaleOut && sts.Annotations[annotationTopicsExtended] != "true"
+	if !readOnly && !extend {
+		return "", nil
+	}
+	if r.Admin == nil {
+		return fmt.Sprintf("%s: admin is not configured, can not scale out broker group", sts.Name), nil
+	}
+	if sts.Spec.Replicas == nil || sts.Status.ReadyReplicas < *sts.Spec.Replicas {
+		return fmt.Sprintf("%s: waiting for brokers to be ready", sts.Name), nil
+	}
+
+	if readOnly {
+		perm := instance.Spec.Config[configs.BrokerPermission]
+		if perm == "" {
+			perm = strconv.Itoa(admin.PermRead | admin.PermWrite)
+		}
+		if err := r.setBrokerPermission(ctx, instance, i, int(*sts.Spec.Replicas), perm); err != nil {
+			r.Log.Warnw("restore broker permission failed", "statefulset", sts.Name, "error", err)
+			return fmt.Sprintf("%s: restore brokerPermission: %v", sts.Name, err), nil
+		}
+		r.Log.Infow("restore broker permission", "statefulset", sts.Name, "brokerPermission", perm)
+		if err := r.annotateStatefulSet(ctx, sts, map[string]string{annotationReadOnly: "", annotationDrained: ""}); err != nil {
+			return "", err
+		}
+	}
+	if !extend {
+		return "", nil
+	}
+
+	master, err := r.groupMasterAddr(ctx, instance, i, namesrvAddr)
+	if err != nil {
+		r.Log.Warnw("get broker master failed", "statefulset", sts.Name, "error", err)
+		return fmt.Sprintf("%s: get broker master: %v", sts.Name, err), nil
+	}
+	if master == "" {
+		return fmt.Sprintf("%s: waiting for broker to register to nameserver", sts.Name), nil
+	}
+	if err := r.extendTopics(ctx, instance, namesrvAddr, sts.Name, master); err != nil {
+		r.Log.Warnw("extend topics failed", "statefulset", sts.Name, "error", err)
+		return fmt.Sprintf("%s: extend topics: %v", sts.Name, err), nil
+	}
+	return "", r.annotateStatefulSet(ctx, sts, map[string]string{annotationTopicsExtended: "true"})
+}
+
+// extendTopics 为已有的业务topic在新的broker组上创建相同队列数的队列
+func (r *DledgerBrokerReconciler) extendTopics(ctx context.Context, instance *rocketmqv1.DledgerBroker, namesrvAddr, brokerName, master string) error {
+	var lastErr error
+	for _, addr := range splitNamesrvAddr(namesrvAddr) {
+		callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+		topics, err := r.Admin.GetAllTopicList(callCtx, addr)
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return r.extendTopicsFrom(ctx, instance, addr, topics, brokerName, master)
+	}
+	if lastErr == nil {
+		lastErr = errors2.New("namesrvAddr is empty")
+	}
+	return lastErr
+}
+
+// extendTopicsFrom 从namesrvAddr获取topics的路由，将属于本集群的topic扩展到brokerName
+func (r *DledgerBrokerReconciler) extendTopicsFrom(ctx context.Context, instance *rocketmqv1.DledgerBroker, namesrvAddr string, topics []string, brokerName, master string) error {
+	for _, topic := range topics {
+		if admin.IsSystemTopic(topic) || isClusterTopic(instance, topic) {
+			continue
+		}
+		callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+		route, err := r.Admin.GetTopicRouteData(callCtx, namesrvAddr, topic)
+		cancel()
+		if admin.IsTopicNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		q, ok := topicQueueTemplate(instance, route, brokerName)
+		if !ok {
+			continue
+		}
+		callCtx, cancel = context.WithTimeout(ctx, brokerInfoTimeout)
+		err = r.Admin.CreateOrUpdateTopic(callCtx, master, admin.TopicConfig{
+			TopicName:      topic,
+			ReadQueueNums:  q.ReadQueueNums,
+			WriteQueueNums: q.WriteQueueNums,
+			Perm:           q.Perm,
+		})
+		cancel()
+		if err != nil {
+			return err
+		}
+		r.Log.Infow("extend topic to broker group", "topic", topic, "brokerName", brokerName,
+			"readQueueNums", q.ReadQueueNums, "writeQueueNums", q.WriteQueueNums)
+	}
+	return nil
+}
+
+// isClusterTopic broker会以集群名、brokerName以及 集群名_REPLY_TOPIC 创建内部topic
+func isClusterTopic(instance *rocketmqv1.DledgerBroker, topic string) bool {
+	return topic == instance.Name || strings.HasPrefix(topic, instance.Name+"_") ||
+		strings.HasPrefix(topic, instance.Name+"-broker-")
+}
+
+// topicQueueTemplate 从topic在本集群其他broker组上的队列配置中选择新broker组使用的配置，
+// topic已经分布在brokerName上或者不属于本集群时返回false
+func topicQueueTemplate(instance *rocketmqv1.DledgerBroker, route *admin.TopicRouteData, brokerName string) (admin.QueueData, bool) {
+	var template *admin.QueueData
+	for k := range route.QueueDatas {
+		q := &route.QueueDatas[k]
+		if q.BrokerName == brokerName {
+			return admin.QueueData{}, false
+		}
+		if !strings.HasPrefix(q.BrokerName, instance.Name+"-broker-") {
+			continue
+		}
+		if template == nil || (template.Perm&admin.PermWrite == 0 && q.Perm&admin.PermWrite != 0) {
+			template = q
+		}
+	}
+	if template == nil {
+		return admin.QueueData{}, false
+	}
+	q := *template
+	q.BrokerName = brokerName
+	// 模板所在的broker组可能正在缩容被设置为只读
+	q.Perm |= admin.PermRead | admin.PermWrite
+	return q, true
+}
+
+// drainBrokerGroup 将待删除的broker组设置为只读，等待写入停止且所有消费组消费完毕。
+// 返回false时同时返回描述等待原因的消息
+func (r *DledgerBrokerReconciler) drainBrokerGroup(ctx context.Context, instance *rocketmqv1.DledgerBroker, group int, sts *appsv1.StatefulSet, namesrvAddr string) (bool, string, error) {
+	if sts.Annotations[annotationDrained] == "true" {
+		return true, "", nil
+	}
+	if r.Admin == nil {
+		return false, fmt.Sprintf("%s: admin is not configured, set annotation %s=true on the statefulset to remove it without draining",
+			sts.Name, annotationDrained), nil
+	}
+	pod, err := r.readyBrokerPod(ctx, instance, group)
+	if err != nil {
+		return false, "", err
+	}
+	if pod == "" {
+		return false, fmt.Sprintf("%s: no ready broker to drain, set annotation %s=true on the statefulset to remove it anyway",
+			sts.Name, annotationDrained), nil
+	}
+
+	if sts.Annotations[annotationReadOnly] != "true" {
+		if err := r.setBrokerPermission(ctx, instance, group, int(*sts.Spec.Replicas), strconv.Itoa(admin.PermRead)); err != nil {
+			r.Log.Warnw("set broker read-only failed", "statefulset", sts.Name, "error", err)
+			return false, fmt.Sprintf("%s: set brokerPermission: %v", sts.Name, err), nil
+		}
+		r.Log.Infow("set broker group read-only", "statefulset", sts.Name)
+		if err := r.annotateStatefulSet(ctx, sts, map[string]string{annotationReadOnly: "true"}); err != nil {
+			return false, "", err
+		}
+		return false, fmt.Sprintf("%s: set read-only, waiting for writes to stop", sts.Name), nil
+	}
+
+	master, err := r.groupMasterAddr(ctx, instance, group, namesrvAddr)
+	if err != nil {
+		r.Log.Warnw("get broker master failed", "statefulset", sts.Name, "error", err)
+		return false, fmt.Sprintf("%s: get broker master: %v", sts.Name, err), nil
+	}
+	// 未注册到nameserver的broker不会再有客户端访问
+	if master != "" {
+		tps, diff, err := r.brokerTraffic(ctx, master, brokerGroupName(instance, group))
+		if err != nil {
+			r.Log.Warnw("get broker traffic failed", "statefulset", sts.Name, "error", err)
+			return false, fmt.Sprintf("%s: get putTps and consume diff: %v", sts.Name, err), nil
+		}
+		if tps > 0 || diff > 0 {
+			return false, fmt.Sprintf("%s: waiting for putTps %.2f and consume diff %d to reach 0, set annotation %s=true on the statefulset to remove it anyway",
+				sts.Name, tps, diff, annotationDrained), nil
+		}
+	}
+	r.Log.Infow("broker group drained", "statefulset", sts.Name)
+	if err := r.annotateStatefulSet(ctx, sts, map[string]string{annotationDrained: "true"}); err != nil {
+		return false, "", err
+	}
+	return true, "", nil
+}
+
+// brokerTraffic 返回broker最近的写入tps和所有消费组在brokerName的队列上的消息堆积总数
+func (r *DledgerBrokerReconciler) brokerTraffic(ctx context.Context, brokerAddr, brokerName string) (float64, int64, error) {
+	callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+	defer cancel()
+	info, err := r.Admin.GetBrokerRuntimeInfo(callCtx, brokerAddr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, ok := info.Table["putTps"]; !ok {
+		return 0, 0, errors2.Errorf("putTps not found in runtime info of %s", brokerAddr)
+	}
+	stats, err := r.Admin.GetBrokerConsumeStats(callCtx, brokerAddr)
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.PutTps, stats.BrokerDiff(brokerName), nil
+}
+
+// setScalingCondition 根据扩缩容以及组成员调整的进度设置Scaling状态，缩容优先展示
+func setScalingCondition(instance *rocketmqv1.DledgerBroker, scalingIn, scalingOut, resizing []string) {
+	condition := metav1.Condition{
+		Type:               rocketmqv1.ConditionScaling,
+		Status:             metav1.ConditionFalse,
+		Reason:             reasonScaleComplete,
+		Message:            "broker groups match spec",
+		ObservedGeneration: instance.Generation,
+	}
+	switch {
+	case len(scalingIn) > 0:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = reasonScalingIn
+		condition.Message = strings.Join(scalingIn, "; ")
+	case len(scalingOut) > 0:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = reasonScalingOut
+		condition.Message = strings.Join(scalingOut, "; ")
+	case len(resizing) > 0:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = reasonResizingMembers
+		condition.Message = strings.Join(resizing, "; ")
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+}
@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"rocketmq-operator-v2/pkg/admin"
+	"rocketmq-operator-v2/pkg/configs"
+	"rocketmq-operator-v2/pkg/logi"
+)
+
+func TestTopicQueueTemplate(t *testing.T) {
+	instance := testBrokerInstance()
+	queue := func(brokerName string, read, write, perm int) admin.QueueData {
+		return admin.QueueData{BrokerName: brokerName, ReadQueueNums: read, WriteQueueNums: write, Perm: perm}
+	}
+	tests := []struct {
+		name   string
+		queues []admin.QueueData
+		want   admin.QueueData
+		wantOk bool
+	}{
+		{
+			name:   "copy queues from another group",
+			queues: []admin.QueueData{queue("demo-broker-0", 8, 4, 6)},
+			want:   queue("demo-broker-1", 8, 4, 6),
+			wantOk: true,
+		},
+		{
+			name:   "prefer a writable group as template",
+			queues: []admin.QueueData{queue("demo-broker-0", 8, 8, 4), queue("demo-broker-2", 16, 16, 6)},
+			want:   queue("demo-broker-1", 16, 16, 6),
+			wantOk: true,
+		},
+		{
+			name:   "restore permission of a read-only template",
+			queues: []admin.QueueData{queue("demo-broker-0", 8, 8, admin.PermRead)},
+			want:   queue("demo-broker-1", 8, 8, admin.PermRead|admin.PermWrite),
+			wantOk: true,
+		},
+		{
+			name:   "already on the group",
+			queues: []admin.QueueData{queue("demo-broker-0", 8, 8, 6), queue("demo-broker-1", 4, 4, 6)},
+		},
+		{
+			name:   "topic of another cluster",
+			queues: []admin.QueueData{queue("other-broker-0", 8, 8, 6)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := topicQueueTemplate(instance, &admin.TopicRouteData{QueueDatas: tt.queues}, "demo-broker-1")
+			if ok != tt.wantOk || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("topicQueueTemplate() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestExtendTopics(t *testing.T) {
+	instance := testBrokerInstance()
+	route := func(brokerName string) *admin.TopicRouteData {
+		return &admin.TopicRouteData{QueueDatas: []admin.QueueData{
+			{BrokerName: brokerName, ReadQueueNums: 8, WriteQueueNums: 4, Perm: 6},
+		}}
+	}
+	a := &fakeAdmin{
+		topicList: []string{"orders", "TBW102", "%RETRY%billing", "demo", "demo_REPLY_TOPIC", "demo-broker-0", "foreign", "deleted"},
+		routes: map[string]*admin.TopicRouteData{
+			"orders":         route("demo-broker-0"),
+			"TBW102":         route("demo-broker-0"),
+			"%RETRY%billing": route("demo-broker-0"),
+			"demo":           route("demo-broker-0"),
+			"foreign":        route("other-broker-0"),
+		},
+	}
+	r := &DledgerBrokerReconciler{Admin: a, Log: logi.GetSugaredLogger()}
+	if err := r.extendTopics(context.Background(), instance, "ns-0:9876;ns-1:9876", "demo-broker-1", "m:10911"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]admin.TopicConfig{
+		"m:10911": {"orders": {TopicName: "orders", ReadQueueNums: 8, WriteQueueNums: 4, Perm: 6}},
+	}
+	if !reflect.DeepEqual(a.topicConfigs, want) {
+		t.Errorf("created topics = %+v, want %+v", a.topicConfigs, want)
+	}
+	if err := r.extendTopics(context.Background(), instance, "", "demo-broker-1", "m:10911"); err == nil {
+		t.Error("extendTopics() without nameserver should fail")
+	}
+}
+
+func TestDrainBrokerGroup(t *testing.T) {
+	instance := testBrokerInstance()
+	instance.Spec.BrokerGroupNumber = 1
+	pod := testBrokerPod(instance, 1, 0, true)
+	replicas := int32(1)
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "demo-broker-1"},
+		Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+	}
+	headless := fmt.Sprintf("%s:%d", brokerPodFQDN(instance, 1, 0), brokerPortMain)
+	registered := &admin.ClusterInfo{BrokerAddrTable: map[string]admin.BrokerData{
+		"demo-broker-1": {BrokerName: "demo-broker-1", BrokerAddrs: map[string]string{admin.MasterId: fmt.Sprintf("10.0.1.0:%d", brokerPortMain)}},
+	}}
+	traffic := func(tps float64) map[string]*admin.BrokerRuntimeInfo {
+		return map[string]*admin.BrokerRuntimeInfo{headless: {PutTps: tps, Table: map[string]string{"putTps": fmt.Sprint(tps)}}}
+	}
+	// backlog 返回headless上的消费进度，diffs为各broker组队列上的堆积
+	backlog := func(diffs map[string]int64) map[string]*admin.BrokerConsumeStats {
+		stats := admin.ConsumeStats{OffsetTable: make(map[admin.MessageQueue]admin.OffsetWrapper)}
+		var total int64
+		for brokerName, diff := range diffs {
+			stats.OffsetTable[admin.MessageQueue{Topic: "orders", BrokerName: brokerName}] = admin.OffsetWrapper{BrokerOffset: 100 + diff, ConsumerOffset: 100}
+			total += diff
+		}
+		return map[string]*admin.BrokerConsumeStats{headless: {
+			BrokerAddr:       headless,
+			ConsumeStatsList: []map[string][]admin.ConsumeStats{{"billing": {stats}}},
+			TotalDiff:        total,
+		}}
+	}
+	a := &fakeAdmin{}
+	r := &DledgerBrokerReconciler{Client: newFakeClient(sts, &pod), Admin: a, Log: logi.GetSugaredLogger()}
+	ctx := context.Background()
+
+	drained, msg, err := r.drainBrokerGroup(ctx, instance, 1, sts, "ns:9876")
+	if err != nil || drained {
+		t.Fatalf("set read-only: drainBrokerGroup() = %v, %q, %v", drained, msg, err)
+	}
+	if got := a.brokerConfigs[headless][configs.BrokerPermission]; got != "4" {
+		t.Errorf("brokerPermission = %q, want 4", got)
+	}
+	if sts.Annotations[annotationReadOnly] != "true" {
+		t.Errorf("annotations = %v, want %s=true", sts.Annotations, annotationReadOnly)
+	}
+
+	a.cluster = registered
+	a.runtime = traffic(1.5)
+	a.brokerConsumeStats = backlog(nil)
+	if drained, msg, err = r.drainBrokerGroup(ctx, instance, 1, sts, "ns:9876"); err != nil || drained {
+		t.Fatalf("writes in progress: drainBrokerGroup() = %v, %q, %v", drained, msg, err)
+	}
+	a.runtime = traffic(0)
+	a.brokerConsumeStats = backlog(map[string]int64{"demo-broker-1": 12})
+	if drained, msg, err = r.drainBrokerGroup(ctx, instance, 1, sts, "ns:9876"); err != nil || drained {
+		t.Fatalf("messages not consumed: drainBrokerGroup() = %v, %q, %v", drained, msg, err)
+	}
+	// 其他broker组队列上的堆积不影响下线
+	a.brokerConsumeStats = backlog(map[string]int64{"demo-broker-0": 30})
+	if drained, msg, err = r.drainBrokerGroup(ctx, instance, 1, sts, "ns:9876"); err != nil || !drained {
+		t.Fatalf("drained: drainBrokerGroup() = %v, %q, %v", drained, msg, err)
+	}
+	if sts.Annotations[annotationDrained] != "true" {
+		t.Errorf("annotations = %v, want %s=true", sts.Annotations, annotationDrained)
+	}
+
+	r.Admin = nil
+	delete(sts.Annotations, annotationDrained)
+	if drained, msg, _ = r.drainBrokerGroup(ctx, instance, 1, sts, "ns:9876"); drained || msg == "" {
+		t.Errorf("without admin: drainBrokerGroup() = %v, %q, want to wait", drained, msg)
+	}
+}
@@ -0,0 +1,261 @@
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/configs"
+)
+
+const (
+	labelApp         = "app"
+	labelCluster     = "rocketmq.daocloud.io/cluster"
+	labelBrokerGroup = "rocketmq.daocloud.io/broker-group"
+
+	appBroker = "rocketmq-broker"
+
+	brokerContainerName = "broker"
+
+	brokerPortMain    = 10911
+	brokerPortVip     = 10909
+	brokerPortHA      = 10912
+	brokerPortDledger = 40911
+)
+
+// brokerGroupName 返回第i个broker组的名称，同时作为statefulset名称和brokerName
+func brokerGroupName(instance *rocketmqv1.DledgerBroker, i int) string {
+	return fmt.Sprintf("%s-broker-%d", instance.Name, i)
+}
+
+// brokerHeadlessServiceName 返回所有broker pod共用的headless service名称
+func brokerHeadlessServiceName(instance *rocketmqv1.DledgerBroker) string {
+	return fmt.Sprintf("%s-broker-hs", instance.Name)
+}
+
+func brokerClusterLabels(instance *rocketmqv1.DledgerBroker) map[string]string {
+	return map[string]string{
+		labelApp:     appBroker,
+		labelCluster: instance.Name,
+	}
+}
+
+func brokerGroupLabels(instance *rocketmqv1.DledgerBroker, i int) map[string]string {
+	labels := brokerClusterLabels(instance)
+	labels[labelBrokerGroup] = strconv.Itoa(i)
+	return labels
+}
+
+// mutateBrokerHeadlessService 渲染broker的headless service，为每个pod提供稳定的dns名称
+func mutateBrokerHeadlessService(instance *rocketmqv1.DledgerBroker, svc *corev1.Service) {
+	svc.Labels = mergeLabels(svc.Labels, brokerClusterLabels(instance))
+	svc.Spec.ClusterIP = corev1.ClusterIPNone
+	svc.Spec.PublishNotReadyAddresses = true
+	svc.Spec.Selector = brokerClusterLabels(instance)
+	ports := brokerContainerPorts(instance)
+	svc.Spec.Ports = make([]corev1.ServicePort, 0, len(ports))
+	for _, p := range ports {
+		svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Name: p.Name, Port: p.ContainerPort, TargetPort: intstr.FromInt(int(p.ContainerPort))})
+	}
+}
+
+// brokerContainerPorts 返回所有broker pod共同监听的端口。NodePort方式下各pod的main和vip端口为各自分配的nodePort，
+// 由pod的对外service声明，这里不再声明固定的端口
+func brokerContainerPorts(instance *rocketmqv1.DledgerBroker) []corev1.ContainerPort {
+	ports := []corev1.ContainerPort{
+		{Name: "main", ContainerPort: brokerPortMain},
+		{Name: "vip", ContainerPort: brokerPortVip},
+		{Name: "ha", ContainerPort: brokerPortHA},
+		{Name: "dledger", ContainerPort: brokerPortDledger},
+	}
+	if brokerListensOnNodePort(instance) {
+		ports = ports[2:]
+	}
+	return ports
+}
+
+// mutateBrokerStatefulSet 渲染第i个broker组的statefulset，members为当前的组成员数，hash为该组broker配置的摘要。
+// LeaderAware策略下pod由operator按先follower后leader的顺序重启，statefulset使用OnDelete更新策略
+func mutateBrokerStatefulSet(instance *rocketmqv1.DledgerBroker, i, members int, hash string, sts *appsv1.StatefulSet) {
+	labels := brokerGroupLabels(instance, i)
+	replicas := int32(members)
+
+	sts.Labels = mergeLabels(sts.Labels, labels)
+	sts.Spec.Replicas = &replicas
+	strategy := appsv1.OnDeleteStatefulSetStrategyType
+	if instance.Spec.UpdateStrategy == rocketmqv1.UpdateStrategyRollingUpdate {
+		strategy = appsv1.RollingUpdateStatefulSetStrategyType
+	}
+	// 保留apiserver为RollingUpdate填充的默认partition，避免每次调谐都更新statefulset
+	if sts.Spec.UpdateStrategy.Type != strategy {
+		sts.Spec.UpdateStrategy = appsv1.StatefulSetUpdateStrategy{Type: strategy}
+	}
+	sts.Spec.ServiceName = brokerHeadlessServiceName(instance)
+	sts.Spec.PodManagementPolicy = appsv1.ParallelPodManagement
+	// selector创建后不可修改，只在创建时设置
+	if sts.Spec.Selector == nil {
+		sts.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+	}
+
+	template := &sts.Spec.Template
+	template.Labels = mergeLabels(template.Labels, labels)
+	template.Annotations = mergeLabels(template.Annotations, map[string]string{annotationConfigHash: hash})
+	podSpec := &template.Spec
+	podSpec.ServiceAccountName = instance.Spec.ServiceAccountName
+	podSpec.ImagePullSecrets = instance.Spec.ImagePullSecret
+	applyPodSpec(podSpec, instance.Spec.PodSpec)
+	setVolume(podSpec, corev1.Volume{
+		Name: brokerConfigVolume,
+		VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: brokerConfigMapName(instance, i)},
+		}},
+	})
+	if instance.Spec.Acl != nil {
+		setVolume(podSpec, corev1.Volume{
+			Name: brokerAclVolume,
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+				SecretName: brokerAclSecretName(instance),
+			}},
+		})
+	} else {
+		removeVolume(podSpec, brokerAclVolume)
+	}
+
+	container := findOrAppendContainer(podSpec, brokerContainerName)
+	container.Image = instance.Spec.Image
+	container.ImagePullPolicy = instance.Spec.ImagePullPolicy
+	container.Env = brokerEnv(instance)
+	if instance.Spec.Resource != nil {
+		container.Resources = *instance.Spec.Resource
+	}
+	container.Ports = brokerContainerPorts(instance)
+	setVolumeMount(container, corev1.VolumeMount{Name: brokerConfigVolume, MountPath: brokerConfigMountPath})
+	applyBrokerExternalAccess(instance, template, container)
+	applyBrokerStorage(instance, sts, container)
+	if instance.Spec.Acl != nil {
+		setVolumeMount(container, corev1.VolumeMount{
+			Name:      brokerAclVolume,
+			MountPath: configs.GetGlobalConfig().ROCKETMQ_HOME + brokerAclDir,
+			ReadOnly:  true,
+		})
+	} else {
+		removeVolumeMount(container, brokerAclVolume)
+	}
+}
+
+// brokerEnv 返回broker容器的环境变量，开启acl时追加读取挂载的plain_acl.yml的jvm参数
+func brokerEnv(instance *rocketmqv1.DledgerBroker) []corev1.EnvVar {
+	env := make([]corev1.EnvVar, 0, len(instance.Spec.Env)+1)
+	env = append(env, instance.Spec.Env...)
+	if instance.Spec.Acl != nil {
+		opt := brokerAclJavaOpt()
+		if v, ok := configs.LookupEnv(env, configs.JAVA_OPT_EXT); ok && v != "" && v != configs.Empty {
+			opt = v + " " + opt
+		}
+		env = configs.SetEnv(env, configs.JAVA_OPT_EXT, opt)
+	}
+	return env
+}
+
+// brokerExporter 返回broker实例的exporter，namesrvAddr为空时使用Spec.Config中用户配置的地址，
+// adminVersion为admin secret的resourceVersion，为空表示集群没有admin账号，exporter不开启acl
+func brokerExporter(instance *rocketmqv1.DledgerBroker, namesrvAddr, adminVersion string) *exporter {
+	if namesrvAddr == "" {
+		namesrvAddr = instance.Spec.Config[configs.NamesrvAddr]
+	}
+	e := &exporter{
+		Name:        instance.Name + "-broker-exporter",
+		For:         appBroker,
+		Cluster:     instance.Name,
+		Setting:     instance.Spec.Export,
+		NamesrvAddr: namesrvAddr,
+	}
+	if adminVersion != "" {
+		e.Env = brokerExporterEnv(instance)
+		e.CredentialVersion = adminVersion
+	}
+	return e
+}
+
+// applyPodSpec 将crd中的pod配置应用到pod spec
+func applyPodSpec(podSpec *corev1.PodSpec, s *rocketmqv1.PodSpec) {
+	if s == nil {
+		return
+	}
+	podSpec.HostAliases = s.HostAliases
+	if s.RestartPolicy != "" {
+		podSpec.RestartPolicy = s.RestartPolicy
+	}
+	podSpec.NodeSelector = s.NodeSelector
+	podSpec.SecurityContext = s.SecurityContext
+	podSpec.Affinity = s.Affinity
+	podSpec.Tolerations = s.Tolerations
+}
+
+// findOrAppendContainer 返回指定名称的container，不存在时追加一个
+func findOrAppendContainer(podSpec *corev1.PodSpec, name string) *corev1.Container {
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name == name {
+			return &podSpec.Containers[i]
+		}
+	}
+	podSpec.Containers = append(podSpec.Containers, corev1.Container{Name: name})
+	return &podSpec.Containers[len(podSpec.Containers)-1]
+}
+
+// setVolume 按名称替换或追加pod的volume
+func setVolume(podSpec *corev1.PodSpec, volume corev1.Volume) {
+	for i := range podSpec.Volumes {
+		if podSpec.Volumes[i].Name == volume.Name {
+			podSpec.Volumes[i] = volume
+			return
+		}
+	}
+	podSpec.Volumes = append(podSpec.Volumes, volume)
+}
+
+// setVolumeMount 按名称替换或追加container的挂载
+func setVolumeMount(container *corev1.Container, mount corev1.VolumeMount) {
+	for i := range container.VolumeMounts {
+		if container.VolumeMounts[i].Name == mount.Name {
+			container.VolumeMounts[i] = mount
+			return
+		}
+	}
+	container.VolumeMounts = append(container.VolumeMounts, mount)
+}
+
+// removeVolume 删除指定名称的volume
+func removeVolume(podSpec *corev1.PodSpec, name string) {
+	for i := range podSpec.Volumes {
+		if podSpec.Volumes[i].Name == name {
+			podSpec.Volumes = append(podSpec.Volumes[:i], podSpec.Volumes[i+1:]...)
+			return
+		}
+	}
+}
+
+// removeVolumeMount 删除指定名称的挂载
+func removeVolumeMount(container *corev1.Container, name string) {
+	for i := range container.VolumeMounts {
+		if container.VolumeMounts[i].Name == name {
+			container.VolumeMounts = append(container.VolumeMounts[:i], container.VolumeMounts[i+1:]...)
+			return
+		}
+	}
+}
+
+func mergeLabels(dst, src map[string]string) map[string]string {
+	if dst == nil {
+		dst = make(map[string]string, len(src))
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/logi"
+)
+
+func TestMutateBrokerStatefulSet(t *testing.T) {
+	instance := testBrokerInstance()
+	instance.UID = "uid"
+	instance.Spec.BrokerGroupNumber = 2
+	instance.Spec.Image = "apache/rocketmq:4.6.1"
+	instance.Spec.ServiceAccountName = "rocketmq"
+	instance.Spec.Env = []corev1.EnvVar{{Name: "JAVA_OPT_EXT", Value: "-Xmx1g"}}
+	c := newFakeClient(instance)
+	r := &DledgerBrokerReconciler{Client: c, Scheme: testScheme(), Log: logi.GetSugaredLogger()}
+	ctx := context.Background()
+
+	sts, err := r.reconcileStatefulSet(ctx, instance, 1, 3, "hash-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{labelApp: appBroker, labelCluster: "demo", labelBrokerGroup: "1"}
+	if sts.Name != "demo-broker-1" || !reflect.DeepEqual(sts.Labels, labels) || !metav1.IsControlledBy(sts, instance) {
+		t.Errorf("statefulset meta = %s %v, owners %v", sts.Name, sts.Labels, sts.OwnerReferences)
+	}
+	if *sts.Spec.Replicas != 3 || sts.Spec.ServiceName != "demo-broker-hs" || sts.Spec.PodManagementPolicy != appsv1.ParallelPodManagement ||
+		sts.Spec.UpdateStrategy.Type != appsv1.OnDeleteStatefulSetStrategyType {
+		t.Errorf("statefulset spec = %+v", sts.Spec)
+	}
+	if !reflect.DeepEqual(sts.Spec.Selector.MatchLabels, labels) || !reflect.DeepEqual(sts.Spec.Template.Labels, labels) {
+		t.Errorf("selector = %v, template labels = %v, want %v", sts.Spec.Selector.MatchLabels, sts.Spec.Template.Labels, labels)
+	}
+	if sts.Spec.Template.Annotations[annotationConfigHash] != "hash-1" {
+		t.Errorf("template annotations = %v, want config hash hash-1", sts.Spec.Template.Annotations)
+	}
+	podSpec := sts.Spec.Template.Spec
+	if podSpec.ServiceAccountName != "rocketmq" || podSpec.Volumes[0].ConfigMap == nil ||
+		podSpec.Volumes[0].ConfigMap.Name != brokerConfigMapName(instance, 1) {
+		t.Errorf("pod spec = %+v, want configmap volume %s", podSpec, brokerConfigMapName(instance, 1))
+	}
+	container := podSpec.Containers[0]
+	if container.Name != brokerContainerName || container.Image != "apache/rocketmq:4.6.1" || len(container.Ports) != 4 ||
+		!reflect.DeepEqual(container.Env, instance.Spec.Env) || container.VolumeMounts[0].MountPath != brokerConfigMountPath {
+		t.Errorf("broker container = %+v", container)
+	}
+
+	// 更新时保留创建后不可修改的selector以及用户添加的container
+	sts.Spec.Selector.MatchLabels = map[string]string{labelApp: appBroker}
+	sts.Spec.Template.Spec.Containers = append(sts.Spec.Template.Spec.Containers, corev1.Container{Name: "sidecar", Image: "busybox"})
+	if err := c.Update(ctx, sts); err != nil {
+		t.Fatal(err)
+	}
+	instance.Spec.Image = "apache/rocketmq:4.9.4"
+	instance.Spec.UpdateStrategy = rocketmqv1.UpdateStrategyRollingUpdate
+	if sts, err = r.reconcileStatefulSet(ctx, instance, 1, 2, "hash-2"); err != nil {
+		t.Fatal(err)
+	}
+	if *sts.Spec.Replicas != 2 || sts.Spec.Template.Annotations[annotationConfigHash] != "hash-2" ||
+		sts.Spec.UpdateStrategy.Type != appsv1.RollingUpdateStatefulSetStrategyType {
+		t.Errorf("updated statefulset spec = %+v", sts.Spec)
+	}
+	if !reflect.DeepEqual(sts.Spec.Selector.MatchLabels, map[string]string{labelApp: appBroker}) {
+		t.Errorf("selector = %v, want unchanged", sts.Spec.Selector.MatchLabels)
+	}
+	containers := sts.Spec.Template.Spec.Containers
+	if len(containers) != 2 || containers[0].Image != "apache/rocketmq:4.9.4" || containers[1].Name != "sidecar" {
+		t.Errorf("containers = %+v", containers)
+	}
+}
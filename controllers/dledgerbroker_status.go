@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+)
+
+// brokerHealth 统计各broker组的就绪节点数并设置Ready、Progressing、Degraded状态和Phase，
+// 需要在syncBrokerInfo之后调用。返回有pod即将达到降级阈值时需要重新调谐的等待时间
+func (r *DledgerBrokerReconciler) brokerHealth(ctx context.Context, instance *rocketmqv1.DledgerBroker, members []int, progressing []string) (time.Duration, error) {
+	var notReady, degraded []string
+	degradedReason := reasonPodsUnavailable
+	var requeue time.Duration
+	readyGroups, readyNodes, totalNodes := 0, 0, 0
+	now := time.Now()
+	for i := range members {
+		pods, err := r.groupPods(ctx, instance, i)
+		if err != nil {
+			return 0, err
+		}
+		group := brokerGroupName(instance, i)
+		ready := 0
+		for k := range pods {
+			if isPodReady(&pods[k]) && podOrdinal(&pods[k]) < members[i] {
+				ready++
+			}
+		}
+		readyNodes += ready
+		totalNodes += members[i]
+
+		unavailable, next := unavailablePods(pods, now)
+		if next > 0 && (requeue == 0 || next < requeue) {
+			requeue = next
+		}
+		if len(unavailable) > 0 {
+			msg := fmt.Sprintf("%s: pods %v unavailable for more than %s", group, unavailable, podUnavailableThreshold)
+			if ready < dledgerQuorum(members[i]) {
+				degradedReason = reasonQuorumLost
+				msg = fmt.Sprintf("%s: only %d/%d nodes ready, quorum of %d lost, pods %v unavailable",
+					group, ready, members[i], dledgerQuorum(members[i]), unavailable)
+			}
+			degraded = append(degraded, msg)
+		}
+
+		switch {
+		case ready < members[i]:
+			notReady = append(notReady, fmt.Sprintf("%s: %d/%d nodes ready", group, ready, members[i]))
+		case !groupHasMaster(instance, group):
+			notReady = append(notReady, fmt.Sprintf("%s: no master registered in nameserver", group))
+		default:
+			readyGroups++
+		}
+	}
+	instance.Status.ReadyGroups = fmt.Sprintf("%d/%d", readyGroups, len(members))
+	instance.Status.ReadyNodes = fmt.Sprintf("%d/%d", readyNodes, totalNodes)
+	instance.Status.Phase = setHealthConditions(&instance.Status.Conditions, instance.Generation, instance.Status.Phase,
+		notReady, progressing, degradedReason, degraded)
+	return requeue, nil
+}
+
+// groupHasMaster 根据Status.BrokerMembers判断broker组是否有master注册到nameserver，没有BrokerMembers时不做判断
+func groupHasMaster(instance *rocketmqv1.DledgerBroker, group string) bool {
+	members, ok := instance.Status.BrokerMembers[group]
+	if !ok {
+		return true
+	}
+	for _, m := range members {
+		if m.Registered && m.BrokerId != nil && *m.BrokerId == 0 {
+			return true
+		}
+	}
+	return false
+}
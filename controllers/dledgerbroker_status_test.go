@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+)
+
+func TestBrokerHealth(t *testing.T) {
+	master, follower := 0, 1
+	tests := []struct {
+		name       string
+		members    map[string][]rocketmqv1.BrokerMember
+		ready      int
+		want       rocketmqv1.Phase
+		wantGroups string
+		wantNodes  string
+	}{
+		{name: "without broker members", ready: 3, want: rocketmqv1.PhaseRunning, wantGroups: "1/1", wantNodes: "3/3"},
+		{
+			name:       "master registered",
+			members:    map[string][]rocketmqv1.BrokerMember{"demo-broker-0": {{Registered: true, BrokerId: &master}}},
+			ready:      3,
+			want:       rocketmqv1.PhaseRunning,
+			wantGroups: "1/1",
+			wantNodes:  "3/3",
+		},
+		{
+			name:       "no master registered",
+			members:    map[string][]rocketmqv1.BrokerMember{"demo-broker-0": {{Registered: true, BrokerId: &follower}}},
+			ready:      3,
+			want:       rocketmqv1.PhasePending,
+			wantGroups: "0/1",
+			wantNodes:  "3/3",
+		},
+		{name: "nodes unavailable", ready: 2, want: rocketmqv1.PhaseDegraded, wantGroups: "0/1", wantNodes: "2/3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := testBrokerInstance()
+			instance.Spec.BrokerGroupNumber = 1
+			instance.Status.BrokerMembers = tt.members
+			var objs []client.Object
+			for k := 0; k < 3; k++ {
+				pod := testBrokerPod(instance, 0, k, k < tt.ready)
+				objs = append(objs, &pod)
+			}
+			r := &DledgerBrokerReconciler{Client: newFakeClient(objs...)}
+			if _, err := r.brokerHealth(context.Background(), instance, []int{3}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if instance.Status.Phase != tt.want || instance.Status.ReadyGroups != tt.wantGroups || instance.Status.ReadyNodes != tt.wantNodes {
+				t.Errorf("status = %s %s %s, want %s %s %s, conditions %+v", instance.Status.Phase, instance.Status.ReadyGroups,
+					instance.Status.ReadyNodes, tt.want, tt.wantGroups, tt.wantNodes, instance.Status.Conditions)
+			}
+			if meta.IsStatusConditionTrue(instance.Status.Conditions, rocketmqv1.ConditionReady) != (tt.want == rocketmqv1.PhaseRunning) {
+				t.Errorf("Ready condition = %+v", instance.Status.Conditions)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+)
+
+const (
+	brokerStoreVolume = "store"
+	brokerStorePath   = "/home/rocketmq/store"
+	brokerLogsVolume  = "logs"
+	brokerLogsPath    = "/home/rocketmq/logs"
+
+	reasonStorageInSync   = "InSync"
+	reasonStorageDrift    = "Drift"
+	reasonVolumesReleased = "VolumesReleased"
+)
+
+// brokerVolumeClaimTemplates 根据Spec.Storage渲染store以及可选的logs持久卷模板
+func brokerVolumeClaimTemplates(instance *rocketmqv1.DledgerBroker) []corev1.PersistentVolumeClaim {
+	storage := instance.Spec.Storage
+	if storage == nil {
+		return nil
+	}
+	var templates []corev1.PersistentVolumeClaim
+	if pvc, ok := newVolumeClaimTemplate(brokerStoreVolume, storage.StorageClass, storage.Size); ok {
+		templates = append(templates, pvc)
+	}
+	if pvc, ok := newVolumeClaimTemplate(brokerLogsVolume, storage.StorageClass, storage.LogSize); ok {
+		templates = append(templates, pvc)
+	}
+	return templates
+}
+
+// newVolumeClaimTemplate size为空或无法解析时返回false，由webhook保证size合法
+func newVolumeClaimTemplate(name, storageClass, size string) (corev1.PersistentVolumeClaim, bool) {
+	if size == "" {
+		return corev1.PersistentVolumeClaim{}, false
+	}
+	q, err := resource.ParseQuantity(size)
+	if err != nil {
+		return corev1.PersistentVolumeClaim{}, false
+	}
+	pvc := corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: q},
+			},
+		},
+	}
+	if storageClass != "" {
+		pvc.Spec.StorageClassName = &storageClass
+	}
+	return pvc, true
+}
+
+// applyBrokerStorage 设置statefulset的持久卷模板以及broker容器的挂载。
+// volumeClaimTemplates创建后不可修改，已存在的statefulset保留原有模板，差异由storageDrift报告
+func applyBrokerStorage(instance *rocketmqv1.DledgerBroker, sts *appsv1.StatefulSet, container *corev1.Container) {
+	if sts.CreationTimestamp.IsZero() {
+		sts.Spec.VolumeClaimTemplates = brokerVolumeClaimTemplates(instance)
+	}
+	podSpec := &sts.Spec.Template.Spec
+	if findVolumeClaimTemplate(sts.Spec.VolumeClaimTemplates, brokerStoreVolume) == nil {
+		setVolume(podSpec, corev1.Volume{
+			Name:         brokerStoreVolume,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+	} else {
+		removeVolume(podSpec, brokerStoreVolume)
+	}
+	setVolumeMount(container, corev1.VolumeMount{Name: brokerStoreVolume, MountPath: brokerStorePath})
+	if findVolumeClaimTemplate(sts.Spec.VolumeClaimTemplates, brokerLogsVolume) != nil {
+		setVolumeMount(container, corev1.VolumeMount{Name: brokerLogsVolume, MountPath: brokerLogsPath})
+	} else {
+		removeVolumeMount(container, brokerLogsVolume)
+	}
+}
+
+// storageDrift 比较statefulset现有的持久卷模板与Spec.Storage，返回不一致的描述
+func storageDrift(instance *rocketmqv1.DledgerBroker, sts *appsv1.StatefulSet) []string {
+	var drift []string
+	desired := brokerVolumeClaimTemplates(instance)
+	for k := range desired {
+		want := &desired[k]
+		got := findVolumeClaimTemplate(sts.Spec.VolumeClaimTemplates, want.Name)
+		if got == nil {
+			drift = append(drift, fmt.Sprintf("%s: volume %s is missing", sts.Name, want.Name))
+			continue
+		}
+		if wantClass, gotClass := storageClassName(want), storageClassName(got); wantClass != gotClass {
+			drift = append(drift, fmt.Sprintf("%s: volume %s storageClass is %q, want %q", sts.Name, want.Name, gotClass, wantClass))
+		}
+		wantSize, gotSize := want.Spec.Resources.Requests[corev1.ResourceStorage], got.Spec.Resources.Requests[corev1.ResourceStorage]
+		if wantSize.Cmp(gotSize) != 0 {
+			drift = append(drift, fmt.Sprintf("%s: volume %s size is %s, want %s", sts.Name, want.Name, gotSize.String(), wantSize.String()))
+		}
+	}
+	return drift
+}
+
+// setStorageCondition 根据持久卷差异以及被拒绝复用的pvc设置StorageReady状态
+func setStorageCondition(instance *rocketmqv1.DledgerBroker, drift, released []string) {
+	condition := metav1.Condition{
+		Type:               rocketmqv1.ConditionStorageReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             reasonStorageInSync,
+		Message:            "broker volumes match spec.storage",
+		ObservedGeneration: instance.Generation,
+	}
+	if len(drift) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = reasonStorageDrift
+		condition.Message = strings.Join(drift, "; ")
+	}
+	if len(released) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = reasonVolumesReleased
+		condition.Message = strings.Join(append(released, drift...), "; ")
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+}
+
+func findVolumeClaimTemplate(templates []corev1.PersistentVolumeClaim, name string) *corev1.PersistentVolumeClaim {
+	for k := range templates {
+		if templates[k].Name == name {
+			return &templates[k]
+		}
+	}
+	return nil
+}
+
+func storageClassName(pvc *corev1.PersistentVolumeClaim) string {
+	if pvc.Spec.StorageClassName == nil {
+		return ""
+	}
+	return *pvc.Spec.StorageClassName
+}
+
+const (
+	volumeResizing                = "Resizing"
+	volumeFileSystemResizePending = "FileSystemResizePending"
+)
+
+// expandVolumes 在Spec.Storage扩容且StorageClass允许扩容时，扩容第i个broker组已有的pvc，
+// 并以orphan方式删除statefulset，下次调谐时按新的volumeClaimTemplates重建并接管原有pod。
+// 返回true表示statefulset已删除，需要重新调谐
+func (r *DledgerBrokerReconciler) expandVolumes(ctx context.Context, instance *rocketmqv1.DledgerBroker, i int) (bool, error) {
+	sts := &appsv1.StatefulSet{}
+	key := types.NamespacedName{Namespace: instance.Namespace, Name: brokerGroupName(instance, i)}
+	if err := r.Get(ctx, key, sts); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	var grown []corev1.PersistentVolumeClaim
+	desired := brokerVolumeClaimTemplates(instance)
+	for k := range desired {
+		want := &desired[k]
+		got := findVolumeClaimTemplate(sts.Spec.VolumeClaimTemplates, want.Name)
+		if got == nil || storageClassName(want) != storageClassName(got) {
+			continue
+		}
+		wantSize, gotSize := want.Spec.Resources.Requests[corev1.ResourceStorage], got.Spec.Resources.Requests[corev1.ResourceStorage]
+		if wantSize.Cmp(gotSize) > 0 {
+			grown = append(grown, *want)
+		}
+	}
+	if len(grown) == 0 {
+		return false, nil
+	}
+
+	for k := range grown {
+		allowed, err := r.allowVolumeExpansion(ctx, storageClassName(&grown[k]))
+		if err != nil {
+			return false, err
+		}
+		if !allowed {
+			r.Log.Warnw("storage class does not allow volume expansion", "statefulset", sts.Name,
+				"volume", grown[k].Name, "storageClass", storageClassName(&grown[k]))
+			return false, nil
+		}
+	}
+
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, pvcs, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(brokerGroupLabels(instance, i))); err != nil {
+		return false, err
+	}
+	for k := range grown {
+		want := grown[k].Spec.Resources.Requests[corev1.ResourceStorage]
+		prefix := grown[k].Name + "-" + sts.Name + "-"
+		for n := range pvcs.Items {
+			pvc := &pvcs.Items[n]
+			if !strings.HasPrefix(pvc.Name, prefix) {
+				continue
+			}
+			current := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+			if want.Cmp(current) <= 0 {
+				continue
+			}
+			patch := client.MergeFrom(pvc.DeepCopy())
+			pvc.Spec.Resources.Requests[corev1.ResourceStorage] = want
+			if err := r.Patch(ctx, pvc, patch); err != nil {
+				return false, err
+			}
+			r.Log.Infow("expand broker volume", "pvc", pvc.Name, "from", current.String(), "to", want.String())
+		}
+	}
+
+	r.Log.Infow("recreate broker statefulset to update volumeClaimTemplates", "statefulset", sts.Name)
+	if err := r.Delete(ctx, sts, client.PropagationPolicy(metav1.DeletePropagationOrphan)); err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *DledgerBrokerReconciler) allowVolumeExpansion(ctx context.Context, name string) (bool, error) {
+	if name == "" {
+		return false, nil
+	}
+	sc := &storagev1.StorageClass{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name}, sc); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return sc.AllowVolumeExpansion != nil && *sc.AllowVolumeExpansion, nil
+}
+
+// volumeResizeStatus 返回实例下尚未完成扩容的pvc
+func (r *DledgerBrokerReconciler) volumeResizeStatus(ctx context.Context, instance *rocketmqv1.DledgerBroker) ([]rocketmqv1.VolumeResizeStatus, error) {
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, pvcs, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(brokerClusterLabels(instance))); err != nil {
+		return nil, err
+	}
+	var resizing []rocketmqv1.VolumeResizeStatus
+	for k := range pvcs.Items {
+		pvc := &pvcs.Items[k]
+		requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+		capacity, ok := pvc.Status.Capacity[corev1.ResourceStorage]
+		if !ok || pvc.Status.Phase != corev1.ClaimBound {
+			continue
+		}
+		phase := ""
+		for _, c := range pvc.Status.Conditions {
+			if c.Type == corev1.PersistentVolumeClaimFileSystemResizePending && c.Status == corev1.ConditionTrue {
+				phase = volumeFileSystemResizePending
+			}
+		}
+		if phase == "" && requested.Cmp(capacity) > 0 {
+			phase = volumeResizing
+		}
+		if phase == "" {
+			continue
+		}
+		resizing = append(resizing, rocketmqv1.VolumeResizeStatus{
+			Name:      pvc.Name,
+			Requested: requested.String(),
+			Capacity:  capacity.String(),
+			Phase:     phase,
+		})
+	}
+	return resizing, nil
+}
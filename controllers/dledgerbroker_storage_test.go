@@ -0,0 +1,206 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/logi"
+)
+
+// testStorageInstance 返回使用storageClass的实例，每组一个节点
+func testStorageInstance(size, logSize string) *rocketmqv1.DledgerBroker {
+	instance := testBrokerInstance()
+	instance.UID = "uid"
+	instance.Spec.BrokerGroupNumber = 1
+	instance.Spec.BrokerNumberPerGroup = []int{1}
+	instance.Spec.Storage = &rocketmqv1.DledgerStorage{StorageClass: "fast", Size: size, LogSize: logSize}
+	return instance
+}
+
+// testBrokerStatefulSet 返回按instance当前Spec.Storage创建、由instance控制的第i个broker组的statefulset
+func testBrokerStatefulSet(t *testing.T, instance *rocketmqv1.DledgerBroker, i int) *appsv1.StatefulSet {
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: instance.Namespace, Name: brokerGroupName(instance, i)}}
+	mutateBrokerStatefulSet(instance, i, 1, "hash", sts)
+	if err := controllerutil.SetControllerReference(instance, sts, testScheme()); err != nil {
+		t.Fatal(err)
+	}
+	sts.CreationTimestamp = metav1.Now()
+	return sts
+}
+
+// testBrokerPVC 返回第i个broker组第k个节点的pvc，capacity为空时未绑定
+func testBrokerPVC(instance *rocketmqv1.DledgerBroker, volume string, i, k int, size, capacity string) *corev1.PersistentVolumeClaim {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: instance.Namespace,
+			Name:      volume + "-" + brokerPodName(instance, i, k),
+			Labels:    brokerGroupLabels(instance, i),
+			UID:       types.UID("0123456789abcdef-" + brokerPodName(instance, i, k)),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)}},
+		},
+	}
+	if capacity != "" {
+		pvc.Status.Phase = corev1.ClaimBound
+		pvc.Status.Capacity = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(capacity)}
+	}
+	return pvc
+}
+
+func TestStorageDrift(t *testing.T) {
+	created := testStorageInstance("10Gi", "")
+	sts := testBrokerStatefulSet(t, created, 0)
+	tests := []struct {
+		name    string
+		storage *rocketmqv1.DledgerStorage
+		want    []string
+	}{
+		{name: "in sync", storage: &rocketmqv1.DledgerStorage{StorageClass: "fast", Size: "10Gi"}},
+		{
+			name:    "size changed",
+			storage: &rocketmqv1.DledgerStorage{StorageClass: "fast", Size: "20Gi"},
+			want:    []string{"demo-broker-0: volume store size is 10Gi, want 20Gi"},
+		},
+		{
+			name:    "storage class changed",
+			storage: &rocketmqv1.DledgerStorage{StorageClass: "slow", Size: "10Gi"},
+			want:    []string{`demo-broker-0: volume store storageClass is "fast", want "slow"`},
+		},
+		{
+			name:    "logs volume added",
+			storage: &rocketmqv1.DledgerStorage{StorageClass: "fast", Size: "10Gi", LogSize: "1Gi"},
+			want:    []string{"demo-broker-0: volume logs is missing"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := created.DeepCopy()
+			instance.Spec.Storage = tt.storage
+			drift := storageDrift(instance, sts)
+			if !reflect.DeepEqual(drift, tt.want) {
+				t.Errorf("storageDrift() = %v, want %v", drift, tt.want)
+			}
+
+			setStorageCondition(instance, drift, nil)
+			c := meta.FindStatusCondition(instance.Status.Conditions, rocketmqv1.ConditionStorageReady)
+			wantReason := reasonStorageInSync
+			if len(tt.want) > 0 {
+				wantReason = reasonStorageDrift
+			}
+			if c == nil || c.Reason != wantReason || (c.Status == metav1.ConditionTrue) != (len(tt.want) == 0) {
+				t.Errorf("StorageReady = %+v, want reason %s", c, wantReason)
+			}
+		})
+	}
+}
+
+func TestExpandVolumes(t *testing.T) {
+	expandable := func(name string, allow bool) *storagev1.StorageClass {
+		return &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: name}, AllowVolumeExpansion: &allow}
+	}
+	tests := []struct {
+		name         string
+		size         string
+		class        *storagev1.StorageClass
+		wantRecreate bool
+		wantSizes    []string
+	}{
+		{name: "size unchanged", size: "10Gi", class: expandable("fast", true), wantSizes: []string{"10Gi", "10Gi"}},
+		{name: "size shrunk", size: "5Gi", class: expandable("fast", true), wantSizes: []string{"10Gi", "10Gi"}},
+		{name: "storage class without expansion", size: "20Gi", class: expandable("fast", false), wantSizes: []string{"10Gi", "10Gi"}},
+		{name: "storage class not found", size: "20Gi", wantSizes: []string{"10Gi", "10Gi"}},
+		{name: "grow volumes", size: "20Gi", class: expandable("fast", true), wantRecreate: true, wantSizes: []string{"20Gi", "20Gi"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := testStorageInstance("10Gi", "")
+			sts := testBrokerStatefulSet(t, instance, 0)
+			instance.Spec.Storage.Size = tt.size
+			pvcs := []*corev1.PersistentVolumeClaim{
+				testBrokerPVC(instance, brokerStoreVolume, 0, 0, "10Gi", "10Gi"),
+				testBrokerPVC(instance, brokerStoreVolume, 0, 1, "10Gi", "10Gi"),
+			}
+			objs := []client.Object{sts, pvcs[0], pvcs[1]}
+			if tt.class != nil {
+				objs = append(objs, tt.class)
+			}
+			c := newFakeClient(objs...)
+			r := &DledgerBrokerReconciler{Client: c, Log: logi.GetSugaredLogger()}
+			recreate, err := r.expandVolumes(context.Background(), instance, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recreate != tt.wantRecreate {
+				t.Errorf("expandVolumes() = %v, want %v", recreate, tt.wantRecreate)
+			}
+			// 扩容时以orphan方式删除statefulset，pod保留并在重建后被接管
+			err = c.Get(context.Background(), client.ObjectKeyFromObject(sts), &appsv1.StatefulSet{})
+			if errors.IsNotFound(err) != tt.wantRecreate {
+				t.Errorf("statefulset after expandVolumes: %v, want deleted %v", err, tt.wantRecreate)
+			}
+			for k, pvc := range pvcs {
+				if err := c.Get(context.Background(), client.ObjectKeyFromObject(pvc), pvc); err != nil {
+					t.Fatal(err)
+				}
+				size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+				if size.String() != tt.wantSizes[k] {
+					t.Errorf("pvc %s size = %s, want %s", pvc.Name, size.String(), tt.wantSizes[k])
+				}
+			}
+			if !tt.wantRecreate {
+				return
+			}
+
+			// 重建的statefulset使用新的volumeClaimTemplates，不再有差异
+			recreated := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: instance.Namespace, Name: sts.Name}}
+			mutateBrokerStatefulSet(instance, 0, 1, "hash", recreated)
+			if drift := storageDrift(instance, recreated); len(drift) > 0 {
+				t.Errorf("drift after recreate = %v", drift)
+			}
+		})
+	}
+}
+
+func TestVolumeResizeStatus(t *testing.T) {
+	instance := testStorageInstance("20Gi", "")
+	pending := testBrokerPVC(instance, brokerStoreVolume, 0, 1, "20Gi", "20Gi")
+	pending.Status.Conditions = []corev1.PersistentVolumeClaimCondition{
+		{Type: corev1.PersistentVolumeClaimFileSystemResizePending, Status: corev1.ConditionTrue},
+	}
+	other := testBrokerPVC(instance, brokerStoreVolume, 0, 0, "20Gi", "10Gi")
+	other.Name = "store-other-broker-0-0"
+	other.Labels = map[string]string{labelApp: appBroker, labelCluster: "other"}
+	c := newFakeClient(
+		testBrokerPVC(instance, brokerStoreVolume, 0, 0, "20Gi", "10Gi"),
+		pending,
+		testBrokerPVC(instance, brokerStoreVolume, 0, 2, "20Gi", "20Gi"),
+		testBrokerPVC(instance, brokerStoreVolume, 0, 3, "20Gi", ""),
+		other,
+	)
+	r := &DledgerBrokerReconciler{Client: c}
+	got, err := r.volumeResizeStatus(context.Background(), instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []rocketmqv1.VolumeResizeStatus{
+		{Name: "store-demo-broker-0-0", Requested: "20Gi", Capacity: "10Gi", Phase: volumeResizing},
+		{Name: "store-demo-broker-0-1", Requested: "20Gi", Capacity: "20Gi", Phase: volumeFileSystemResizePending},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("volumeResizeStatus() = %+v, want %+v", got, want)
+	}
+}
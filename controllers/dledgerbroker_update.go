@@ -0,0 +1,272 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	errors2 "github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/admin"
+)
+
+const (
+	// catchUpLagBytes follower的commitlog落后leader不超过该值时认为已追上
+	catchUpLagBytes = 4 * 1024 * 1024
+
+	// annotationTransferFailures 记录本轮更新中leadership转移连续失败的次数
+	annotationTransferFailures = "rocketmq.daocloud.io/leadership-transfer-failures"
+	// maxTransferFailures leadership转移连续失败达到该次数后直接重启leader
+	maxTransferFailures = 3
+
+	reasonRolling                  = "Rolling"
+	reasonAllUpdated               = "AllUpdated"
+	reasonLeadershipTransferFailed = "LeadershipTransferFailed"
+	reasonLeaderRestarted          = "LeaderRestartedWithoutTransfer"
+)
+
+// dledgerAddr 返回第i个broker组中第k个节点的dledger地址
+func dledgerAddr(instance *rocketmqv1.DledgerBroker, i, k int) string {
+	return fmt.Sprintf("%s:%d", brokerPodFQDN(instance, i, k), brokerPortDledger)
+}
+
+// rollBrokerGroup 每次重启第i个broker组中一个未更新的pod，先重启follower，最后重启leader。
+// 重启前要求剩余就绪节点满足quorum、leader存在且其他follower已追上leader，
+// 重启leader前先将leadership转移到已更新的follower，单节点的组直接重启。返回非空的消息表示仍有pod等待重启，
+// 返回非空的reason用于RollingUpdate状态，说明leadership转移失败或leader未经转移直接重启
+func (r *DledgerBrokerReconciler) rollBrokerGroup(ctx context.Context, instance *rocketmqv1.DledgerBroker, i, members int, sts *appsv1.StatefulSet, namesrvAddr string) (string, string, error) {
+	if sts.Status.ObservedGeneration < sts.Generation || sts.Status.UpdateRevision == "" {
+		return fmt.Sprintf("%s: waiting for statefulset to observe the new template", sts.Name), "", nil
+	}
+	pods, err := r.groupPods(ctx, instance, i)
+	if err != nil {
+		return "", "", err
+	}
+	var outdated []*corev1.Pod
+	ready := 0
+	for k := range pods {
+		if isPodReady(&pods[k]) {
+			ready++
+		}
+		if pods[k].Labels[appsv1.ControllerRevisionHashLabelKey] != sts.Status.UpdateRevision {
+			outdated = append(outdated, &pods[k])
+		}
+	}
+	if len(outdated) == 0 {
+		if sts.Annotations[annotationTransferFailures] != "" {
+			return "", "", r.annotateStatefulSet(ctx, sts, map[string]string{annotationTransferFailures: ""})
+		}
+		return "", "", nil
+	}
+	if instance.Spec.UpdateStrategy == rocketmqv1.UpdateStrategyRollingUpdate {
+		return fmt.Sprintf("%s: statefulset rolling update in progress, %d pods outdated", sts.Name, len(outdated)), "", nil
+	}
+	if members == 1 && len(pods) == 1 {
+		// 单节点的组重启期间无法保持quorum，也没有可以接管leadership的节点
+		return r.restartBrokerPod(ctx, sts, outdated[0], len(outdated))
+	}
+	if ready < len(pods) {
+		return fmt.Sprintf("%s: %d pods outdated, waiting for %d/%d pods to be ready", sts.Name, len(outdated), ready, len(pods)), "", nil
+	}
+	if ready-1 < dledgerQuorum(members) {
+		return fmt.Sprintf("%s: refuse to restart pods, %d ready pods can not keep a quorum of %d during restart",
+			sts.Name, ready, dledgerQuorum(members)), "", nil
+	}
+	leader, err := r.groupLeader(ctx, instance, i, pods)
+	if err != nil {
+		r.Log.Warnw("get dledger leader failed", "statefulset", sts.Name, "error", err)
+		return fmt.Sprintf("%s: get leader: %v", sts.Name, err), "", nil
+	}
+	if leader == "" {
+		return fmt.Sprintf("%s: waiting for leader election before restarting pods", sts.Name), "", nil
+	}
+	lagging, err := r.laggingFollowers(ctx, instance, i, pods, leader, namesrvAddr)
+	if err != nil {
+		r.Log.Warnw("check dledger followers failed", "statefulset", sts.Name, "error", err)
+		return fmt.Sprintf("%s: check followers: %v", sts.Name, err), "", nil
+	}
+	if len(lagging) > 0 {
+		return fmt.Sprintf("%s: waiting for followers %s to rejoin and catch up with leader %s",
+			sts.Name, strings.Join(lagging, ","), leader), "", nil
+	}
+
+	// 序号大的follower优先重启，leader最后重启
+	for k := len(outdated) - 1; k >= 0; k-- {
+		if outdated[k].Name != leader {
+			return r.restartBrokerPod(ctx, sts, outdated[k], len(outdated))
+		}
+	}
+	// 只剩leader未更新，其他节点都已更新并追上leader
+	restart, msg, reason, err := r.transferLeadership(ctx, instance, i, sts, pods, outdated[0])
+	if err != nil || !restart {
+		return msg, reason, err
+	}
+	if _, _, err := r.restartBrokerPod(ctx, sts, outdated[0], len(outdated)); err != nil {
+		return "", "", err
+	}
+	return msg, reason, nil
+}
+
+// restartBrokerPod 删除未更新的pod，由statefulset按新的模板重建
+func (r *DledgerBrokerReconciler) restartBrokerPod(ctx context.Context, sts *appsv1.StatefulSet, pod *corev1.Pod, outdated int) (string, string, error) {
+	r.Log.Infow("restart broker pod", "pod", pod.Name,
+		"revision", pod.Labels[appsv1.ControllerRevisionHashLabelKey], "updateRevision", sts.Status.UpdateRevision)
+	if err := r.Delete(ctx, pod); err != nil && !errors.IsNotFound(err) {
+		return "", "", err
+	}
+	return fmt.Sprintf("%s: restarting pod %s, %d pods outdated", sts.Name, pod.Name, outdated), "", nil
+}
+
+// laggingFollowers 返回尚未注册到nameserver或commitlog落后leader较多的follower
+func (r *DledgerBrokerReconciler) laggingFollowers(ctx context.Context, instance *rocketmqv1.DledgerBroker, i int, pods []corev1.Pod, leader, namesrvAddr string) ([]string, error) {
+	cluster, err := clusterInfo(ctx, r.Admin, namesrvAddr)
+	if err != nil {
+		return nil, err
+	}
+	registered := make(map[string]bool)
+	for _, addr := range cluster.BrokerAddrTable[brokerGroupName(instance, i)].BrokerAddrs {
+		registered[addr] = true
+	}
+
+	var leaderOffset int64
+	var followers []*corev1.Pod
+	for k := range pods {
+		if pods[k].Name != leader {
+			followers = append(followers, &pods[k])
+			continue
+		}
+		if leaderOffset, err = r.commitLogMaxOffset(ctx, instance, i, podOrdinal(&pods[k])); err != nil {
+			return nil, err
+		}
+	}
+	var lagging []string
+	for _, pod := range followers {
+		_, advertised, err := brokerEndpoint(ctx, r.Client, instance, pod)
+		if err != nil {
+			return nil, err
+		}
+		if advertised == "" || !registered[advertised] {
+			lagging = append(lagging, pod.Name)
+			continue
+		}
+		offset, err := r.commitLogMaxOffset(ctx, instance, i, podOrdinal(pod))
+		if err != nil {
+			return nil, err
+		}
+		if leaderOffset-offset > catchUpLagBytes {
+			lagging = append(lagging, pod.Name)
+		}
+	}
+	return lagging, nil
+}
+
+// commitLogMaxOffset 返回第i个broker组第k个节点commitlog的最大偏移量，用于比较follower与leader的差距
+func (r *DledgerBrokerReconciler) commitLogMaxOffset(ctx context.Context, instance *rocketmqv1.DledgerBroker, i, k int) (int64, error) {
+	addr, err := brokerAddr(ctx, r.Client, instance, i, k)
+	if err != nil {
+		return 0, err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+	defer cancel()
+	info, err := r.Admin.GetBrokerRuntimeInfo(callCtx, addr)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := info.Table["commitLogMaxOffset"]; !ok {
+		return 0, errors2.Errorf("commitLogMaxOffset not found in runtime info of %s", addr)
+	}
+	return info.CommitLogMaxOffset, nil
+}
+
+// transferLeadership 重启leader前将leadership转移到已更新的follower，返回true时可以重启leader。
+// 转移成功后等待下次调谐确认新的leader；broker版本不支持转移，或转移连续失败maxTransferFailures次后，
+// 其他节点都已更新并追上leader，直接重启leader由dledger重新选举，返回的reason说明未经转移重启。
+// 转移失败且未达到次数时leader保持运行，返回reasonLeadershipTransferFailed
+func (r *DledgerBrokerReconciler) transferLeadership(ctx context.Context, instance *rocketmqv1.DledgerBroker, i int, sts *appsv1.StatefulSet, pods []corev1.Pod, leader *corev1.Pod) (restart bool, msg, reason string, err error) {
+	var target *corev1.Pod
+	for k := range pods {
+		if pods[k].Name != leader.Name && isPodReady(&pods[k]) &&
+			pods[k].Labels[appsv1.ControllerRevisionHashLabelKey] == sts.Status.UpdateRevision {
+			target = &pods[k]
+			break
+		}
+	}
+	if target == nil {
+		return false, fmt.Sprintf("%s: waiting for an updated follower to take over leadership from %s", sts.Name, leader.Name), "", nil
+	}
+
+	version, err := r.brokerVersion(ctx, instance, i, podOrdinal(leader))
+	if err != nil {
+		r.Log.Warnw("get broker version failed", "pod", leader.Name, "error", err)
+		return false, fmt.Sprintf("%s: get broker version of %s: %v", sts.Name, leader.Name, err), "", nil
+	}
+	if !admin.LeadershipTransferSupported(version) {
+		r.Log.Infow("broker does not support leadership transfer, restart leader directly", "pod", leader.Name, "version", version)
+		return true, fmt.Sprintf("%s: restarting leader %s without leadership transfer, broker version %s does not support it",
+			sts.Name, leader.Name, version), reasonLeaderRestarted, nil
+	}
+	failures, _ := strconv.Atoi(sts.Annotations[annotationTransferFailures])
+	if failures >= maxTransferFailures {
+		r.Log.Warnw("leadership transfer keeps failing, restart leader directly", "pod", leader.Name, "failures", failures)
+		return true, fmt.Sprintf("%s: restarting leader %s without leadership transfer after %d failed attempts",
+			sts.Name, leader.Name, failures), reasonLeaderRestarted, nil
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+	defer cancel()
+	err = r.Admin.TransferLeadership(callCtx, dledgerAddr(instance, i, podOrdinal(leader)),
+		brokerGroupName(instance, i), dledgerSelfId(podOrdinal(leader)), dledgerSelfId(podOrdinal(target)))
+	if err != nil {
+		r.Log.Warnw("transfer leadership failed, keep leader running", "pod", leader.Name, "target", target.Name,
+			"failures", failures+1, "error", err)
+		if err := r.annotateStatefulSet(ctx, sts, map[string]string{annotationTransferFailures: strconv.Itoa(failures + 1)}); err != nil {
+			return false, "", "", err
+		}
+		return false, fmt.Sprintf("%s: transfer leadership from %s to %s (attempt %d/%d): %v",
+			sts.Name, leader.Name, target.Name, failures+1, maxTransferFailures, err), reasonLeadershipTransferFailed, nil
+	}
+	r.Log.Infow("transfer leadership", "from", leader.Name, "to", target.Name)
+	return false, fmt.Sprintf("%s: transferring leadership from %s to %s", sts.Name, leader.Name, target.Name), "", nil
+}
+
+// brokerVersion 返回第i个broker组第k个节点的brokerVersionDesc
+func (r *DledgerBrokerReconciler) brokerVersion(ctx context.Context, instance *rocketmqv1.DledgerBroker, i, k int) (string, error) {
+	addr, err := brokerAddr(ctx, r.Client, instance, i, k)
+	if err != nil {
+		return "", err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+	defer cancel()
+	info, err := r.Admin.GetBrokerRuntimeInfo(callCtx, addr)
+	if err != nil {
+		return "", err
+	}
+	return info.Version, nil
+}
+
+// setRollingCondition 根据pod重启进度设置RollingUpdate状态，leadership转移失败或leader未经转移重启时使用reason
+func setRollingCondition(instance *rocketmqv1.DledgerBroker, rolling []string, reason string) {
+	condition := metav1.Condition{
+		Type:               rocketmqv1.ConditionRollingUpdate,
+		Status:             metav1.ConditionFalse,
+		Reason:             reasonAllUpdated,
+		Message:            "all broker pods are up to date",
+		ObservedGeneration: instance.Generation,
+	}
+	if len(rolling) > 0 {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = reasonRolling
+		condition.Message = strings.Join(rolling, "; ")
+	}
+	if len(rolling) > 0 && reason != "" {
+		condition.Reason = reason
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+}
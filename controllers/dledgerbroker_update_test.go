@@ -0,0 +1,292 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	errors2 "github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/admin"
+	"rocketmq-operator-v2/pkg/logi"
+)
+
+func TestTransferLeadership(t *testing.T) {
+	instance := testBrokerInstance()
+	pod := func(k int, revision string) corev1.Pod {
+		p := testBrokerPod(instance, 0, k, true)
+		p.Labels[appsv1.ControllerRevisionHashLabelKey] = revision
+		return p
+	}
+	version := func(v string) map[string]*admin.BrokerRuntimeInfo {
+		return map[string]*admin.BrokerRuntimeInfo{testMasterAddr(instance, 0): {Version: v}}
+	}
+	tests := []struct {
+		name          string
+		pods          []corev1.Pod
+		failures      string
+		runtime       map[string]*admin.BrokerRuntimeInfo
+		transferErr   error
+		wantRestart   bool
+		wantReason    string
+		wantFailures  string
+		wantTransfers []string
+	}{
+		{
+			name:          "transfer to updated follower",
+			pods:          []corev1.Pod{pod(0, "old"), pod(1, "new"), pod(2, "new")},
+			runtime:       version("V4_9_4"),
+			wantTransfers: []string{dledgerAddr(instance, 0, 0) + " n0->n1"},
+		},
+		{
+			name:          "failed transfer keeps leader running",
+			pods:          []corev1.Pod{pod(0, "old"), pod(1, "new"), pod(2, "new")},
+			runtime:       version("V4_9_4"),
+			transferErr:   errors2.New("dledger response code 502"),
+			wantReason:    reasonLeadershipTransferFailed,
+			wantFailures:  "1",
+			wantTransfers: []string{dledgerAddr(instance, 0, 0) + " n0->n1"},
+		},
+		{
+			name:          "failures are counted",
+			pods:          []corev1.Pod{pod(0, "old"), pod(1, "new"), pod(2, "new")},
+			failures:      "1",
+			runtime:       version("V4_9_4"),
+			transferErr:   errors2.New("dledger response code 502"),
+			wantReason:    reasonLeadershipTransferFailed,
+			wantFailures:  "2",
+			wantTransfers: []string{dledgerAddr(instance, 0, 0) + " n0->n1"},
+		},
+		{
+			name:         "leader restarted after bounded failures",
+			pods:         []corev1.Pod{pod(0, "old"), pod(1, "new"), pod(2, "new")},
+			failures:     "3",
+			runtime:      version("V4_9_4"),
+			wantRestart:  true,
+			wantReason:   reasonLeaderRestarted,
+			wantFailures: "3",
+		},
+		{
+			name:        "broker version without leadership transfer",
+			pods:        []corev1.Pod{pod(0, "old"), pod(1, "new"), pod(2, "new")},
+			runtime:     version("V4_6_1"),
+			wantRestart: true,
+			wantReason:  reasonLeaderRestarted,
+		},
+		{
+			name: "broker version unknown",
+			pods: []corev1.Pod{pod(0, "old"), pod(1, "new"), pod(2, "new")},
+		},
+		{
+			name: "no updated follower",
+			pods: []corev1.Pod{pod(0, "old"), pod(1, "old")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sts := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "demo-broker-0"},
+				Status:     appsv1.StatefulSetStatus{UpdateRevision: "new"},
+			}
+			if tt.failures != "" {
+				sts.Annotations = map[string]string{annotationTransferFailures: tt.failures}
+			}
+			c := newFakeClient(sts)
+			a := &fakeAdmin{runtime: tt.runtime, transferErr: tt.transferErr}
+			r := &DledgerBrokerReconciler{Client: c, Admin: a, Log: logi.GetSugaredLogger()}
+			restart, msg, reason, err := r.transferLeadership(context.Background(), instance, 0, sts, tt.pods, &tt.pods[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restart != tt.wantRestart || reason != tt.wantReason {
+				t.Errorf("transferLeadership() = %v, %q, %q, want restart %v reason %q", restart, msg, reason, tt.wantRestart, tt.wantReason)
+			}
+			if msg == "" {
+				t.Error("transferLeadership() should explain what happens to the leader")
+			}
+			if !reflect.DeepEqual(a.transfers, tt.wantTransfers) {
+				t.Errorf("transfers = %v, want %v", a.transfers, tt.wantTransfers)
+			}
+			if err := c.Get(context.Background(), types.NamespacedName{Namespace: "mq", Name: "demo-broker-0"}, sts); err != nil {
+				t.Fatal(err)
+			}
+			if got := sts.Annotations[annotationTransferFailures]; got != tt.wantFailures {
+				t.Errorf("failures annotation = %q, want %q", got, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestRollBrokerGroup(t *testing.T) {
+	instance := testBrokerInstance()
+	pod := func(k int, revision string, ready bool) *corev1.Pod {
+		p := testBrokerPod(instance, 0, k, ready)
+		p.Labels[appsv1.ControllerRevisionHashLabelKey] = revision
+		return &p
+	}
+	leader := func(k int) map[string]*admin.DledgerMetadata {
+		m := make(map[string]*admin.DledgerMetadata)
+		for n := 0; n < 3; n++ {
+			m[dledgerAddr(instance, 0, n)] = &admin.DledgerMetadata{LeaderId: dledgerSelfId(k), Term: 1}
+		}
+		return m
+	}
+	cluster := &admin.ClusterInfo{BrokerAddrTable: map[string]admin.BrokerData{"demo-broker-0": {BrokerAddrs: map[string]string{
+		"0": "10.0.0.0:10911", "1": "10.0.0.1:10911", "2": "10.0.0.2:10911",
+	}}}}
+	runtime := func(version string) map[string]*admin.BrokerRuntimeInfo {
+		m := make(map[string]*admin.BrokerRuntimeInfo)
+		for k := 0; k < 3; k++ {
+			m[fmt.Sprintf("%s:%d", brokerPodFQDN(instance, 0, k), brokerPortMain)] = &admin.BrokerRuntimeInfo{
+				Version: version, Table: map[string]string{"commitLogMaxOffset": "0"},
+			}
+		}
+		return m
+	}
+	tests := []struct {
+		name        string
+		members     int
+		failures    string
+		pods        []*corev1.Pod
+		admin       *fakeAdmin
+		wantDeleted []string
+		wantReason  string
+		wantRolling bool
+	}{
+		{
+			name:        "single member restarts directly",
+			members:     1,
+			pods:        []*corev1.Pod{pod(0, "old", true)},
+			wantDeleted: []string{"demo-broker-0-0"},
+			wantRolling: true,
+		},
+		{
+			name:        "single member restarts when not ready",
+			members:     1,
+			pods:        []*corev1.Pod{pod(0, "old", false)},
+			wantDeleted: []string{"demo-broker-0-0"},
+			wantRolling: true,
+		},
+		{
+			name:        "followers restart before the leader",
+			members:     3,
+			pods:        []*corev1.Pod{pod(0, "old", true), pod(1, "old", true), pod(2, "old", true)},
+			admin:       &fakeAdmin{metadata: leader(2), cluster: cluster, runtime: runtime("V4_9_4")},
+			wantDeleted: []string{"demo-broker-0-1"},
+			wantRolling: true,
+		},
+		{
+			name:        "leader restarted without transfer on old brokers",
+			members:     3,
+			pods:        []*corev1.Pod{pod(0, "old", true), pod(1, "new", true), pod(2, "new", true)},
+			admin:       &fakeAdmin{metadata: leader(0), cluster: cluster, runtime: runtime("V4_6_1")},
+			wantDeleted: []string{"demo-broker-0-0"},
+			wantReason:  reasonLeaderRestarted,
+			wantRolling: true,
+		},
+		{
+			name:        "quorum kept while a pod is not ready",
+			members:     3,
+			pods:        []*corev1.Pod{pod(0, "old", true), pod(1, "new", false), pod(2, "new", true)},
+			admin:       &fakeAdmin{},
+			wantRolling: true,
+		},
+		{
+			name:     "all updated clears failures",
+			members:  3,
+			failures: "2",
+			pods:     []*corev1.Pod{pod(0, "new", true), pod(1, "new", true), pod(2, "new", true)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sts := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "demo-broker-0"},
+				Status:     appsv1.StatefulSetStatus{UpdateRevision: "new"},
+			}
+			if tt.failures != "" {
+				sts.Annotations = map[string]string{annotationTransferFailures: tt.failures}
+			}
+			objs := []client.Object{sts}
+			for _, p := range tt.pods {
+				objs = append(objs, p)
+			}
+			c := newFakeClient(objs...)
+			instance := instance.DeepCopy()
+			instance.Spec.UpdateStrategy = rocketmqv1.UpdateStrategyLeaderAware
+			r := &DledgerBrokerReconciler{Client: c, Log: logi.GetSugaredLogger()}
+			if tt.admin != nil {
+				r.Admin = tt.admin
+			}
+			msg, reason, err := r.rollBrokerGroup(context.Background(), instance, 0, tt.members, sts, "ns:9876")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (msg != "") != tt.wantRolling || reason != tt.wantReason {
+				t.Errorf("rollBrokerGroup() = %q, %q, want rolling %v reason %q", msg, reason, tt.wantRolling, tt.wantReason)
+			}
+			var deleted []string
+			for _, p := range tt.pods {
+				if err := c.Get(context.Background(), client.ObjectKeyFromObject(p), &corev1.Pod{}); errors.IsNotFound(err) {
+					deleted = append(deleted, p.Name)
+				}
+			}
+			if !reflect.DeepEqual(deleted, tt.wantDeleted) {
+				t.Errorf("deleted pods = %v, want %v", deleted, tt.wantDeleted)
+			}
+			if err := c.Get(context.Background(), client.ObjectKeyFromObject(sts), sts); err != nil {
+				t.Fatal(err)
+			}
+			if got := sts.Annotations[annotationTransferFailures]; got != "" {
+				t.Errorf("failures annotation = %q, want cleared or unset", got)
+			}
+		})
+	}
+}
+
+func TestSetRollingCondition(t *testing.T) {
+	tests := []struct {
+		name       string
+		rolling    []string
+		reason     string
+		wantStatus metav1.ConditionStatus
+		wantReason string
+	}{
+		{name: "all updated", wantStatus: metav1.ConditionFalse, wantReason: reasonAllUpdated},
+		{name: "rolling", rolling: []string{"a: restarting pod a-1"}, wantStatus: metav1.ConditionTrue, wantReason: reasonRolling},
+		{
+			name:       "leadership transfer failed",
+			rolling:    []string{"a: transfer leadership from a-0 to a-1: timeout"},
+			reason:     reasonLeadershipTransferFailed,
+			wantStatus: metav1.ConditionTrue,
+			wantReason: reasonLeadershipTransferFailed,
+		},
+		{
+			name:       "leader restarted without transfer",
+			rolling:    []string{"a: restarting leader a-0 without leadership transfer"},
+			reason:     reasonLeaderRestarted,
+			wantStatus: metav1.ConditionTrue,
+			wantReason: reasonLeaderRestarted,
+		},
+		{name: "reason ignored when all updated", reason: reasonLeaderRestarted, wantStatus: metav1.ConditionFalse, wantReason: reasonAllUpdated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := testBrokerInstance()
+			setRollingCondition(instance, tt.rolling, tt.reason)
+			c := meta.FindStatusCondition(instance.Status.Conditions, rocketmqv1.ConditionRollingUpdate)
+			if c == nil || c.Status != tt.wantStatus || c.Reason != tt.wantReason {
+				t.Errorf("condition = %+v, want %s/%s", c, tt.wantStatus, tt.wantReason)
+			}
+		})
+	}
+}
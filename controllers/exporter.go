@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/configs"
+)
+
+const (
+	appExporter         = "rocketmq-exporter"
+	labelExporterFor    = "rocketmq.daocloud.io/exporter-for"
+	exporterPort        = 5557
+	exporterPortName    = "metrics"
+	exporterMetricsPath = "/metrics"
+
+	exporterContainerName = "exporter"
+
+	annotationCredentialVersion = "rocketmq.daocloud.io/credential-version"
+)
+
+var serviceMonitorGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"}
+
+// exporter 描述一个实例需要的rocketmq-exporter
+type exporter struct {
+	// Name 为exporter的deployment、service和ServiceMonitor名称
+	Name string
+	// For 区分broker和nameserver的exporter，避免同名实例的service选中彼此的pod
+	For         string
+	Cluster     string
+	Setting     *rocketmqv1.ExportSetting
+	NamesrvAddr string
+	// Env 为额外注入的环境变量，开启acl时包含ACCESS_KEY/SECRET_KEY
+	Env []corev1.EnvVar
+	// CredentialVersion 为凭证secret的resourceVersion，写入pod模板注解，凭证轮转时重建exporter pod。
+	// 不使用凭证本身的摘要，避免能读取deployment的用户离线猜测secretKey
+	CredentialVersion string
+}
+
+func (e *exporter) labels() map[string]string {
+	return map[string]string{
+		labelApp:         appExporter,
+		labelCluster:     e.Cluster,
+		labelExporterFor: e.For,
+	}
+}
+
+func (e *exporter) enabled() bool {
+	return e.Setting != nil && e.Setting.Open
+}
+
+// args 返回rocketmq-exporter的启动参数
+func (e *exporter) args() []string {
+	args := []string{"--rocketmq.config.namesrvAddr=" + e.NamesrvAddr}
+	if _, ok := configs.LookupEnv(e.Env, configs.ACCESS_KEY); ok {
+		args = append(args,
+			"--rocketmq.config.enableACL=true",
+			"--rocketmq.config.accessKey=$("+configs.ACCESS_KEY+")",
+			"--rocketmq.config.secretKey=$("+configs.SECRET_KEY+")",
+		)
+	}
+	return args
+}
+
+func (e *exporter) mutateDeployment(dep *appsv1.Deployment) {
+	labels := e.labels()
+	replicas := int32(1)
+	dep.Labels = mergeLabels(dep.Labels, labels)
+	dep.Spec.Replicas = &replicas
+	if dep.Spec.Selector == nil {
+		dep.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+	}
+	template := &dep.Spec.Template
+	template.Labels = mergeLabels(template.Labels, labels)
+	if e.CredentialVersion != "" {
+		template.Annotations = mergeLabels(template.Annotations, map[string]string{annotationCredentialVersion: e.CredentialVersion})
+	} else {
+		delete(template.Annotations, annotationCredentialVersion)
+	}
+	template.Spec.ImagePullSecrets = e.Setting.ImagePullSecret
+
+	container := findOrAppendContainer(&template.Spec, exporterContainerName)
+	container.Image = e.Setting.Image
+	container.ImagePullPolicy = e.Setting.ImagePullPolicy
+	container.Args = e.args()
+	container.Env = e.Env
+	if e.Setting.Resource != nil {
+		container.Resources = *e.Setting.Resource
+	}
+	container.Ports = []corev1.ContainerPort{{Name: exporterPortName, ContainerPort: exporterPort}}
+}
+
+func (e *exporter) mutateService(svc *corev1.Service) {
+	svc.Labels = mergeLabels(svc.Labels, e.labels())
+	svc.Spec.Selector = e.labels()
+	svc.Spec.Ports = []corev1.ServicePort{
+		{Name: exporterPortName, Port: exporterPort, TargetPort: intstr.FromInt(exporterPort)},
+	}
+}
+
+func (e *exporter) mutateServiceMonitor(sm *unstructured.Unstructured) error {
+	sm.SetLabels(mergeLabels(sm.GetLabels(), e.labels()))
+	return unstructured.SetNestedField(sm.Object, map[string]interface{}{
+		"selector": map[string]interface{}{
+			"matchLabels": stringMapToInterface(e.labels()),
+		},
+		"endpoints": []interface{}{
+			map[string]interface{}{
+				"port": exporterPortName,
+				"path": exporterMetricsPath,
+			},
+		},
+	}, "spec")
+}
+
+// reconcileExporter 按ExportSetting创建或删除exporter的deployment、service以及可选的ServiceMonitor
+func reconcileExporter(ctx context.Context, c client.Client, scheme *runtime.Scheme, log *zap.SugaredLogger, owner metav1.Object, e *exporter) error {
+	objMeta := metav1.ObjectMeta{Name: e.Name, Namespace: owner.GetNamespace()}
+	dep := &appsv1.Deployment{ObjectMeta: objMeta}
+	svc := &corev1.Service{ObjectMeta: objMeta}
+	sm := &unstructured.Unstructured{}
+	sm.SetGroupVersionKind(serviceMonitorGVK)
+	sm.SetName(e.Name)
+	sm.SetNamespace(owner.GetNamespace())
+
+	if !e.enabled() || e.NamesrvAddr == "" {
+		for _, obj := range []client.Object{dep, svc} {
+			if err := c.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+		}
+		return deleteServiceMonitor(ctx, c, sm)
+	}
+
+	op, err := controllerutil.CreateOrUpdate(ctx, c, dep, func() error {
+		e.mutateDeployment(dep)
+		return controllerutil.SetControllerReference(owner, dep, scheme)
+	})
+	if err != nil {
+		return err
+	}
+	if op != controllerutil.OperationResultNone {
+		log.Infow("reconciled exporter deployment", "deployment", dep.Name, "operation", op)
+	}
+	op, err = controllerutil.CreateOrUpdate(ctx, c, svc, func() error {
+		e.mutateService(svc)
+		return controllerutil.SetControllerReference(owner, svc, scheme)
+	})
+	if err != nil {
+		return err
+	}
+	if op != controllerutil.OperationResultNone {
+		log.Infow("reconciled exporter service", "service", svc.Name, "operation", op)
+	}
+
+	if !e.Setting.ServiceMonitor {
+		return deleteServiceMonitor(ctx, c, sm)
+	}
+	op, err = controllerutil.CreateOrUpdate(ctx, c, sm, func() error {
+		if err := e.mutateServiceMonitor(sm); err != nil {
+			return err
+		}
+		return controllerutil.SetControllerReference(owner, sm, scheme)
+	})
+	if err != nil {
+		if isNoMatchError(err) {
+			log.Warnw("ServiceMonitor CRD is not installed, skip creating ServiceMonitor", "servicemonitor", e.Name)
+			return nil
+		}
+		return err
+	}
+	if op != controllerutil.OperationResultNone {
+		log.Infow("reconciled exporter servicemonitor", "servicemonitor", sm.GetName(), "operation", op)
+	}
+	return nil
+}
+
+func deleteServiceMonitor(ctx context.Context, c client.Client, sm *unstructured.Unstructured) error {
+	if err := c.Delete(ctx, sm); err != nil && !errors.IsNotFound(err) && !isNoMatchError(err) {
+		return err
+	}
+	return nil
+}
+
+// isNoMatchError 判断错误是否由于集群中未安装对应的CRD
+func isNoMatchError(err error) bool {
+	return meta.IsNoMatchError(err) || strings.Contains(err.Error(), "no matches for kind")
+}
+
+// brokerExporterEnv 以secretKeyRef注入admin secret中的凭证，明文key不会出现在deployment中
+func brokerExporterEnv(instance *rocketmqv1.DledgerBroker) []corev1.EnvVar {
+	ref := func(key string) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: brokerAdminSecretName(instance)},
+			Key:                  key,
+		}}
+	}
+	return []corev1.EnvVar{
+		{Name: configs.ACCESS_KEY, ValueFrom: ref(credentialAccessKey)},
+		{Name: configs.SECRET_KEY, ValueFrom: ref(credentialSecretKey)},
+	}
+}
+
+func stringMapToInterface(m map[string]string) map[string]interface{} {
+	r := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		r[k] = v
+	}
+	return r
+}
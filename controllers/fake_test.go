@@ -0,0 +1,211 @@
+package controllers
+
+import (
+	"context"
+
+	errors2 "github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/admin"
+	"rocketmq-operator-v2/pkg/remoting"
+)
+
+// testScheme 返回包含内置资源和rocketmq资源的scheme
+func testScheme() *runtime.Scheme {
+	s := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(s)
+	_ = rocketmqv1.AddToScheme(s)
+	return s
+}
+
+// newFakeClient 返回预置了objs的fake client
+func newFakeClient(objs ...client.Object) client.Client {
+	return fake.NewClientBuilder().WithScheme(testScheme()).WithObjects(objs...).Build()
+}
+
+// fakeAdmin 按地址返回预置结果的admin.Admin，未预置的地址返回错误，未实现的方法会panic
+type fakeAdmin struct {
+	admin.Admin
+
+	cluster  *admin.ClusterInfo
+	metadata map[string]*admin.DledgerMetadata
+	runtime  map[string]*admin.BrokerRuntimeInfo
+	// brokerConsumeStats 为各broker地址上的消费进度
+	brokerConsumeStats map[string]*admin.BrokerConsumeStats
+	// brokerConfigs 记录UpdateBrokerConfig对各broker地址的修改
+	brokerConfigs map[string]map[string]string
+
+	topicList []string
+	routes    map[string]*admin.TopicRouteData
+	// topicConfigs 为各broker地址上的topic配置，CreateOrUpdateTopic和DeleteTopicInBroker会修改，不存在的地址不可达
+	topicConfigs map[string]map[string]admin.TopicConfig
+	// namesrvDeleted 记录DeleteTopicInNamesrv删除的"地址 topic"
+	namesrvDeleted []string
+	// kvConfigs 为各nameserver地址上的kv配置，key为 namespace/key
+	kvConfigs map[string]map[string]string
+
+	// groupConfigs 为各broker地址上的消费组配置，不存在的地址不可达
+	groupConfigs map[string]map[string]admin.SubscriptionGroupConfig
+	// consumeStats 为各broker地址上的消费进度，未预置时返回消费组不存在，consumeErrs中的地址返回对应错误
+	consumeStats map[string]*admin.ConsumeStats
+	consumeErrs  map[string]error
+	// connections 为各broker地址上的在线客户端，未预置时返回没有在线客户端，预置为nil时不可达
+	connections map[string]*admin.ConsumerConnection
+
+	transferErr error
+	transfers   []string
+}
+
+func (f *fakeAdmin) GetClusterInfo(_ context.Context, namesrvAddr string) (*admin.ClusterInfo, error) {
+	if f.cluster == nil {
+		return nil, errors2.Errorf("nameserver %s unreachable", namesrvAddr)
+	}
+	return f.cluster, nil
+}
+
+func (f *fakeAdmin) GetDledgerMetadata(_ context.Context, addr, _, _ string) (*admin.DledgerMetadata, error) {
+	if m, ok := f.metadata[addr]; ok {
+		return m, nil
+	}
+	return nil, errors2.Errorf("dledger %s unreachable", addr)
+}
+
+func (f *fakeAdmin) GetBrokerRuntimeInfo(_ context.Context, brokerAddr string) (*admin.BrokerRuntimeInfo, error) {
+	if info, ok := f.runtime[brokerAddr]; ok {
+		return info, nil
+	}
+	return nil, errors2.Errorf("broker %s unreachable", brokerAddr)
+}
+
+func (f *fakeAdmin) TransferLeadership(_ context.Context, leaderAddr, _, leaderId, targetId string) error {
+	f.transfers = append(f.transfers, leaderAddr+" "+leaderId+"->"+targetId)
+	return f.transferErr
+}
+
+func (f *fakeAdmin) GetBrokerConsumeStats(_ context.Context, brokerAddr string) (*admin.BrokerConsumeStats, error) {
+	if stats, ok := f.brokerConsumeStats[brokerAddr]; ok {
+		return stats, nil
+	}
+	return nil, errors2.Errorf("broker %s unreachable", brokerAddr)
+}
+
+func (f *fakeAdmin) UpdateBrokerConfig(_ context.Context, brokerAddr string, properties map[string]string) error {
+	if f.brokerConfigs == nil {
+		f.brokerConfigs = make(map[string]map[string]string)
+	}
+	if f.brokerConfigs[brokerAddr] == nil {
+		f.brokerConfigs[brokerAddr] = make(map[string]string)
+	}
+	for k, v := range properties {
+		f.brokerConfigs[brokerAddr][k] = v
+	}
+	return nil
+}
+
+func (f *fakeAdmin) GetAllTopicList(_ context.Context, _ string) ([]string, error) {
+	return f.topicList, nil
+}
+
+func (f *fakeAdmin) GetTopicRouteData(_ context.Context, _, topic string) (*admin.TopicRouteData, error) {
+	if route, ok := f.routes[topic]; ok {
+		return route, nil
+	}
+	return nil, &admin.ResponseError{Code: remoting.TopicNotExist, Remark: "no route info of " + topic}
+}
+
+func (f *fakeAdmin) CreateOrUpdateTopic(_ context.Context, brokerAddr string, config admin.TopicConfig) error {
+	if f.topicConfigs == nil {
+		f.topicConfigs = make(map[string]map[string]admin.TopicConfig)
+	}
+	if f.topicConfigs[brokerAddr] == nil {
+		f.topicConfigs[brokerAddr] = make(map[string]admin.TopicConfig)
+	}
+	f.topicConfigs[brokerAddr][config.TopicName] = config
+	return nil
+}
+
+func (f *fakeAdmin) GetAllTopicConfig(_ context.Context, brokerAddr string) (map[string]admin.TopicConfig, error) {
+	if configs, ok := f.topicConfigs[brokerAddr]; ok {
+		return configs, nil
+	}
+	return nil, errors2.Errorf("broker %s unreachable", brokerAddr)
+}
+
+func (f *fakeAdmin) DeleteTopicInBroker(_ context.Context, brokerAddr, topic string) error {
+	configs, ok := f.topicConfigs[brokerAddr]
+	if !ok {
+		return errors2.Errorf("broker %s unreachable", brokerAddr)
+	}
+	delete(configs, topic)
+	return nil
+}
+
+func (f *fakeAdmin) DeleteTopicInNamesrv(_ context.Context, namesrvAddr, topic string) error {
+	f.namesrvDeleted = append(f.namesrvDeleted, namesrvAddr+" "+topic)
+	return nil
+}
+
+func (f *fakeAdmin) PutKVConfig(_ context.Context, namesrvAddr, namespace, key, value string) error {
+	if f.kvConfigs == nil {
+		f.kvConfigs = make(map[string]map[string]string)
+	}
+	if f.kvConfigs[namesrvAddr] == nil {
+		f.kvConfigs[namesrvAddr] = make(map[string]string)
+	}
+	f.kvConfigs[namesrvAddr][namespace+"/"+key] = value
+	return nil
+}
+
+func (f *fakeAdmin) DeleteKVConfig(_ context.Context, namesrvAddr, namespace, key string) error {
+	delete(f.kvConfigs[namesrvAddr], namespace+"/"+key)
+	return nil
+}
+
+func (f *fakeAdmin) GetAllSubscriptionGroupConfig(_ context.Context, brokerAddr string) (map[string]admin.SubscriptionGroupConfig, error) {
+	if configs, ok := f.groupConfigs[brokerAddr]; ok {
+		return configs, nil
+	}
+	return nil, errors2.Errorf("broker %s unreachable", brokerAddr)
+}
+
+func (f *fakeAdmin) CreateOrUpdateSubscriptionGroup(_ context.Context, brokerAddr string, config admin.SubscriptionGroupConfig) error {
+	configs, ok := f.groupConfigs[brokerAddr]
+	if !ok {
+		return errors2.Errorf("broker %s unreachable", brokerAddr)
+	}
+	configs[config.GroupName] = config
+	return nil
+}
+
+func (f *fakeAdmin) DeleteSubscriptionGroup(_ context.Context, brokerAddr, group string) error {
+	configs, ok := f.groupConfigs[brokerAddr]
+	if !ok {
+		return errors2.Errorf("broker %s unreachable", brokerAddr)
+	}
+	delete(configs, group)
+	return nil
+}
+
+func (f *fakeAdmin) GetConsumeStats(_ context.Context, brokerAddr, group, _ string) (*admin.ConsumeStats, error) {
+	if err, ok := f.consumeErrs[brokerAddr]; ok {
+		return nil, err
+	}
+	if stats, ok := f.consumeStats[brokerAddr]; ok {
+		return stats, nil
+	}
+	return nil, &admin.ResponseError{Code: remoting.SubscriptionGroupNotExist, Remark: "subscription group not exist: " + group}
+}
+
+func (f *fakeAdmin) GetConsumerConnectionList(_ context.Context, brokerAddr, group string) (*admin.ConsumerConnection, error) {
+	if connection, ok := f.connections[brokerAddr]; ok {
+		if connection == nil {
+			return nil, errors2.Errorf("broker %s unreachable", brokerAddr)
+		}
+		return connection, nil
+	}
+	return nil, &admin.ResponseError{Code: remoting.ConsumerNotOnline, Remark: "consumer not online: " + group}
+}
@@ -18,11 +18,22 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/go-logr/logr"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	rocketmqv1 "rocketmq-operator-v2/api/v1"
 )
@@ -30,21 +41,177 @@ import (
 // NameserverReconciler reconciles a Nameserver object
 type NameserverReconciler struct {
 	client.Client
-	Log    logr.Logger
+	Log    *zap.SugaredLogger
 	Scheme *runtime.Scheme
 }
 
 // +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=nameservers,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=nameservers/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
 
-func (r *NameserverReconciler) Reconcile(context context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = r.Log.WithValues("nameserver", req.NamespacedName)
+func (r *NameserverReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	reqLog := log.With(
+		zap.String("Request.Namespace", req.Namespace),
+		zap.String("Request.Name", req.Name),
+	)
+	reqLog.Info("Reconcile Nameserver")
+	r.Log = reqLog
+	instance := &rocketmqv1.Nameserver{}
+	err := r.Client.Get(ctx, req.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	if !instance.ObjectMeta.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
 
-	return ctrl.Result{}, nil
+	if _, err := r.reconcileService(ctx, instance, nameserverHeadlessServiceName(instance), true); err != nil {
+		return ctrl.Result{}, err
+	}
+	svc, err := r.reconcileService(ctx, instance, nameserverName(instance), false)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	sts, err := r.reconcileStatefulSet(ctx, instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	connectAddr := nameserverConnectAddr(instance)
+	if err := reconcileExporter(ctx, r.Client, r.Scheme, r.Log, instance, nameserverExporter(instance, connectAddr)); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	oldStatus := instance.Status.DeepCopy()
+	instance.Status.ConnectAddr = connectAddr
+	if instance.Status.ExternalAccess, err = r.nameserverExternalAccess(ctx, instance, svc); err != nil {
+		return ctrl.Result{}, err
+	}
+	requeue, err := r.nameserverHealth(ctx, instance, sts)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	instance.Status.ObservedGeneration = instance.Generation
+	if !equality.Semantic.DeepEqual(oldStatus, &instance.Status) {
+		if err := r.Status().Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// pod长时间未就绪不会触发调谐，在其达到降级阈值时重新检查
+	return ctrl.Result{RequeueAfter: requeue}, nil
+}
+
+// nameserverHealth 根据statefulset和pod状态设置Ready、Progressing、Degraded状态和Phase，
+// 返回有pod即将达到降级阈值时需要重新调谐的等待时间
+func (r *NameserverReconciler) nameserverHealth(ctx context.Context, instance *rocketmqv1.Nameserver, sts *appsv1.StatefulSet) (time.Duration, error) {
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(nameserverLabels(instance))); err != nil {
+		return 0, err
+	}
+	replicas := int32(instance.Spec.NameserverNumber)
+	var notReady, progressing, degraded []string
+	if sts.Status.ObservedGeneration < sts.Generation {
+		progressing = append(progressing, fmt.Sprintf("%s: waiting for statefulset to observe the new template", sts.Name))
+	} else if sts.Status.UpdatedReplicas < replicas {
+		progressing = append(progressing, fmt.Sprintf("%s: %d/%d pods updated", sts.Name, sts.Status.UpdatedReplicas, replicas))
+	}
+	if sts.Status.ReadyReplicas < replicas {
+		notReady = append(notReady, fmt.Sprintf("%s: %d/%d pods ready", sts.Name, sts.Status.ReadyReplicas, replicas))
+	}
+	unavailable, requeue := unavailablePods(pods.Items, time.Now())
+	if len(unavailable) > 0 {
+		degraded = append(degraded, fmt.Sprintf("pods %v unavailable for more than %s", unavailable, podUnavailableThreshold))
+	}
+	instance.Status.ReadyReplicas = sts.Status.ReadyReplicas
+	instance.Status.Phase = setHealthConditions(&instance.Status.Conditions, instance.Generation, instance.Status.Phase,
+		notReady, progressing, reasonPodsUnavailable, degraded)
+	return requeue, nil
+}
+
+// nameserverExternalAccess 返回集群外访问nameserver的地址，NodePort方式为各pod所在节点的地址，
+// LoadBalancer方式为负载均衡的地址，未开启或地址未分配时为空
+func (r *NameserverReconciler) nameserverExternalAccess(ctx context.Context, instance *rocketmqv1.Nameserver, svc *corev1.Service) (string, error) {
+	if instance.Spec.ExternalAccess == nil {
+		return "", nil
+	}
+	if instance.Spec.ExternalAccess.Type == corev1.ServiceTypeLoadBalancer {
+		if host := loadBalancerHost(svc); host != "" {
+			return fmt.Sprintf("%s:%d", host, nameserverPort), nil
+		}
+		return "", nil
+	}
+	nodePort := mainNodePort(svc)
+	if nodePort == 0 {
+		return "", nil
+	}
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(nameserverLabels(instance))); err != nil {
+		return "", err
+	}
+	var addrs []string
+	seen := make(map[string]bool)
+	for k := range pods.Items {
+		host := pods.Items[k].Status.HostIP
+		if host == "" || seen[host] {
+			continue
+		}
+		seen[host] = true
+		addrs = append(addrs, fmt.Sprintf("%s:%d", host, nodePort))
+	}
+	sort.Strings(addrs)
+	return strings.Join(addrs, ";"), nil
+}
+
+func (r *NameserverReconciler) reconcileService(ctx context.Context, instance *rocketmqv1.Nameserver, name string, headless bool) (*corev1.Service, error) {
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name:      name,
+		Namespace: instance.Namespace,
+	}}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, svc, func() error {
+		mutateNameserverService(instance, headless, svc)
+		return controllerutil.SetControllerReference(instance, svc, r.Scheme)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if op != controllerutil.OperationResultNone {
+		r.Log.Infow("reconciled nameserver service", "service", svc.Name, "operation", op)
+	}
+	return svc, nil
+}
+
+func (r *NameserverReconciler) reconcileStatefulSet(ctx context.Context, instance *rocketmqv1.Nameserver) (*appsv1.StatefulSet, error) {
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+		Name:      nameserverName(instance),
+		Namespace: instance.Namespace,
+	}}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, sts, func() error {
+		mutateNameserverStatefulSet(instance, sts)
+		return controllerutil.SetControllerReference(instance, sts, r.Scheme)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if op != controllerutil.OperationResultNone {
+		r.Log.Infow("reconciled nameserver statefulset", "statefulset", sts.Name, "operation", op)
+	}
+	return sts, nil
 }
 
 func (r *NameserverReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&rocketmqv1.Nameserver{}).
+		Owns(&appsv1.StatefulSet{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&corev1.Service{}).
 		Complete(r)
 }
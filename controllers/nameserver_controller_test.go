@@ -0,0 +1,101 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+)
+
+func testNameserver(replicas int) *rocketmqv1.Nameserver {
+	return &rocketmqv1.Nameserver{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: "demo", UID: "uid"},
+		Spec:       rocketmqv1.NameserverSpec{NameserverNumber: replicas},
+	}
+}
+
+func TestNameserverConnectAddr(t *testing.T) {
+	tests := []struct {
+		name     string
+		replicas int
+		want     string
+	}{
+		{name: "no replicas", replicas: 0, want: ""},
+		{name: "single", replicas: 1, want: "demo-nameserver-0.demo-nameserver-hs.mq.svc.cluster.local:9876"},
+		{
+			name:     "one address per pod",
+			replicas: 3,
+			want: "demo-nameserver-0.demo-nameserver-hs.mq.svc.cluster.local:9876;" +
+				"demo-nameserver-1.demo-nameserver-hs.mq.svc.cluster.local:9876;" +
+				"demo-nameserver-2.demo-nameserver-hs.mq.svc.cluster.local:9876",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nameserverConnectAddr(testNameserver(tt.replicas)); got != tt.want {
+				t.Errorf("nameserverConnectAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNameserverReconcile(t *testing.T) {
+	instance := testNameserver(2)
+	c := newFakeClient(instance)
+	r := &NameserverReconciler{Client: c, Scheme: testScheme()}
+	ref := types.NamespacedName{Namespace: "mq", Name: "demo"}
+	ctx := context.Background()
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: ref}); err != nil {
+		t.Fatal(err)
+	}
+
+	headless := &corev1.Service{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "mq", Name: "demo-nameserver-hs"}, headless); err != nil {
+		t.Fatal(err)
+	}
+	if headless.Spec.ClusterIP != corev1.ClusterIPNone || !headless.Spec.PublishNotReadyAddresses || !metav1.IsControlledBy(headless, instance) {
+		t.Errorf("headless service = %+v", headless.Spec)
+	}
+	svc := &corev1.Service{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "mq", Name: "demo-nameserver"}, svc); err != nil {
+		t.Fatal(err)
+	}
+	if svc.Spec.Type != corev1.ServiceTypeClusterIP || svc.Spec.Ports[0].Port != nameserverPort {
+		t.Errorf("client service = %+v", svc.Spec)
+	}
+	sts := &appsv1.StatefulSet{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "mq", Name: "demo-nameserver"}, sts); err != nil {
+		t.Fatal(err)
+	}
+	if *sts.Spec.Replicas != 2 || sts.Spec.ServiceName != "demo-nameserver-hs" || !metav1.IsControlledBy(sts, instance) {
+		t.Errorf("statefulset spec = %+v", sts.Spec)
+	}
+
+	if err := c.Get(ctx, ref, instance); err != nil {
+		t.Fatal(err)
+	}
+	if instance.Status.ConnectAddr != nameserverConnectAddr(instance) {
+		t.Errorf("connectAddr = %q, want %q", instance.Status.ConnectAddr, nameserverConnectAddr(instance))
+	}
+
+	// 扩容后connectAddr随之更新
+	instance.Spec.NameserverNumber = 3
+	if err := c.Update(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: ref}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, ref, instance); err != nil {
+		t.Fatal(err)
+	}
+	if instance.Status.ConnectAddr != nameserverConnectAddr(testNameserver(3)) {
+		t.Errorf("connectAddr after scaling = %q", instance.Status.ConnectAddr)
+	}
+}
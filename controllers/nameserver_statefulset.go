@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/configs"
+)
+
+const (
+	appNameserver = "rocketmq-nameserver"
+
+	nameserverContainerName = "nameserver"
+
+	nameserverPort = 9876
+)
+
+// nameserverName 返回nameserver statefulset和客户端service的名称
+func nameserverName(instance *rocketmqv1.Nameserver) string {
+	return fmt.Sprintf("%s-nameserver", instance.Name)
+}
+
+// nameserverHeadlessServiceName 返回nameserver的headless service名称
+func nameserverHeadlessServiceName(instance *rocketmqv1.Nameserver) string {
+	return fmt.Sprintf("%s-nameserver-hs", instance.Name)
+}
+
+func nameserverLabels(instance *rocketmqv1.Nameserver) map[string]string {
+	return map[string]string{
+		labelApp:     appNameserver,
+		labelCluster: instance.Name,
+	}
+}
+
+// nameserverPodFQDN 返回第k个nameserver pod通过headless service解析的稳定dns名称
+func nameserverPodFQDN(instance *rocketmqv1.Nameserver, k int) string {
+	return fmt.Sprintf("%s-%d.%s.%s.svc.%s", nameserverName(instance), k,
+		nameserverHeadlessServiceName(instance), instance.Namespace, configs.GetGlobalConfig().CLUSTER_DOMAIN)
+}
+
+// nameserverConnectAddr 计算namesrvAddr，格式为 host:port;host:port
+func nameserverConnectAddr(instance *rocketmqv1.Nameserver) string {
+	addrs := make([]string, 0, instance.Spec.NameserverNumber)
+	for k := 0; k < instance.Spec.NameserverNumber; k++ {
+		addrs = append(addrs, fmt.Sprintf("%s:%d", nameserverPodFQDN(instance, k), nameserverPort))
+	}
+	return strings.Join(addrs, ";")
+}
+
+// mutateNameserverService 渲染nameserver的service，headless为true时渲染headless service
+func mutateNameserverService(instance *rocketmqv1.Nameserver, headless bool, svc *corev1.Service) {
+	svc.Labels = mergeLabels(svc.Labels, nameserverLabels(instance))
+	if headless {
+		svc.Spec.ClusterIP = corev1.ClusterIPNone
+		svc.Spec.PublishNotReadyAddresses = true
+	}
+	svc.Spec.Selector = nameserverLabels(instance)
+	port := corev1.ServicePort{Name: "main", Port: nameserverPort, TargetPort: intstr.FromInt(nameserverPort)}
+	if !headless {
+		applyNameserverExternalAccess(instance, svc, &port)
+	}
+	svc.Spec.Ports = []corev1.ServicePort{port}
+}
+
+// applyNameserverExternalAccess 开启外部访问时将客户端service改为NodePort或LoadBalancer类型，
+// 保留apiserver已分配的nodePort；关闭时恢复为ClusterIP
+func applyNameserverExternalAccess(instance *rocketmqv1.Nameserver, svc *corev1.Service, port *corev1.ServicePort) {
+	access := instance.Spec.ExternalAccess
+	if access == nil {
+		svc.Spec.Type = corev1.ServiceTypeClusterIP
+		svc.Spec.ExternalTrafficPolicy = ""
+		return
+	}
+	svc.Annotations = mergeLabels(svc.Annotations, access.Annotations)
+	svc.Spec.Type = access.Type
+	for _, old := range svc.Spec.Ports {
+		if old.Name == port.Name {
+			port.NodePort = old.NodePort
+		}
+	}
+}
+
+// mutateNameserverStatefulSet 渲染nameserver的statefulset
+func mutateNameserverStatefulSet(instance *rocketmqv1.Nameserver, sts *appsv1.StatefulSet) {
+	labels := nameserverLabels(instance)
+	replicas := int32(instance.Spec.NameserverNumber)
+
+	sts.Labels = mergeLabels(sts.Labels, labels)
+	sts.Spec.Replicas = &replicas
+	sts.Spec.ServiceName = nameserverHeadlessServiceName(instance)
+	sts.Spec.PodManagementPolicy = appsv1.ParallelPodManagement
+	// selector创建后不可修改，只在创建时设置
+	if sts.Spec.Selector == nil {
+		sts.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+	}
+
+	template := &sts.Spec.Template
+	template.Labels = mergeLabels(template.Labels, labels)
+	podSpec := &template.Spec
+	podSpec.ServiceAccountName = instance.Spec.ServiceAccountName
+	podSpec.ImagePullSecrets = instance.Spec.Image.ImagePullSecret
+	applyPodSpec(podSpec, &instance.Spec.PodSpec)
+
+	container := findOrAppendContainer(podSpec, nameserverContainerName)
+	container.Image = instance.Spec.Image.Image
+	container.ImagePullPolicy = instance.Spec.Image.ImagePullPolicy
+	container.Command = []string{"sh", "mqnamesrv"}
+	container.Env = nameserverEnv(instance.Spec.Env)
+	container.Resources = instance.Spec.Resource
+	container.Ports = []corev1.ContainerPort{
+		{Name: "main", ContainerPort: nameserverPort},
+	}
+}
+
+// nameserverEnv 将NS_前缀的jvm参数转换为镜像启动脚本识别的Xmx/Xms
+func nameserverEnv(env []corev1.EnvVar) []corev1.EnvVar {
+	r := make([]corev1.EnvVar, 0, len(env))
+	r = append(r, env...)
+	if v, ok := configs.LookupEnv(env, configs.NS_JVM_XMX); ok {
+		r = configs.SetEnv(r, configs.JVM_XMX, v)
+	}
+	if v, ok := configs.LookupEnv(env, configs.NS_JVM_XMS); ok {
+		r = configs.SetEnv(r, configs.JVM_XMS, v)
+	}
+	return r
+}
+
+// nameserverExporter 返回nameserver实例的exporter
+func nameserverExporter(instance *rocketmqv1.Nameserver, connectAddr string) *exporter {
+	return &exporter{
+		Name:        nameserverName(instance) + "-exporter",
+		For:         appNameserver,
+		Cluster:     instance.Name,
+		Setting:     &instance.Spec.Export,
+		NamesrvAddr: connectAddr,
+	}
+}
@@ -0,0 +1,256 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+)
+
+const (
+	reasonAccessKeyConflict   = "AccessKeyConflict"
+	reasonNamespaceNotAllowed = "NamespaceNotAllowed"
+
+	// userSecretKeyLength 生成的secretKey长度
+	userSecretKeyLength = 32
+	userSecretKeyChars  = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// RocketMQUserReconciler reconciles a RocketMQUser object
+type RocketMQUserReconciler struct {
+	client.Client
+	Log    *zap.SugaredLogger
+	Scheme *runtime.Scheme
+}
+
+// +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=rocketmqusers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=rocketmqusers/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=dledgerbrokers,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+
+// Reconcile 生成账号的凭证secret，并检查账号能否被聚合到集群的plain_acl.yml。
+// plain_acl.yml由DledgerBroker控制器渲染，RocketMQUser及其secret变化时会触发集群重新渲染
+func (r *RocketMQUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	reqLog := log.With(
+		zap.String("Request.Namespace", req.Namespace),
+		zap.String("Request.Name", req.Name),
+	)
+	reqLog.Info("Reconcile RocketMQUser")
+	r.Log = reqLog
+	instance := &rocketmqv1.RocketMQUser{}
+	if err := r.Client.Get(ctx, req.NamespacedName, instance); err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	if !instance.DeletionTimestamp.IsZero() {
+		// 凭证secret通过ownerReference回收，集群通过watch移除账号
+		return ctrl.Result{}, nil
+	}
+
+	oldStatus := instance.Status.DeepCopy()
+	if err := r.reconcileSecret(ctx, instance); err != nil {
+		return ctrl.Result{}, err
+	}
+	if old := instance.Status.SecretName; old != "" && old != instance.SecretName() {
+		if err := r.deleteStaleSecret(ctx, instance, old); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	instance.Status.AccessKey = instance.AccessKey()
+	instance.Status.SecretName = instance.SecretName()
+
+	notReady, degradedReason, degraded, err := r.checkCluster(ctx, instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	instance.Status.Phase = setHealthConditions(&instance.Status.Conditions, instance.Generation, instance.Status.Phase,
+		notReady, nil, degradedReason, degraded)
+	instance.Status.ObservedGeneration = instance.Generation
+	if equality.Semantic.DeepEqual(oldStatus, &instance.Status) {
+		return ctrl.Result{}, nil
+	}
+	return ctrl.Result{}, r.Status().Update(ctx, instance)
+}
+
+// reconcileSecret 将accessKey写入凭证secret，secret中没有secretKey时生成随机值，已有的secretKey保持不变
+func (r *RocketMQUserReconciler) reconcileSecret(ctx context.Context, instance *rocketmqv1.RocketMQUser) error {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:      instance.SecretName(),
+		Namespace: instance.Namespace,
+	}}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, secret, func() error {
+		secret.Labels = mergeLabels(secret.Labels, map[string]string{labelUser: instance.Name})
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte, 2)
+		}
+		secret.Data[credentialAccessKey] = []byte(instance.AccessKey())
+		if len(secret.Data[credentialSecretKey]) == 0 {
+			secretKey, err := randomSecretKey()
+			if err != nil {
+				return err
+			}
+			secret.Data[credentialSecretKey] = []byte(secretKey)
+		}
+		return controllerutil.SetControllerReference(instance, secret, r.Scheme)
+	})
+	if err != nil {
+		return err
+	}
+	if op != controllerutil.OperationResultNone {
+		r.Log.Infow("reconciled rocketmq user secret", "secret", secret.Name, "operation", op)
+	}
+	return nil
+}
+
+// deleteStaleSecret 修改Spec.SecretName后删除之前生成的secret，不删除非本实例创建的secret
+func (r *RocketMQUserReconciler) deleteStaleSecret(ctx context.Context, instance *rocketmqv1.RocketMQUser, name string) error {
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: instance.Namespace, Name: name}, secret); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !metav1.IsControlledBy(secret, instance) {
+		return nil
+	}
+	if err := r.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	r.Log.Infow("deleted stale rocketmq user secret", "secret", name)
+	return nil
+}
+
+// checkCluster 返回账号未生效的原因，以及降级的原因和描述。与DledgerBroker控制器按相同的规则判断命名空间和accessKey冲突
+func (r *RocketMQUserReconciler) checkCluster(ctx context.Context, instance *rocketmqv1.RocketMQUser) (notReady []string, degradedReason string, degraded []string, err error) {
+	cluster := &rocketmqv1.DledgerBroker{}
+	if err := r.Get(ctx, instance.ClusterRef(), cluster); err != nil {
+		if errors.IsNotFound(err) {
+			return []string{fmt.Sprintf("cluster %s not found", instance.ClusterRef())}, "", nil, nil
+		}
+		return nil, "", nil, err
+	}
+	if msg := clusterNotAllowed(cluster, instance.Namespace); msg != "" {
+		return []string{msg}, reasonNamespaceNotAllowed, []string{msg}, nil
+	}
+	if cluster.Spec.Acl == nil {
+		return []string{fmt.Sprintf("acl is not enabled on cluster %s", instance.ClusterRef())}, "", nil, nil
+	}
+	defaults, err := defaultPlainAcl(ctx, r.Client)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	accounts, err := resolveAccounts(ctx, r.Client, cluster)
+	if err != nil {
+		// 集群自身的账号配置有误时plain_acl.yml无法渲染
+		return []string{fmt.Sprintf("cluster %s acl: %v", instance.ClusterRef(), err)}, "", nil, nil
+	}
+	_, conflicts, err := userAccounts(ctx, r.Client, cluster, reservedAccessKeys(defaults.Accounts, accounts))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if msg, ok := conflicts[types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name}]; ok {
+		return []string{msg}, reasonAccessKeyConflict, []string{msg}, nil
+	}
+	return nil, "", nil, nil
+}
+
+// randomSecretKey 生成随机secretKey
+func randomSecretKey() (string, error) {
+	b := make([]byte, userSecretKeyLength)
+	max := big.NewInt(int64(len(userSecretKeyChars)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = userSecretKeyChars[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// usersForCluster 返回引用了该DledgerBroker的所有RocketMQUser，集群开启或关闭acl、账号变化时重新检查
+func (r *RocketMQUserReconciler) usersForCluster(obj client.Object) []reconcile.Request {
+	users := &rocketmqv1.RocketMQUserList{}
+	if err := r.List(context.Background(), users); err != nil {
+		log.Errorw("list rocketmqusers failed", "error", err)
+		return nil
+	}
+	cluster := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	var requests []reconcile.Request
+	for k := range users.Items {
+		user := &users.Items[k]
+		if user.ClusterRef() != cluster {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Namespace: user.Namespace,
+			Name:      user.Name,
+		}})
+	}
+	return requests
+}
+
+// usersForUser 返回与该RocketMQUser引用同一集群的其他RocketMQUser，先创建的账号删除或修改accessKey后冲突可能解除
+func (r *RocketMQUserReconciler) usersForUser(obj client.Object) []reconcile.Request {
+	user, ok := obj.(*rocketmqv1.RocketMQUser)
+	if !ok {
+		return nil
+	}
+	cluster := user.ClusterRef()
+	var requests []reconcile.Request
+	for _, req := range r.usersForCluster(&rocketmqv1.DledgerBroker{ObjectMeta: metav1.ObjectMeta{Namespace: cluster.Namespace, Name: cluster.Name}}) {
+		if req.Namespace != user.Namespace || req.Name != user.Name {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+func (r *RocketMQUserReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&rocketmqv1.RocketMQUser{}).
+		Owns(&corev1.Secret{}).
+		Watches(&source.Kind{Type: &rocketmqv1.DledgerBroker{}}, handler.EnqueueRequestsFromMapFunc(r.usersForCluster),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&source.Kind{Type: &rocketmqv1.RocketMQUser{}}, handler.EnqueueRequestsFromMapFunc(r.usersForUser),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+)
+
+// testUser 返回引用cluster的RocketMQUser，created为创建时间的偏移
+func testUser(namespace, name, cluster, accessKey string, created time.Duration) *rocketmqv1.RocketMQUser {
+	return &rocketmqv1.RocketMQUser{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         namespace,
+			Name:              name,
+			CreationTimestamp: metav1.NewTime(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC).Add(created)),
+		},
+		Spec: rocketmqv1.RocketMQUserSpec{Cluster: cluster, AccessKey: accessKey, TopicPerms: []string{"orders=PUB"}},
+	}
+}
+
+// testUserSecret 返回RocketMQUser的凭证secret
+func testUserSecret(user *rocketmqv1.RocketMQUser, accessKey, secretKey string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: user.Namespace, Name: user.SecretName(), Labels: map[string]string{labelUser: user.Name}},
+		Data:       map[string][]byte{credentialAccessKey: []byte(accessKey), credentialSecretKey: []byte(secretKey)},
+	}
+}
+
+func TestUserAccounts(t *testing.T) {
+	cluster := testBrokerInstance()
+	cluster.Spec.Acl = &rocketmqv1.Acl{}
+	first := testUser("mq", "first", "demo", "orders-key", 0)
+	second := testUser("mq", "second", "demo", "billing-key", time.Minute)
+	duplicate := testUser("mq", "duplicate", "demo", "orders-key", 2*time.Minute)
+	remote := testUser("apps", "remote", "mq/demo", "apps-key", 3*time.Minute)
+	reserved := testUser("mq", "reserved", "demo", "rocketmq2", 4*time.Minute)
+	pending := testUser("mq", "pending", "demo", "pending-key", 5*time.Minute)
+	rotated := testUser("mq", "rotated", "demo", "new-key", 6*time.Minute)
+	other := testUser("mq", "other", "other", "other-key", 7*time.Minute)
+	account := func(accessKey, secretKey string) plainAccount {
+		return plainAccount{AccessKey: accessKey, SecretKey: secretKey, TopicPerms: []string{"orders=PUB"}}
+	}
+
+	tests := []struct {
+		name          string
+		allowed       []string
+		users         []*rocketmqv1.RocketMQUser
+		secrets       []*corev1.Secret
+		want          []plainAccount
+		wantConflicts []string
+	}{
+		{
+			name:    "accounts in creation order",
+			users:   []*rocketmqv1.RocketMQUser{second, first, other},
+			secrets: []*corev1.Secret{testUserSecret(first, "orders-key", "s1"), testUserSecret(second, "billing-key", "s2")},
+			want:    []plainAccount{account("orders-key", "s1"), account("billing-key", "s2")},
+		},
+		{
+			name:          "newer user with a duplicate accessKey is ignored",
+			users:         []*rocketmqv1.RocketMQUser{duplicate, first},
+			secrets:       []*corev1.Secret{testUserSecret(first, "orders-key", "s1"), testUserSecret(duplicate, "orders-key", "s3")},
+			want:          []plainAccount{account("orders-key", "s1")},
+			wantConflicts: []string{"mq/duplicate"},
+		},
+		{
+			name:          "accessKey reserved by the cluster",
+			users:         []*rocketmqv1.RocketMQUser{reserved},
+			secrets:       []*corev1.Secret{testUserSecret(reserved, "rocketmq2", "s4")},
+			wantConflicts: []string{"mq/reserved"},
+		},
+		{
+			name:    "users without generated credentials are skipped",
+			users:   []*rocketmqv1.RocketMQUser{pending, rotated},
+			secrets: []*corev1.Secret{testUserSecret(pending, "pending-key", ""), testUserSecret(rotated, "old-key", "s5")},
+		},
+		{
+			name:    "user from a namespace not allowed is ignored",
+			users:   []*rocketmqv1.RocketMQUser{remote},
+			secrets: []*corev1.Secret{testUserSecret(remote, "apps-key", "s6")},
+		},
+		{
+			name:    "user from an allowed namespace",
+			allowed: []string{"apps"},
+			users:   []*rocketmqv1.RocketMQUser{remote},
+			secrets: []*corev1.Secret{testUserSecret(remote, "apps-key", "s6")},
+			want:    []plainAccount{account("apps-key", "s6")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := cluster.DeepCopy()
+			cluster.Spec.AllowedNamespaces = tt.allowed
+			var objs []client.Object
+			for _, u := range tt.users {
+				objs = append(objs, u)
+			}
+			for _, s := range tt.secrets {
+				objs = append(objs, s)
+			}
+			accounts, conflicts, err := userAccounts(context.Background(), newFakeClient(objs...), cluster, map[string]bool{"rocketmq2": true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(accounts, tt.want) {
+				t.Errorf("accounts = %+v, want %+v", accounts, tt.want)
+			}
+			var got []string
+			for ref := range conflicts {
+				got = append(got, ref.String())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.wantConflicts) {
+				t.Errorf("conflicts = %v, want %v", conflicts, tt.wantConflicts)
+			}
+		})
+	}
+}
+
+func TestRocketMQUserReconcileCluster(t *testing.T) {
+	cluster := testBrokerInstance()
+	cluster.Spec.Acl = &rocketmqv1.Acl{Accounts: []rocketmqv1.Account{{AccessKey: "rocketmq2", SecretKey: "12345678", Admin: true}}}
+	tests := []struct {
+		name       string
+		allowed    []string
+		users      []*rocketmqv1.RocketMQUser
+		reconcile  types.NamespacedName
+		wantPhase  rocketmqv1.Phase
+		wantReason string
+	}{
+		{
+			name:      "account ready",
+			users:     []*rocketmqv1.RocketMQUser{testUser("mq", "orders", "demo", "orders-key", 0)},
+			reconcile: types.NamespacedName{Namespace: "mq", Name: "orders"},
+			wantPhase: rocketmqv1.PhaseRunning,
+		},
+		{
+			name:       "accessKey of a cluster account",
+			users:      []*rocketmqv1.RocketMQUser{testUser("mq", "admin", "demo", "rocketmq2", 0)},
+			reconcile:  types.NamespacedName{Namespace: "mq", Name: "admin"},
+			wantPhase:  rocketmqv1.PhaseDegraded,
+			wantReason: reasonAccessKeyConflict,
+		},
+		{
+			name: "newer user with the same accessKey",
+			users: []*rocketmqv1.RocketMQUser{
+				testUser("mq", "orders", "demo", "orders-key", 0),
+				testUser("mq", "copy", "demo", "orders-key", time.Minute),
+			},
+			reconcile:  types.NamespacedName{Namespace: "mq", Name: "copy"},
+			wantPhase:  rocketmqv1.PhaseDegraded,
+			wantReason: reasonAccessKeyConflict,
+		},
+		{
+			name:       "namespace not allowed",
+			users:      []*rocketmqv1.RocketMQUser{testUser("apps", "orders", "mq/demo", "orders-key", 0)},
+			reconcile:  types.NamespacedName{Namespace: "apps", Name: "orders"},
+			wantPhase:  rocketmqv1.PhaseDegraded,
+			wantReason: reasonNamespaceNotAllowed,
+		},
+		{
+			name:      "namespace allowed",
+			allowed:   []string{"*"},
+			users:     []*rocketmqv1.RocketMQUser{testUser("apps", "orders", "mq/demo", "orders-key", 0)},
+			reconcile: types.NamespacedName{Namespace: "apps", Name: "orders"},
+			wantPhase: rocketmqv1.PhaseRunning,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := cluster.DeepCopy()
+			cluster.Spec.AllowedNamespaces = tt.allowed
+			objs := []client.Object{cluster}
+			for _, u := range tt.users {
+				objs = append(objs, u.DeepCopy())
+			}
+			c := newFakeClient(objs...)
+			r := &RocketMQUserReconciler{Client: c, Scheme: testScheme()}
+			// 先为所有用户生成凭证，冲突按已生成凭证的账号判断
+			for _, u := range tt.users {
+				req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: u.Namespace, Name: u.Name}}
+				if _, err := r.Reconcile(context.Background(), req); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: tt.reconcile}); err != nil {
+				t.Fatal(err)
+			}
+			user := &rocketmqv1.RocketMQUser{}
+			if err := c.Get(context.Background(), tt.reconcile, user); err != nil {
+				t.Fatal(err)
+			}
+			if user.Status.Phase != tt.wantPhase {
+				t.Errorf("phase = %s, want %s, conditions %+v", user.Status.Phase, tt.wantPhase, user.Status.Conditions)
+			}
+			degraded := meta.FindStatusCondition(user.Status.Conditions, rocketmqv1.ConditionDegraded)
+			if tt.wantReason != "" && (degraded == nil || degraded.Reason != tt.wantReason) {
+				t.Errorf("Degraded condition = %+v, want reason %s", degraded, tt.wantReason)
+			}
+		})
+	}
+}
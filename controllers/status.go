@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+)
+
+const (
+	// podUnavailableThreshold pod未就绪超过该时间才认为实例降级，避免创建和重启期间状态抖动
+	podUnavailableThreshold = 5 * time.Minute
+
+	reasonAllReady        = "AllReady"
+	reasonNotReady        = "NotReady"
+	reasonUpdating        = "Updating"
+	reasonStable          = "Stable"
+	reasonPodsUnavailable = "PodsUnavailable"
+	reasonQuorumLost      = "QuorumLost"
+	reasonAvailable       = "Available"
+)
+
+// unavailablePods 返回未就绪时间超过podUnavailableThreshold的pod，以及最早一个pod达到阈值的剩余时间
+func unavailablePods(pods []corev1.Pod, now time.Time) ([]string, time.Duration) {
+	var names []string
+	var next time.Duration
+	for k := range pods {
+		pod := &pods[k]
+		if isPodReady(pod) || !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+		since := pod.CreationTimestamp.Time
+		for _, c := range pod.Status.Conditions {
+			if c.Type == corev1.PodReady {
+				since = c.LastTransitionTime.Time
+			}
+		}
+		if wait := since.Add(podUnavailableThreshold).Sub(now); wait > 0 {
+			if next == 0 || wait < next {
+				next = wait
+			}
+			continue
+		}
+		names = append(names, pod.Name)
+	}
+	sort.Strings(names)
+	return names, next
+}
+
+// setCondition 设置状态，status为true时使用trueReason
+func setCondition(conditions *[]metav1.Condition, generation int64, conditionType string, status bool, trueReason, falseReason, message string) {
+	condition := metav1.Condition{
+		Type:               conditionType,
+		Status:             metav1.ConditionFalse,
+		Reason:             falseReason,
+		Message:            message,
+		ObservedGeneration: generation,
+	}
+	if status {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = trueReason
+	}
+	meta.SetStatusCondition(conditions, condition)
+}
+
+// setHealthConditions 设置Ready、Progressing、Degraded状态并根据上一次的phase返回新的Phase。
+// notReady、progressing、degraded分别为未就绪、正在进行的操作和降级的描述，为空表示不处于该状态
+func setHealthConditions(conditions *[]metav1.Condition, generation int64, previous rocketmqv1.Phase,
+	notReady, progressing []string, degradedReason string, degraded []string) rocketmqv1.Phase {
+	readyMessage := "all nodes are ready"
+	if len(notReady) > 0 {
+		readyMessage = strings.Join(notReady, "; ")
+	}
+	setCondition(conditions, generation, rocketmqv1.ConditionReady, len(notReady) == 0, reasonAllReady, reasonNotReady, readyMessage)
+
+	progressingMessage := "no update in progress"
+	if len(progressing) > 0 {
+		progressingMessage = strings.Join(progressing, "; ")
+	}
+	setCondition(conditions, generation, rocketmqv1.ConditionProgressing, len(progressing) > 0, reasonUpdating, reasonStable, progressingMessage)
+
+	degradedMessage := "all nodes are available"
+	if len(degraded) > 0 {
+		degradedMessage = strings.Join(degraded, "; ")
+	}
+	setCondition(conditions, generation, rocketmqv1.ConditionDegraded, len(degraded) > 0, degradedReason, reasonAvailable, degradedMessage)
+
+	switch {
+	case len(degraded) > 0:
+		return rocketmqv1.PhaseDegraded
+	case len(notReady) == 0 && len(progressing) == 0:
+		return rocketmqv1.PhaseRunning
+	case previous == "" || previous == rocketmqv1.PhasePending:
+		// 首次就绪前保持Pending
+		return rocketmqv1.PhasePending
+	default:
+		return rocketmqv1.PhaseUpdating
+	}
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+)
+
+func TestUnavailablePods(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	pod := func(name string, ready bool, since time.Duration) corev1.Pod {
+		status := corev1.ConditionFalse
+		if ready {
+			status = corev1.ConditionTrue
+		}
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: metav1.NewTime(now.Add(-time.Hour))},
+			Status: corev1.PodStatus{Conditions: []corev1.PodCondition{
+				{Type: corev1.PodReady, Status: status, LastTransitionTime: metav1.NewTime(now.Add(-since))},
+			}},
+		}
+	}
+	deleting := pod("deleting", false, time.Hour)
+	deleting.DeletionTimestamp = &metav1.Time{Time: now}
+	created := pod("created", false, 0)
+	created.Status.Conditions = nil
+	created.CreationTimestamp = metav1.NewTime(now.Add(-time.Minute))
+
+	tests := []struct {
+		name     string
+		pods     []corev1.Pod
+		want     []string
+		wantNext time.Duration
+	}{
+		{name: "all ready", pods: []corev1.Pod{pod("a", true, time.Hour)}},
+		{name: "not ready beyond threshold", pods: []corev1.Pod{pod("b", false, 6*time.Minute), pod("a", false, 5*time.Minute)}, want: []string{"a", "b"}},
+		{name: "not ready within threshold", pods: []corev1.Pod{pod("a", false, 4*time.Minute), pod("b", false, 2*time.Minute)}, wantNext: time.Minute},
+		{name: "without ready condition since creation", pods: []corev1.Pod{created}, wantNext: 4 * time.Minute},
+		{name: "terminating pods are ignored", pods: []corev1.Pod{deleting}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, next := unavailablePods(tt.pods, now)
+			if !reflect.DeepEqual(got, tt.want) || next != tt.wantNext {
+				t.Errorf("unavailablePods() = %v, %s, want %v, %s", got, next, tt.want, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestSetHealthConditions(t *testing.T) {
+	tests := []struct {
+		name          string
+		previous      rocketmqv1.Phase
+		notReady      []string
+		progressing   []string
+		degraded      []string
+		want          rocketmqv1.Phase
+		wantReady     metav1.ConditionStatus
+		wantDegraded  string
+		wantReadyNote string
+	}{
+		{name: "running", want: rocketmqv1.PhaseRunning, wantReady: metav1.ConditionTrue, wantDegraded: reasonAvailable},
+		{
+			name:          "pending until first ready",
+			notReady:      []string{"g0: 1/3 nodes ready"},
+			want:          rocketmqv1.PhasePending,
+			wantReady:     metav1.ConditionFalse,
+			wantDegraded:  reasonAvailable,
+			wantReadyNote: "g0: 1/3 nodes ready",
+		},
+		{
+			name:         "updating after first ready",
+			previous:     rocketmqv1.PhaseRunning,
+			progressing:  []string{"g0: 1/3 pods updated"},
+			want:         rocketmqv1.PhaseUpdating,
+			wantReady:    metav1.ConditionTrue,
+			wantDegraded: reasonAvailable,
+		},
+		{
+			name:          "degraded takes precedence",
+			previous:      rocketmqv1.PhaseRunning,
+			notReady:      []string{"g0: 1/3 nodes ready", "g1: 2/3 nodes ready"},
+			progressing:   []string{"g0: 1/3 pods updated"},
+			degraded:      []string{"g0: quorum lost"},
+			want:          rocketmqv1.PhaseDegraded,
+			wantReady:     metav1.ConditionFalse,
+			wantDegraded:  reasonQuorumLost,
+			wantReadyNote: "g0: 1/3 nodes ready; g1: 2/3 nodes ready",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conditions []metav1.Condition
+			got := setHealthConditions(&conditions, 3, tt.previous, tt.notReady, tt.progressing, reasonQuorumLost, tt.degraded)
+			if got != tt.want {
+				t.Errorf("phase = %s, want %s", got, tt.want)
+			}
+			ready := meta.FindStatusCondition(conditions, rocketmqv1.ConditionReady)
+			if ready.Status != tt.wantReady || ready.ObservedGeneration != 3 || (tt.wantReadyNote != "" && ready.Message != tt.wantReadyNote) {
+				t.Errorf("Ready = %+v, want %s %q", ready, tt.wantReady, tt.wantReadyNote)
+			}
+			progressing := meta.FindStatusCondition(conditions, rocketmqv1.ConditionProgressing)
+			if (progressing.Status == metav1.ConditionTrue) != (len(tt.progressing) > 0) {
+				t.Errorf("Progressing = %+v", progressing)
+			}
+			if degraded := meta.FindStatusCondition(conditions, rocketmqv1.ConditionDegraded); degraded.Reason != tt.wantDegraded {
+				t.Errorf("Degraded = %+v, want reason %s", degraded, tt.wantDegraded)
+			}
+		})
+	}
+}
@@ -0,0 +1,636 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	errors2 "github.com/pkg/errors"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/admin"
+)
+
+var topicFinalizerName = "topic.finalizers.rocketmq.daocloud.io"
+
+const (
+	// topicRetryInterval broker组没有master或同步失败时重试的间隔
+	topicRetryInterval = 10 * time.Second
+
+	reasonSyncFailed    = "SyncFailed"
+	reasonCleanupFailed = "CleanupFailed"
+
+	// topicCleanupTimeout 删除Topic时清理broker和nameserver失败，超过该时间后放弃清理并移除finalizer
+	topicCleanupTimeout = 10 * time.Minute
+	// annotationSkipCleanup 设置为true时删除Topic不清理broker和nameserver上的topic
+	annotationSkipCleanup = "rocketmq.daocloud.io/skip-cleanup"
+
+	// messageTypeAttribute 5.x的topic属性中记录消息类型的key
+	messageTypeAttribute = "message.type"
+)
+
+// TopicReconciler reconciles a Topic object
+type TopicReconciler struct {
+	client.Client
+	Log    *zap.SugaredLogger
+	Scheme *runtime.Scheme
+	Admin  admin.Admin
+	// SyncInterval 定期检查broker上的topic配置，修复broker组重建或手动修改导致的偏差，为0时不定期检查
+	SyncInterval time.Duration
+}
+
+// +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=topics,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=topics/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=rocketmq.daocloud.io,resources=dledgerbrokers,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+
+func (r *TopicReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	reqLog := log.With(
+		zap.String("Request.Namespace", req.Namespace),
+		zap.String("Request.Name", req.Name),
+	)
+	reqLog.Info("Reconcile Topic")
+	r.Log = reqLog
+	instance := &rocketmqv1.Topic{}
+	if err := r.Client.Get(ctx, req.NamespacedName, instance); err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	if !instance.ObjectMeta.DeletionTimestamp.IsZero() {
+		if containsString(instance.GetFinalizers(), topicFinalizerName) {
+			if instance.Status.Phase != rocketmqv1.PhaseTerminating {
+				instance.Status.Phase = rocketmqv1.PhaseTerminating
+				if err := r.Status().Update(ctx, instance); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+			if instance.Spec.DeletePolicy == rocketmqv1.DeletePolicyDelete {
+				if done, err := r.cleanupTopic(ctx, instance); !done || err != nil {
+					return ctrl.Result{RequeueAfter: topicRetryInterval}, err
+				}
+			}
+			controllerutil.RemoveFinalizer(instance, topicFinalizerName)
+			if err := r.Update(ctx, instance); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+	if !containsString(instance.GetFinalizers(), topicFinalizerName) {
+		controllerutil.AddFinalizer(instance, topicFinalizerName)
+		if err := r.Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	oldStatus := instance.Status.DeepCopy()
+	cluster := &rocketmqv1.DledgerBroker{}
+	if err := r.Get(ctx, instance.ClusterRef(), cluster); err != nil {
+		if !errors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		// DledgerBroker创建后会通过watch重新触发
+		return ctrl.Result{}, r.setTopicHealth(ctx, instance, oldStatus,
+			[]string{fmt.Sprintf("cluster %s not found", instance.ClusterRef())}, nil)
+	}
+	if msg := clusterNotAllowed(cluster, instance.Namespace); msg != "" {
+		// 集群修改allowedNamespaces后会通过watch重新触发
+		return ctrl.Result{}, r.setTopicHealth(ctx, instance, oldStatus, []string{msg}, []string{msg})
+	}
+	owner, err := r.topicOwner(ctx, instance, cluster)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if owner != (types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name}) {
+		// 先创建的Topic删除或改名后会通过watch重新触发
+		msg := fmt.Sprintf("topic %s is already managed by Topic %s", instance.TopicName(), owner)
+		return ctrl.Result{}, r.setTopicHealth(ctx, instance, oldStatus, []string{msg}, []string{msg})
+	}
+	ctx, err = clusterAdminContext(ctx, r.Client, cluster)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	namesrvAddr := brokerNamesrvAddr(cluster)
+	if namesrvAddr == "" {
+		return ctrl.Result{}, r.setTopicHealth(ctx, instance, oldStatus,
+			[]string{fmt.Sprintf("waiting for namesrvAddr of cluster %s", instance.ClusterRef())}, nil)
+	}
+	info, err := clusterInfo(ctx, r.Admin, namesrvAddr)
+	if err != nil {
+		r.Log.Warnw("get cluster info from nameserver failed", "namesrvAddr", namesrvAddr, "error", err)
+		return ctrl.Result{RequeueAfter: topicRetryInterval}, r.setTopicHealth(ctx, instance, oldStatus,
+			[]string{fmt.Sprintf("get cluster info from nameserver: %v", err)}, nil)
+	}
+
+	groups, notReady := topicGroups(instance, cluster)
+	statuses := make([]rocketmqv1.TopicGroupStatus, 0, len(groups))
+	for _, i := range groups {
+		statuses = append(statuses, r.syncTopicGroup(ctx, instance, cluster, i, info))
+	}
+	statuses = append(statuses, r.removeStaleTopicGroups(ctx, instance, cluster, info, namesrvAddr, statuses)...)
+	instance.Status.TopicName = instance.TopicName()
+	instance.Status.BrokerGroups = statuses
+
+	var degraded []string
+	for _, s := range statuses {
+		if s.State != rocketmqv1.SyncStateSynced {
+			notReady = append(notReady, fmt.Sprintf("%s: %s", s.BrokerName, s.Message))
+		}
+		if s.State == rocketmqv1.SyncStateFailed {
+			degraded = append(degraded, fmt.Sprintf("%s: %s", s.BrokerName, s.Message))
+		}
+	}
+	if len(notReady) == 0 {
+		if err := r.syncOrderConf(ctx, instance, namesrvAddr); err != nil {
+			r.Log.Warnw("update order topic config failed", "topic", instance.TopicName(), "error", err)
+			degraded = append(degraded, fmt.Sprintf("update order topic config: %v", err))
+		}
+	}
+	if err := r.setTopicHealth(ctx, instance, oldStatus, notReady, degraded); err != nil {
+		return ctrl.Result{}, err
+	}
+	if len(notReady) > 0 || len(degraded) > 0 {
+		return ctrl.Result{RequeueAfter: topicRetryInterval}, nil
+	}
+	return ctrl.Result{RequeueAfter: r.SyncInterval}, nil
+}
+
+// setTopicHealth 设置状态并在变化时更新
+func (r *TopicReconciler) setTopicHealth(ctx context.Context, instance *rocketmqv1.Topic, oldStatus *rocketmqv1.TopicStatus, notReady, degraded []string) error {
+	instance.Status.Phase = setHealthConditions(&instance.Status.Conditions, instance.Generation, instance.Status.Phase,
+		notReady, nil, reasonSyncFailed, degraded)
+	instance.Status.ObservedGeneration = instance.Generation
+	if equality.Semantic.DeepEqual(oldStatus, &instance.Status) {
+		return nil
+	}
+	return r.Status().Update(ctx, instance)
+}
+
+// topicOwner 返回在集群上使用同一topic名称的Topic中最先创建的一个，只有它会同步到broker，其他Topic标记为Degraded
+func (r *TopicReconciler) topicOwner(ctx context.Context, instance *rocketmqv1.Topic, cluster *rocketmqv1.DledgerBroker) (types.NamespacedName, error) {
+	list := &rocketmqv1.TopicList{}
+	if err := r.List(ctx, list); err != nil {
+		return types.NamespacedName{}, err
+	}
+	ref := types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}
+	var topics []rocketmqv1.Topic
+	for k := range list.Items {
+		topic := &list.Items[k]
+		if topic.ClusterRef() == ref && topic.TopicName() == instance.TopicName() &&
+			topic.DeletionTimestamp.IsZero() && cluster.AllowsNamespace(topic.Namespace) {
+			topics = append(topics, *topic)
+		}
+	}
+	if len(topics) == 0 {
+		// 缓存中还没有该实例
+		return types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name}, nil
+	}
+	sort.SliceStable(topics, func(a, b int) bool {
+		ta, tb := topics[a].CreationTimestamp, topics[b].CreationTimestamp
+		if !ta.Equal(&tb) {
+			return ta.Before(&tb)
+		}
+		if topics[a].Namespace != topics[b].Namespace {
+			return topics[a].Namespace < topics[b].Namespace
+		}
+		return topics[a].Name < topics[b].Name
+	})
+	return types.NamespacedName{Namespace: topics[0].Namespace, Name: topics[0].Name}, nil
+}
+
+// topicGroups 返回放置topic的broker组序号，以及BrokerGroups中不存在的broker组
+func topicGroups(instance *rocketmqv1.Topic, cluster *rocketmqv1.DledgerBroker) ([]int, []string) {
+	if len(instance.Spec.BrokerGroups) == 0 {
+		groups := make([]int, 0, cluster.Spec.BrokerGroupNumber)
+		for i := 0; i < cluster.Spec.BrokerGroupNumber; i++ {
+			groups = append(groups, i)
+		}
+		return groups, nil
+	}
+	var groups []int
+	var missing []string
+	seen := make(map[int]bool)
+	for _, i := range instance.Spec.BrokerGroups {
+		if seen[i] {
+			continue
+		}
+		seen[i] = true
+		if i < 0 || i >= cluster.Spec.BrokerGroupNumber {
+			missing = append(missing, fmt.Sprintf("broker group %d does not exist in cluster %s", i, instance.ClusterRef()))
+			continue
+		}
+		groups = append(groups, i)
+	}
+	sort.Ints(groups)
+	return groups, missing
+}
+
+// topicConfig 返回Spec对应的topic配置，未设置的字段使用mqadmin的默认值
+func topicConfig(instance *rocketmqv1.Topic) admin.TopicConfig {
+	config := admin.TopicConfig{
+		TopicName:      instance.TopicName(),
+		ReadQueueNums:  instance.Spec.ReadQueueNums,
+		WriteQueueNums: instance.Spec.WriteQueueNums,
+		Perm:           instance.Spec.Perm,
+		Order:          instance.Spec.Order,
+	}
+	if config.ReadQueueNums <= 0 {
+		config.ReadQueueNums = 8
+	}
+	if config.WriteQueueNums <= 0 {
+		config.WriteQueueNums = 8
+	}
+	if config.Perm == 0 {
+		config.Perm = 6
+	}
+	if instance.Spec.MessageType != "" {
+		config.Attributes = map[string]string{messageTypeAttribute: string(instance.Spec.MessageType)}
+	}
+	return config
+}
+
+// syncTopicGroup 在第i个broker组的master上创建或更新topic，返回该组的状态
+func (r *TopicReconciler) syncTopicGroup(ctx context.Context, instance *rocketmqv1.Topic, cluster *rocketmqv1.DledgerBroker, i int, info *admin.ClusterInfo) rocketmqv1.TopicGroupStatus {
+	status := rocketmqv1.TopicGroupStatus{BrokerName: brokerGroupName(cluster, i)}
+	addr, err := masterBrokerAddr(ctx, r.Client, cluster, i, info)
+	if err != nil {
+		status.State, status.Message = rocketmqv1.SyncStateFailed, err.Error()
+		return status
+	}
+	if addr == "" {
+		status.State, status.Message = rocketmqv1.SyncStatePending, "no master registered in nameserver"
+		return status
+	}
+
+	want := topicConfig(instance)
+	callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+	defer cancel()
+	configs, err := r.Admin.GetAllTopicConfig(callCtx, addr)
+	if err != nil {
+		status.State, status.Message = rocketmqv1.SyncStateFailed, fmt.Sprintf("get topic config: %v", err)
+		return status
+	}
+	current, ok := configs[want.TopicName]
+	if !ok || current.ReadQueueNums != want.ReadQueueNums || current.WriteQueueNums != want.WriteQueueNums ||
+		current.Perm != want.Perm || current.Order != want.Order || !containsAttributes(current.Attributes, want.Attributes) {
+		if err := r.Admin.CreateOrUpdateTopic(callCtx, addr, want); err != nil {
+			status.State, status.Message = rocketmqv1.SyncStateFailed, fmt.Sprintf("create or update topic: %v", err)
+			return status
+		}
+		r.Log.Infow("create or update topic", "topic", want.TopicName, "brokerName", status.BrokerName, "created", !ok,
+			"readQueueNums", want.ReadQueueNums, "writeQueueNums", want.WriteQueueNums, "perm", want.Perm, "order", want.Order, "attributes", want.Attributes)
+		current = want
+	}
+	status.State = rocketmqv1.SyncStateSynced
+	status.ReadQueueNums, status.WriteQueueNums, status.Perm = current.ReadQueueNums, current.WriteQueueNums, current.Perm
+	return status
+}
+
+// containsAttributes 判断broker上的topic属性是否包含want中的属性，broker自行添加的其他属性不视为偏差
+func containsAttributes(current, want map[string]string) bool {
+	for k, v := range want {
+		if current[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// removeStaleTopicGroups 处理上次调谐放置了topic但已不在放置范围内的broker组，topic改名时原名称的topic也按此处理。
+// DeletePolicy为Delete时从这些broker组删除topic，删除失败的组保留在状态中以便重试
+func (r *TopicReconciler) removeStaleTopicGroups(ctx context.Context, instance *rocketmqv1.Topic, cluster *rocketmqv1.DledgerBroker, info *admin.ClusterInfo, namesrvAddr string, statuses []rocketmqv1.TopicGroupStatus) []rocketmqv1.TopicGroupStatus {
+	renamed := instance.Status.TopicName != "" && instance.Status.TopicName != instance.TopicName()
+	current := make(map[string]bool, len(statuses))
+	for _, s := range statuses {
+		current[s.BrokerName] = true
+	}
+	var failed []rocketmqv1.TopicGroupStatus
+	for _, s := range instance.Status.BrokerGroups {
+		if current[s.BrokerName] && !renamed {
+			continue
+		}
+		if instance.Spec.DeletePolicy != rocketmqv1.DeletePolicyDelete {
+			r.Log.Infow("stop managing topic on broker group", "topic", instance.Status.TopicName, "brokerName", s.BrokerName)
+			continue
+		}
+		i, ok := brokerGroupIndex(cluster, s.BrokerName)
+		if !ok {
+			continue
+		}
+		addr, err := masterBrokerAddr(ctx, r.Client, cluster, i, info)
+		if err == nil && addr == "" {
+			err = errors2.New("no master registered in nameserver")
+		}
+		if err == nil {
+			callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+			err = r.Admin.DeleteTopicInBroker(callCtx, addr, instance.Status.TopicName)
+			cancel()
+		}
+		if err != nil {
+			if renamed {
+				// 新名称的topic已经放置到该组，无法在状态中同时记录两个topic，只记录警告
+				r.Log.Warnw("delete renamed topic failed", "topic", instance.Status.TopicName, "brokerName", s.BrokerName, "error", err)
+				continue
+			}
+			failed = append(failed, rocketmqv1.TopicGroupStatus{
+				BrokerName: s.BrokerName,
+				State:      rocketmqv1.SyncStateFailed,
+				Message:    fmt.Sprintf("delete topic removed from brokerGroups: %v", err),
+			})
+			continue
+		}
+		r.Log.Infow("delete topic from broker group", "topic", instance.Status.TopicName, "brokerName", s.BrokerName)
+	}
+	if renamed && instance.Spec.DeletePolicy == rocketmqv1.DeletePolicyDelete {
+		if err := deleteTopicInNamesrv(ctx, r.Admin, namesrvAddr, instance.Status.TopicName); err != nil {
+			r.Log.Warnw("delete renamed topic in nameserver failed", "topic", instance.Status.TopicName, "error", err)
+		}
+	}
+	return failed
+}
+
+// syncOrderConf 顺序topic在nameserver中记录各broker组的写队列数，与mqadmin updateTopic -o true一致；
+// 关闭顺序后删除该配置
+func (r *TopicReconciler) syncOrderConf(ctx context.Context, instance *rocketmqv1.Topic, namesrvAddr string) error {
+	var conf string
+	if instance.Spec.Order {
+		items := make([]string, 0, len(instance.Status.BrokerGroups))
+		for _, s := range instance.Status.BrokerGroups {
+			items = append(items, fmt.Sprintf("%s:%d", s.BrokerName, s.WriteQueueNums))
+		}
+		conf = strings.Join(items, ";")
+	}
+	if conf == instance.Status.OrderConf {
+		return nil
+	}
+	for _, addr := range splitNamesrvAddr(namesrvAddr) {
+		callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+		var err error
+		if conf != "" {
+			err = r.Admin.PutKVConfig(callCtx, addr, admin.OrderTopicConfigNamespace, instance.TopicName(), conf)
+		} else {
+			err = r.Admin.DeleteKVConfig(callCtx, addr, admin.OrderTopicConfigNamespace, instance.Status.TopicName)
+		}
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	r.Log.Infow("update order topic config", "topic", instance.TopicName(), "orderConf", conf)
+	instance.Status.OrderConf = conf
+	return nil
+}
+
+// cleanupTopic 删除Topic时清理broker和nameserver上的topic，失败时在Degraded状态中说明原因并重试。
+// 超过topicCleanupTimeout或设置了skip-cleanup注解时放弃清理，记录残留的topic。返回true表示可以移除finalizer
+func (r *TopicReconciler) cleanupTopic(ctx context.Context, instance *rocketmqv1.Topic) (bool, error) {
+	if instance.Annotations[annotationSkipCleanup] == "true" {
+		r.Log.Warnw("skip deleting topic, remove it from brokers and nameservers manually", "topic", instance.Status.TopicName,
+			"brokerGroups", topicBrokerNames(instance), "orderConf", instance.Status.OrderConf)
+		return true, nil
+	}
+	err := r.deleteTopic(ctx, instance)
+	if err == nil {
+		return true, nil
+	}
+	if time.Since(instance.DeletionTimestamp.Time) >= topicCleanupTimeout {
+		r.Log.Errorw("give up deleting topic, remove it from brokers and nameservers manually", "topic", instance.Status.TopicName,
+			"brokerGroups", topicBrokerNames(instance), "orderConf", instance.Status.OrderConf, "error", err)
+		return true, nil
+	}
+	r.Log.Warnw("delete topic failed", "topic", instance.Status.TopicName, "error", err)
+	oldStatus := instance.Status.DeepCopy()
+	setCondition(&instance.Status.Conditions, instance.Generation, rocketmqv1.ConditionDegraded, true, reasonCleanupFailed, reasonAvailable,
+		fmt.Sprintf("delete topic: %v, give up after %s or set annotation %s=true to remove it anyway", err, topicCleanupTimeout, annotationSkipCleanup))
+	if equality.Semantic.DeepEqual(oldStatus, &instance.Status) {
+		return false, nil
+	}
+	return false, r.Status().Update(ctx, instance)
+}
+
+// topicBrokerNames 返回上次调谐放置了topic的broker组
+func topicBrokerNames(instance *rocketmqv1.Topic) []string {
+	names := make([]string, 0, len(instance.Status.BrokerGroups))
+	for _, s := range instance.Status.BrokerGroups {
+		names = append(names, s.BrokerName)
+	}
+	return names
+}
+
+// deleteTopic 从所有放置了topic的broker组和nameserver删除topic。
+// 集群已删除时无需处理，broker组没有master时跳过该组，某个broker组删除失败时继续处理其他位置，返回的错误中列出残留topic的位置
+func (r *TopicReconciler) deleteTopic(ctx context.Context, instance *rocketmqv1.Topic) error {
+	if instance.Status.TopicName == "" {
+		return nil
+	}
+	cluster := &rocketmqv1.DledgerBroker{}
+	if err := r.Get(ctx, instance.ClusterRef(), cluster); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if msg := clusterNotAllowed(cluster, instance.Namespace); msg != "" {
+		r.Log.Warnw("skip deleting topic on cluster not allowed", "topic", instance.Status.TopicName, "reason", msg)
+		return nil
+	}
+	ctx, err := clusterAdminContext(ctx, r.Client, cluster)
+	if err != nil {
+		return err
+	}
+	namesrvAddr := brokerNamesrvAddr(cluster)
+	info, err := clusterInfo(ctx, r.Admin, namesrvAddr)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, s := range instance.Status.BrokerGroups {
+		i, ok := brokerGroupIndex(cluster, s.BrokerName)
+		if !ok {
+			continue
+		}
+		addr, err := masterBrokerAddr(ctx, r.Client, cluster, i, info)
+		if err == nil && addr == "" {
+			r.Log.Warnw("skip deleting topic on broker group without master", "topic", instance.Status.TopicName, "brokerName", s.BrokerName)
+			continue
+		}
+		if err == nil {
+			callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+			err = r.Admin.DeleteTopicInBroker(callCtx, addr, instance.Status.TopicName)
+			cancel()
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", s.BrokerName, err))
+		}
+	}
+	if err := deleteTopicInNamesrv(ctx, r.Admin, namesrvAddr, instance.Status.TopicName); err != nil {
+		failed = append(failed, fmt.Sprintf("nameserver: %v", err))
+	}
+	if instance.Status.OrderConf != "" {
+		for _, addr := range splitNamesrvAddr(namesrvAddr) {
+			callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+			err := r.Admin.DeleteKVConfig(callCtx, addr, admin.OrderTopicConfigNamespace, instance.Status.TopicName)
+			cancel()
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("order config on %s: %v", addr, err))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return errors2.Errorf("topic %s is left on %s", instance.Status.TopicName, strings.Join(failed, "; "))
+	}
+	r.Log.Infow("delete topic", "topic", instance.Status.TopicName)
+	return nil
+}
+
+// deleteTopicInNamesrv 从所有nameserver删除topic路由
+func deleteTopicInNamesrv(ctx context.Context, a admin.Admin, namesrvAddr, topic string) error {
+	for _, addr := range splitNamesrvAddr(namesrvAddr) {
+		callCtx, cancel := context.WithTimeout(ctx, brokerInfoTimeout)
+		err := a.DeleteTopicInNamesrv(callCtx, addr, topic)
+		cancel()
+		if err != nil {
+			return errors2.Wrapf(err, "delete topic in nameserver %s", addr)
+		}
+	}
+	return nil
+}
+
+// clusterNotAllowed 返回集群不允许namespace中的资源引用时的原因，允许时为空
+func clusterNotAllowed(cluster *rocketmqv1.DledgerBroker, namespace string) string {
+	if cluster.AllowsNamespace(namespace) {
+		return ""
+	}
+	return fmt.Sprintf("namespace %s is not in allowedNamespaces of cluster %s/%s", namespace, cluster.Namespace, cluster.Name)
+}
+
+// splitNamesrvAddr 拆分以;分隔的namesrvAddr
+func splitNamesrvAddr(namesrvAddr string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(namesrvAddr, ";") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// brokerGroupIndex 根据brokerName返回broker组序号
+func brokerGroupIndex(instance *rocketmqv1.DledgerBroker, brokerName string) (int, bool) {
+	for i := 0; i < instance.Spec.BrokerGroupNumber; i++ {
+		if brokerGroupName(instance, i) == brokerName {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// masterBrokerAddr 返回第i个broker组master通过headless service访问的地址，避免operator无法访问broker注册的外部地址。
+// 没有master时返回空，master不是该实例的pod时返回其注册的地址
+func masterBrokerAddr(ctx context.Context, c client.Reader, instance *rocketmqv1.DledgerBroker, i int, info *admin.ClusterInfo) (string, error) {
+	broker := info.BrokerAddrTable[brokerGroupName(instance, i)]
+	master := broker.MasterAddr()
+	if master == "" {
+		return "", nil
+	}
+	pods := &corev1.PodList{}
+	if err := c.List(ctx, pods, client.InNamespace(instance.Namespace),
+		client.MatchingLabels(brokerGroupLabels(instance, i))); err != nil {
+		return "", err
+	}
+	for k := range pods.Items {
+		_, advertised, err := brokerEndpoint(ctx, c, instance, &pods.Items[k])
+		if err != nil {
+			return "", err
+		}
+		if advertised == master {
+			return brokerAddr(ctx, c, instance, i, podOrdinal(&pods.Items[k]))
+		}
+	}
+	return master, nil
+}
+
+// topicsForCluster 返回引用了该DledgerBroker的所有Topic，集群变化(如扩容broker组、master切换)时重新同步
+func (r *TopicReconciler) topicsForCluster(obj client.Object) []reconcile.Request {
+	topics := &rocketmqv1.TopicList{}
+	if err := r.List(context.Background(), topics); err != nil {
+		log.Errorw("list topics failed", "error", err)
+		return nil
+	}
+	cluster := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	var requests []reconcile.Request
+	for k := range topics.Items {
+		topic := &topics.Items[k]
+		if topic.ClusterRef() != cluster {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Namespace: topic.Namespace,
+			Name:      topic.Name,
+		}})
+	}
+	return requests
+}
+
+// topicsForTopic 返回与该Topic在同一集群上使用同一topic名称的其他Topic，先创建的Topic删除或改名后冲突可能解除
+func (r *TopicReconciler) topicsForTopic(obj client.Object) []reconcile.Request {
+	topic, ok := obj.(*rocketmqv1.Topic)
+	if !ok {
+		return nil
+	}
+	cluster := topic.ClusterRef()
+	var requests []reconcile.Request
+	for _, req := range r.topicsForCluster(&rocketmqv1.DledgerBroker{ObjectMeta: metav1.ObjectMeta{Namespace: cluster.Namespace, Name: cluster.Name}}) {
+		if req.Namespace != topic.Namespace || req.Name != topic.Name {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+func (r *TopicReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&rocketmqv1.Topic{}).
+		Watches(&source.Kind{Type: &rocketmqv1.DledgerBroker{}}, handler.EnqueueRequestsFromMapFunc(r.topicsForCluster)).
+		Watches(&source.Kind{Type: &rocketmqv1.Topic{}}, handler.EnqueueRequestsFromMapFunc(r.topicsForTopic),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
@@ -0,0 +1,521 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	rocketmqv1 "rocketmq-operator-v2/api/v1"
+	"rocketmq-operator-v2/pkg/admin"
+	"rocketmq-operator-v2/pkg/configs"
+	"rocketmq-operator-v2/pkg/logi"
+)
+
+// testTopicCluster 返回有groups个broker组的集群，以及各组第0个节点为master的路由信息
+func testTopicCluster(groups int) (*rocketmqv1.DledgerBroker, []corev1.Pod, *admin.ClusterInfo) {
+	instance := testBrokerInstance()
+	instance.Spec.BrokerGroupNumber = groups
+	instance.Spec.Config = map[string]string{configs.NamesrvAddr: "ns-0:9876;ns-1:9876"}
+	info := &admin.ClusterInfo{BrokerAddrTable: make(map[string]admin.BrokerData)}
+	var pods []corev1.Pod
+	for i := 0; i < groups; i++ {
+		pods = append(pods, testBrokerPod(instance, i, 0, true))
+		name := brokerGroupName(instance, i)
+		info.BrokerAddrTable[name] = admin.BrokerData{BrokerName: name, BrokerAddrs: map[string]string{
+			admin.MasterId: fmt.Sprintf("10.0.%d.0:%d", i, brokerPortMain),
+		}}
+	}
+	return instance, pods, info
+}
+
+// testMasterAddr 返回testTopicCluster中第i个broker组master通过headless service访问的地址
+func testMasterAddr(instance *rocketmqv1.DledgerBroker, i int) string {
+	return fmt.Sprintf("%s:%d", brokerPodFQDN(instance, i, 0), brokerPortMain)
+}
+
+func testTopic(namespace, name string, created time.Time, spec rocketmqv1.TopicSpec) *rocketmqv1.Topic {
+	return &rocketmqv1.Topic{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, CreationTimestamp: metav1.NewTime(created)},
+		Spec:       spec,
+	}
+}
+
+func TestTopicGroups(t *testing.T) {
+	cluster := testBrokerInstance()
+	cluster.Spec.BrokerGroupNumber = 3
+	tests := []struct {
+		name        string
+		groups      []int
+		want        []int
+		wantMissing int
+	}{
+		{name: "all groups by default", want: []int{0, 1, 2}},
+		{name: "sorted and deduplicated", groups: []int{2, 0, 2}, want: []int{0, 2}},
+		{name: "missing groups reported", groups: []int{1, 3, -1}, want: []int{1}, wantMissing: 2},
+		{name: "no existing group", groups: []int{5}, wantMissing: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topic := &rocketmqv1.Topic{Spec: rocketmqv1.TopicSpec{Cluster: "demo", BrokerGroups: tt.groups}}
+			got, missing := topicGroups(topic, cluster)
+			if !reflect.DeepEqual(got, tt.want) || len(missing) != tt.wantMissing {
+				t.Errorf("topicGroups() = %v, %v, want %v and %d missing", got, missing, tt.want, tt.wantMissing)
+			}
+		})
+	}
+}
+
+func TestMasterBrokerAddr(t *testing.T) {
+	instance, pods, _ := testTopicCluster(1)
+	registered := func(master string) *admin.ClusterInfo {
+		return &admin.ClusterInfo{BrokerAddrTable: map[string]admin.BrokerData{
+			"demo-broker-0": {BrokerName: "demo-broker-0", BrokerAddrs: map[string]string{admin.MasterId: master}},
+		}}
+	}
+	second := testBrokerPod(instance, 0, 1, true)
+
+	external := instance.DeepCopy()
+	external.Spec.ExternalAccess = &rocketmqv1.ExternalAccess{Type: corev1.ServiceTypeNodePort}
+	nodePortPod := second.DeepCopy()
+	nodePortPod.Status.HostIP = "192.168.1.10"
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "mq", Name: brokerExternalServiceName(nodePortPod.Name)},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+			{Name: "main", Port: 31002, TargetPort: intstr.FromInt(31002), NodePort: 31002},
+		}},
+	}
+
+	tests := []struct {
+		name     string
+		instance *rocketmqv1.DledgerBroker
+		objs     []corev1.Pod
+		info     *admin.ClusterInfo
+		want     string
+	}{
+		{
+			name:     "no master registered",
+			instance: instance,
+			objs:     []corev1.Pod{pods[0], second},
+			info:     &admin.ClusterInfo{},
+		},
+		{
+			name:     "master pod by pod ip",
+			instance: instance,
+			objs:     []corev1.Pod{pods[0], second},
+			info:     registered(fmt.Sprintf("10.0.0.1:%d", brokerPortMain)),
+			want:     fmt.Sprintf("%s:%d", brokerPodFQDN(instance, 0, 1), brokerPortMain),
+		},
+		{
+			name:     "master pod by node port",
+			instance: external,
+			objs:     []corev1.Pod{pods[0], *nodePortPod},
+			info:     registered("192.168.1.10:31002"),
+			want:     fmt.Sprintf("%s:31002", brokerPodFQDN(instance, 0, 1)),
+		},
+		{
+			name:     "master outside the instance",
+			instance: instance,
+			objs:     []corev1.Pod{pods[0], second},
+			info:     registered("172.16.0.9:10911"),
+			want:     "172.16.0.9:10911",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeClient(svc, &tt.objs[0], &tt.objs[1])
+			got, err := masterBrokerAddr(context.Background(), c, tt.instance, 0, tt.info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("masterBrokerAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncTopicGroup(t *testing.T) {
+	cluster, pods, info := testTopicCluster(1)
+	addr := testMasterAddr(cluster, 0)
+	spec := rocketmqv1.TopicSpec{Cluster: "demo", ReadQueueNums: 8, WriteQueueNums: 8, Perm: 6, MessageType: rocketmqv1.TopicMessageTypeFIFO}
+	synced := admin.TopicConfig{TopicName: "orders", ReadQueueNums: 8, WriteQueueNums: 8, Perm: 6,
+		Attributes: map[string]string{messageTypeAttribute: "FIFO", "queue.type": "SimpleCQ"}}
+	tests := []struct {
+		name    string
+		current map[string]admin.TopicConfig
+		want    admin.TopicConfig
+	}{
+		{
+			name:    "create missing topic",
+			current: map[string]admin.TopicConfig{},
+			want:    topicConfig(testTopic("mq", "orders", time.Time{}, spec)),
+		},
+		{
+			name:    "keep synced topic with broker attributes",
+			current: map[string]admin.TopicConfig{"orders": synced},
+			want:    synced,
+		},
+		{
+			name: "update queue numbers",
+			current: map[string]admin.TopicConfig{"orders": {TopicName: "orders", ReadQueueNums: 4, WriteQueueNums: 4, Perm: 6,
+				Attributes: map[string]string{messageTypeAttribute: "FIFO"}}},
+			want: topicConfig(testTopic("mq", "orders", time.Time{}, spec)),
+		},
+		{
+			name: "update message type",
+			current: map[string]admin.TopicConfig{"orders": {TopicName: "orders", ReadQueueNums: 8, WriteQueueNums: 8, Perm: 6,
+				Attributes: map[string]string{messageTypeAttribute: "NORMAL"}}},
+			want: topicConfig(testTopic("mq", "orders", time.Time{}, spec)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &fakeAdmin{topicConfigs: map[string]map[string]admin.TopicConfig{addr: tt.current}}
+			r := &TopicReconciler{Client: newFakeClient(&pods[0]), Admin: a, Log: logi.GetSugaredLogger()}
+			status := r.syncTopicGroup(context.Background(), testTopic("mq", "orders", time.Time{}, spec), cluster, 0, info)
+			if status.State != rocketmqv1.SyncStateSynced {
+				t.Fatalf("syncTopicGroup() = %+v, want synced", status)
+			}
+			if got := a.topicConfigs[addr]["orders"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("topic config = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveStaleTopicGroups(t *testing.T) {
+	cluster, pods, info := testTopicCluster(2)
+	addr0, addr1 := testMasterAddr(cluster, 0), testMasterAddr(cluster, 1)
+	group := func(i int) rocketmqv1.TopicGroupStatus {
+		return rocketmqv1.TopicGroupStatus{BrokerName: brokerGroupName(cluster, i), State: rocketmqv1.SyncStateSynced}
+	}
+	topics := func(names ...string) map[string]admin.TopicConfig {
+		m := make(map[string]admin.TopicConfig)
+		for _, name := range names {
+			m[name] = admin.TopicConfig{TopicName: name}
+		}
+		return m
+	}
+	tests := []struct {
+		name        string
+		topicName   string
+		policy      rocketmqv1.DeletePolicy
+		brokers     map[string]map[string]admin.TopicConfig
+		wantBrokers map[string]map[string]admin.TopicConfig
+		wantNamesrv []string
+		wantFailed  []string
+	}{
+		{
+			name:        "delete topic from removed group",
+			topicName:   "orders",
+			policy:      rocketmqv1.DeletePolicyDelete,
+			brokers:     map[string]map[string]admin.TopicConfig{addr0: topics("orders"), addr1: topics("orders")},
+			wantBrokers: map[string]map[string]admin.TopicConfig{addr0: topics("orders"), addr1: topics()},
+		},
+		{
+			name:        "retain topic on removed group",
+			topicName:   "orders",
+			policy:      rocketmqv1.DeletePolicyRetain,
+			brokers:     map[string]map[string]admin.TopicConfig{addr0: topics("orders"), addr1: topics("orders")},
+			wantBrokers: map[string]map[string]admin.TopicConfig{addr0: topics("orders"), addr1: topics("orders")},
+		},
+		{
+			name:        "keep failed group in status",
+			topicName:   "orders",
+			policy:      rocketmqv1.DeletePolicyDelete,
+			brokers:     map[string]map[string]admin.TopicConfig{addr0: topics("orders")},
+			wantBrokers: map[string]map[string]admin.TopicConfig{addr0: topics("orders")},
+			wantFailed:  []string{"demo-broker-1"},
+		},
+		{
+			name:        "delete old name after rename",
+			topicName:   "payments",
+			policy:      rocketmqv1.DeletePolicyDelete,
+			brokers:     map[string]map[string]admin.TopicConfig{addr0: topics("orders", "payments"), addr1: topics("orders")},
+			wantBrokers: map[string]map[string]admin.TopicConfig{addr0: topics("payments"), addr1: topics()},
+			wantNamesrv: []string{"ns-0:9876 orders", "ns-1:9876 orders"},
+		},
+		{
+			name:        "rename failure is not kept in status",
+			topicName:   "payments",
+			policy:      rocketmqv1.DeletePolicyDelete,
+			brokers:     map[string]map[string]admin.TopicConfig{addr0: topics("orders", "payments")},
+			wantBrokers: map[string]map[string]admin.TopicConfig{addr0: topics("payments")},
+			wantNamesrv: []string{"ns-0:9876 orders", "ns-1:9876 orders"},
+		},
+		{
+			name:        "retain old name after rename",
+			topicName:   "payments",
+			policy:      rocketmqv1.DeletePolicyRetain,
+			brokers:     map[string]map[string]admin.TopicConfig{addr0: topics("orders", "payments"), addr1: topics("orders")},
+			wantBrokers: map[string]map[string]admin.TopicConfig{addr0: topics("orders", "payments"), addr1: topics("orders")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topic := testTopic("mq", "orders", time.Time{}, rocketmqv1.TopicSpec{Cluster: "demo", TopicName: tt.topicName, DeletePolicy: tt.policy})
+			topic.Status.TopicName = "orders"
+			topic.Status.BrokerGroups = []rocketmqv1.TopicGroupStatus{group(0), group(1)}
+			a := &fakeAdmin{topicConfigs: tt.brokers}
+			r := &TopicReconciler{Client: newFakeClient(&pods[0], &pods[1]), Admin: a, Log: logi.GetSugaredLogger()}
+			failed := r.removeStaleTopicGroups(context.Background(), topic, cluster, info, brokerNamesrvAddr(cluster),
+				[]rocketmqv1.TopicGroupStatus{group(0)})
+			var gotFailed []string
+			for _, s := range failed {
+				if s.State != rocketmqv1.SyncStateFailed {
+					t.Errorf("failed group %s state = %s", s.BrokerName, s.State)
+				}
+				gotFailed = append(gotFailed, s.BrokerName)
+			}
+			if !reflect.DeepEqual(gotFailed, tt.wantFailed) {
+				t.Errorf("failed groups = %v, want %v", gotFailed, tt.wantFailed)
+			}
+			if !reflect.DeepEqual(a.topicConfigs, tt.wantBrokers) {
+				t.Errorf("broker topics = %v, want %v", a.topicConfigs, tt.wantBrokers)
+			}
+			if !reflect.DeepEqual(a.namesrvDeleted, tt.wantNamesrv) {
+				t.Errorf("deleted in nameserver = %v, want %v", a.namesrvDeleted, tt.wantNamesrv)
+			}
+		})
+	}
+}
+
+func TestSyncOrderConf(t *testing.T) {
+	groups := []rocketmqv1.TopicGroupStatus{
+		{BrokerName: "demo-broker-0", WriteQueueNums: 8},
+		{BrokerName: "demo-broker-1", WriteQueueNums: 4},
+	}
+	key := admin.OrderTopicConfigNamespace + "/orders"
+	tests := []struct {
+		name      string
+		order     bool
+		orderConf string
+		kv        map[string]map[string]string
+		want      map[string]map[string]string
+	}{
+		{
+			name:  "put order config on every nameserver",
+			order: true,
+			want: map[string]map[string]string{
+				"ns-0:9876": {key: "demo-broker-0:8;demo-broker-1:4"},
+				"ns-1:9876": {key: "demo-broker-0:8;demo-broker-1:4"},
+			},
+		},
+		{
+			name:      "unchanged order config is not written",
+			order:     true,
+			orderConf: "demo-broker-0:8;demo-broker-1:4",
+		},
+		{
+			name:      "delete order config when order is disabled",
+			orderConf: "demo-broker-0:8",
+			kv: map[string]map[string]string{
+				"ns-0:9876": {key: "demo-broker-0:8"},
+				"ns-1:9876": {key: "demo-broker-0:8"},
+			},
+			want: map[string]map[string]string{"ns-0:9876": {}, "ns-1:9876": {}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topic := testTopic("mq", "orders", time.Time{}, rocketmqv1.TopicSpec{Cluster: "demo", Order: tt.order})
+			topic.Status.TopicName = "orders"
+			topic.Status.BrokerGroups = groups
+			topic.Status.OrderConf = tt.orderConf
+			a := &fakeAdmin{kvConfigs: tt.kv}
+			r := &TopicReconciler{Admin: a, Log: logi.GetSugaredLogger()}
+			if err := r.syncOrderConf(context.Background(), topic, "ns-0:9876;ns-1:9876"); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(a.kvConfigs, tt.want) {
+				t.Errorf("kv configs = %v, want %v", a.kvConfigs, tt.want)
+			}
+			if want := map[bool]string{true: "demo-broker-0:8;demo-broker-1:4"}[tt.order]; topic.Status.OrderConf != want {
+				t.Errorf("orderConf = %q, want %q", topic.Status.OrderConf, want)
+			}
+		})
+	}
+}
+
+func TestTopicReconcileOwnership(t *testing.T) {
+	cluster, pods, info := testTopicCluster(1)
+	now := time.Now()
+	spec := rocketmqv1.TopicSpec{Cluster: "mq/demo", TopicName: "orders"}
+	tests := []struct {
+		name         string
+		allowed      []string
+		topics       []*rocketmqv1.Topic
+		reconcile    types.NamespacedName
+		wantDegraded bool
+		wantSynced   bool
+	}{
+		{
+			name:       "first topic is synced",
+			topics:     []*rocketmqv1.Topic{testTopic("mq", "a", now, spec), testTopic("mq", "b", now.Add(time.Minute), spec)},
+			reconcile:  types.NamespacedName{Namespace: "mq", Name: "a"},
+			wantSynced: true,
+		},
+		{
+			name:         "newer topic with the same name is degraded",
+			topics:       []*rocketmqv1.Topic{testTopic("mq", "a", now, spec), testTopic("mq", "b", now.Add(time.Minute), spec)},
+			reconcile:    types.NamespacedName{Namespace: "mq", Name: "b"},
+			wantDegraded: true,
+		},
+		{
+			name:         "namespace not allowed",
+			topics:       []*rocketmqv1.Topic{testTopic("apps", "a", now, spec)},
+			reconcile:    types.NamespacedName{Namespace: "apps", Name: "a"},
+			wantDegraded: true,
+		},
+		{
+			name:       "allowed namespace",
+			allowed:    []string{"apps"},
+			topics:     []*rocketmqv1.Topic{testTopic("apps", "a", now, spec)},
+			reconcile:  types.NamespacedName{Namespace: "apps", Name: "a"},
+			wantSynced: true,
+		},
+		{
+			name:       "topic from a namespace not allowed does not block",
+			topics:     []*rocketmqv1.Topic{testTopic("apps", "a", now, spec), testTopic("mq", "b", now.Add(time.Minute), spec)},
+			reconcile:  types.NamespacedName{Namespace: "mq", Name: "b"},
+			wantSynced: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := cluster.DeepCopy()
+			cluster.Spec.AllowedNamespaces = tt.allowed
+			c := newFakeClient(cluster, &pods[0])
+			for _, topic := range tt.topics {
+				if err := c.Create(context.Background(), topic.DeepCopy()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			addr := testMasterAddr(cluster, 0)
+			a := &fakeAdmin{cluster: info, topicConfigs: map[string]map[string]admin.TopicConfig{addr: {}}}
+			r := &TopicReconciler{Client: c, Admin: a, Scheme: testScheme()}
+			if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: tt.reconcile}); err != nil {
+				t.Fatal(err)
+			}
+			topic := &rocketmqv1.Topic{}
+			if err := c.Get(context.Background(), tt.reconcile, topic); err != nil {
+				t.Fatal(err)
+			}
+			if got := meta.IsStatusConditionTrue(topic.Status.Conditions, rocketmqv1.ConditionDegraded); got != tt.wantDegraded {
+				t.Errorf("Degraded = %v, want %v, conditions %+v", got, tt.wantDegraded, topic.Status.Conditions)
+			}
+			if _, got := a.topicConfigs[addr]["orders"]; got != tt.wantSynced {
+				t.Errorf("topic created = %v, want %v", got, tt.wantSynced)
+			}
+		})
+	}
+}
+
+func TestDeleteTopicNamespaceNotAllowed(t *testing.T) {
+	cluster, pods, info := testTopicCluster(1)
+	addr := testMasterAddr(cluster, 0)
+	topic := testTopic("apps", "orders", time.Time{}, rocketmqv1.TopicSpec{Cluster: "mq/demo", DeletePolicy: rocketmqv1.DeletePolicyDelete})
+	topic.Status.TopicName = "orders"
+	topic.Status.BrokerGroups = []rocketmqv1.TopicGroupStatus{{BrokerName: "demo-broker-0"}}
+	a := &fakeAdmin{cluster: info, topicConfigs: map[string]map[string]admin.TopicConfig{addr: {"orders": {TopicName: "orders"}}}}
+	r := &TopicReconciler{Client: newFakeClient(cluster, &pods[0]), Admin: a, Log: logi.GetSugaredLogger()}
+	if err := r.deleteTopic(context.Background(), topic); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.topicConfigs[addr]["orders"]; !ok || len(a.namesrvDeleted) > 0 {
+		t.Errorf("topic of a namespace not allowed was deleted: %v, %v", a.topicConfigs, a.namesrvDeleted)
+	}
+
+	cluster.Spec.AllowedNamespaces = []string{"*"}
+	r.Client = newFakeClient(cluster, &pods[0])
+	if err := r.deleteTopic(context.Background(), topic); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.topicConfigs[addr]["orders"]; ok {
+		t.Errorf("topic of an allowed namespace was not deleted: %v", a.topicConfigs)
+	}
+}
+
+func TestCleanupTopic(t *testing.T) {
+	tests := []struct {
+		name        string
+		deleted     time.Duration
+		skip        bool
+		reachable   []int
+		wantDone    bool
+		wantDeleted []int
+		wantReason  string
+	}{
+		{name: "all groups deleted", deleted: time.Minute, reachable: []int{0, 1}, wantDone: true, wantDeleted: []int{0, 1}},
+		{
+			name:        "retry while a group is unreachable",
+			deleted:     time.Minute,
+			reachable:   []int{1},
+			wantDeleted: []int{1},
+			wantReason:  reasonCleanupFailed,
+		},
+		{name: "give up after timeout", deleted: topicCleanupTimeout, reachable: []int{1}, wantDone: true, wantDeleted: []int{1}},
+		{name: "skip cleanup", deleted: time.Minute, skip: true, reachable: []int{0, 1}, wantDone: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster, pods, info := testTopicCluster(2)
+			cluster.Spec.AllowedNamespaces = []string{"*"}
+			topic := testTopic("apps", "orders", time.Time{}, rocketmqv1.TopicSpec{Cluster: "mq/demo", DeletePolicy: rocketmqv1.DeletePolicyDelete})
+			deletion := metav1.NewTime(time.Now().Add(-tt.deleted))
+			topic.DeletionTimestamp = &deletion
+			if tt.skip {
+				topic.Annotations = map[string]string{annotationSkipCleanup: "true"}
+			}
+			topic.Status.TopicName = "orders"
+			topic.Status.BrokerGroups = []rocketmqv1.TopicGroupStatus{{BrokerName: "demo-broker-0"}, {BrokerName: "demo-broker-1"}}
+			a := &fakeAdmin{cluster: info, topicConfigs: make(map[string]map[string]admin.TopicConfig)}
+			for _, i := range tt.reachable {
+				a.topicConfigs[testMasterAddr(cluster, i)] = map[string]admin.TopicConfig{"orders": {TopicName: "orders"}}
+			}
+			r := &TopicReconciler{Client: newFakeClient(cluster, &pods[0], &pods[1], topic), Admin: a, Log: logi.GetSugaredLogger()}
+			done, err := r.cleanupTopic(context.Background(), topic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if done != tt.wantDone {
+				t.Errorf("cleanupTopic() = %v, want %v", done, tt.wantDone)
+			}
+			var deleted []int
+			for i := 0; i < 2; i++ {
+				configs, ok := a.topicConfigs[testMasterAddr(cluster, i)]
+				if _, left := configs["orders"]; ok && !left {
+					deleted = append(deleted, i)
+				}
+			}
+			if !reflect.DeepEqual(deleted, tt.wantDeleted) {
+				t.Errorf("deleted from groups %v, want %v", deleted, tt.wantDeleted)
+			}
+			c := meta.FindStatusCondition(topic.Status.Conditions, rocketmqv1.ConditionDegraded)
+			if tt.wantReason == "" {
+				if c != nil {
+					t.Errorf("Degraded = %+v, want unset", c)
+				}
+				return
+			}
+			if c == nil || c.Reason != tt.wantReason || c.Status != metav1.ConditionTrue {
+				t.Fatalf("Degraded = %+v, want reason %s", c, tt.wantReason)
+			}
+			for _, want := range []string{"demo-broker-0", annotationSkipCleanup} {
+				if !strings.Contains(c.Message, want) {
+					t.Errorf("Degraded message %q does not mention %s", c.Message, want)
+				}
+			}
+		})
+	}
+}
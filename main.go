@@ -21,11 +21,14 @@ import (
 	"fmt"
 	"os"
 	"rocketmq-operator-v2/pkg/logi"
+	"time"
 
 	"github.com/open-policy-agent/cert-controller/pkg/rotator"
 	"k8s.io/apimachinery/pkg/types"
 
+	"rocketmq-operator-v2/pkg/admin"
 	"rocketmq-operator-v2/pkg/controller/common"
+	"rocketmq-operator-v2/pkg/remoting"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -73,12 +76,15 @@ func main() {
 	var enableLeaderElection bool
 	var disableCertRotation bool
 	var certDir string
+	var statusSyncInterval time.Duration
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.StringVar(&certDir, "cert-dir", "/certs", "The directory where certs are stored, defaults to /certs")
 	flag.BoolVar(&disableCertRotation, "disable-cert-rotation", false, "disable automatic generation and rotation of webhook TLS certificates/keys")
+	flag.DurationVar(&statusSyncInterval, "status-sync-interval", 30*time.Second,
+		"The interval to refresh broker topology in DledgerBroker status and resync Topic and ConsumerGroup configs and consume lag, 0 disables periodic refresh.")
 	flag.Parse()
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
@@ -93,6 +99,8 @@ func main() {
 		os.Exit(1)
 	}
 
+	rocketmqAdmin := admin.NewAdmin(remoting.NewClient(remoting.Config{RPCHook: remoting.AclHook}))
+
 	setupFinished := make(chan struct{})
 	if !disableCertRotation {
 		setupLog.Info("setting up cert rotation")
@@ -120,8 +128,10 @@ func main() {
 		<-setupFinished
 
 		if err = (&controllers.DledgerBrokerReconciler{
-			Client: mgr.GetClient(),
-			Scheme: mgr.GetScheme(),
+			Client:             mgr.GetClient(),
+			Scheme:             mgr.GetScheme(),
+			Admin:              rocketmqAdmin,
+			StatusSyncInterval: statusSyncInterval,
 		}).SetupWithManager(mgr); err != nil {
 			setupLog.Error(err, "unable to create controller", "controller", "DledgerBroker")
 			os.Exit(1)
@@ -133,6 +143,31 @@ func main() {
 			setupLog.Error(err, "unable to create controller", "controller", "Nameserver")
 			os.Exit(1)
 		}
+		if err = (&controllers.TopicReconciler{
+			Client:       mgr.GetClient(),
+			Scheme:       mgr.GetScheme(),
+			Admin:        rocketmqAdmin,
+			SyncInterval: statusSyncInterval,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Topic")
+			os.Exit(1)
+		}
+		if err = (&controllers.ConsumerGroupReconciler{
+			Client:       mgr.GetClient(),
+			Scheme:       mgr.GetScheme(),
+			Admin:        rocketmqAdmin,
+			SyncInterval: statusSyncInterval,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ConsumerGroup")
+			os.Exit(1)
+		}
+		if err = (&controllers.RocketMQUserReconciler{
+			Client: mgr.GetClient(),
+			Scheme: mgr.GetScheme(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "RocketMQUser")
+			os.Exit(1)
+		}
 
 		if certDir != "" {
 			if err = (&rocketmqv1.DledgerBroker{}).SetupWebhookWithManager(mgr); err != nil {
@@ -143,6 +178,10 @@ func main() {
 				setupLog.Error(err, "unable to create webhook", "webhook", "Nameserver")
 				os.Exit(1)
 			}
+			if err = (&rocketmqv1.RocketMQUser{}).SetupWebhookWithManager(mgr); err != nil {
+				setupLog.Error(err, "unable to create webhook", "webhook", "RocketMQUser")
+				os.Exit(1)
+			}
 		}
 	}()
 	// +kubebuilder:scaffold:builder
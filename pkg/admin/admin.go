@@ -0,0 +1,375 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	errors2 "github.com/pkg/errors"
+
+	"rocketmq-operator-v2/pkg/remoting"
+)
+
+// MasterId brokerAddrs中master的brokerId，dledger模式下即为leader
+const MasterId = "0"
+
+// Admin 通过remoting协议访问nameserver和broker，接口便于在控制器测试中替换
+type Admin interface {
+	// GetClusterInfo 从nameserver获取集群和broker注册信息
+	GetClusterInfo(ctx context.Context, namesrvAddr string) (*ClusterInfo, error)
+	// GetTopicRouteData 从nameserver获取topic路由
+	GetTopicRouteData(ctx context.Context, namesrvAddr, topic string) (*TopicRouteData, error)
+	// GetBrokerRuntimeInfo 获取broker运行时统计
+	GetBrokerRuntimeInfo(ctx context.Context, brokerAddr string) (*BrokerRuntimeInfo, error)
+	// GetBrokerConfig 获取broker当前生效的配置
+	GetBrokerConfig(ctx context.Context, brokerAddr string) (map[string]string, error)
+	// UpdateBrokerConfig 在线更新broker配置，broker会同时持久化到配置文件
+	UpdateBrokerConfig(ctx context.Context, brokerAddr string, properties map[string]string) error
+	// GetConsumeStats 获取消费组在broker上的消费进度，topic为空时返回所有订阅的topic
+	GetConsumeStats(ctx context.Context, brokerAddr, group, topic string) (*ConsumeStats, error)
+	// GetBrokerConsumeStats 获取broker上所有消费组的消费进度
+	GetBrokerConsumeStats(ctx context.Context, brokerAddr string) (*BrokerConsumeStats, error)
+	// GetDledgerMetadata 获取dledger节点所在组的leader和term，addr为节点的dledger地址，selfId为该节点的id
+	GetDledgerMetadata(ctx context.Context, addr, group, selfId string) (*DledgerMetadata, error)
+	// TransferLeadership 将dledger组的leadership从leaderId转移到targetId，leaderAddr为leader的dledger地址
+	TransferLeadership(ctx context.Context, leaderAddr, group, leaderId, targetId string) error
+	// GetAllTopicList 从nameserver获取所有topic名称
+	GetAllTopicList(ctx context.Context, namesrvAddr string) ([]string, error)
+	// GetAllTopicConfig 获取broker上的所有topic配置，key为topic名称
+	GetAllTopicConfig(ctx context.Context, brokerAddr string) (map[string]TopicConfig, error)
+	// CreateOrUpdateTopic 在broker上创建或更新topic，broker随后会向nameserver注册新的路由
+	CreateOrUpdateTopic(ctx context.Context, brokerAddr string, config TopicConfig) error
+	// DeleteTopicInBroker 删除broker上的topic
+	DeleteTopicInBroker(ctx context.Context, brokerAddr, topic string) error
+	// DeleteTopicInNamesrv 删除nameserver上的topic路由
+	DeleteTopicInNamesrv(ctx context.Context, namesrvAddr, topic string) error
+	// PutKVConfig 写入nameserver的kv配置
+	PutKVConfig(ctx context.Context, namesrvAddr, namespace, key, value string) error
+	// DeleteKVConfig 删除nameserver的kv配置
+	DeleteKVConfig(ctx context.Context, namesrvAddr, namespace, key string) error
+	// GetAllSubscriptionGroupConfig 获取broker上的所有消费组配置，key为消费组名称
+	GetAllSubscriptionGroupConfig(ctx context.Context, brokerAddr string) (map[string]SubscriptionGroupConfig, error)
+	// CreateOrUpdateSubscriptionGroup 在broker上创建或更新消费组配置
+	CreateOrUpdateSubscriptionGroup(ctx context.Context, brokerAddr string, config SubscriptionGroupConfig) error
+	// DeleteSubscriptionGroup 删除broker上的消费组配置
+	DeleteSubscriptionGroup(ctx context.Context, brokerAddr, group string) error
+	// GetConsumerConnectionList 获取消费组在broker上的在线客户端，没有在线客户端时返回ConsumerNotOnline错误
+	GetConsumerConnectionList(ctx context.Context, brokerAddr, group string) (*ConsumerConnection, error)
+}
+
+// ResponseError nameserver或broker返回的非成功响应
+type ResponseError struct {
+	Code   int
+	Remark string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("rocketmq response code %d: %s", e.Code, e.Remark)
+}
+
+// IsTopicNotExist 判断错误是否为topic不存在
+func IsTopicNotExist(err error) bool {
+	return responseCode(err) == remoting.TopicNotExist
+}
+
+// IsSubscriptionGroupNotExist 判断错误是否为消费组不存在
+func IsSubscriptionGroupNotExist(err error) bool {
+	return responseCode(err) == remoting.SubscriptionGroupNotExist
+}
+
+func responseCode(err error) int {
+	var e *ResponseError
+	if errors2.As(err, &e) {
+		return e.Code
+	}
+	return -1
+}
+
+// ClusterInfo 对应rocketmq的ClusterInfo
+type ClusterInfo struct {
+	BrokerAddrTable  map[string]BrokerData `json:"brokerAddrTable"`
+	ClusterAddrTable map[string][]string   `json:"clusterAddrTable"`
+}
+
+// BrokerData 一个broker组的注册信息，BrokerAddrs的key为brokerId
+type BrokerData struct {
+	Cluster     string            `json:"cluster"`
+	BrokerName  string            `json:"brokerName"`
+	BrokerAddrs map[string]string `json:"brokerAddrs"`
+}
+
+// MasterAddr 返回master的地址，没有master时返回空
+func (b *BrokerData) MasterAddr() string {
+	return b.BrokerAddrs[MasterId]
+}
+
+// SlaveAddrs 返回按brokerId排序的slave地址
+func (b *BrokerData) SlaveAddrs() []string {
+	var ids []int
+	for id := range b.BrokerAddrs {
+		if n, err := strconv.Atoi(id); err == nil && id != MasterId {
+			ids = append(ids, n)
+		}
+	}
+	sort.Ints(ids)
+	addrs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		addrs = append(addrs, b.BrokerAddrs[strconv.Itoa(id)])
+	}
+	return addrs
+}
+
+// TopicRouteData 对应rocketmq的TopicRouteData
+type TopicRouteData struct {
+	QueueDatas  []QueueData  `json:"queueDatas"`
+	BrokerDatas []BrokerData `json:"brokerDatas"`
+}
+
+type QueueData struct {
+	BrokerName     string `json:"brokerName"`
+	ReadQueueNums  int    `json:"readQueueNums"`
+	WriteQueueNums int    `json:"writeQueueNums"`
+	Perm           int    `json:"perm"`
+	TopicSynFlag   int    `json:"topicSynFlag"`
+}
+
+// BrokerRuntimeInfo broker运行时统计，Table为broker返回的全部字段
+type BrokerRuntimeInfo struct {
+	Version            string
+	PutTps             float64
+	GetTransferedTps   float64
+	CommitLogMinOffset int64
+	CommitLogMaxOffset int64
+	MsgPutTotalToday   int64
+	MsgGetTotalToday   int64
+	Table              map[string]string
+}
+
+// ConsumeStats 对应rocketmq的ConsumeStats
+type ConsumeStats struct {
+	OffsetTable map[MessageQueue]OffsetWrapper
+	ConsumeTps  float64
+}
+
+// BrokerConsumeStats 对应rocketmq的ConsumeStatsList，ConsumeStatsList中每项为消费组到其各topic消费进度的映射
+type BrokerConsumeStats struct {
+	BrokerAddr       string
+	ConsumeStatsList []map[string][]ConsumeStats
+	TotalDiff        int64
+}
+
+type MessageQueue struct {
+	Topic      string `json:"topic"`
+	BrokerName string `json:"brokerName"`
+	QueueId    int    `json:"queueId"`
+}
+
+type OffsetWrapper struct {
+	BrokerOffset   int64 `json:"brokerOffset"`
+	ConsumerOffset int64 `json:"consumerOffset"`
+	LastTimestamp  int64 `json:"lastTimestamp"`
+}
+
+// Diff 返回所有队列未消费的消息数
+func (s *ConsumeStats) Diff() int64 {
+	var diff int64
+	for _, o := range s.OffsetTable {
+		diff += o.BrokerOffset - o.ConsumerOffset
+	}
+	return diff
+}
+
+// BrokerDiff 返回所有消费组在brokerName的队列上未消费的消息数，TotalDiff则不区分队列所属的broker
+func (s *BrokerConsumeStats) BrokerDiff(brokerName string) int64 {
+	var diff int64
+	for _, groups := range s.ConsumeStatsList {
+		for _, list := range groups {
+			for _, stats := range list {
+				for mq, o := range stats.OffsetTable {
+					if mq.BrokerName == brokerName {
+						diff += o.BrokerOffset - o.ConsumerOffset
+					}
+				}
+			}
+		}
+	}
+	return diff
+}
+
+// rawConsumeStats 为ConsumeStats的原始格式，offsetTable的key是json对象
+type rawConsumeStats struct {
+	OffsetTable map[string]OffsetWrapper `json:"offsetTable"`
+	ConsumeTps  float64                  `json:"consumeTps"`
+}
+
+func (raw *rawConsumeStats) decode() (*ConsumeStats, error) {
+	stats := &ConsumeStats{OffsetTable: make(map[MessageQueue]OffsetWrapper, len(raw.OffsetTable)), ConsumeTps: raw.ConsumeTps}
+	for key, offset := range raw.OffsetTable {
+		mq := MessageQueue{}
+		if err := unmarshal([]byte(key), &mq); err != nil {
+			return nil, errors2.Wrapf(err, "decode message queue %s", key)
+		}
+		stats.OffsetTable[mq] = offset
+	}
+	return stats, nil
+}
+
+type admin struct {
+	client remoting.Client
+}
+
+// NewAdmin 使用remoting客户端创建Admin
+func NewAdmin(client remoting.Client) Admin {
+	return &admin{client: client}
+}
+
+// invoke 发送同步请求，响应码不为Success时返回ResponseError
+func (a *admin) invoke(ctx context.Context, addr string, code int, extFields map[string]string, body []byte) (*remoting.RemotingCommand, error) {
+	return a.invokeExpect(ctx, addr, code, extFields, body, remoting.Success)
+}
+
+// invokeExpect 发送同步请求，响应码不为success时返回ResponseError
+func (a *admin) invokeExpect(ctx context.Context, addr string, code int, extFields map[string]string, body []byte, success int) (*remoting.RemotingCommand, error) {
+	resp, err := a.client.InvokeSync(ctx, addr, remoting.NewRequest(code, extFields, body))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != success {
+		return nil, errors2.Wrapf(&ResponseError{Code: resp.Code, Remark: resp.Remark}, "request code %d to %s", code, addr)
+	}
+	return resp, nil
+}
+
+func (a *admin) GetClusterInfo(ctx context.Context, namesrvAddr string) (*ClusterInfo, error) {
+	resp, err := a.invoke(ctx, namesrvAddr, remoting.GetBrokerClusterInfo, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	info := &ClusterInfo{}
+	if err := unmarshal(resp.Body, info); err != nil {
+		return nil, errors2.Wrap(err, "decode cluster info")
+	}
+	return info, nil
+}
+
+func (a *admin) GetTopicRouteData(ctx context.Context, namesrvAddr, topic string) (*TopicRouteData, error) {
+	resp, err := a.invoke(ctx, namesrvAddr, remoting.GetRouteInfoByTopic, map[string]string{"topic": topic}, nil)
+	if err != nil {
+		return nil, err
+	}
+	route := &TopicRouteData{}
+	if err := unmarshal(resp.Body, route); err != nil {
+		return nil, errors2.Wrap(err, "decode topic route")
+	}
+	return route, nil
+}
+
+func (a *admin) GetBrokerRuntimeInfo(ctx context.Context, brokerAddr string) (*BrokerRuntimeInfo, error) {
+	resp, err := a.invoke(ctx, brokerAddr, remoting.GetBrokerRuntimeInfo, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	kv := struct {
+		Table map[string]string `json:"table"`
+	}{}
+	if err := unmarshal(resp.Body, &kv); err != nil {
+		return nil, errors2.Wrap(err, "decode broker runtime info")
+	}
+	return newBrokerRuntimeInfo(kv.Table), nil
+}
+
+// newBrokerRuntimeInfo 解析KVTable，tps类字段为"10秒 1分钟 10分钟"三个值，取最近10秒的值
+func newBrokerRuntimeInfo(table map[string]string) *BrokerRuntimeInfo {
+	firstFloat := func(key string) float64 {
+		fields := strings.Fields(table[key])
+		if len(fields) == 0 {
+			return 0
+		}
+		v, _ := strconv.ParseFloat(fields[0], 64)
+		return v
+	}
+	int64Value := func(key string) int64 {
+		v, _ := strconv.ParseInt(table[key], 10, 64)
+		return v
+	}
+	return &BrokerRuntimeInfo{
+		Version:            table["brokerVersionDesc"],
+		PutTps:             firstFloat("putTps"),
+		GetTransferedTps:   firstFloat("getTransferedTps"),
+		CommitLogMinOffset: int64Value("commitLogMinOffset"),
+		CommitLogMaxOffset: int64Value("commitLogMaxOffset"),
+		MsgPutTotalToday:   int64Value("msgPutTotalTodayNow"),
+		MsgGetTotalToday:   int64Value("msgGetTotalTodayNow"),
+		Table:              table,
+	}
+}
+
+func (a *admin) GetBrokerConfig(ctx context.Context, brokerAddr string) (map[string]string, error) {
+	resp, err := a.invoke(ctx, brokerAddr, remoting.GetBrokerConfig, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseProperties(resp.Body), nil
+}
+
+func (a *admin) UpdateBrokerConfig(ctx context.Context, brokerAddr string, properties map[string]string) error {
+	keys := make([]string, 0, len(properties))
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var body strings.Builder
+	for _, k := range keys {
+		body.WriteString(k + "=" + properties[k] + "\n")
+	}
+	_, err := a.invoke(ctx, brokerAddr, remoting.UpdateBrokerConfig, nil, []byte(body.String()))
+	return err
+}
+
+func (a *admin) GetConsumeStats(ctx context.Context, brokerAddr, group, topic string) (*ConsumeStats, error) {
+	extFields := map[string]string{"consumerGroup": group}
+	if topic != "" {
+		extFields["topic"] = topic
+	}
+	resp, err := a.invoke(ctx, brokerAddr, remoting.GetConsumeStats, extFields, nil)
+	if err != nil {
+		return nil, err
+	}
+	raw := &rawConsumeStats{}
+	if err := unmarshal(resp.Body, raw); err != nil {
+		return nil, errors2.Wrap(err, "decode consume stats")
+	}
+	return raw.decode()
+}
+
+func (a *admin) GetBrokerConsumeStats(ctx context.Context, brokerAddr string) (*BrokerConsumeStats, error) {
+	resp, err := a.invoke(ctx, brokerAddr, remoting.GetBrokerConsumeStats, map[string]string{"isOrder": "false"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	raw := struct {
+		BrokerAddr       string                         `json:"brokerAddr"`
+		ConsumeStatsList []map[string][]rawConsumeStats `json:"consumeStatsList"`
+		TotalDiff        int64                          `json:"totalDiff"`
+	}{}
+	if err := unmarshal(resp.Body, &raw); err != nil {
+		return nil, errors2.Wrap(err, "decode broker consume stats")
+	}
+	stats := &BrokerConsumeStats{BrokerAddr: raw.BrokerAddr, TotalDiff: raw.TotalDiff}
+	for _, groups := range raw.ConsumeStatsList {
+		decoded := make(map[string][]ConsumeStats, len(groups))
+		for group, list := range groups {
+			for k := range list {
+				cs, err := list[k].decode()
+				if err != nil {
+					return nil, err
+				}
+				decoded[group] = append(decoded[group], *cs)
+			}
+		}
+		stats.ConsumeStatsList = append(stats.ConsumeStatsList, decoded)
+	}
+	return stats, nil
+}
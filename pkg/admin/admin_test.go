@@ -0,0 +1,459 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"rocketmq-operator-v2/pkg/remoting"
+)
+
+func newTestAdmin(t *testing.T) (*remoting.FakeServer, Admin) {
+	s, err := remoting.NewFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := remoting.NewClient(remoting.Config{})
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = s.Close()
+	})
+	return s, NewAdmin(client)
+}
+
+func respond(body string) remoting.Handler {
+	return func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		return remoting.NewResponse(req, remoting.Success, "", []byte(body))
+	}
+}
+
+// respondDledger 模拟dledger的响应，remoting响应码固定为200，结果码在body中
+func respondDledger(body string) remoting.Handler {
+	return func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		return remoting.NewResponse(req, dledgerSuccess, "", []byte(body))
+	}
+}
+
+func TestQuoteKeys(t *testing.T) {
+	cases := map[string]string{
+		`{0:"a:1",1:"b"}`:                       `{"0":"a:1","1":"b"}`,
+		`{"k":{ -1 :"v"},"s":"{0:1}"}`:          `{"k":{ "-1" :"v"},"s":"{0:1}"}`,
+		`{{"topic":"t","queueId":0}:{"x":[1]}}`: `{"{\"topic\":\"t\",\"queueId\":0}":{"x":[1]}}`,
+		`[{},{"a":[]}]`:                         `[{},{"a":[]}]`,
+	}
+	for in, want := range cases {
+		if got := string(quoteKeys([]byte(in))); got != want {
+			t.Errorf("quoteKeys(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestGetClusterInfo(t *testing.T) {
+	s, a := newTestAdmin(t)
+	s.Handle(remoting.GetBrokerClusterInfo, respond(`{"brokerAddrTable":{"demo-broker-0":{"brokerAddrs":{1:"10.0.0.2:10911",0:"10.0.0.1:10911",2:"10.0.0.3:10911"},"brokerName":"demo-broker-0","cluster":"demo"}},"clusterAddrTable":{"demo":["demo-broker-0"]}}`))
+	info, err := a.GetClusterInfo(context.Background(), s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := info.BrokerAddrTable["demo-broker-0"]
+	if broker.MasterAddr() != "10.0.0.1:10911" {
+		t.Errorf("master = %s", broker.MasterAddr())
+	}
+	if want := []string{"10.0.0.2:10911", "10.0.0.3:10911"}; !reflect.DeepEqual(broker.SlaveAddrs(), want) {
+		t.Errorf("slaves = %v, want %v", broker.SlaveAddrs(), want)
+	}
+	if want := []string{"demo-broker-0"}; !reflect.DeepEqual(info.ClusterAddrTable["demo"], want) {
+		t.Errorf("cluster brokers = %v, want %v", info.ClusterAddrTable["demo"], want)
+	}
+}
+
+func TestGetTopicRouteData(t *testing.T) {
+	s, a := newTestAdmin(t)
+	s.Handle(remoting.GetRouteInfoByTopic, func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		if req.ExtFields["topic"] != "orders" {
+			return remoting.NewResponse(req, remoting.TopicNotExist, "No topic route info in name server for the topic: "+req.ExtFields["topic"], nil)
+		}
+		return respond(`{"brokerDatas":[{"brokerAddrs":{0:"10.0.0.1:10911"},"brokerName":"demo-broker-0","cluster":"demo"}],"filterServerTable":{},"queueDatas":[{"brokerName":"demo-broker-0","perm":6,"readQueueNums":8,"topicSynFlag":0,"writeQueueNums":8}]}`)(req)
+	})
+	route, err := a.GetTopicRouteData(context.Background(), s.Addr(), "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &TopicRouteData{
+		QueueDatas: []QueueData{{BrokerName: "demo-broker-0", ReadQueueNums: 8, WriteQueueNums: 8, Perm: 6}},
+		BrokerDatas: []BrokerData{{Cluster: "demo", BrokerName: "demo-broker-0",
+			BrokerAddrs: map[string]string{"0": "10.0.0.1:10911"}}},
+	}
+	if !reflect.DeepEqual(route, want) {
+		t.Errorf("route = %+v, want %+v", route, want)
+	}
+	if _, err := a.GetTopicRouteData(context.Background(), s.Addr(), "missing"); !IsTopicNotExist(err) {
+		t.Errorf("expected topic not exist error, got %v", err)
+	}
+}
+
+func TestGetBrokerRuntimeInfo(t *testing.T) {
+	s, a := newTestAdmin(t)
+	s.Handle(remoting.GetBrokerRuntimeInfo, respond(`{"table":{"brokerVersionDesc":"V4_6_1","putTps":"12.5 10.0 8.0","getTransferedTps":"3.0 2.0 1.0","commitLogMaxOffset":"4096","commitLogMinOffset":"0","msgPutTotalTodayNow":"100"}}`))
+	info, err := a.GetBrokerRuntimeInfo(context.Background(), s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "V4_6_1" || info.PutTps != 12.5 || info.GetTransferedTps != 3 ||
+		info.CommitLogMaxOffset != 4096 || info.MsgPutTotalToday != 100 {
+		t.Errorf("runtime info = %+v", info)
+	}
+}
+
+func TestAclSignedRequest(t *testing.T) {
+	s, err := remoting.NewFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := remoting.NewClient(remoting.Config{RPCHook: remoting.AclHook})
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = s.Close()
+	})
+	a := NewAdmin(client)
+	var extFields map[string]string
+	s.Handle(remoting.DeleteTopicInBroker, func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		extFields = req.ExtFields
+		return remoting.NewResponse(req, remoting.Success, "", nil)
+	})
+	ctx := remoting.WithCredentials(context.Background(), remoting.SessionCredentials{AccessKey: "rocketmq2", SecretKey: "12345678"})
+	if err := a.DeleteTopicInBroker(ctx, s.Addr(), "orders"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"topic": "orders", "AccessKey": "rocketmq2"}
+	req := remoting.NewRequest(remoting.DeleteTopicInBroker, map[string]string{"topic": "orders"}, nil)
+	remoting.Sign(req, remoting.SessionCredentials{AccessKey: "rocketmq2", SecretKey: "12345678"})
+	want["Signature"] = req.ExtFields["Signature"]
+	if !reflect.DeepEqual(extFields, want) {
+		t.Errorf("extFields = %v, want %v", extFields, want)
+	}
+}
+
+func TestGetBrokerConsumeStats(t *testing.T) {
+	s, a := newTestAdmin(t)
+	var isOrder string
+	s.Handle(remoting.GetBrokerConsumeStats, func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		isOrder = req.ExtFields["isOrder"]
+		return respond(`{"brokerAddr":"10.0.0.1:10911","consumeStatsList":[{"billing":[{"consumeTps":0.0,"offsetTable":{{"brokerName":"demo-broker-0","queueId":0,"topic":"orders"}:{"brokerOffset":50,"consumerOffset":8,"lastTimestamp":0},{"brokerName":"demo-broker-1","queueId":0,"topic":"orders"}:{"brokerOffset":7,"consumerOffset":2,"lastTimestamp":0}}}]}],"totalDiff":47}`)(req)
+	})
+	stats, err := a.GetBrokerConsumeStats(context.Background(), s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalDiff != 47 || stats.BrokerAddr != "10.0.0.1:10911" || len(stats.ConsumeStatsList) != 1 {
+		t.Errorf("broker consume stats = %+v", stats)
+	}
+	if diff := stats.BrokerDiff("demo-broker-0"); diff != 42 {
+		t.Errorf("BrokerDiff(demo-broker-0) = %d, want 42", diff)
+	}
+	if diff := stats.BrokerDiff("demo-broker-2"); diff != 0 {
+		t.Errorf("BrokerDiff(demo-broker-2) = %d, want 0", diff)
+	}
+	if isOrder != "false" {
+		t.Errorf("isOrder = %q, want false", isOrder)
+	}
+}
+
+func TestBrokerConfig(t *testing.T) {
+	s, a := newTestAdmin(t)
+	var updated string
+	s.Handle(remoting.UpdateBrokerConfig, func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		updated = string(req.Body)
+		return remoting.NewResponse(req, remoting.Success, "", nil)
+	})
+	s.Handle(remoting.GetBrokerConfig, respond("brokerName=demo-broker-0\nbrokerPermission=6\nnamesrvAddr=a:9876;b:9876\n"))
+	ctx := context.Background()
+
+	if err := a.UpdateBrokerConfig(ctx, s.Addr(), map[string]string{"brokerPermission": "4", "autoCreateTopicEnable": "false"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "autoCreateTopicEnable=false\nbrokerPermission=4\n"; updated != want {
+		t.Errorf("update body = %q, want %q", updated, want)
+	}
+	config, err := a.GetBrokerConfig(ctx, s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"brokerName": "demo-broker-0", "brokerPermission": "6", "namesrvAddr": "a:9876;b:9876"}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("config = %v, want %v", config, want)
+	}
+}
+
+func TestGetConsumeStats(t *testing.T) {
+	s, a := newTestAdmin(t)
+	s.Handle(remoting.GetConsumeStats, func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		if req.ExtFields["consumerGroup"] != "g" {
+			return remoting.NewResponse(req, remoting.SubscriptionGroupNotExist, "", nil)
+		}
+		return respond(`{"consumeTps":1.5,"offsetTable":{{"brokerName":"demo-broker-0","queueId":0,"topic":"orders"}:{"brokerOffset":10,"consumerOffset":4,"lastTimestamp":0},{"brokerName":"demo-broker-0","queueId":1,"topic":"orders"}:{"brokerOffset":5,"consumerOffset":5,"lastTimestamp":0}}}`)(req)
+	})
+	stats, err := a.GetConsumeStats(context.Background(), s.Addr(), "g", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Diff() != 6 || stats.ConsumeTps != 1.5 || len(stats.OffsetTable) != 2 {
+		t.Errorf("consume stats = %+v", stats)
+	}
+	if o := stats.OffsetTable[MessageQueue{Topic: "orders", BrokerName: "demo-broker-0", QueueId: 0}]; o.BrokerOffset != 10 {
+		t.Errorf("offset of queue 0 = %+v", o)
+	}
+	if _, err := a.GetConsumeStats(context.Background(), s.Addr(), "missing", ""); !IsSubscriptionGroupNotExist(err) {
+		t.Errorf("expected subscription group not exist error, got %v", err)
+	}
+}
+
+func TestTransferLeadership(t *testing.T) {
+	s, a := newTestAdmin(t)
+	var transfer dledgerMessage
+	s.Handle(dledgerMetadata, respondDledger(`{"code":200,"group":"demo-broker-0","leaderId":"n0","term":3,"peers":{"n0":"a:40911"}}`))
+	s.Handle(dledgerLeadershipTransfer, func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		_ = json.Unmarshal(req.Body, &transfer)
+		return respondDledger(`{"code":200}`)(req)
+	})
+	metadata, err := a.GetDledgerMetadata(context.Background(), s.Addr(), "demo-broker-0", "n0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.LeaderId != "n0" || metadata.Term != 3 || metadata.Peers["n0"] != "a:40911" {
+		t.Errorf("metadata = %+v", metadata)
+	}
+	if err := a.TransferLeadership(context.Background(), s.Addr(), "demo-broker-0", "n0", "n2"); err != nil {
+		t.Fatal(err)
+	}
+	want := dledgerMessage{Group: "demo-broker-0", RemoteId: "n0", LeaderId: "n0", Term: 3, TransferId: "n0", TransfereeId: "n2"}
+	if !reflect.DeepEqual(transfer, want) {
+		t.Errorf("transfer request = %+v, want %+v", transfer, want)
+	}
+	if err := a.TransferLeadership(context.Background(), s.Addr(), "demo-broker-0", "n1", "n2"); err == nil {
+		t.Error("expected error when transferring from a follower")
+	}
+}
+
+func TestLeadershipTransferSupported(t *testing.T) {
+	cases := map[string]bool{
+		"V4_6_1":   false,
+		"V4_7_1":   false,
+		"V4_8_0":   true,
+		"V4_9_4":   true,
+		"V5_1_0":   true,
+		"SNAPSHOT": true,
+		"":         true,
+	}
+	for version, want := range cases {
+		if got := LeadershipTransferSupported(version); got != want {
+			t.Errorf("LeadershipTransferSupported(%q) = %v, want %v", version, got, want)
+		}
+	}
+}
+
+func TestInvokeDledgerResponseCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler remoting.Handler
+		wantErr bool
+	}{
+		{
+			name:    "success in body",
+			handler: respondDledger(`{"code":200,"group":"g","leaderId":"n1","term":1}`),
+		},
+		{
+			name:    "failure code in body",
+			handler: respondDledger(`{"code":502,"group":"g","term":1}`),
+			wantErr: true,
+		},
+		{
+			name:    "remoting success code is not a dledger response",
+			handler: respond(`{"code":200,"group":"g","leaderId":"n1","term":1}`),
+			wantErr: true,
+		},
+		{
+			name: "remoting error",
+			handler: func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+				return remoting.NewResponse(req, remoting.RequestCodeNotSupported, "not supported", nil)
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, a := newTestAdmin(t)
+			s.Handle(dledgerMetadata, tt.handler)
+			metadata, err := a.GetDledgerMetadata(context.Background(), s.Addr(), "g", "n0")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetDledgerMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && metadata.LeaderId != "n1" {
+				t.Errorf("leader = %s, want n1", metadata.LeaderId)
+			}
+		})
+	}
+}
+
+func TestTopic(t *testing.T) {
+	s, a := newTestAdmin(t)
+	var created, deleted map[string]string
+	s.Handle(remoting.UpdateAndCreateTopic, func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		created = req.ExtFields
+		return remoting.NewResponse(req, remoting.Success, "", nil)
+	})
+	s.Handle(remoting.DeleteTopicInBroker, func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		deleted = req.ExtFields
+		return remoting.NewResponse(req, remoting.Success, "", nil)
+	})
+	s.Handle(remoting.GetAllTopicConfig, respond(`{"dataVersion":{"counter":3,"timestamp":1},"topicConfigTable":{"orders":{"order":true,"perm":6,"readQueueNums":8,"topicFilterType":"SINGLE_TAG","topicName":"orders","topicSysFlag":0,"writeQueueNums":4}}}`))
+	ctx := context.Background()
+
+	config := TopicConfig{TopicName: "orders", ReadQueueNums: 8, WriteQueueNums: 4, Perm: 6, Order: true,
+		Attributes: map[string]string{"message.type": "FIFO"}}
+	if err := a.CreateOrUpdateTopic(ctx, s.Addr(), config); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"topic": "orders", "defaultTopic": "TBW102", "readQueueNums": "8", "writeQueueNums": "4",
+		"perm": "6", "topicFilterType": "SINGLE_TAG", "topicSysFlag": "0", "order": "true", "attributes": "+message.type=FIFO"}
+	if !reflect.DeepEqual(created, want) {
+		t.Errorf("create request = %v, want %v", created, want)
+	}
+	configs, err := a.GetAllTopicConfig(ctx, s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Attributes = nil
+	config.TopicFilterType = "SINGLE_TAG"
+	if !reflect.DeepEqual(configs["orders"], config) {
+		t.Errorf("topic config = %+v, want %+v", configs["orders"], config)
+	}
+	if err := a.DeleteTopicInBroker(ctx, s.Addr(), "orders"); err != nil {
+		t.Fatal(err)
+	}
+	if deleted["topic"] != "orders" {
+		t.Errorf("delete request = %v", deleted)
+	}
+}
+
+func TestGetAllTopicList(t *testing.T) {
+	s, a := newTestAdmin(t)
+	s.Handle(remoting.GetAllTopicListFromNameserver, respond(`{"topicList":["orders","TBW102","%RETRY%billing"]}`))
+	topics, err := a.GetAllTopicList(context.Background(), s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"orders", "TBW102", "%RETRY%billing"}; !reflect.DeepEqual(topics, want) {
+		t.Errorf("topics = %v, want %v", topics, want)
+	}
+}
+
+func TestIsSystemTopic(t *testing.T) {
+	cases := map[string]bool{
+		"orders":              false,
+		"TBW102":              true,
+		"SCHEDULE_TOPIC_XXXX": true,
+		"%RETRY%billing":      true,
+		"%DLQ%billing":        true,
+		"RMQ_SYS_TRACE_TOPIC": true,
+		"rmq_sys_wheel":       true,
+	}
+	for topic, want := range cases {
+		if got := IsSystemTopic(topic); got != want {
+			t.Errorf("IsSystemTopic(%s) = %v, want %v", topic, got, want)
+		}
+	}
+}
+
+func TestKVConfig(t *testing.T) {
+	s, a := newTestAdmin(t)
+	kv := make(map[string]string)
+	s.Handle(remoting.PutKVConfig, func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		kv[req.ExtFields["namespace"]+"/"+req.ExtFields["key"]] = req.ExtFields["value"]
+		return remoting.NewResponse(req, remoting.Success, "", nil)
+	})
+	s.Handle(remoting.DeleteKVConfig, func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		delete(kv, req.ExtFields["namespace"]+"/"+req.ExtFields["key"])
+		return remoting.NewResponse(req, remoting.Success, "", nil)
+	})
+	ctx := context.Background()
+	if err := a.PutKVConfig(ctx, s.Addr(), OrderTopicConfigNamespace, "orders", "demo-broker-0:4"); err != nil {
+		t.Fatal(err)
+	}
+	if kv["ORDER_TOPIC_CONFIG/orders"] != "demo-broker-0:4" {
+		t.Errorf("kv = %v", kv)
+	}
+	if err := a.DeleteKVConfig(ctx, s.Addr(), OrderTopicConfigNamespace, "orders"); err != nil {
+		t.Fatal(err)
+	}
+	if len(kv) != 0 {
+		t.Errorf("kv = %v, want empty", kv)
+	}
+}
+
+func TestSubscriptionGroup(t *testing.T) {
+	s, a := newTestAdmin(t)
+	var created SubscriptionGroupConfig
+	var deleted string
+	s.Handle(remoting.UpdateAndCreateSubscriptionGroup, func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		_ = json.Unmarshal(req.Body, &created)
+		return remoting.NewResponse(req, remoting.Success, "", nil)
+	})
+	s.Handle(remoting.DeleteSubscriptionGroup, func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		deleted = req.ExtFields["groupName"]
+		return remoting.NewResponse(req, remoting.Success, "", nil)
+	})
+	s.Handle(remoting.GetAllSubscriptionGroupConfig, respond(`{"dataVersion":{"counter":1},"subscriptionGroupTable":{"billing":{"brokerId":0,"consumeBroadcastEnable":true,"consumeEnable":true,"consumeFromMinEnable":true,"groupName":"billing","notifyConsumerIdsChangedEnable":true,"retryMaxTimes":3,"retryQueueNums":1,"whichBrokerWhenConsumeSlowly":1}}}`))
+	ctx := context.Background()
+
+	config := NewSubscriptionGroupConfig("billing")
+	config.ConsumeBroadcastEnable = true
+	config.RetryMaxTimes = 3
+	if err := a.CreateOrUpdateSubscriptionGroup(ctx, s.Addr(), config); err != nil {
+		t.Fatal(err)
+	}
+	if created != config {
+		t.Errorf("create request = %+v, want %+v", created, config)
+	}
+	configs, err := a.GetAllSubscriptionGroupConfig(ctx, s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configs["billing"] != config {
+		t.Errorf("subscription group config = %+v, want %+v", configs["billing"], config)
+	}
+	if err := a.DeleteSubscriptionGroup(ctx, s.Addr(), "billing"); err != nil {
+		t.Fatal(err)
+	}
+	if deleted != "billing" {
+		t.Errorf("deleted group = %q", deleted)
+	}
+}
+
+func TestGetConsumerConnectionList(t *testing.T) {
+	s, a := newTestAdmin(t)
+	s.Handle(remoting.GetConsumerConnectionList, func(req *remoting.RemotingCommand) *remoting.RemotingCommand {
+		if req.ExtFields["consumerGroup"] != "billing" {
+			return remoting.NewResponse(req, remoting.ConsumerNotOnline, "the consumer group not online", nil)
+		}
+		return respond(`{"connectionSet":[{"clientAddr":"10.0.1.5:52312","clientId":"10.0.1.5@1","language":"JAVA","version":359}],"consumeFromWhere":"CONSUME_FROM_LAST_OFFSET","consumeType":"CONSUME_PASSIVELY","messageModel":"CLUSTERING","subscriptionTable":{"orders":{"subString":"*","tagsSet":[]}}}`)(req)
+	})
+	ctx := context.Background()
+	connection, err := a.GetConsumerConnectionList(ctx, s.Addr(), "billing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ConsumerConnection{
+		ConnectionSet:    []Connection{{ClientId: "10.0.1.5@1", ClientAddr: "10.0.1.5:52312", Language: "JAVA", Version: 359}},
+		ConsumeType:      "CONSUME_PASSIVELY",
+		MessageModel:     "CLUSTERING",
+		ConsumeFromWhere: "CONSUME_FROM_LAST_OFFSET",
+	}
+	if !reflect.DeepEqual(connection, want) {
+		t.Errorf("connection = %+v, want %+v", connection, want)
+	}
+	if _, err := a.GetConsumerConnectionList(ctx, s.Addr(), "offline"); !IsConsumerNotOnline(err) {
+		t.Errorf("expected consumer not online error, got %v", err)
+	}
+}
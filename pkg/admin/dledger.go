@@ -0,0 +1,98 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	errors2 "github.com/pkg/errors"
+)
+
+// dledger节点间通信使用的请求码，对应DLedgerRequestCode
+const (
+	dledgerMetadata           int = 50000
+	dledgerLeadershipTransfer int = 51005
+
+	// dledgerSuccess 对应DLedgerResponseCode.SUCCESS，dledger的结果码在响应body中
+	dledgerSuccess = 200
+)
+
+// LeadershipTransferSupported 判断brokerVersionDesc(如V4_6_1)对应的broker是否支持转移dledger leadership，
+// LEADERSHIP_TRANSFER请求从dledger 0.2(RocketMQ 4.8.0)开始提供，无法识别的版本视为支持
+func LeadershipTransferSupported(version string) bool {
+	var major, minor, patch int
+	if _, err := fmt.Sscanf(version, "V%d_%d_%d", &major, &minor, &patch); err != nil {
+		return true
+	}
+	return major > 4 || major == 4 && minor >= 8
+}
+
+// dledgerMessage 对应dledger的RequestOrResponse及其子类中用到的字段
+type dledgerMessage struct {
+	Group        string            `json:"group"`
+	RemoteId     string            `json:"remoteId,omitempty"`
+	LocalId      string            `json:"localId,omitempty"`
+	Code         int               `json:"code"`
+	LeaderId     string            `json:"leaderId,omitempty"`
+	Term         int64             `json:"term"`
+	TransferId   string            `json:"transferId,omitempty"`
+	TransfereeId string            `json:"transfereeId,omitempty"`
+	Peers        map[string]string `json:"peers,omitempty"`
+}
+
+// DledgerMetadata dledger节点返回的组信息，LeaderId为空表示正在选举
+type DledgerMetadata struct {
+	Group    string
+	LeaderId string
+	Term     int64
+	Peers    map[string]string
+}
+
+// invokeDledger 向dledger地址发送请求，remoteId为接收请求的节点id。
+// dledger处理过的请求remoting响应码固定为SUCCESS(200)，真正的结果码在body的code中
+func (a *admin) invokeDledger(ctx context.Context, addr string, code int, req *dledgerMessage) (*dledgerMessage, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.invokeExpect(ctx, addr, code, nil, body, dledgerSuccess)
+	if err != nil {
+		return nil, err
+	}
+	result := &dledgerMessage{}
+	if err := unmarshal(resp.Body, result); err != nil {
+		return nil, errors2.Wrap(err, "decode dledger response")
+	}
+	if result.Code != dledgerSuccess {
+		return nil, errors2.Errorf("dledger request code %d to %s: response code %d", code, addr, result.Code)
+	}
+	return result, nil
+}
+
+func (a *admin) GetDledgerMetadata(ctx context.Context, addr, group, selfId string) (*DledgerMetadata, error) {
+	resp, err := a.invokeDledger(ctx, addr, dledgerMetadata, &dledgerMessage{Group: group, RemoteId: selfId})
+	if err != nil {
+		return nil, errors2.Wrap(err, "get dledger metadata")
+	}
+	return &DledgerMetadata{Group: resp.Group, LeaderId: resp.LeaderId, Term: resp.Term, Peers: resp.Peers}, nil
+}
+
+// TransferLeadership 先从leader获取当前term，再请求leader将leadership转移给targetId
+func (a *admin) TransferLeadership(ctx context.Context, leaderAddr, group, leaderId, targetId string) error {
+	metadata, err := a.GetDledgerMetadata(ctx, leaderAddr, group, leaderId)
+	if err != nil {
+		return err
+	}
+	if metadata.LeaderId != leaderId {
+		return errors2.Errorf("%s is not the leader of dledger group %s, current leader is %q", leaderId, group, metadata.LeaderId)
+	}
+	_, err = a.invokeDledger(ctx, leaderAddr, dledgerLeadershipTransfer, &dledgerMessage{
+		Group:        group,
+		RemoteId:     leaderId,
+		LeaderId:     leaderId,
+		Term:         metadata.Term,
+		TransferId:   leaderId,
+		TransfereeId: targetId,
+	})
+	return errors2.Wrap(err, "transfer dledger leadership")
+}
@@ -0,0 +1,97 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+
+	errors2 "github.com/pkg/errors"
+
+	"rocketmq-operator-v2/pkg/remoting"
+)
+
+// SubscriptionGroupConfig 对应rocketmq的SubscriptionGroupConfig
+type SubscriptionGroupConfig struct {
+	GroupName                      string `json:"groupName"`
+	ConsumeEnable                  bool   `json:"consumeEnable"`
+	ConsumeFromMinEnable           bool   `json:"consumeFromMinEnable"`
+	ConsumeBroadcastEnable         bool   `json:"consumeBroadcastEnable"`
+	RetryQueueNums                 int    `json:"retryQueueNums"`
+	RetryMaxTimes                  int    `json:"retryMaxTimes"`
+	BrokerId                       int64  `json:"brokerId"`
+	WhichBrokerWhenConsumeSlowly   int64  `json:"whichBrokerWhenConsumeSlowly"`
+	NotifyConsumerIdsChangedEnable bool   `json:"notifyConsumerIdsChangedEnable"`
+}
+
+// NewSubscriptionGroupConfig 返回与broker默认值一致的消费组配置
+func NewSubscriptionGroupConfig(group string) SubscriptionGroupConfig {
+	return SubscriptionGroupConfig{
+		GroupName:                      group,
+		ConsumeEnable:                  true,
+		ConsumeFromMinEnable:           true,
+		RetryQueueNums:                 1,
+		RetryMaxTimes:                  16,
+		WhichBrokerWhenConsumeSlowly:   1,
+		NotifyConsumerIdsChangedEnable: true,
+	}
+}
+
+// ConsumerConnection 对应rocketmq的ConsumerConnection，只保留管理需要的字段
+type ConsumerConnection struct {
+	ConnectionSet    []Connection `json:"connectionSet"`
+	ConsumeType      string       `json:"consumeType"`
+	MessageModel     string       `json:"messageModel"`
+	ConsumeFromWhere string       `json:"consumeFromWhere"`
+}
+
+// Connection 一个在线的客户端
+type Connection struct {
+	ClientId   string `json:"clientId"`
+	ClientAddr string `json:"clientAddr"`
+	Language   string `json:"language"`
+	Version    int    `json:"version"`
+}
+
+// IsConsumerNotOnline 判断错误是否为消费组没有在线的客户端
+func IsConsumerNotOnline(err error) bool {
+	return responseCode(err) == remoting.ConsumerNotOnline
+}
+
+func (a *admin) GetAllSubscriptionGroupConfig(ctx context.Context, brokerAddr string) (map[string]SubscriptionGroupConfig, error) {
+	resp, err := a.invoke(ctx, brokerAddr, remoting.GetAllSubscriptionGroupConfig, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	wrapper := struct {
+		SubscriptionGroupTable map[string]SubscriptionGroupConfig `json:"subscriptionGroupTable"`
+	}{}
+	if err := unmarshal(resp.Body, &wrapper); err != nil {
+		return nil, errors2.Wrap(err, "decode subscription group config")
+	}
+	return wrapper.SubscriptionGroupTable, nil
+}
+
+func (a *admin) CreateOrUpdateSubscriptionGroup(ctx context.Context, brokerAddr string, config SubscriptionGroupConfig) error {
+	body, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = a.invoke(ctx, brokerAddr, remoting.UpdateAndCreateSubscriptionGroup, nil, body)
+	return err
+}
+
+func (a *admin) DeleteSubscriptionGroup(ctx context.Context, brokerAddr, group string) error {
+	_, err := a.invoke(ctx, brokerAddr, remoting.DeleteSubscriptionGroup, map[string]string{"groupName": group}, nil)
+	return err
+}
+
+func (a *admin) GetConsumerConnectionList(ctx context.Context, brokerAddr, group string) (*ConsumerConnection, error) {
+	resp, err := a.invoke(ctx, brokerAddr, remoting.GetConsumerConnectionList, map[string]string{"consumerGroup": group}, nil)
+	if err != nil {
+		return nil, err
+	}
+	connection := &ConsumerConnection{}
+	if err := unmarshal(resp.Body, connection); err != nil {
+		return nil, errors2.Wrap(err, "decode consumer connection")
+	}
+	return connection, nil
+}
@@ -0,0 +1,113 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// unmarshal 解析fastjson序列化的响应。fastjson会将非字符串的map key原样输出，
+// 如brokerAddrs的{0:"ip:port"}和offsetTable的{{"topic":"t",...}:{...}}，
+// 这里先将这些key转换为json字符串再交给encoding/json
+func unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(quoteKeys(data), v)
+}
+
+func quoteKeys(data []byte) []byte {
+	out := make([]byte, 0, len(data)+16)
+	// expectKey 为true表示当前位于对象中key的位置
+	expectKey := false
+	var stack []byte
+	for k := 0; k < len(data); k++ {
+		c := data[k]
+		switch {
+		case c == '"':
+			end := skipString(data, k)
+			out = append(out, data[k:end]...)
+			k = end - 1
+			expectKey = false
+			continue
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		case expectKey && c == '{':
+			end := skipValue(data, k)
+			key := quoteKeys(data[k:end])
+			out = append(out, strconv.Quote(string(key))...)
+			k = end - 1
+			expectKey = false
+			continue
+		case expectKey && c != '}':
+			end := k
+			for end < len(data) && data[end] != ':' && data[end] != ' ' && data[end] != '\t' &&
+				data[end] != '\r' && data[end] != '\n' {
+				end++
+			}
+			out = append(out, strconv.Quote(string(data[k:end]))...)
+			k = end - 1
+			expectKey = false
+			continue
+		case c == '{' || c == '[':
+			stack = append(stack, c)
+			expectKey = c == '{'
+		case c == '}' || c == ']':
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			expectKey = false
+		case c == ',':
+			expectKey = len(stack) > 0 && stack[len(stack)-1] == '{'
+		default:
+			expectKey = false
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// skipString 返回从start处的引号开始的字符串结束后的位置
+func skipString(data []byte, start int) int {
+	for k := start + 1; k < len(data); k++ {
+		switch data[k] {
+		case '\\':
+			k++
+		case '"':
+			return k + 1
+		}
+	}
+	return len(data)
+}
+
+// skipValue 返回从start处开始的对象或数组结束后的位置
+func skipValue(data []byte, start int) int {
+	depth := 0
+	for k := start; k < len(data); k++ {
+		switch data[k] {
+		case '"':
+			k = skipString(data, k) - 1
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 0 {
+				return k + 1
+			}
+		}
+	}
+	return len(data)
+}
+
+// parseProperties 解析MixAll.properties2String格式的配置
+func parseProperties(data []byte) map[string]string {
+	properties := make(map[string]string)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		k := bytes.IndexByte(line, '=')
+		if k < 0 {
+			continue
+		}
+		properties[string(bytes.TrimSpace(line[:k]))] = string(bytes.TrimSpace(line[k+1:]))
+	}
+	return properties
+}
@@ -0,0 +1,145 @@
+package admin
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	errors2 "github.com/pkg/errors"
+
+	"rocketmq-operator-v2/pkg/remoting"
+)
+
+const (
+	// defaultTopic 创建topic时使用的模板topic，与mqadmin一致
+	defaultTopic = "TBW102"
+	// defaultTopicFilterType 对应TopicFilterType.SINGLE_TAG
+	defaultTopicFilterType = "SINGLE_TAG"
+
+	// OrderTopicConfigNamespace nameserver中记录顺序topic分区配置的kv命名空间，对应NamesrvUtil.NAMESPACE_ORDER_TOPIC_CONFIG
+	OrderTopicConfigNamespace = "ORDER_TOPIC_CONFIG"
+)
+
+// PermRead、PermWrite 对应rocketmq的PermName，brokerPermission为PermRead时broker只读
+const (
+	PermRead  = 4
+	PermWrite = 2
+)
+
+var systemTopics = map[string]bool{
+	defaultTopic:                 true,
+	"SELF_TEST_TOPIC":            true,
+	"OFFSET_MOVED_EVENT":         true,
+	"SCHEDULE_TOPIC_XXXX":        true,
+	"BenchmarkTest":              true,
+	"TRANS_CHECK_MAX_TIME_TOPIC": true,
+}
+
+// IsSystemTopic 判断是否为broker内部使用的topic以及重试、死信topic
+func IsSystemTopic(topic string) bool {
+	for _, prefix := range []string{"%RETRY%", "%DLQ%", "RMQ_SYS_", "rmq_sys_"} {
+		if strings.HasPrefix(topic, prefix) {
+			return true
+		}
+	}
+	return systemTopics[topic]
+}
+
+// TopicConfig 对应rocketmq的TopicConfig，Attributes只有5.x的broker支持，4.x的broker会忽略
+type TopicConfig struct {
+	TopicName       string            `json:"topicName"`
+	ReadQueueNums   int               `json:"readQueueNums"`
+	WriteQueueNums  int               `json:"writeQueueNums"`
+	Perm            int               `json:"perm"`
+	TopicFilterType string            `json:"topicFilterType,omitempty"`
+	TopicSysFlag    int               `json:"topicSysFlag"`
+	Order           bool              `json:"order"`
+	Attributes      map[string]string `json:"attributes,omitempty"`
+}
+
+func (a *admin) GetAllTopicList(ctx context.Context, namesrvAddr string) ([]string, error) {
+	resp, err := a.invoke(ctx, namesrvAddr, remoting.GetAllTopicListFromNameserver, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	list := struct {
+		TopicList []string `json:"topicList"`
+	}{}
+	if err := unmarshal(resp.Body, &list); err != nil {
+		return nil, errors2.Wrap(err, "decode topic list")
+	}
+	return list.TopicList, nil
+}
+
+func (a *admin) GetAllTopicConfig(ctx context.Context, brokerAddr string) (map[string]TopicConfig, error) {
+	resp, err := a.invoke(ctx, brokerAddr, remoting.GetAllTopicConfig, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	wrapper := struct {
+		TopicConfigTable map[string]TopicConfig `json:"topicConfigTable"`
+	}{}
+	if err := unmarshal(resp.Body, &wrapper); err != nil {
+		return nil, errors2.Wrap(err, "decode topic config")
+	}
+	return wrapper.TopicConfigTable, nil
+}
+
+func (a *admin) CreateOrUpdateTopic(ctx context.Context, brokerAddr string, config TopicConfig) error {
+	filterType := config.TopicFilterType
+	if filterType == "" {
+		filterType = defaultTopicFilterType
+	}
+	extFields := map[string]string{
+		"topic":           config.TopicName,
+		"defaultTopic":    defaultTopic,
+		"readQueueNums":   strconv.Itoa(config.ReadQueueNums),
+		"writeQueueNums":  strconv.Itoa(config.WriteQueueNums),
+		"perm":            strconv.Itoa(config.Perm),
+		"topicFilterType": filterType,
+		"topicSysFlag":    strconv.Itoa(config.TopicSysFlag),
+		"order":           strconv.FormatBool(config.Order),
+	}
+	if len(config.Attributes) > 0 {
+		extFields["attributes"] = formatAttributes(config.Attributes)
+	}
+	_, err := a.invoke(ctx, brokerAddr, remoting.UpdateAndCreateTopic, extFields, nil)
+	return err
+}
+
+// formatAttributes 按AttributeParser的格式编码为+key=value,+key=value
+func formatAttributes(attributes map[string]string) string {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	items := make([]string, 0, len(keys))
+	for _, k := range keys {
+		items = append(items, "+"+k+"="+attributes[k])
+	}
+	return strings.Join(items, ",")
+}
+
+func (a *admin) DeleteTopicInBroker(ctx context.Context, brokerAddr, topic string) error {
+	_, err := a.invoke(ctx, brokerAddr, remoting.DeleteTopicInBroker, map[string]string{"topic": topic}, nil)
+	return err
+}
+
+func (a *admin) DeleteTopicInNamesrv(ctx context.Context, namesrvAddr, topic string) error {
+	_, err := a.invoke(ctx, namesrvAddr, remoting.DeleteTopicInNamesrv, map[string]string{"topic": topic}, nil)
+	return err
+}
+
+func (a *admin) PutKVConfig(ctx context.Context, namesrvAddr, namespace, key, value string) error {
+	_, err := a.invoke(ctx, namesrvAddr, remoting.PutKVConfig,
+		map[string]string{"namespace": namespace, "key": key, "value": value}, nil)
+	return err
+}
+
+func (a *admin) DeleteKVConfig(ctx context.Context, namesrvAddr, namespace, key string) error {
+	_, err := a.invoke(ctx, namesrvAddr, remoting.DeleteKVConfig,
+		map[string]string{"namespace": namespace, "key": key}, nil)
+	return err
+}
@@ -2,6 +2,7 @@ package configs
 
 import (
 	"os"
+	"sort"
 	"strings"
 
 	errors2 "github.com/pkg/errors"
@@ -21,6 +22,29 @@ const (
 	NS_JVM_XMS  = NsEnvPrefix + JVM_XMS
 	NS_JVM_XMX  = NsEnvPrefix + JVM_XMX
 
+	// broker.conf中由operator维护的配置项
+	BrokerClusterName     = "brokerClusterName"
+	BrokerName            = "brokerName"
+	EnableDLegerCommitLog = "enableDLegerCommitLog"
+	DLegerGroup           = "dLegerGroup"
+	DLegerPeers           = "dLegerPeers"
+	DLegerSelfId          = "dLegerSelfId"
+	NamesrvAddr           = "namesrvAddr"
+	AclEnable             = "aclEnable"
+	StorePathRootDir      = "storePathRootDir"
+	StorePathCommitLog    = "storePathCommitLog"
+	BrokerPermission      = "brokerPermission"
+	BrokerIP1             = "brokerIP1"
+	ListenPort            = "listenPort"
+
+	// 默认broker配置所在configmap中的key
+	BrokerConfigKey = "broker.conf"
+	// 默认acl配置所在configmap中的key
+	PlainAclKey = "plain_acl.yml"
+
+	// broker启动参数
+	JAVA_OPT_EXT = "JAVA_OPT_EXT"
+
 	// exporter
 	SECRET_KEY = "SECRET_KEY"
 	ACCESS_KEY = "ACCESS_KEY"
@@ -28,6 +52,18 @@ const (
 	Empty = "EMPTY" // crd有bug，空的env会被填上值，使用empty占位符
 )
 
+// ManagedBrokerConfigKeys 由operator维护、不允许在Spec.Config中覆盖的broker配置项
+var ManagedBrokerConfigKeys = []string{
+	BrokerClusterName,
+	BrokerName,
+	EnableDLegerCommitLog,
+	DLegerGroup,
+	DLegerPeers,
+	DLegerSelfId,
+	StorePathRootDir,
+	StorePathCommitLog,
+}
+
 func GetGlobalConfig() Config {
 	return globalConfig
 }
@@ -37,6 +73,7 @@ func init() {
 }
 
 type Config struct {
+	// MOCK_RANDOM_PORT 为broker开启NodePort外部访问时分配端口的范围，格式为 start-end，默认使用kubernetes默认的nodePort范围
 	MOCK_RANDOM_PORT string
 
 	SERVICE_ACCOUNT string
@@ -49,13 +86,16 @@ type Config struct {
 	BROKER_CONFIG_MAP string
 	ACL_CONFIG_MAP    string
 
+	CLUSTER_DOMAIN string
+	ROCKETMQ_HOME  string
+
 	INSTANCE_ENV string
 	InstanceEnv  []corev1.EnvVar
 }
 
 func configFromEnv() Config {
 	c := Config{
-		MOCK_RANDOM_PORT: getEnv("MOCK_RANDOM_PORT", ""),
+		MOCK_RANDOM_PORT: getEnv("MOCK_RANDOM_PORT", "30000-32767"),
 
 		IMAGE_ROCKETMQ:     getEnv("IMAGE_ROCKETMQ", "harbor.dsp.local/middleware/rocketmq:4.6.1"),
 		IMAGE_EXPORTER:     getEnv("IMAGE_EXPORTER", "harbor.dsp.local/middleware/rocketmq-exporter:0.0.1"),
@@ -65,6 +105,8 @@ func configFromEnv() Config {
 		CLUSTER_ROLE:      getEnv("CLUSTER_ROLE", "rocketmq-operator-instance"),
 		BROKER_CONFIG_MAP: getEnv("BROKER_CONFIG_MAP", "rocketmq-default-broker-config"),
 		ACL_CONFIG_MAP:    getEnv("ACL_CONFIG_MAP", "rocketmq-default-plain-acl"),
+		CLUSTER_DOMAIN:    getEnv("CLUSTER_DOMAIN", "cluster.local"),
+		ROCKETMQ_HOME:     getEnv("ROCKETMQ_HOME", "/home/rocketmq/rocketmq-4.6.1"),
 		INSTANCE_ENV:      getEnv("INSTANCE_ENV", ""),
 	}
 
@@ -158,26 +200,59 @@ func SetEnv(env []corev1.EnvVar, key, val string) []corev1.EnvVar {
 	return env
 }
 
+// MergeEnv 将dst中src没有的环境变量追加到src之后，保持原有顺序以免pod模板无意义地变化
 func MergeEnv(src, dst []corev1.EnvVar) []corev1.EnvVar {
 	//  使用set会去重
-	set := make(map[string]string)
+	set := make(map[string]bool)
+	var r []corev1.EnvVar
 	for _, e := range src {
-		set[e.Name] = e.Value
+		if set[e.Name] {
+			continue
+		}
+		set[e.Name] = true
+		r = append(r, e)
 	}
 
 	for _, e := range dst {
-		_, ok := set[e.Name]
-		if !ok {
-			set[e.Name] = e.Value
+		if !set[e.Name] {
+			set[e.Name] = true
+			r = append(r, e)
 		}
 	}
+	return r
+}
 
-	var r []corev1.EnvVar
-	for k, v := range set {
-		r = append(r, corev1.EnvVar{
-			Name:  k,
-			Value: v,
-		})
+// ParseProperties 解析java properties格式的配置，忽略空行和注释
+func ParseProperties(s string) map[string]string {
+	r := make(map[string]string)
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) < 2 {
+			continue
+		}
+		r[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
 	}
 	return r
 }
+
+// FormatProperties 将配置按key排序输出为java properties格式
+func FormatProperties(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(m[k])
+		b.WriteString("\n")
+	}
+	return b.String()
+}
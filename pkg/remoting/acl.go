@@ -0,0 +1,73 @@
+package remoting
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"sort"
+)
+
+// acl签名使用的extFields，对应SessionCredentials中的常量
+const (
+	aclAccessKey     = "AccessKey"
+	aclSignature     = "Signature"
+	aclSecurityToken = "SecurityToken"
+
+	// uniqueMsgQueryFlag 对应MixAll.UNIQUE_MSG_QUERY_FLAG，broker验证签名时忽略该字段
+	uniqueMsgQueryFlag = "_UNIQUE_KEY_QUERY"
+)
+
+// SessionCredentials acl账号，对应rocketmq的SessionCredentials
+type SessionCredentials struct {
+	AccessKey     string
+	SecretKey     string
+	SecurityToken string
+}
+
+type credentialsKey struct{}
+
+// WithCredentials 返回携带acl账号的ctx，使用AclHook的客户端会用该账号对ctx下发出的请求签名
+func WithCredentials(ctx context.Context, credentials SessionCredentials) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, credentials)
+}
+
+// CredentialsFrom 返回ctx携带的acl账号
+func CredentialsFrom(ctx context.Context) (SessionCredentials, bool) {
+	credentials, ok := ctx.Value(credentialsKey{}).(SessionCredentials)
+	return credentials, ok && credentials.AccessKey != ""
+}
+
+// AclHook 使用ctx携带的acl账号对请求签名，与AclClientRPCHook一致；ctx没有账号时不修改请求
+func AclHook(ctx context.Context, _ string, req *RemotingCommand) {
+	if credentials, ok := CredentialsFrom(ctx); ok {
+		Sign(req, credentials)
+	}
+}
+
+// Sign 将AccessKey、SecurityToken加入extFields，并按key排序拼接除Signature外的所有extFields的值和body，
+// 以SecretKey计算HmacSHA1后base64编码作为Signature
+func Sign(req *RemotingCommand, credentials SessionCredentials) {
+	if req.ExtFields == nil {
+		req.ExtFields = make(map[string]string)
+	}
+	req.ExtFields[aclAccessKey] = credentials.AccessKey
+	if credentials.SecurityToken != "" {
+		req.ExtFields[aclSecurityToken] = credentials.SecurityToken
+	}
+	delete(req.ExtFields, aclSignature)
+
+	keys := make([]string, 0, len(req.ExtFields))
+	for k := range req.ExtFields {
+		if k != uniqueMsgQueryFlag {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	mac := hmac.New(sha1.New, []byte(credentials.SecretKey))
+	for _, k := range keys {
+		mac.Write([]byte(req.ExtFields[k]))
+	}
+	mac.Write(req.Body)
+	req.ExtFields[aclSignature] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
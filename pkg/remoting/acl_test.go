@@ -0,0 +1,72 @@
+package remoting
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	credentials := SessionCredentials{AccessKey: "rocketmq2", SecretKey: "12345678"}
+	tests := []struct {
+		name      string
+		extFields map[string]string
+		body      []byte
+		want      map[string]string
+	}{
+		{
+			// 按key排序拼接 AccessKey、readQueueNums、topic 的值以及body: "rocketmq2" + "8" + "orders" + "k=v"
+			name:      "ext fields and body",
+			extFields: map[string]string{"topic": "orders", "readQueueNums": "8"},
+			body:      []byte("k=v"),
+			want: map[string]string{"topic": "orders", "readQueueNums": "8",
+				"AccessKey": "rocketmq2", "Signature": "rWMg/ofw5al4PXH2XxXznpFdpHk="},
+		},
+		{
+			name: "no ext fields",
+			want: map[string]string{"AccessKey": "rocketmq2", "Signature": "Ou1T58RIcyZWaTIwzkhJZWn/Zvs="},
+		},
+		{
+			name:      "stale signature and unique key flag are not signed",
+			extFields: map[string]string{"Signature": "stale", "_UNIQUE_KEY_QUERY": "true"},
+			want: map[string]string{"_UNIQUE_KEY_QUERY": "true",
+				"AccessKey": "rocketmq2", "Signature": "Ou1T58RIcyZWaTIwzkhJZWn/Zvs="},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := NewRequest(UpdateAndCreateTopic, tt.extFields, tt.body)
+			Sign(req, credentials)
+			if !reflect.DeepEqual(req.ExtFields, tt.want) {
+				t.Errorf("extFields = %v, want %v", req.ExtFields, tt.want)
+			}
+		})
+	}
+}
+
+func TestAclHook(t *testing.T) {
+	s := newServer(t)
+	var received map[string]string
+	s.Handle(GetBrokerRuntimeInfo, func(req *RemotingCommand) *RemotingCommand {
+		received = req.ExtFields
+		return NewResponse(req, Success, "", nil)
+	})
+	c := NewClient(Config{RPCHook: AclHook})
+	defer c.Close()
+
+	ctx := WithCredentials(context.Background(), SessionCredentials{AccessKey: "rocketmq2", SecretKey: "12345678"})
+	if _, err := c.InvokeSync(ctx, s.Addr(), NewRequest(GetBrokerRuntimeInfo, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"AccessKey": "rocketmq2", "Signature": "Ou1T58RIcyZWaTIwzkhJZWn/Zvs="}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("signed extFields = %v, want %v", received, want)
+	}
+
+	if _, err := c.InvokeSync(context.Background(), s.Addr(), NewRequest(GetBrokerRuntimeInfo, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 0 {
+		t.Errorf("extFields without credentials = %v, want none", received)
+	}
+}
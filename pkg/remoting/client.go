@@ -0,0 +1,300 @@
+package remoting
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	errors2 "github.com/pkg/errors"
+)
+
+const (
+	defaultDialTimeout    = 3 * time.Second
+	defaultRequestTimeout = 5 * time.Second
+)
+
+// ErrClosed 客户端或连接已关闭
+var ErrClosed = errors2.New("remoting: connection closed")
+
+// Config 客户端配置，零值使用默认超时和JSON序列化
+type Config struct {
+	DialTimeout time.Duration
+	// RequestTimeout 为ctx未设置deadline时同步、异步调用等待响应的超时时间
+	RequestTimeout time.Duration
+	SerializeType  SerializeType
+	// RPCHook 在请求发送前调用，ctx为调用方传入的ctx，可用于acl签名，见AclHook
+	RPCHook func(ctx context.Context, addr string, req *RemotingCommand)
+}
+
+// Client rocketmq remoting客户端，对同一地址复用一个连接，请求按opaque关联响应
+type Client interface {
+	// InvokeSync 发送请求并等待响应
+	InvokeSync(ctx context.Context, addr string, req *RemotingCommand) (*RemotingCommand, error)
+	// InvokeAsync 发送请求，收到响应或超时后调用callback
+	InvokeAsync(ctx context.Context, addr string, req *RemotingCommand, callback func(*RemotingCommand, error)) error
+	// InvokeOneway 发送请求，不等待响应
+	InvokeOneway(ctx context.Context, addr string, req *RemotingCommand) error
+	Close() error
+}
+
+type client struct {
+	config Config
+	// dial 建立tcp连接，不持有mu，一个地址连接超时不影响其他地址的请求
+	dial func(ctx context.Context, addr string) (net.Conn, error)
+
+	mu      sync.Mutex
+	conns   map[string]*conn
+	dialing map[string]*dialCall
+	closed  bool
+}
+
+// dialCall 一个地址正在进行的建连，同一地址的并发请求等待同一次建连的结果
+type dialCall struct {
+	done chan struct{}
+	cn   *conn
+	err  error
+}
+
+// NewClient 创建remoting客户端
+func NewClient(config Config) Client {
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = defaultDialTimeout
+	}
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = defaultRequestTimeout
+	}
+	dialer := &net.Dialer{Timeout: config.DialTimeout}
+	return &client{
+		config: config,
+		dial: func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		},
+		conns:   make(map[string]*conn),
+		dialing: make(map[string]*dialCall),
+	}
+}
+
+func (c *client) InvokeSync(ctx context.Context, addr string, req *RemotingCommand) (*RemotingCommand, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	cn, err := c.conn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	future, err := cn.send(c.prepare(ctx, addr, req), c.config.SerializeType)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		cn.forget(req.Opaque)
+		return nil, errors2.Wrapf(ctx.Err(), "remoting: wait response of code %d from %s", req.Code, addr)
+	case result := <-future:
+		return result.response, result.err
+	}
+}
+
+func (c *client) InvokeAsync(ctx context.Context, addr string, req *RemotingCommand, callback func(*RemotingCommand, error)) error {
+	ctx, cancel := c.withTimeout(ctx)
+	cn, err := c.conn(ctx, addr)
+	if err != nil {
+		cancel()
+		return err
+	}
+	future, err := cn.send(c.prepare(ctx, addr, req), c.config.SerializeType)
+	if err != nil {
+		cancel()
+		return err
+	}
+	go func() {
+		defer cancel()
+		select {
+		case <-ctx.Done():
+			cn.forget(req.Opaque)
+			callback(nil, errors2.Wrapf(ctx.Err(), "remoting: wait response of code %d from %s", req.Code, addr))
+		case result := <-future:
+			callback(result.response, result.err)
+		}
+	}()
+	return nil
+}
+
+func (c *client) InvokeOneway(ctx context.Context, addr string, req *RemotingCommand) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	cn, err := c.conn(ctx, addr)
+	if err != nil {
+		return err
+	}
+	req.markOneway()
+	return cn.write(c.prepare(ctx, addr, req), c.config.SerializeType)
+}
+
+func (c *client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for addr, cn := range c.conns {
+		cn.close(ErrClosed)
+		delete(c.conns, addr)
+	}
+	return nil
+}
+
+func (c *client) prepare(ctx context.Context, addr string, req *RemotingCommand) *RemotingCommand {
+	if c.config.RPCHook != nil {
+		c.config.RPCHook(ctx, addr, req)
+	}
+	return req
+}
+
+func (c *client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.config.RequestTimeout)
+}
+
+// conn 返回addr的连接，连接不存在或已断开时重新建立。建连期间不持有mu，
+// 同一地址的并发请求复用同一次建连，等待时ctx结束则直接返回
+func (c *client) conn(ctx context.Context, addr string) (*conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if cn, ok := c.conns[addr]; ok && !cn.isClosed() {
+		c.mu.Unlock()
+		return cn, nil
+	}
+	if call, ok := c.dialing[addr]; ok {
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, errors2.Wrapf(ctx.Err(), "remoting: dial %s", addr)
+		case <-call.done:
+			return call.cn, call.err
+		}
+	}
+	call := &dialCall{done: make(chan struct{})}
+	c.dialing[addr] = call
+	c.mu.Unlock()
+
+	nc, err := c.dial(ctx, addr)
+
+	c.mu.Lock()
+	delete(c.dialing, addr)
+	switch {
+	case err != nil:
+		call.err = errors2.Wrapf(err, "remoting: dial %s", addr)
+	case c.closed:
+		_ = nc.Close()
+		call.err = ErrClosed
+	default:
+		call.cn = newConn(nc)
+		c.conns[addr] = call.cn
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.cn, call.err
+}
+
+type result struct {
+	response *RemotingCommand
+	err      error
+}
+
+// conn 一个tcp连接，写入加锁，由读协程按opaque分发响应
+type conn struct {
+	nc net.Conn
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[int32]chan result
+	err     error
+}
+
+func newConn(nc net.Conn) *conn {
+	cn := &conn{nc: nc, pending: make(map[int32]chan result)}
+	go cn.readLoop()
+	return cn
+}
+
+func (cn *conn) send(req *RemotingCommand, st SerializeType) (<-chan result, error) {
+	future := make(chan result, 1)
+	cn.mu.Lock()
+	if cn.err != nil {
+		cn.mu.Unlock()
+		return nil, cn.err
+	}
+	cn.pending[req.Opaque] = future
+	cn.mu.Unlock()
+	if err := cn.write(req, st); err != nil {
+		cn.forget(req.Opaque)
+		return nil, err
+	}
+	return future, nil
+}
+
+func (cn *conn) write(req *RemotingCommand, st SerializeType) error {
+	cn.writeMu.Lock()
+	defer cn.writeMu.Unlock()
+	if err := WriteCommand(cn.nc, req, st); err != nil {
+		cn.close(err)
+		return errors2.Wrap(err, "remoting: write request")
+	}
+	return nil
+}
+
+func (cn *conn) forget(opaque int32) {
+	cn.mu.Lock()
+	delete(cn.pending, opaque)
+	cn.mu.Unlock()
+}
+
+func (cn *conn) readLoop() {
+	for {
+		c, _, err := ReadCommand(cn.nc)
+		if err != nil {
+			cn.close(err)
+			return
+		}
+		// 服务端主动发起的请求(如检查事务状态)不在管理场景中使用，直接忽略
+		if !c.IsResponse() {
+			continue
+		}
+		cn.mu.Lock()
+		future, ok := cn.pending[c.Opaque]
+		delete(cn.pending, c.Opaque)
+		cn.mu.Unlock()
+		if ok {
+			future <- result{response: c}
+		}
+	}
+}
+
+// close 关闭连接并使所有等待中的请求失败
+func (cn *conn) close(err error) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	if cn.err != nil {
+		return
+	}
+	cn.err = errors2.Wrap(err, "remoting: connection broken")
+	if err == ErrClosed {
+		cn.err = ErrClosed
+	}
+	_ = cn.nc.Close()
+	for opaque, future := range cn.pending {
+		future <- result{err: cn.err}
+		delete(cn.pending, opaque)
+	}
+}
+
+func (cn *conn) isClosed() bool {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	return cn.err != nil
+}
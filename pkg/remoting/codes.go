@@ -0,0 +1,40 @@
+package remoting
+
+// 请求码，对应org.apache.rocketmq.common.protocol.RequestCode
+const (
+	UpdateAndCreateTopic             int = 17
+	GetAllTopicConfig                int = 21
+	UpdateBrokerConfig               int = 25
+	GetBrokerConfig                  int = 26
+	GetBrokerRuntimeInfo             int = 28
+	GetMaxOffset                     int = 30
+	UpdateAndCreateAclConfig         int = 50
+	DeleteAclConfig                  int = 51
+	GetBrokerClusterAclInfo          int = 52
+	PutKVConfig                      int = 100
+	DeleteKVConfig                   int = 102
+	GetRouteInfoByTopic              int = 105
+	GetBrokerClusterInfo             int = 106
+	UpdateAndCreateSubscriptionGroup int = 200
+	GetAllSubscriptionGroupConfig    int = 201
+	GetTopicStatsInfo                int = 202
+	GetConsumerConnectionList        int = 203
+	GetAllTopicListFromNameserver    int = 206
+	DeleteSubscriptionGroup          int = 207
+	GetConsumeStats                  int = 208
+	DeleteTopicInBroker              int = 215
+	DeleteTopicInNamesrv             int = 216
+	GetBrokerConsumeStats            int = 317
+)
+
+// 响应码，对应org.apache.rocketmq.common.protocol.ResponseCode
+const (
+	Success                   int = 0
+	SystemError               int = 1
+	SystemBusy                int = 2
+	RequestCodeNotSupported   int = 3
+	NoPermission              int = 16
+	TopicNotExist             int = 17
+	SubscriptionGroupNotExist int = 26
+	ConsumerNotOnline         int = 206
+)
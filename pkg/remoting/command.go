@@ -0,0 +1,308 @@
+package remoting
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync/atomic"
+
+	errors2 "github.com/pkg/errors"
+)
+
+// SerializeType 为header的序列化方式
+type SerializeType byte
+
+const (
+	JSON     SerializeType = 0
+	ROCKETMQ SerializeType = 1
+)
+
+// LanguageCode 对应rocketmq的LanguageCode，json序列化时使用名称
+type LanguageCode byte
+
+const (
+	JAVA   LanguageCode = 0
+	CPP    LanguageCode = 1
+	DOTNET LanguageCode = 2
+	PYTHON LanguageCode = 3
+	DELPHI LanguageCode = 4
+	ERLANG LanguageCode = 5
+	RUBY   LanguageCode = 6
+	OTHER  LanguageCode = 7
+	HTTP   LanguageCode = 8
+	GO     LanguageCode = 9
+	PHP    LanguageCode = 10
+	OMS    LanguageCode = 11
+)
+
+var languageNames = []string{"JAVA", "CPP", "DOTNET", "PYTHON", "DELPHI", "ERLANG", "RUBY", "OTHER", "HTTP", "GO", "PHP", "OMS"}
+
+func (l LanguageCode) String() string {
+	if int(l) < len(languageNames) {
+		return languageNames[l]
+	}
+	return "OTHER"
+}
+
+func (l LanguageCode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+// UnmarshalJSON 兼容名称和数字两种格式
+func (l *LanguageCode) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		n, err := strconv.Atoi(string(data))
+		if err != nil {
+			return err
+		}
+		*l = LanguageCode(n)
+		return nil
+	}
+	*l = OTHER
+	for k, v := range languageNames {
+		if v == name {
+			*l = LanguageCode(k)
+		}
+	}
+	return nil
+}
+
+const (
+	flagResponse = 1 << 0
+	flagOneway   = 1 << 1
+
+	// version 对应rocketmq 4.6.1的MQVersion
+	version = 359
+
+	// maxFrameLength 与rocketmq默认的com.rocketmq.remoting.frameMaxLength一致
+	maxFrameLength = 16777216
+)
+
+var opaqueCounter int32
+
+// RemotingCommand rocketmq remoting协议的请求和响应
+type RemotingCommand struct {
+	Code      int               `json:"code"`
+	Language  LanguageCode      `json:"language"`
+	Version   int16             `json:"version"`
+	Opaque    int32             `json:"opaque"`
+	Flag      int32             `json:"flag"`
+	Remark    string            `json:"remark,omitempty"`
+	ExtFields map[string]string `json:"extFields,omitempty"`
+	Body      []byte            `json:"-"`
+}
+
+// NewRequest 创建请求，opaque全局递增用于关联响应
+func NewRequest(code int, extFields map[string]string, body []byte) *RemotingCommand {
+	return &RemotingCommand{
+		Code:      code,
+		Language:  GO,
+		Version:   version,
+		Opaque:    atomic.AddInt32(&opaqueCounter, 1),
+		ExtFields: extFields,
+		Body:      body,
+	}
+}
+
+// NewResponse 创建对请求的响应
+func NewResponse(req *RemotingCommand, code int, remark string, body []byte) *RemotingCommand {
+	return &RemotingCommand{
+		Code:     code,
+		Language: GO,
+		Version:  version,
+		Opaque:   req.Opaque,
+		Flag:     flagResponse,
+		Remark:   remark,
+		Body:     body,
+	}
+}
+
+func (c *RemotingCommand) IsResponse() bool {
+	return c.Flag&flagResponse != 0
+}
+
+func (c *RemotingCommand) IsOneway() bool {
+	return c.Flag&flagOneway != 0
+}
+
+func (c *RemotingCommand) markOneway() {
+	c.Flag |= flagOneway
+}
+
+// Encode 编码为不含长度前缀的帧：4字节序列化类型和header长度、header、body
+func Encode(c *RemotingCommand, st SerializeType) ([]byte, error) {
+	var header []byte
+	var err error
+	switch st {
+	case JSON:
+		header, err = json.Marshal(c)
+	case ROCKETMQ:
+		header, err = encodeRocketMQHeader(c)
+	default:
+		return nil, errors2.Errorf("unsupported serialize type %d", st)
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4+len(header)+len(c.Body))
+	binary.BigEndian.PutUint32(buf, uint32(st)<<24|uint32(len(header))&0xFFFFFF)
+	copy(buf[4:], header)
+	copy(buf[4+len(header):], c.Body)
+	return buf, nil
+}
+
+// Decode 解码不含长度前缀的帧，返回帧使用的序列化类型
+func Decode(frame []byte) (*RemotingCommand, SerializeType, error) {
+	if len(frame) < 4 {
+		return nil, 0, errors2.New("remoting frame too short")
+	}
+	mark := binary.BigEndian.Uint32(frame)
+	st := SerializeType(mark >> 24)
+	headerLength := int(mark & 0xFFFFFF)
+	if 4+headerLength > len(frame) {
+		return nil, 0, errors2.Errorf("remoting header length %d exceeds frame length %d", headerLength, len(frame))
+	}
+	header := frame[4 : 4+headerLength]
+	c := &RemotingCommand{}
+	var err error
+	switch st {
+	case JSON:
+		err = json.Unmarshal(header, c)
+	case ROCKETMQ:
+		err = decodeRocketMQHeader(header, c)
+	default:
+		err = errors2.Errorf("unsupported serialize type %d", st)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if body := frame[4+headerLength:]; len(body) > 0 {
+		c.Body = append([]byte(nil), body...)
+	}
+	return c, st, nil
+}
+
+// WriteCommand 写入带4字节长度前缀的帧
+func WriteCommand(w io.Writer, c *RemotingCommand, st SerializeType) error {
+	frame, err := Encode(c, st)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	copy(buf[4:], frame)
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadCommand 读取一个带4字节长度前缀的帧
+func ReadCommand(r io.Reader) (*RemotingCommand, SerializeType, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, 0, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxFrameLength {
+		return nil, 0, errors2.Errorf("remoting frame length %d exceeds %d", n, maxFrameLength)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, 0, err
+	}
+	return Decode(frame)
+}
+
+// encodeRocketMQHeader 对应RocketMQSerializable.rocketMQProtocolEncode
+func encodeRocketMQHeader(c *RemotingCommand) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	write := func(v interface{}) {
+		_ = binary.Write(buf, binary.BigEndian, v)
+	}
+	// 与java实现一致，二进制header中code只占2字节
+	write(int16(c.Code))
+	write(byte(c.Language))
+	write(c.Version)
+	write(c.Opaque)
+	write(c.Flag)
+	write(int32(len(c.Remark)))
+	buf.WriteString(c.Remark)
+
+	ext := &bytes.Buffer{}
+	for k, v := range c.ExtFields {
+		if len(k) > 0xFFFF {
+			return nil, errors2.Errorf("extField key %q too long", k)
+		}
+		_ = binary.Write(ext, binary.BigEndian, int16(len(k)))
+		ext.WriteString(k)
+		_ = binary.Write(ext, binary.BigEndian, int32(len(v)))
+		ext.WriteString(v)
+	}
+	write(int32(ext.Len()))
+	buf.Write(ext.Bytes())
+	return buf.Bytes(), nil
+}
+
+// decodeRocketMQHeader 对应RocketMQSerializable.rocketMQProtocolDecode
+func decodeRocketMQHeader(header []byte, c *RemotingCommand) error {
+	r := bytes.NewReader(header)
+	read := func(v interface{}) error {
+		return binary.Read(r, binary.BigEndian, v)
+	}
+	readString := func(n int) (string, error) {
+		if n < 0 || n > r.Len() {
+			return "", errors2.Errorf("invalid string length %d", n)
+		}
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		return string(b), err
+	}
+	var code int16
+	var language byte
+	var remarkLength, extLength int32
+	for _, v := range []interface{}{&code, &language, &c.Version, &c.Opaque, &c.Flag, &remarkLength} {
+		if err := read(v); err != nil {
+			return errors2.Wrap(err, "decode rocketmq header")
+		}
+	}
+	c.Code = int(code)
+	c.Language = LanguageCode(language)
+	remark, err := readString(int(remarkLength))
+	if err != nil {
+		return err
+	}
+	c.Remark = remark
+	if err := read(&extLength); err != nil {
+		return errors2.Wrap(err, "decode rocketmq header")
+	}
+	if extLength <= 0 {
+		return nil
+	}
+	if int(extLength) > r.Len() {
+		return errors2.Errorf("invalid extFields length %d", extLength)
+	}
+	c.ExtFields = make(map[string]string)
+	end := r.Len() - int(extLength)
+	for r.Len() > end {
+		var keyLength int16
+		var valueLength int32
+		if err := read(&keyLength); err != nil {
+			return err
+		}
+		key, err := readString(int(uint16(keyLength)))
+		if err != nil {
+			return err
+		}
+		if err := read(&valueLength); err != nil {
+			return err
+		}
+		value, err := readString(int(valueLength))
+		if err != nil {
+			return err
+		}
+		c.ExtFields[key] = value
+	}
+	return nil
+}
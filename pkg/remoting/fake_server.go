@@ -0,0 +1,124 @@
+package remoting
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Handler 处理一个请求，返回nil时不响应
+type Handler func(req *RemotingCommand) *RemotingCommand
+
+// FakeServer 进程内的remoting服务端，用于在没有rocketmq集群时测试客户端。
+// 响应使用请求的opaque和序列化方式，未注册的请求码返回RequestCodeNotSupported
+type FakeServer struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	handlers map[int]Handler
+	conns    map[net.Conn]struct{}
+
+	accepted int32
+	wg       sync.WaitGroup
+}
+
+// NewFakeServer 在127.0.0.1的随机端口上启动FakeServer
+func NewFakeServer() (*FakeServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &FakeServer{
+		listener: listener,
+		handlers: make(map[int]Handler),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Handle 注册请求码的处理函数
+func (s *FakeServer) Handle(code int, handler Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[code] = handler
+}
+
+func (s *FakeServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Accepted 返回已接受的连接数
+func (s *FakeServer) Accepted() int {
+	return int(atomic.LoadInt32(&s.accepted))
+}
+
+// CloseConnections 断开所有已建立的连接，服务端继续监听
+func (s *FakeServer) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+func (s *FakeServer) Close() error {
+	err := s.listener.Close()
+	s.CloseConnections()
+	s.wg.Wait()
+	return err
+}
+
+func (s *FakeServer) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.accepted, 1)
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(c)
+	}
+}
+
+func (s *FakeServer) serveConn(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		_ = c.Close()
+	}()
+	var writeMu sync.Mutex
+	for {
+		req, st, err := ReadCommand(c)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		handler, ok := s.handlers[req.Code]
+		s.mu.Unlock()
+		// 每个请求单独处理，处理慢的请求不阻塞后续请求的响应
+		go func() {
+			var resp *RemotingCommand
+			if ok {
+				resp = handler(req)
+			} else {
+				resp = NewResponse(req, RequestCodeNotSupported, "request code not supported", nil)
+			}
+			if resp == nil || req.IsOneway() {
+				return
+			}
+			resp.Opaque = req.Opaque
+			resp.Flag |= flagResponse
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			_ = WriteCommand(c, resp, st)
+		}()
+	}
+}
@@ -0,0 +1,245 @@
+package remoting
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newServer(t *testing.T) *FakeServer {
+	s, err := NewFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	s.Handle(GetBrokerConfig, func(req *RemotingCommand) *RemotingCommand {
+		return NewResponse(req, Success, "", []byte("brokerName="+req.ExtFields["brokerName"]))
+	})
+	return s
+}
+
+func TestEncodeDecode(t *testing.T) {
+	for _, st := range []SerializeType{JSON, ROCKETMQ} {
+		req := NewRequest(UpdateBrokerConfig, map[string]string{"a": "1", "brokerName": "demo-broker-0"}, []byte("k=v"))
+		req.Remark = "remark"
+		buf := &bytes.Buffer{}
+		if err := WriteCommand(buf, req, st); err != nil {
+			t.Fatal(err)
+		}
+		got, gotSt, err := ReadCommand(buf)
+		if err != nil {
+			t.Fatalf("serialize type %d: %v", st, err)
+		}
+		if gotSt != st {
+			t.Errorf("serialize type = %d, want %d", gotSt, st)
+		}
+		if !reflect.DeepEqual(got, req) {
+			t.Errorf("serialize type %d: decoded %+v, want %+v", st, got, req)
+		}
+	}
+}
+
+func TestDecodeJavaHeader(t *testing.T) {
+	header := `{"code":0,"extFields":{"k":"v"},"flag":1,"language":"JAVA","opaque":7,"serializeTypeCurrentRPC":"JSON","version":359}`
+	frame := append([]byte{0, 0, 0, byte(len(header))}, header...)
+	frame = append(frame, "body"...)
+	c, st, err := Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &RemotingCommand{Language: JAVA, Version: 359, Opaque: 7, Flag: flagResponse,
+		ExtFields: map[string]string{"k": "v"}, Body: []byte("body")}
+	if st != JSON || !reflect.DeepEqual(c, want) {
+		t.Errorf("decoded %+v, want %+v", c, want)
+	}
+	if !c.IsResponse() || c.IsOneway() {
+		t.Errorf("flag %d should be a response", c.Flag)
+	}
+}
+
+func TestInvoke(t *testing.T) {
+	s := newServer(t)
+	oneway := make(chan *RemotingCommand, 1)
+	s.Handle(UpdateBrokerConfig, func(req *RemotingCommand) *RemotingCommand {
+		oneway <- req
+		return nil
+	})
+	for _, st := range []SerializeType{JSON, ROCKETMQ} {
+		c := NewClient(Config{SerializeType: st})
+		ctx := context.Background()
+
+		resp, err := c.InvokeSync(ctx, s.Addr(), NewRequest(GetBrokerConfig, map[string]string{"brokerName": "demo"}, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != Success || string(resp.Body) != "brokerName=demo" {
+			t.Errorf("sync response = %+v", resp)
+		}
+
+		resp, err = c.InvokeSync(ctx, s.Addr(), NewRequest(GetMaxOffset, nil, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != RequestCodeNotSupported {
+			t.Errorf("response code = %d, want %d", resp.Code, RequestCodeNotSupported)
+		}
+
+		done := make(chan *RemotingCommand, 1)
+		err = c.InvokeAsync(ctx, s.Addr(), NewRequest(GetBrokerConfig, map[string]string{"brokerName": "async"}, nil),
+			func(resp *RemotingCommand, err error) {
+				if err != nil {
+					t.Error(err)
+				}
+				done <- resp
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp := <-done; resp == nil || string(resp.Body) != "brokerName=async" {
+			t.Errorf("async response = %+v", resp)
+		}
+
+		if err := c.InvokeOneway(ctx, s.Addr(), NewRequest(UpdateBrokerConfig, nil, []byte("k=v"))); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case req := <-oneway:
+			if !req.IsOneway() || string(req.Body) != "k=v" {
+				t.Errorf("oneway request = %+v", req)
+			}
+		case <-time.After(time.Second):
+			t.Error("oneway request not received")
+		}
+		_ = c.Close()
+	}
+}
+
+func TestInvokeTimeout(t *testing.T) {
+	s := newServer(t)
+	block := make(chan struct{})
+	defer close(block)
+	s.Handle(GetBrokerRuntimeInfo, func(req *RemotingCommand) *RemotingCommand {
+		<-block
+		return nil
+	})
+	c := NewClient(Config{RequestTimeout: 50 * time.Millisecond})
+	defer c.Close()
+
+	if _, err := c.InvokeSync(context.Background(), s.Addr(), NewRequest(GetBrokerRuntimeInfo, nil, nil)); err == nil {
+		t.Error("expected timeout")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	if err := c.InvokeAsync(ctx, s.Addr(), NewRequest(GetBrokerRuntimeInfo, nil, nil), func(_ *RemotingCommand, err error) {
+		done <- err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err == nil {
+		t.Error("expected async timeout")
+	}
+	// 超时的请求不影响同一连接上的后续请求
+	if _, err := c.InvokeSync(context.Background(), s.Addr(), NewRequest(GetBrokerConfig, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if s.Accepted() != 1 {
+		t.Errorf("accepted %d connections, want 1", s.Accepted())
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	s := newServer(t)
+	c := NewClient(Config{})
+	defer c.Close()
+	ctx := context.Background()
+
+	for k := 0; k < 3; k++ {
+		if _, err := c.InvokeSync(ctx, s.Addr(), NewRequest(GetBrokerConfig, nil, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Accepted() != 1 {
+		t.Fatalf("accepted %d connections, want 1", s.Accepted())
+	}
+
+	s.CloseConnections()
+	// 等待读协程发现连接断开
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := c.InvokeSync(ctx, s.Addr(), NewRequest(GetBrokerConfig, nil, nil))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("reconnect failed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.Accepted() != 2 {
+		t.Errorf("accepted %d connections, want 2", s.Accepted())
+	}
+
+	_ = c.Close()
+	if _, err := c.InvokeSync(ctx, s.Addr(), NewRequest(GetBrokerConfig, nil, nil)); err != ErrClosed {
+		t.Errorf("invoke after close: %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestDialDoesNotBlockOtherAddrs(t *testing.T) {
+	s := newServer(t)
+	c := NewClient(Config{}).(*client)
+	defer c.Close()
+	unreachable := "10.255.255.1:10911"
+	block := make(chan struct{})
+	dials := make(chan string, 4)
+	dial := c.dial
+	c.dial = func(ctx context.Context, addr string) (net.Conn, error) {
+		dials <- addr
+		if addr == unreachable {
+			select {
+			case <-block:
+			case <-ctx.Done():
+			}
+			return nil, errors.New("connect timeout")
+		}
+		return dial(ctx, addr)
+	}
+
+	failed := make(chan error, 1)
+	go func() {
+		_, err := c.InvokeSync(context.Background(), unreachable, NewRequest(GetBrokerConfig, nil, nil))
+		failed <- err
+	}()
+	if addr := <-dials; addr != unreachable {
+		t.Fatalf("dialed %s, want %s", addr, unreachable)
+	}
+	// 不可达地址建连期间，其他地址的请求不受影响
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := c.InvokeSync(ctx, s.Addr(), NewRequest(GetBrokerConfig, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	// 同一地址的请求等待正在进行的建连，不再重复建连
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer waitCancel()
+	if _, err := c.InvokeSync(waitCtx, unreachable, NewRequest(GetBrokerConfig, nil, nil)); err == nil {
+		t.Error("expected timeout while waiting for the dial")
+	}
+	close(block)
+	if err := <-failed; err == nil {
+		t.Error("expected dial error")
+	}
+	close(dials)
+	var got []string
+	for addr := range dials {
+		got = append(got, addr)
+	}
+	if !reflect.DeepEqual(got, []string{s.Addr()}) {
+		t.Errorf("dials after the first = %v, want only %s", got, s.Addr())
+	}
+}